@@ -2,6 +2,7 @@ package v1
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -9,6 +10,16 @@ import (
 
 const (
 	AnnotationLastApplied string = "clickhouse.service.diamond.sensetime.com/last-applied-configuration"
+	// AnnotationRolloutPaused set to "true" stops the restart of the pods after the current one
+	AnnotationRolloutPaused string = "clickhouse.service.diamond.sensetime.com/rollout-paused"
+	// AnnotationPaused set to "true" stops the operator from changing anything of the cluster
+	AnnotationPaused string = "clickhouse.service.diamond.sensetime.com/paused"
+	// AnnotationForceDelete set to "true" on a deleted cluster removes the finalizer of the operator
+	// without running the rest of the cleanup
+	AnnotationForceDelete string = "clickhouse.service.diamond.sensetime.com/force-delete"
+	// AnnotationAcceptDrainMismatch set to "true" accepts the tables of the draining shards whose
+	// copy could not be verified, it is removed once no shard is draining anymore
+	AnnotationAcceptDrainMismatch string = "clickhouse.service.diamond.sensetime.com/accept-drain-mismatch"
 )
 
 // ClickHouseClusterSpec defines the desired state of ClickHouseCluster
@@ -24,20 +35,41 @@ type ClickHouseClusterSpec struct {
 	//it is false by default
 	DeletePVC bool `json:"deletePVC"`
 
+	//Deletion defines the cleanup run when the cluster is deleted
+	Deletion *DeletionSpec `json:"deletion,omitempty"`
+
 	//Shards count
 	ShardsCount int32 `json:"shardsCount,omitempty"`
 
 	//Replicas count
 	ReplicasCount int32 `json:"replicasCount,omitempty"`
 
+	//Per-shard overrides of the cluster-wide topology
+	Shards []ShardSpec `json:"shards,omitempty"`
+
 	//Zookeeper config
 	Zookeeper *ZookeeperConfig `json:"zookeeper,omitempty"`
 
-	//Custom defined XML settings, like <yandex>something</yandex>
-	CustomSettings string `json:"custom_settings,omitempty"`
+	//Keeper deploys a ClickHouse Keeper ensemble the replicas coordinate through, in place of
+	//the external zookeeper of spec.zookeeper
+	Keeper *KeeperSpec `json:"keeper,omitempty"`
+
+	//Server settings rendered into config.d by the operator, keyed by the path of
+	//the setting, like merge_tree/parts_to_throw_insert: 600
+	Settings map[string]SettingValue `json:"settings,omitempty"`
+
+	//LegacyCustomSettings is the XML config the clusters of the previous releases
+	//had, the cluster is refused until its settings are moved to settings
+	LegacyCustomSettings string `json:"custom_settings,omitempty"`
 
-	//Users defined
-	Users string `json:"users,omitempty"`
+	//Users defined, the first one is used by the operator and the broker to
+	//connect to ClickHouse
+	Users []UserConfig `json:"users,omitempty"`
+
+	//LegacyUsers is the users.xml the clusters of the previous releases had in
+	//users, it is kept as it is and the cluster is refused until its users are
+	//rewritten as a list
+	LegacyUsers string `json:"-"`
 
 	//The storage capacity
 	DataCapacity string `json:"dataCapacity,omitempty"`
@@ -45,19 +77,86 @@ type ClickHouseClusterSpec struct {
 	//Define StorageClass for Persistent Volume Claims in the local storage.
 	DataStorageClass string `json:"dataStorageClass,omitempty"`
 
+	//Disks of the pods and the storage policies of the tables, replaces
+	//dataStorageClass and dataCapacity when volumes are defined
+	Storage *StorageSpec `json:"storage,omitempty"`
+
+	//Service defines how the cluster Service is exposed
+	Service *ServiceSpec `json:"service,omitempty"`
+
 	Pod *PodPolicy `json:"pod,omitempty"`
 
+	//PodTemplate is merged into the pod template generated for the shards with a strategic merge
+	//patch, it can add sidecars, env vars, volumes and most pod settings, the generated containers,
+	//volumes and probes are kept as they are
+	PodTemplate *corev1.PodTemplateSpec `json:"podTemplate,omitempty"`
+
 	// Pod defines the policy for pods owned by clickhouse operator.
 	// This field cannot be updated once the CR is created.
 	Resources ClickHouseResources `json:"resources,omitempty"`
+
+	//Upgrade defines how a change of the image is rolled out
+	Upgrade *UpgradeSpec `json:"upgrade,omitempty"`
+
+	//Stopped scales the StatefulSets of the shards to zero, the PVCs, the configuration and the
+	//zookeeper paths are kept so the cluster starts again with its data
+	Stopped bool `json:"stopped,omitempty"`
+
+	//SchemaCheck defines the periodic comparison of the tables of the hosts
+	SchemaCheck *SchemaCheckSpec `json:"schemaCheck,omitempty"`
 }
 
-// Remove subresources, cuz https://github.com/kubernetes/kubectl/issues/564
 // ClickHouseClusterStatus defines the observed state of ClickHouseCluster
 // +k8s:openapi-gen=true
 type ClickHouseClusterStatus struct {
-	Phase       string                  `json:"phase,omitempty"`
+	// ObservedGeneration is the generation of the spec the status has been computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	Phase string `json:"phase,omitempty"`
+
+	// Conditions are the latest observations of the cluster's state
+	Conditions []ClusterCondition `json:"conditions,omitempty"`
+
 	ShardStatus map[string]*ShardStatus `json:"shardStatus,omitempty"`
+
+	// Upgrade is the state of the last canary upgrade
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+
+	// Deletion is the progress of the cleanup of the deleted cluster
+	Deletion *DeletionStatus `json:"deletion,omitempty"`
+
+	// Schema is the state of the schema replicated to the hosts
+	Schema *SchemaStatus `json:"schema,omitempty"`
+}
+
+// ClusterConditionType is the type of a condition of the cluster
+type ClusterConditionType string
+
+const (
+	// ClusterReady means all the replicas of all the shards are ready
+	ClusterReady ClusterConditionType = "Ready"
+	// ClusterReconciling means the operator is rolling out the spec
+	ClusterReconciling ClusterConditionType = "Reconciling"
+	// ClusterConfigValid means the spec has been accepted by the operator
+	ClusterConfigValid ClusterConditionType = "ConfigValid"
+	// ClusterSchemaSynced means the tables have been created on every host
+	ClusterSchemaSynced ClusterConditionType = "SchemaSynced"
+	// ClusterZookeeperReachable means the operator can connect to the zookeeper of the cluster
+	ClusterZookeeperReachable ClusterConditionType = "ZookeeperReachable"
+	// ClusterDegraded means the reconcile is failing or some hosts are unavailable
+	ClusterDegraded ClusterConditionType = "Degraded"
+)
+
+// ClusterCondition describes the state of the cluster at a certain point
+type ClusterCondition struct {
+	Type   ClusterConditionType   `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+	// The last time the condition transitioned from one status to another
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// A one-word CamelCase reason for the condition's last transition
+	Reason string `json:"reason,omitempty"`
+	// A human readable message indicating details about the transition
+	Message string `json:"message,omitempty"`
 }
 
 // ClickHouseResources sets the limits and requests for a container
@@ -66,6 +165,186 @@ type ClickHouseResources struct {
 	Limits   CPUAndMem `json:"limits,omitempty"`
 }
 
+// ShardSpec overrides the cluster-wide topology for one shard
+type ShardSpec struct {
+	// ID of the shard, from 0 to shardsCount-1
+	ID int32 `json:"id"`
+	// Replicas count of the shard
+	ReplicasCount int32 `json:"replicasCount,omitempty"`
+	// Resources of the pods of the shard
+	Resources *ClickHouseResources `json:"resources,omitempty"`
+	// The storage capacity of the shard
+	DataCapacity string `json:"dataCapacity,omitempty"`
+	// NodeSelector is merged into the cluster-wide one for the pods of the shard
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Weight of the shard when writing through Distributed tables, 1 by default
+	Weight int32 `json:"weight,omitempty"`
+}
+
+// StorageSpec defines the disks of the pods and how ClickHouse uses them
+type StorageSpec struct {
+	// Volumes are the disks of each pod, the first one is the default disk of ClickHouse
+	// mounted at /var/lib/clickhouse/, it must be named default
+	Volumes []StorageVolume `json:"volumes,omitempty"`
+	// Policies are the storage policies the tables can be created with
+	Policies []StoragePolicy `json:"policies,omitempty"`
+	// Log is a separate volume for the logs of ClickHouse, so they can not fill up a data disk
+	Log *StorageVolume `json:"log,omitempty"`
+}
+
+// StorageVolume is a PersistentVolumeClaim of each pod
+type StorageVolume struct {
+	// Name of the volume, it is also the name of the disk in ClickHouse
+	Name string `json:"name,omitempty"`
+	// StorageClass of the claim, the default StorageClass if empty
+	StorageClass string `json:"storageClass,omitempty"`
+	// Capacity of the claim
+	Capacity string `json:"capacity"`
+}
+
+// StoragePolicy defines the volumes of a storage policy, from the hottest to the coldest
+type StoragePolicy struct {
+	// Name of the policy, tables use it with SETTINGS storage_policy = 'name'
+	Name    string                `json:"name"`
+	Volumes []StoragePolicyVolume `json:"volumes"`
+	// MoveFactor is the ratio of free space of a volume below which parts are moved to the next one,
+	// 0.1 by default
+	MoveFactor string `json:"moveFactor,omitempty"`
+}
+
+// StoragePolicyVolume is a volume of a storage policy, made of one or more disks
+type StoragePolicyVolume struct {
+	Name string `json:"name"`
+	// Disks are names of the volumes of the storage
+	Disks []string `json:"disks"`
+	// MaxDataPartSizeBytes is the size of the parts above which they are stored in the next volume
+	MaxDataPartSizeBytes int64 `json:"maxDataPartSizeBytes,omitempty"`
+}
+
+// KeeperSpec defines the ClickHouse Keeper ensemble deployed by the operator
+type KeeperSpec struct {
+	// Replicas of the ensemble, an odd number, 3 by default
+	Replicas int32 `json:"replicas,omitempty"`
+	// Image of clickhouse-keeper
+	Image string `json:"image,omitempty"`
+	// Storage of the Raft logs and snapshots of each replica, an emptyDir if not set
+	Storage *StorageVolume `json:"storage,omitempty"`
+	// Resources of the keeper pods
+	Resources ClickHouseResources `json:"resources,omitempty"`
+}
+
+// UpgradeSpec defines how a change of the image is rolled out
+type UpgradeSpec struct {
+	// Canary restarts one replica of the first shard with the new image first, the other hosts are
+	// only upgraded once it stayed healthy for the soak period, the image is reverted otherwise
+	Canary bool `json:"canary,omitempty"`
+	// SoakSeconds is how long the canary has to stay healthy, 600 by default
+	SoakSeconds int32 `json:"soakSeconds,omitempty"`
+	// MaxNewErrors is how many errors may be added to system.errors of the canary during the soak
+	MaxNewErrors int64 `json:"maxNewErrors,omitempty"`
+}
+
+// UpgradeStatus is the state of a canary upgrade
+type UpgradeStatus struct {
+	// Phase of the upgrade, one of Canary, Soaking, Succeeded and RolledBack
+	Phase string `json:"phase,omitempty"`
+	// FromImage is the image before the upgrade, the one restored by a rollback
+	FromImage string `json:"fromImage,omitempty"`
+	// ToImage is the image being upgraded to
+	ToImage string `json:"toImage,omitempty"`
+	// CanaryPod is the pod upgraded first
+	CanaryPod string `json:"canaryPod,omitempty"`
+	// CanaryVersion is the version() reported by the canary once restarted
+	CanaryVersion string `json:"canaryVersion,omitempty"`
+	// SoakStartTime is when the canary came back with the new image
+	SoakStartTime *metav1.Time `json:"soakStartTime,omitempty"`
+	// BaselineErrors is the sum of system.errors of the canary when the soak started
+	BaselineErrors int64 `json:"baselineErrors,omitempty"`
+	// Message tells why the upgrade has been rolled back
+	Message string `json:"message,omitempty"`
+}
+
+// DeletionSpec defines the cleanup of a deleted cluster
+type DeletionSpec struct {
+	// BackupDisk is a disk of ClickHouse allowed in backups.allowed_disk and stored outside of the
+	// PVCs, like an S3 disk, the databases of each shard are backed up to before the PVCs are deleted
+	BackupDisk string `json:"backupDisk,omitempty"`
+}
+
+// DeletionStatus is the progress of the cleanup of a deleted cluster
+type DeletionStatus struct {
+	// Step being run, one of StopWrites, Backup, StopShards, DeletePVCs and DeleteZookeeperPath
+	Step string `json:"step,omitempty"`
+	// CompletedSteps are the steps done, in order
+	CompletedSteps []string `json:"completedSteps,omitempty"`
+	// Message tells why the step has not completed yet
+	Message string `json:"message,omitempty"`
+}
+
+// SchemaCheckSpec defines the periodic comparison of the tables of the hosts
+type SchemaCheckSpec struct {
+	// Disabled stops the checks
+	Disabled bool `json:"disabled,omitempty"`
+	// IntervalSeconds is the time between two checks, 300 by default
+	IntervalSeconds int32 `json:"intervalSeconds,omitempty"`
+	// Repair creates the tables missing on some hosts as they are defined on the others
+	Repair bool `json:"repair,omitempty"`
+}
+
+// SchemaStatus is the state of the schema replicated to the hosts
+type SchemaStatus struct {
+	// FailedObjects are the objects the last sync could not create, by host
+	FailedObjects []SchemaObjectFailure `json:"failedObjects,omitempty"`
+	// LastCheckTime is when the tables of the hosts were last compared
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+	// Drifts are the differences between the hosts found by the last check
+	Drifts []SchemaDrift `json:"drifts,omitempty"`
+}
+
+// SchemaDrift is a table differing on a host from the other hosts
+type SchemaDrift struct {
+	// Host is the FQDN of the replica
+	Host string `json:"host"`
+	// Table qualified by its database
+	Table string `json:"table"`
+	// Type of the difference, one of Missing, Extra and Mismatch
+	Type string `json:"type"`
+}
+
+// SchemaObjectFailure is an object of the schema that could not be created on a host
+type SchemaObjectFailure struct {
+	// Host is the FQDN of the replica
+	Host string `json:"host"`
+	// Kind of the object, like Database, Table, MaterializedView, Dictionary, Function, User or Grant,
+	// empty when the host could not be reached
+	Kind string `json:"kind,omitempty"`
+	// Name of the object, qualified by its database for the tables, views and dictionaries
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error"`
+}
+
+// ServiceSpec defines how the Service in front of all the replicas of the cluster is exposed
+type ServiceSpec struct {
+	// Type of the Service, one of ClusterIP, NodePort and LoadBalancer, ClusterIP by default
+	Type corev1.ServiceType `json:"type,omitempty"`
+	// Annotations added to the Service, like the ones configuring a cloud load balancer
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// LoadBalancerSourceRanges restricts the clients of a LoadBalancer Service
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+	// Ports exposed, among http, client and exporter, all of them by default
+	Ports []ServicePort `json:"ports,omitempty"`
+	// ExternalTrafficPolicy of a NodePort or LoadBalancer Service, Local keeps the client source IP
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicyType `json:"externalTrafficPolicy,omitempty"`
+}
+
+// ServicePort selects a port of ClickHouse to expose
+type ServicePort struct {
+	// Name of the port, one of http, client and exporter
+	Name string `json:"name"`
+	// NodePort of a NodePort or LoadBalancer Service, allocated by Kubernetes if not set
+	NodePort int32 `json:"nodePort,omitempty"`
+}
+
 // CPUAndMem defines how many cpu and ram the container will request/limit
 type CPUAndMem struct {
 	CPU    string `json:"cpu"`
@@ -78,6 +357,45 @@ type ShardStatus struct {
 	// Phase goes as one way as below:
 	//   Initial -> Running <-> updating
 	Phase string `json:"phase,omitempty"`
+
+	// Hosts are the replicas of the shard
+	Hosts []HostStatus `json:"hosts,omitempty"`
+
+	// DroppingReplicas are the replicas removed from the shard whose metadata is still to be
+	// dropped from ZooKeeper
+	DroppingReplicas []string `json:"droppingReplicas,omitempty"`
+
+	// ExpandingVolumes are the PVCs of the shard being resized
+	ExpandingVolumes []string `json:"expandingVolumes,omitempty"`
+
+	// DrainedTables are the tables of a drained shard whose rows have been sent to the remaining
+	// shards, they are never sent twice
+	DrainedTables []DrainedTable `json:"drainedTables,omitempty"`
+}
+
+// DrainedTable is the copy of a local table of a drained shard
+type DrainedTable struct {
+	// Name of the table, database.table
+	Name string `json:"name"`
+	// Rows of the table on the drained shard
+	Rows int64 `json:"rows"`
+	// TargetRows is the count of the rows of the remaining shards before the copy
+	TargetRows int64 `json:"targetRows"`
+	// Copied tells all the rows have arrived
+	Copied bool `json:"copied,omitempty"`
+	// Error is why the copy could not be verified, it is left to a manual check
+	Error string `json:"error,omitempty"`
+}
+
+// HostStatus is the state of a replica
+type HostStatus struct {
+	// Name of the pod
+	Name string `json:"name"`
+	// FQDN the replica is known as in remote_servers
+	FQDN  string `json:"fqdn"`
+	Ready bool   `json:"ready"`
+	// Reason why the replica is not ready
+	Reason string `json:"reason,omitempty"`
 }
 
 // PodPolicy defines the policy for pods owned by ClickHouse operator.
@@ -92,6 +410,81 @@ type PodPolicy struct {
 	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
 }
 
+// clusterSpec has the fields of ClickHouseClusterSpec without its JSON methods
+type clusterSpec ClickHouseClusterSpec
+
+// UnmarshalJSON accepts the users.xml string of the previous releases in users, into LegacyUsers
+func (s *ClickHouseClusterSpec) UnmarshalJSON(data []byte) error {
+	spec := struct {
+		*clusterSpec
+		Users json.RawMessage `json:"users,omitempty"`
+	}{clusterSpec: (*clusterSpec)(s)}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	s.Users, s.LegacyUsers = nil, ""
+	if len(spec.Users) == 0 || string(spec.Users) == "null" {
+		return nil
+	}
+	if spec.Users[0] == '"' {
+		return json.Unmarshal(spec.Users, &s.LegacyUsers)
+	}
+	return json.Unmarshal(spec.Users, &s.Users)
+}
+
+// MarshalJSON writes LegacyUsers back to users as long as the users have not been rewritten
+func (s ClickHouseClusterSpec) MarshalJSON() ([]byte, error) {
+	if s.LegacyUsers == "" || len(s.Users) > 0 {
+		return json.Marshal(clusterSpec(s))
+	}
+	return json.Marshal(struct {
+		clusterSpec
+		Users string `json:"users"`
+	}{clusterSpec(s), s.LegacyUsers})
+}
+
+// SettingValue is the value of a server setting, numbers and booleans are accepted as well as strings
+type SettingValue string
+
+// UnmarshalJSON accepts a JSON string, number or boolean
+func (v *SettingValue) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case string:
+		*v = SettingValue(value)
+	case float64, bool:
+		*v = SettingValue(data)
+	default:
+		return fmt.Errorf("setting value must be a string, number or boolean: %s", data)
+	}
+	return nil
+}
+
+// UserConfig defines a ClickHouse user rendered into users.xml
+type UserConfig struct {
+	// Name of the user, must be a valid XML tag name
+	Name string `json:"name"`
+	// Password of the user, stored as password_sha256_hex
+	Password UserPassword `json:"password"`
+	// Networks the user is allowed to connect from, ::/0 by default
+	Networks []string `json:"networks,omitempty"`
+	// Profile of the user, default by default
+	Profile string `json:"profile,omitempty"`
+	// Quota of the user, default by default
+	Quota string `json:"quota,omitempty"`
+	// AccessManagement enables SQL-driven access control for the user
+	AccessManagement bool `json:"accessManagement,omitempty"`
+}
+
+// UserPassword defines where the password of a user comes from
+type UserPassword struct {
+	// Selects a key of a secret in the cluster's namespace
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef"`
+}
+
 // ZookeeperConfig defines zookeeper
 // Refers to
 // https://clickhouse.yandex/docs/en/single/index.html?#server-settings_zookeeper
@@ -116,6 +509,7 @@ type CustomPodSpec struct {
 
 // ClickHouseCluster is the Schema for the clickhouseclusters API
 // +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
 // +kubebuilder:resource:path=clickhouseclusters,scope=Namespaced,shortName=chc
 type ClickHouseCluster struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -148,6 +542,112 @@ func (cc *ClickHouseCluster) ComputeLastAppliedConfiguration() (string, error) {
 	return string(lastApplied), err
 }
 
+// GetCondition returns the condition of the type, nil if it has not been set
+func (s *ClickHouseClusterStatus) GetCondition(conditionType ClusterConditionType) *ClusterCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == conditionType {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// IsConditionTrue tells if the condition of the type is set and true
+func (s *ClickHouseClusterStatus) IsConditionTrue(conditionType ClusterConditionType) bool {
+	condition := s.GetCondition(conditionType)
+	return condition != nil && condition.Status == corev1.ConditionTrue
+}
+
+// SetCondition sets the condition of the type, LastTransitionTime only changes along with the status
+func (s *ClickHouseClusterStatus) SetCondition(conditionType ClusterConditionType, status corev1.ConditionStatus,
+	reason, message string) {
+	condition := s.GetCondition(conditionType)
+	if condition == nil {
+		s.Conditions = append(s.Conditions, ClusterCondition{Type: conditionType})
+		condition = &s.Conditions[len(s.Conditions)-1]
+	}
+	if condition.Status != status {
+		condition.Status = status
+		condition.LastTransitionTime = metav1.Now()
+	}
+	condition.Reason = reason
+	condition.Message = message
+}
+
+// Shard returns the overrides of the shard, nil if there are none
+func (s *ClickHouseClusterSpec) Shard(shardID int) *ShardSpec {
+	for i := range s.Shards {
+		if int(s.Shards[i].ID) == shardID {
+			return &s.Shards[i]
+		}
+	}
+	return nil
+}
+
+// ShardReplicasCount returns the replicas count of the shard
+func (s *ClickHouseClusterSpec) ShardReplicasCount(shardID int) int32 {
+	if shard := s.Shard(shardID); shard != nil && shard.ReplicasCount != 0 {
+		return shard.ReplicasCount
+	}
+	return s.ReplicasCount
+}
+
+// ShardResources returns the resources of the pods of the shard
+func (s *ClickHouseClusterSpec) ShardResources(shardID int) ClickHouseResources {
+	if shard := s.Shard(shardID); shard != nil && shard.Resources != nil {
+		resources := *shard.Resources
+		if resources.Limits == (CPUAndMem{}) {
+			resources.Limits = resources.Requests
+		}
+		return resources
+	}
+	return s.Resources
+}
+
+// ShardDataCapacity returns the storage capacity of the shard
+func (s *ClickHouseClusterSpec) ShardDataCapacity(shardID int) string {
+	if shard := s.Shard(shardID); shard != nil && shard.DataCapacity != "" {
+		return shard.DataCapacity
+	}
+	return s.DataCapacity
+}
+
+// DataVolumes returns the data volumes of the pods, nil if the legacy dataStorageClass is used
+func (s *ClickHouseClusterSpec) DataVolumes() []StorageVolume {
+	if s.Storage == nil {
+		return nil
+	}
+	return s.Storage.Volumes
+}
+
+// ShardNodeSelector returns the node selector of the pods of the shard
+func (s *ClickHouseClusterSpec) ShardNodeSelector(shardID int) map[string]string {
+	var nodeSelector map[string]string
+	if s.Pod != nil && s.Pod.NodeSelector != nil {
+		nodeSelector = make(map[string]string)
+		for k, v := range s.Pod.NodeSelector {
+			nodeSelector[k] = v
+		}
+	}
+	if shard := s.Shard(shardID); shard != nil && len(shard.NodeSelector) > 0 {
+		if nodeSelector == nil {
+			nodeSelector = make(map[string]string)
+		}
+		for k, v := range shard.NodeSelector {
+			nodeSelector[k] = v
+		}
+	}
+	return nodeSelector
+}
+
+// ShardWeight returns the weight of the shard
+func (s *ClickHouseClusterSpec) ShardWeight(shardID int) int32 {
+	if shard := s.Shard(shardID); shard != nil && shard.Weight != 0 {
+		return shard.Weight
+	}
+	return 1
+}
+
 func init() {
 	SchemeBuilder.Register(&ClickHouseCluster{}, &ClickHouseClusterList{})
 }
@@ -0,0 +1,62 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClickHouseDatabaseSpec defines a database created on all the hosts of a ClickHouseCluster
+// +k8s:openapi-gen=true
+type ClickHouseDatabaseSpec struct {
+	// ClusterRef is the name of the ClickHouseCluster of the namespace the database is created on
+	ClusterRef string `json:"clusterRef"`
+	// Name of the database, the name of the resource if empty
+	Name string `json:"name,omitempty"`
+	// Engine of the database, like Atomic or Ordinary, the default of the server if empty
+	Engine string `json:"engine,omitempty"`
+}
+
+// ClickHouseDatabaseStatus defines the observed state of ClickHouseDatabase
+// +k8s:openapi-gen=true
+type ClickHouseDatabaseStatus struct {
+	// ObservedGeneration is the generation of the spec the status is about
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Phase is Pending, Created, Refused or Failed
+	Phase string `json:"phase,omitempty"`
+	// Message tells why the spec is pending, refused or failed
+	Message string `json:"message,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClickHouseDatabase is the Schema for the clickhousedatabases API
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=clickhousedatabases,scope=Namespaced,shortName=chdb
+type ClickHouseDatabase struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClickHouseDatabaseSpec   `json:"spec,omitempty"`
+	Status ClickHouseDatabaseStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClickHouseDatabaseList contains a list of ClickHouseDatabase
+type ClickHouseDatabaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClickHouseDatabase `json:"items"`
+}
+
+// DatabaseName is the name of the database in ClickHouse
+func (db *ClickHouseDatabase) DatabaseName() string {
+	if db.Spec.Name != "" {
+		return db.Spec.Name
+	}
+	return db.Name
+}
+
+func init() {
+	SchemeBuilder.Register(&ClickHouseDatabase{}, &ClickHouseDatabaseList{})
+}
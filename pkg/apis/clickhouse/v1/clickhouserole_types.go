@@ -0,0 +1,71 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClickHouseRoleSpec defines a SQL role created on all the hosts of a ClickHouseCluster
+// +k8s:openapi-gen=true
+type ClickHouseRoleSpec struct {
+	// ClusterRef is the name of the ClickHouseCluster of the namespace the role is created on
+	ClusterRef string `json:"clusterRef"`
+	// Name of the role, the name of the resource if empty
+	Name string `json:"name,omitempty"`
+	// Grants are the privileges of the role
+	Grants []Grant `json:"grants,omitempty"`
+	// SettingsProfile is the settings profile of the role
+	SettingsProfile string `json:"settingsProfile,omitempty"`
+	// Settings of the role, they override the ones of the profile
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// ClickHouseRoleStatus defines the observed state of ClickHouseRole
+// +k8s:openapi-gen=true
+type ClickHouseRoleStatus struct {
+	// ObservedGeneration is the generation of the spec the status is about
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Phase is Pending, Created, Refused or Failed
+	Phase string `json:"phase,omitempty"`
+	// Message tells why the spec is pending, refused or failed
+	Message string `json:"message,omitempty"`
+	// AppliedHash is the hash of the definition and the grants read once the spec was applied, the
+	// hosts are compared with it to find the changes made by others
+	AppliedHash string `json:"appliedHash,omitempty"`
+	// LastCheckTime is when the hosts were last compared with the spec
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClickHouseRole is the Schema for the clickhouseroles API
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=clickhouseroles,scope=Namespaced,shortName=chrole
+type ClickHouseRole struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClickHouseRoleSpec   `json:"spec,omitempty"`
+	Status ClickHouseRoleStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClickHouseRoleList contains a list of ClickHouseRole
+type ClickHouseRoleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClickHouseRole `json:"items"`
+}
+
+// RoleName is the name of the role in ClickHouse
+func (r *ClickHouseRole) RoleName() string {
+	if r.Spec.Name != "" {
+		return r.Spec.Name
+	}
+	return r.Name
+}
+
+func init() {
+	SchemeBuilder.Register(&ClickHouseRole{}, &ClickHouseRoleList{})
+}
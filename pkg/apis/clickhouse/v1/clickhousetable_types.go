@@ -0,0 +1,114 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClickHouseTableSpec defines a table, a materialized view or a Distributed table created on all the
+// hosts of a ClickHouseCluster
+// +k8s:openapi-gen=true
+type ClickHouseTableSpec struct {
+	// ClusterRef is the name of the ClickHouseCluster of the namespace the table is created on
+	ClusterRef string `json:"clusterRef"`
+	// Database of the table
+	Database string `json:"database"`
+	// Name of the table, the name of the resource if empty
+	Name string `json:"name,omitempty"`
+	// Columns of the table, the ones added at the end are added to the existing table
+	Columns []TableColumn `json:"columns,omitempty"`
+	// Engine of the table or of the inner table of a materialized view, like
+	// ReplicatedMergeTree('/clickhouse/tables/{shard}/db/table', '{replica}')
+	Engine string `json:"engine,omitempty"`
+	// OrderBy is the expression of the ORDER BY clause
+	OrderBy string `json:"orderBy,omitempty"`
+	// PartitionBy is the expression of the PARTITION BY clause
+	PartitionBy string `json:"partitionBy,omitempty"`
+	// PrimaryKey is the expression of the PRIMARY KEY clause, the ORDER BY one if empty
+	PrimaryKey string `json:"primaryKey,omitempty"`
+	// TTL is the expression of the TTL clause, it can be changed on the existing table
+	TTL string `json:"ttl,omitempty"`
+	// Settings of the table, like index_granularity
+	Settings map[string]string `json:"settings,omitempty"`
+	// Distributed makes the table a Distributed table over a local table of the cluster
+	Distributed *DistributedTableSpec `json:"distributed,omitempty"`
+	// MaterializedView makes the table a materialized view
+	MaterializedView *MaterializedViewSpec `json:"materializedView,omitempty"`
+}
+
+// TableColumn is a column of a table
+type TableColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Default is the expression of the DEFAULT clause
+	Default string `json:"default,omitempty"`
+	// Codec is the list of the CODEC clause, like ZSTD(1)
+	Codec string `json:"codec,omitempty"`
+}
+
+// DistributedTableSpec defines a Distributed table writing to and reading from a table on every
+// shard of the cluster
+type DistributedTableSpec struct {
+	// Database of the local table, the database of the Distributed table if empty
+	Database string `json:"database,omitempty"`
+	// Table is the local table, its columns are used when none is given
+	Table string `json:"table"`
+	// ShardingKey is the expression choosing the shard of the rows inserted, rand() if empty
+	ShardingKey string `json:"shardingKey,omitempty"`
+}
+
+// MaterializedViewSpec defines a materialized view, stored in its own table defined by the engine
+// of the spec or written to another table
+type MaterializedViewSpec struct {
+	// To is the table, as database.table, the rows are written to
+	To string `json:"to,omitempty"`
+	// Query is the SELECT run on the blocks inserted into the source table
+	Query string `json:"query"`
+	// Populate fills a view having no To with the rows already in the source table when created
+	Populate bool `json:"populate,omitempty"`
+}
+
+// ClickHouseTableStatus defines the observed state of ClickHouseTable
+// +k8s:openapi-gen=true
+type ClickHouseTableStatus struct {
+	// ObservedGeneration is the generation of the spec the status is about
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Phase is Pending, Created, Refused or Failed
+	Phase string `json:"phase,omitempty"`
+	// Message tells why the spec is pending, refused or failed
+	Message string `json:"message,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClickHouseTable is the Schema for the clickhousetables API
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=clickhousetables,scope=Namespaced,shortName=chtable
+type ClickHouseTable struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClickHouseTableSpec   `json:"spec,omitempty"`
+	Status ClickHouseTableStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClickHouseTableList contains a list of ClickHouseTable
+type ClickHouseTableList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClickHouseTable `json:"items"`
+}
+
+// TableName is the name of the table in ClickHouse
+func (t *ClickHouseTable) TableName() string {
+	if t.Spec.Name != "" {
+		return t.Spec.Name
+	}
+	return t.Name
+}
+
+func init() {
+	SchemeBuilder.Register(&ClickHouseTable{}, &ClickHouseTableList{})
+}
@@ -0,0 +1,104 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClickHouseUserSpec defines a SQL user created on all the hosts of a ClickHouseCluster
+// +k8s:openapi-gen=true
+type ClickHouseUserSpec struct {
+	// ClusterRef is the name of the ClickHouseCluster of the namespace the user is created on
+	ClusterRef string `json:"clusterRef"`
+	// Name of the user, the name of the resource if empty
+	Name string `json:"name,omitempty"`
+	// Password of the user, read from a secret of the namespace
+	Password UserPassword `json:"password"`
+	// Roles granted to the user, all of them are enabled by default
+	Roles []string `json:"roles,omitempty"`
+	// Grants are the privileges of the user
+	Grants []Grant `json:"grants,omitempty"`
+	// SettingsProfile is the settings profile of the user
+	SettingsProfile string `json:"settingsProfile,omitempty"`
+	// Settings of the user, they override the ones of the profile
+	Settings map[string]string `json:"settings,omitempty"`
+	// Quota limits the usage of the user by interval, in a quota of its own
+	Quota []QuotaInterval `json:"quota,omitempty"`
+}
+
+// Grant is a set of privileges on a database, a table or columns of a table
+type Grant struct {
+	// Privileges granted, like SELECT or INSERT
+	Privileges []string `json:"privileges"`
+	// Database the privileges are granted on, all of them if empty
+	Database string `json:"database,omitempty"`
+	// Table the privileges are granted on, all the tables of the database if empty
+	Table string `json:"table,omitempty"`
+	// Columns the privileges are granted on, all the columns of the table if empty
+	Columns []string `json:"columns,omitempty"`
+	// GrantOption allows the privileges to be granted to others
+	GrantOption bool `json:"grantOption,omitempty"`
+}
+
+// QuotaInterval is the limits of a quota over an interval
+type QuotaInterval struct {
+	// Interval of the limits, like 1 hour
+	Interval string `json:"interval"`
+	// Limits by name: queries, errors, result_rows, result_bytes, read_rows, read_bytes or execution_time
+	Limits map[string]int64 `json:"limits"`
+}
+
+// ClickHouseUserStatus defines the observed state of ClickHouseUser
+// +k8s:openapi-gen=true
+type ClickHouseUserStatus struct {
+	// ObservedGeneration is the generation of the spec the status is about
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Phase is Pending, Created, Refused or Failed
+	Phase string `json:"phase,omitempty"`
+	// Message tells why the spec is pending, refused or failed
+	Message string `json:"message,omitempty"`
+	// AppliedHash is the hash of the definition and the grants read once the spec was applied, the
+	// hosts are compared with it to find the changes made by others
+	AppliedHash string `json:"appliedHash,omitempty"`
+	// LastCheckTime is when the hosts were last compared with the spec
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClickHouseUser is the Schema for the clickhouseusers API
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=clickhouseusers,scope=Namespaced,shortName=chuser
+type ClickHouseUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClickHouseUserSpec   `json:"spec,omitempty"`
+	Status ClickHouseUserStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClickHouseUserList contains a list of ClickHouseUser
+type ClickHouseUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClickHouseUser `json:"items"`
+}
+
+// UserName is the name of the user in ClickHouse
+func (u *ClickHouseUser) UserName() string {
+	if u.Spec.Name != "" {
+		return u.Spec.Name
+	}
+	return u.Name
+}
+
+// QuotaName returns the name of the quota of the user
+func (u *ClickHouseUser) QuotaName() string {
+	return u.UserName() + "_quota"
+}
+
+func init() {
+	SchemeBuilder.Register(&ClickHouseUser{}, &ClickHouseUserList{})
+}
@@ -89,17 +89,73 @@ func (in *ClickHouseClusterList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClickHouseClusterSpec) DeepCopyInto(out *ClickHouseClusterSpec) {
 	*out = *in
+	if in.Shards != nil {
+		in, out := &in.Shards, &out.Shards
+		*out = make([]ShardSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.Zookeeper != nil {
 		in, out := &in.Zookeeper, &out.Zookeeper
 		*out = new(ZookeeperConfig)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Keeper != nil {
+		in, out := &in.Keeper, &out.Keeper
+		*out = new(KeeperSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Settings != nil {
+		in, out := &in.Settings, &out.Settings
+		*out = make(map[string]SettingValue, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Users != nil {
+		in, out := &in.Users, &out.Users
+		*out = make([]UserConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(StorageSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Service != nil {
+		in, out := &in.Service, &out.Service
+		*out = new(ServiceSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Pod != nil {
 		in, out := &in.Pod, &out.Pod
 		*out = new(PodPolicy)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.PodTemplate != nil {
+		in, out := &in.PodTemplate, &out.PodTemplate
+		*out = new(corev1.PodTemplateSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	out.Resources = in.Resources
+	if in.Upgrade != nil {
+		in, out := &in.Upgrade, &out.Upgrade
+		*out = new(UpgradeSpec)
+		**out = **in
+	}
+	if in.Deletion != nil {
+		in, out := &in.Deletion, &out.Deletion
+		*out = new(DeletionSpec)
+		**out = **in
+	}
+	if in.SchemaCheck != nil {
+		in, out := &in.SchemaCheck, &out.SchemaCheck
+		*out = new(SchemaCheckSpec)
+		**out = **in
+	}
 	return
 }
 
@@ -116,6 +172,13 @@ func (in *ClickHouseClusterSpec) DeepCopy() *ClickHouseClusterSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClickHouseClusterStatus) DeepCopyInto(out *ClickHouseClusterStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]ClusterCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.ShardStatus != nil {
 		in, out := &in.ShardStatus, &out.ShardStatus
 		*out = make(map[string]*ShardStatus, len(*in))
@@ -126,11 +189,26 @@ func (in *ClickHouseClusterStatus) DeepCopyInto(out *ClickHouseClusterStatus) {
 			} else {
 				in, out := &val, &outVal
 				*out = new(ShardStatus)
-				**out = **in
+				(*in).DeepCopyInto(*out)
 			}
 			(*out)[key] = outVal
 		}
 	}
+	if in.Upgrade != nil {
+		in, out := &in.Upgrade, &out.Upgrade
+		*out = new(UpgradeStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Deletion != nil {
+		in, out := &in.Deletion, &out.Deletion
+		*out = new(DeletionStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Schema != nil {
+		in, out := &in.Schema, &out.Schema
+		*out = new(SchemaStatus)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -144,6 +222,99 @@ func (in *ClickHouseClusterStatus) DeepCopy() *ClickHouseClusterStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseDatabase) DeepCopyInto(out *ClickHouseDatabase) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	out.Status = in.Status
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseDatabase.
+func (in *ClickHouseDatabase) DeepCopy() *ClickHouseDatabase {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseDatabase)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClickHouseDatabase) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseDatabaseList) DeepCopyInto(out *ClickHouseDatabaseList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClickHouseDatabase, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseDatabaseList.
+func (in *ClickHouseDatabaseList) DeepCopy() *ClickHouseDatabaseList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseDatabaseList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClickHouseDatabaseList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseDatabaseSpec) DeepCopyInto(out *ClickHouseDatabaseSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseDatabaseSpec.
+func (in *ClickHouseDatabaseSpec) DeepCopy() *ClickHouseDatabaseSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseDatabaseSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseDatabaseStatus) DeepCopyInto(out *ClickHouseDatabaseStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseDatabaseStatus.
+func (in *ClickHouseDatabaseStatus) DeepCopy() *ClickHouseDatabaseStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseDatabaseStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClickHouseResources) DeepCopyInto(out *ClickHouseResources) {
 	*out = *in
@@ -163,46 +334,152 @@ func (in *ClickHouseResources) DeepCopy() *ClickHouseResources {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *CustomPodSpec) DeepCopyInto(out *CustomPodSpec) {
+func (in *ClickHouseRole) DeepCopyInto(out *ClickHouseRole) {
 	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomPodSpec.
-func (in *CustomPodSpec) DeepCopy() *CustomPodSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseRole.
+func (in *ClickHouseRole) DeepCopy() *ClickHouseRole {
 	if in == nil {
 		return nil
 	}
-	out := new(CustomPodSpec)
+	out := new(ClickHouseRole)
 	in.DeepCopyInto(out)
 	return out
 }
 
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClickHouseRole) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *PodPolicy) DeepCopyInto(out *PodPolicy) {
+func (in *ClickHouseRoleList) DeepCopyInto(out *ClickHouseRoleList) {
 	*out = *in
-	if in.NodeSelector != nil {
-		in, out := &in.NodeSelector, &out.NodeSelector
-		*out = make(map[string]string, len(*in))
-		for key, val := range *in {
-			(*out)[key] = val
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClickHouseRole, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
-	if in.Affinity != nil {
-		in, out := &in.Affinity, &out.Affinity
-		*out = new(corev1.Affinity)
-		(*in).DeepCopyInto(*out)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseRoleList.
+func (in *ClickHouseRoleList) DeepCopy() *ClickHouseRoleList {
+	if in == nil {
+		return nil
 	}
-	if in.Annotations != nil {
-		in, out := &in.Annotations, &out.Annotations
+	out := new(ClickHouseRoleList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClickHouseRoleList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseRoleSpec) DeepCopyInto(out *ClickHouseRoleSpec) {
+	*out = *in
+	if in.Grants != nil {
+		in, out := &in.Grants, &out.Grants
+		*out = make([]Grant, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Settings != nil {
+		in, out := &in.Settings, &out.Settings
 		*out = make(map[string]string, len(*in))
 		for key, val := range *in {
 			(*out)[key] = val
 		}
 	}
-	if in.Tolerations != nil {
-		in, out := &in.Tolerations, &out.Tolerations
-		*out = make([]corev1.Toleration, len(*in))
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseRoleSpec.
+func (in *ClickHouseRoleSpec) DeepCopy() *ClickHouseRoleSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseRoleSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseRoleStatus) DeepCopyInto(out *ClickHouseRoleStatus) {
+	*out = *in
+	if in.LastCheckTime != nil {
+		in, out := &in.LastCheckTime, &out.LastCheckTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseRoleStatus.
+func (in *ClickHouseRoleStatus) DeepCopy() *ClickHouseRoleStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseRoleStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseTable) DeepCopyInto(out *ClickHouseTable) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	out.Status = in.Status
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseTable.
+func (in *ClickHouseTable) DeepCopy() *ClickHouseTable {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseTable)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClickHouseTable) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseTableList) DeepCopyInto(out *ClickHouseTableList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClickHouseTable, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
@@ -210,28 +487,824 @@ func (in *PodPolicy) DeepCopyInto(out *PodPolicy) {
 	return
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodPolicy.
-func (in *PodPolicy) DeepCopy() *PodPolicy {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseTableList.
+func (in *ClickHouseTableList) DeepCopy() *ClickHouseTableList {
 	if in == nil {
 		return nil
 	}
-	out := new(PodPolicy)
+	out := new(ClickHouseTableList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClickHouseTableList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseTableSpec) DeepCopyInto(out *ClickHouseTableSpec) {
+	*out = *in
+	if in.Columns != nil {
+		in, out := &in.Columns, &out.Columns
+		*out = make([]TableColumn, len(*in))
+		copy(*out, *in)
+	}
+	if in.Settings != nil {
+		in, out := &in.Settings, &out.Settings
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Distributed != nil {
+		in, out := &in.Distributed, &out.Distributed
+		*out = new(DistributedTableSpec)
+		**out = **in
+	}
+	if in.MaterializedView != nil {
+		in, out := &in.MaterializedView, &out.MaterializedView
+		*out = new(MaterializedViewSpec)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseTableSpec.
+func (in *ClickHouseTableSpec) DeepCopy() *ClickHouseTableSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseTableSpec)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *ShardStatus) DeepCopyInto(out *ShardStatus) {
+func (in *ClickHouseTableStatus) DeepCopyInto(out *ClickHouseTableStatus) {
 	*out = *in
 	return
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ShardStatus.
-func (in *ShardStatus) DeepCopy() *ShardStatus {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseTableStatus.
+func (in *ClickHouseTableStatus) DeepCopy() *ClickHouseTableStatus {
 	if in == nil {
 		return nil
 	}
-	out := new(ShardStatus)
+	out := new(ClickHouseTableStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseUser) DeepCopyInto(out *ClickHouseUser) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseUser.
+func (in *ClickHouseUser) DeepCopy() *ClickHouseUser {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseUser)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClickHouseUser) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseUserList) DeepCopyInto(out *ClickHouseUserList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClickHouseUser, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseUserList.
+func (in *ClickHouseUserList) DeepCopy() *ClickHouseUserList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseUserList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClickHouseUserList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseUserSpec) DeepCopyInto(out *ClickHouseUserSpec) {
+	*out = *in
+	in.Password.DeepCopyInto(&out.Password)
+	if in.Roles != nil {
+		in, out := &in.Roles, &out.Roles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Grants != nil {
+		in, out := &in.Grants, &out.Grants
+		*out = make([]Grant, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Settings != nil {
+		in, out := &in.Settings, &out.Settings
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Quota != nil {
+		in, out := &in.Quota, &out.Quota
+		*out = make([]QuotaInterval, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseUserSpec.
+func (in *ClickHouseUserSpec) DeepCopy() *ClickHouseUserSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseUserSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickHouseUserStatus) DeepCopyInto(out *ClickHouseUserStatus) {
+	*out = *in
+	if in.LastCheckTime != nil {
+		in, out := &in.LastCheckTime, &out.LastCheckTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickHouseUserStatus.
+func (in *ClickHouseUserStatus) DeepCopy() *ClickHouseUserStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickHouseUserStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterCondition) DeepCopyInto(out *ClusterCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterCondition.
+func (in *ClusterCondition) DeepCopy() *ClusterCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CustomPodSpec) DeepCopyInto(out *CustomPodSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomPodSpec.
+func (in *CustomPodSpec) DeepCopy() *CustomPodSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CustomPodSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeletionSpec) DeepCopyInto(out *DeletionSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeletionSpec.
+func (in *DeletionSpec) DeepCopy() *DeletionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DeletionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeletionStatus) DeepCopyInto(out *DeletionStatus) {
+	*out = *in
+	if in.CompletedSteps != nil {
+		in, out := &in.CompletedSteps, &out.CompletedSteps
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeletionStatus.
+func (in *DeletionStatus) DeepCopy() *DeletionStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DeletionStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DistributedTableSpec) DeepCopyInto(out *DistributedTableSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DistributedTableSpec.
+func (in *DistributedTableSpec) DeepCopy() *DistributedTableSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DistributedTableSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DrainedTable) DeepCopyInto(out *DrainedTable) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DrainedTable.
+func (in *DrainedTable) DeepCopy() *DrainedTable {
+	if in == nil {
+		return nil
+	}
+	out := new(DrainedTable)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Grant) DeepCopyInto(out *Grant) {
+	*out = *in
+	if in.Privileges != nil {
+		in, out := &in.Privileges, &out.Privileges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Columns != nil {
+		in, out := &in.Columns, &out.Columns
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Grant.
+func (in *Grant) DeepCopy() *Grant {
+	if in == nil {
+		return nil
+	}
+	out := new(Grant)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HostStatus) DeepCopyInto(out *HostStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HostStatus.
+func (in *HostStatus) DeepCopy() *HostStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(HostStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeeperSpec) DeepCopyInto(out *KeeperSpec) {
+	*out = *in
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(StorageVolume)
+		**out = **in
+	}
+	out.Resources = in.Resources
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeeperSpec.
+func (in *KeeperSpec) DeepCopy() *KeeperSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(KeeperSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MaterializedViewSpec) DeepCopyInto(out *MaterializedViewSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MaterializedViewSpec.
+func (in *MaterializedViewSpec) DeepCopy() *MaterializedViewSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(MaterializedViewSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodPolicy) DeepCopyInto(out *PodPolicy) {
+	*out = *in
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(corev1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]corev1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodPolicy.
+func (in *PodPolicy) DeepCopy() *PodPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(PodPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuotaInterval) DeepCopyInto(out *QuotaInterval) {
+	*out = *in
+	if in.Limits != nil {
+		in, out := &in.Limits, &out.Limits
+		*out = make(map[string]int64, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuotaInterval.
+func (in *QuotaInterval) DeepCopy() *QuotaInterval {
+	if in == nil {
+		return nil
+	}
+	out := new(QuotaInterval)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SchemaCheckSpec) DeepCopyInto(out *SchemaCheckSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SchemaCheckSpec.
+func (in *SchemaCheckSpec) DeepCopy() *SchemaCheckSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SchemaCheckSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SchemaDrift) DeepCopyInto(out *SchemaDrift) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SchemaDrift.
+func (in *SchemaDrift) DeepCopy() *SchemaDrift {
+	if in == nil {
+		return nil
+	}
+	out := new(SchemaDrift)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SchemaObjectFailure) DeepCopyInto(out *SchemaObjectFailure) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SchemaObjectFailure.
+func (in *SchemaObjectFailure) DeepCopy() *SchemaObjectFailure {
+	if in == nil {
+		return nil
+	}
+	out := new(SchemaObjectFailure)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SchemaStatus) DeepCopyInto(out *SchemaStatus) {
+	*out = *in
+	if in.FailedObjects != nil {
+		in, out := &in.FailedObjects, &out.FailedObjects
+		*out = make([]SchemaObjectFailure, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastCheckTime != nil {
+		in, out := &in.LastCheckTime, &out.LastCheckTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Drifts != nil {
+		in, out := &in.Drifts, &out.Drifts
+		*out = make([]SchemaDrift, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SchemaStatus.
+func (in *SchemaStatus) DeepCopy() *SchemaStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SchemaStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServicePort) DeepCopyInto(out *ServicePort) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServicePort.
+func (in *ServicePort) DeepCopy() *ServicePort {
+	if in == nil {
+		return nil
+	}
+	out := new(ServicePort)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceSpec) DeepCopyInto(out *ServiceSpec) {
+	*out = *in
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.LoadBalancerSourceRanges != nil {
+		in, out := &in.LoadBalancerSourceRanges, &out.LoadBalancerSourceRanges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Ports != nil {
+		in, out := &in.Ports, &out.Ports
+		*out = make([]ServicePort, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceSpec.
+func (in *ServiceSpec) DeepCopy() *ServiceSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ShardSpec) DeepCopyInto(out *ShardSpec) {
+	*out = *in
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(ClickHouseResources)
+		**out = **in
+	}
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ShardSpec.
+func (in *ShardSpec) DeepCopy() *ShardSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ShardSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ShardStatus) DeepCopyInto(out *ShardStatus) {
+	*out = *in
+	if in.Hosts != nil {
+		in, out := &in.Hosts, &out.Hosts
+		*out = make([]HostStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.DroppingReplicas != nil {
+		in, out := &in.DroppingReplicas, &out.DroppingReplicas
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExpandingVolumes != nil {
+		in, out := &in.ExpandingVolumes, &out.ExpandingVolumes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DrainedTables != nil {
+		in, out := &in.DrainedTables, &out.DrainedTables
+		*out = make([]DrainedTable, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ShardStatus.
+func (in *ShardStatus) DeepCopy() *ShardStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ShardStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StoragePolicy) DeepCopyInto(out *StoragePolicy) {
+	*out = *in
+	if in.Volumes != nil {
+		in, out := &in.Volumes, &out.Volumes
+		*out = make([]StoragePolicyVolume, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StoragePolicy.
+func (in *StoragePolicy) DeepCopy() *StoragePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(StoragePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StoragePolicyVolume) DeepCopyInto(out *StoragePolicyVolume) {
+	*out = *in
+	if in.Disks != nil {
+		in, out := &in.Disks, &out.Disks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StoragePolicyVolume.
+func (in *StoragePolicyVolume) DeepCopy() *StoragePolicyVolume {
+	if in == nil {
+		return nil
+	}
+	out := new(StoragePolicyVolume)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageSpec) DeepCopyInto(out *StorageSpec) {
+	*out = *in
+	if in.Volumes != nil {
+		in, out := &in.Volumes, &out.Volumes
+		*out = make([]StorageVolume, len(*in))
+		copy(*out, *in)
+	}
+	if in.Policies != nil {
+		in, out := &in.Policies, &out.Policies
+		*out = make([]StoragePolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Log != nil {
+		in, out := &in.Log, &out.Log
+		*out = new(StorageVolume)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageSpec.
+func (in *StorageSpec) DeepCopy() *StorageSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageVolume) DeepCopyInto(out *StorageVolume) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageVolume.
+func (in *StorageVolume) DeepCopy() *StorageVolume {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageVolume)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TableColumn) DeepCopyInto(out *TableColumn) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TableColumn.
+func (in *TableColumn) DeepCopy() *TableColumn {
+	if in == nil {
+		return nil
+	}
+	out := new(TableColumn)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpgradeSpec) DeepCopyInto(out *UpgradeSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpgradeSpec.
+func (in *UpgradeSpec) DeepCopy() *UpgradeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UpgradeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpgradeStatus) DeepCopyInto(out *UpgradeStatus) {
+	*out = *in
+	if in.SoakStartTime != nil {
+		in, out := &in.SoakStartTime, &out.SoakStartTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpgradeStatus.
+func (in *UpgradeStatus) DeepCopy() *UpgradeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(UpgradeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UserConfig) DeepCopyInto(out *UserConfig) {
+	*out = *in
+	in.Password.DeepCopyInto(&out.Password)
+	if in.Networks != nil {
+		in, out := &in.Networks, &out.Networks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UserConfig.
+func (in *UserConfig) DeepCopy() *UserConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(UserConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UserPassword) DeepCopyInto(out *UserPassword) {
+	*out = *in
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UserPassword.
+func (in *UserPassword) DeepCopy() *UserPassword {
+	if in == nil {
+		return nil
+	}
+	out := new(UserPassword)
 	in.DeepCopyInto(out)
 	return out
 }
@@ -11,9 +11,21 @@ import (
 
 func GetOpenAPIDefinitions(ref common.ReferenceCallback) map[string]common.OpenAPIDefinition {
 	return map[string]common.OpenAPIDefinition{
-		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseCluster":       schema_pkg_apis_clickhouse_v1_ClickHouseCluster(ref),
-		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseClusterSpec":   schema_pkg_apis_clickhouse_v1_ClickHouseClusterSpec(ref),
-		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseClusterStatus": schema_pkg_apis_clickhouse_v1_ClickHouseClusterStatus(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseCluster":        schema_pkg_apis_clickhouse_v1_ClickHouseCluster(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseClusterSpec":    schema_pkg_apis_clickhouse_v1_ClickHouseClusterSpec(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseClusterStatus":  schema_pkg_apis_clickhouse_v1_ClickHouseClusterStatus(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseDatabase":       schema_pkg_apis_clickhouse_v1_ClickHouseDatabase(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseDatabaseSpec":   schema_pkg_apis_clickhouse_v1_ClickHouseDatabaseSpec(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseDatabaseStatus": schema_pkg_apis_clickhouse_v1_ClickHouseDatabaseStatus(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseRole":           schema_pkg_apis_clickhouse_v1_ClickHouseRole(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseRoleSpec":       schema_pkg_apis_clickhouse_v1_ClickHouseRoleSpec(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseRoleStatus":     schema_pkg_apis_clickhouse_v1_ClickHouseRoleStatus(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseTable":          schema_pkg_apis_clickhouse_v1_ClickHouseTable(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseTableSpec":      schema_pkg_apis_clickhouse_v1_ClickHouseTableSpec(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseTableStatus":    schema_pkg_apis_clickhouse_v1_ClickHouseTableStatus(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseUser":           schema_pkg_apis_clickhouse_v1_ClickHouseUser(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseUserSpec":       schema_pkg_apis_clickhouse_v1_ClickHouseUserSpec(ref),
+		"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseUserStatus":     schema_pkg_apis_clickhouse_v1_ClickHouseUserStatus(ref),
 	}
 }
 
@@ -89,6 +101,12 @@ func schema_pkg_apis_clickhouse_v1_ClickHouseClusterSpec(ref common.ReferenceCal
 							Format:      "",
 						},
 					},
+					"deletion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Deletion defines the cleanup run when the cluster is deleted",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.DeletionSpec"),
+						},
+					},
 					"shardsCount": {
 						SchemaProps: spec.SchemaProps{
 							Description: "Shards count",
@@ -103,24 +121,55 @@ func schema_pkg_apis_clickhouse_v1_ClickHouseClusterSpec(ref common.ReferenceCal
 							Format:      "int32",
 						},
 					},
+					"shards": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Per-shard overrides of the cluster-wide topology",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ShardSpec"),
+									},
+								},
+							},
+						},
+					},
 					"zookeeper": {
 						SchemaProps: spec.SchemaProps{
 							Description: "Zookeeper config",
 							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ZookeeperConfig"),
 						},
 					},
+					"keeper": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Keeper deploys a ClickHouse Keeper ensemble the replicas coordinate through, in place of the external zookeeper of spec.zookeeper",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.KeeperSpec"),
+						},
+					},
+					"settings": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Server settings rendered into config.d by the operator, keyed by the path of the setting, like merge_tree/parts_to_throw_insert: 600",
+							Type:        []string{"object"},
+						},
+					},
 					"custom_settings": {
 						SchemaProps: spec.SchemaProps{
-							Description: "Custom defined XML settings, like <yandex>something</yandex>",
+							Description: "LegacyCustomSettings is the XML config the clusters of the previous releases had, the cluster is refused until its settings are moved to settings",
 							Type:        []string{"string"},
 							Format:      "",
 						},
 					},
 					"users": {
 						SchemaProps: spec.SchemaProps{
-							Description: "Users defined",
-							Type:        []string{"string"},
-							Format:      "",
+							Description: "Users defined, the first one is used by the operator and the broker to connect to ClickHouse",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.UserConfig"),
+									},
+								},
+							},
 						},
 					},
 					"dataCapacity": {
@@ -137,23 +186,60 @@ func schema_pkg_apis_clickhouse_v1_ClickHouseClusterSpec(ref common.ReferenceCal
 							Format:      "",
 						},
 					},
+					"storage": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Disks of the pods and the storage policies of the tables, replaces dataStorageClass and dataCapacity when volumes are defined",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.StorageSpec"),
+						},
+					},
+					"service": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Service defines how the cluster Service is exposed",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ServiceSpec"),
+						},
+					},
 					"pod": {
 						SchemaProps: spec.SchemaProps{
 							Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.PodPolicy"),
 						},
 					},
+					"podTemplate": {
+						SchemaProps: spec.SchemaProps{
+							Description: "PodTemplate is merged into the pod template generated for the shards with a strategic merge patch, it can add sidecars, env vars, volumes and most pod settings, the generated containers, volumes and probes are kept as they are",
+							Ref:         ref("k8s.io/api/core/v1.PodTemplateSpec"),
+						},
+					},
 					"resources": {
 						SchemaProps: spec.SchemaProps{
 							Description: "Pod defines the policy for pods owned by clickhouse operator. This field cannot be updated once the CR is created.",
 							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseResources"),
 						},
 					},
+					"upgrade": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Upgrade defines how a change of the image is rolled out",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.UpgradeSpec"),
+						},
+					},
+					"stopped": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Stopped scales the StatefulSets of the shards to zero, the PVCs, the configuration and the zookeeper paths are kept so the cluster starts again with its data",
+							Type:        []string{"boolean"},
+							Format:      "",
+						},
+					},
+					"schemaCheck": {
+						SchemaProps: spec.SchemaProps{
+							Description: "SchemaCheck defines the periodic comparison of the tables of the hosts",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.SchemaCheckSpec"),
+						},
+					},
 				},
 				Required: []string{"deletePVC"},
 			},
 		},
 		Dependencies: []string{
-			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseResources", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.PodPolicy", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ZookeeperConfig"},
+			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseResources", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.DeletionSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.KeeperSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.PodPolicy", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.SchemaCheckSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ServiceSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ShardSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.StorageSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.UpgradeSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.UserConfig", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ZookeeperConfig", "k8s.io/api/core/v1.PodTemplateSpec"},
 	}
 }
 
@@ -161,15 +247,35 @@ func schema_pkg_apis_clickhouse_v1_ClickHouseClusterStatus(ref common.ReferenceC
 	return common.OpenAPIDefinition{
 		Schema: spec.Schema{
 			SchemaProps: spec.SchemaProps{
-				Description: "Remove subresources, cuz https://github.com/kubernetes/kubectl/issues/564 ClickHouseClusterStatus defines the observed state of ClickHouseCluster",
+				Description: "ClickHouseClusterStatus defines the observed state of ClickHouseCluster",
 				Type:        []string{"object"},
 				Properties: map[string]spec.Schema{
+					"observedGeneration": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ObservedGeneration is the generation of the spec the status has been computed for",
+							Type:        []string{"integer"},
+							Format:      "int64",
+						},
+					},
 					"phase": {
 						SchemaProps: spec.SchemaProps{
 							Type:   []string{"string"},
 							Format: "",
 						},
 					},
+					"conditions": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Conditions are the latest observations of the cluster's state",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClusterCondition"),
+									},
+								},
+							},
+						},
+					},
 					"shardStatus": {
 						SchemaProps: spec.SchemaProps{
 							Type: []string{"object"},
@@ -183,10 +289,653 @@ func schema_pkg_apis_clickhouse_v1_ClickHouseClusterStatus(ref common.ReferenceC
 							},
 						},
 					},
+					"upgrade": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Upgrade is the state of the last canary upgrade",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.UpgradeStatus"),
+						},
+					},
+					"deletion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Deletion is the progress of the cleanup of the deleted cluster",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.DeletionStatus"),
+						},
+					},
+					"schema": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Schema is the state of the schema replicated to the hosts",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.SchemaStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClusterCondition", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.DeletionStatus", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.SchemaStatus", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ShardStatus", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.UpgradeStatus"},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseDatabase(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseDatabase is the Schema for the clickhousedatabases API",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseDatabaseSpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseDatabaseStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseDatabaseSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseDatabaseStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseDatabaseSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseDatabaseSpec defines a database created on all the hosts of a ClickHouseCluster",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"clusterRef": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ClusterRef is the name of the ClickHouseCluster of the namespace the database is created on",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"name": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Name of the database, the name of the resource if empty",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"engine": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Engine of the database, like Atomic or Ordinary, the default of the server if empty",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+				Required: []string{"clusterRef"},
+			},
+		},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseDatabaseStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseDatabaseStatus defines the observed state of ClickHouseDatabase",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"observedGeneration": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ObservedGeneration is the generation of the spec the status is about",
+							Type:        []string{"integer"},
+							Format:      "int64",
+						},
+					},
+					"phase": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Phase is Pending, Created, Refused or Failed",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"message": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Message tells why the spec is pending, refused or failed",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseRole(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseRole is the Schema for the clickhouseroles API",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseRoleSpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseRoleStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseRoleSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseRoleStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseRoleSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseRoleSpec defines a SQL role created on all the hosts of a ClickHouseCluster",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"clusterRef": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ClusterRef is the name of the ClickHouseCluster of the namespace the role is created on",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"name": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Name of the role, the name of the resource if empty",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"grants": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Grants are the privileges of the role",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.Grant"),
+									},
+								},
+							},
+						},
+					},
+					"settingsProfile": {
+						SchemaProps: spec.SchemaProps{
+							Description: "SettingsProfile is the settings profile of the role",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"settings": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Settings of the role, they override the ones of the profile",
+							Type:        []string{"object"},
+						},
+					},
+				},
+				Required: []string{"clusterRef"},
+			},
+		},
+		Dependencies: []string{
+			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.Grant"},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseRoleStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseRoleStatus defines the observed state of ClickHouseRole",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"observedGeneration": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ObservedGeneration is the generation of the spec the status is about",
+							Type:        []string{"integer"},
+							Format:      "int64",
+						},
+					},
+					"phase": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Phase is Pending, Created, Refused or Failed",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"message": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Message tells why the spec is pending, refused or failed",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"appliedHash": {
+						SchemaProps: spec.SchemaProps{
+							Description: "AppliedHash is the hash of the definition and the grants read once the spec was applied, the hosts are compared with it to find the changes made by others",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"lastCheckTime": {
+						SchemaProps: spec.SchemaProps{
+							Description: "LastCheckTime is when the hosts were last compared with the spec",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"k8s.io/apimachinery/pkg/apis/meta/v1.Time"},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseTable(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseTable is the Schema for the clickhousetables API",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseTableSpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseTableStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseTableSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseTableStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseTableSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseTableSpec defines a table, a materialized view or a Distributed table created on all the hosts of a ClickHouseCluster",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"clusterRef": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ClusterRef is the name of the ClickHouseCluster of the namespace the table is created on",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"database": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Database of the table",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"name": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Name of the table, the name of the resource if empty",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"columns": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Columns of the table, the ones added at the end are added to the existing table",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.TableColumn"),
+									},
+								},
+							},
+						},
+					},
+					"engine": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Engine of the table or of the inner table of a materialized view, like ReplicatedMergeTree('/clickhouse/tables/{shard}/db/table', '{replica}')",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"orderBy": {
+						SchemaProps: spec.SchemaProps{
+							Description: "OrderBy is the expression of the ORDER BY clause",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"partitionBy": {
+						SchemaProps: spec.SchemaProps{
+							Description: "PartitionBy is the expression of the PARTITION BY clause",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"primaryKey": {
+						SchemaProps: spec.SchemaProps{
+							Description: "PrimaryKey is the expression of the PRIMARY KEY clause, the ORDER BY one if empty",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"ttl": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TTL is the expression of the TTL clause, it can be changed on the existing table",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"settings": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Settings of the table, like index_granularity",
+							Type:        []string{"object"},
+						},
+					},
+					"distributed": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Distributed makes the table a Distributed table over a local table of the cluster",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.DistributedTableSpec"),
+						},
+					},
+					"materializedView": {
+						SchemaProps: spec.SchemaProps{
+							Description: "MaterializedView makes the table a materialized view",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.MaterializedViewSpec"),
+						},
+					},
+				},
+				Required: []string{"clusterRef", "database"},
+			},
+		},
+		Dependencies: []string{
+			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.DistributedTableSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.MaterializedViewSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.TableColumn"},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseTableStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseTableStatus defines the observed state of ClickHouseTable",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"observedGeneration": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ObservedGeneration is the generation of the spec the status is about",
+							Type:        []string{"integer"},
+							Format:      "int64",
+						},
+					},
+					"phase": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Phase is Pending, Created, Refused or Failed",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"message": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Message tells why the spec is pending, refused or failed",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseUser(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseUser is the Schema for the clickhouseusers API",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseUserSpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseUserStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseUserSpec", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ClickHouseUserStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseUserSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseUserSpec defines a SQL user created on all the hosts of a ClickHouseCluster",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"clusterRef": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ClusterRef is the name of the ClickHouseCluster of the namespace the user is created on",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"name": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Name of the user, the name of the resource if empty",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"password": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Password of the user, read from a secret of the namespace",
+							Ref:         ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.UserPassword"),
+						},
+					},
+					"roles": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Roles granted to the user, all of them are enabled by default",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Type:   []string{"string"},
+										Format: "",
+									},
+								},
+							},
+						},
+					},
+					"grants": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Grants are the privileges of the user",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.Grant"),
+									},
+								},
+							},
+						},
+					},
+					"settingsProfile": {
+						SchemaProps: spec.SchemaProps{
+							Description: "SettingsProfile is the settings profile of the user",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"settings": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Settings of the user, they override the ones of the profile",
+							Type:        []string{"object"},
+						},
+					},
+					"quota": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Quota limits the usage of the user by interval, in a quota of its own",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.QuotaInterval"),
+									},
+								},
+							},
+						},
+					},
+				},
+				Required: []string{"clusterRef", "password"},
+			},
+		},
+		Dependencies: []string{
+			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.Grant", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.QuotaInterval", "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.UserPassword"},
+	}
+}
+
+func schema_pkg_apis_clickhouse_v1_ClickHouseUserStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClickHouseUserStatus defines the observed state of ClickHouseUser",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"observedGeneration": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ObservedGeneration is the generation of the spec the status is about",
+							Type:        []string{"integer"},
+							Format:      "int64",
+						},
+					},
+					"phase": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Phase is Pending, Created, Refused or Failed",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"message": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Message tells why the spec is pending, refused or failed",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"appliedHash": {
+						SchemaProps: spec.SchemaProps{
+							Description: "AppliedHash is the hash of the definition and the grants read once the spec was applied, the hosts are compared with it to find the changes made by others",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"lastCheckTime": {
+						SchemaProps: spec.SchemaProps{
+							Description: "LastCheckTime is when the hosts were last compared with the spec",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+						},
+					},
 				},
 			},
 		},
 		Dependencies: []string{
-			"github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1.ShardStatus"},
+			"k8s.io/apimachinery/pkg/apis/meta/v1.Time"},
 	}
 }
@@ -413,7 +413,7 @@ func (b *CHCBrokerLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.
 	return &response, nil
 }
 
-func (b *CHCBrokerLogic) checkProvisionAction(instanceID string) (osb.LastOperationState, error) {
+func (b *CHCBrokerLogic) checkProvisionAction(instanceID string) (osb.LastOperationState, *string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), OperateTimeOut)
 	defer cancel()
 	clickHouseClusterList := v1alpha1.ClickHouseClusterList{}
@@ -423,14 +423,74 @@ func (b *CHCBrokerLogic) checkProvisionAction(instanceID string) (osb.LastOperat
 		LabelSelector: labelSelect,
 	})
 	if err != nil {
-		return osb.StateFailed, err
+		return osb.StateFailed, nil, err
 	}
 	if len(clickHouseClusterList.Items) != 1 {
-		return osb.StateFailed, fmt.Errorf("the num of find clickhousecluster is not 1")
+		return osb.StateFailed, nil, fmt.Errorf("the num of find clickhousecluster is not 1")
+	}
+	cc := &clickHouseClusterList.Items[0]
+	state, description := clusterOperationState(cc)
+	if state == osb.StateInProgress && description == nil {
+		description = b.lastClusterEvent(ctx, cc)
+	}
+	return state, description, nil
+}
+
+// lastClusterEvent describes the last event recorded by the operator for the cluster since its
+// rollout started, nil if there is none
+func (b *CHCBrokerLogic) lastClusterEvent(ctx context.Context, cc *v1alpha1.ClickHouseCluster) *string {
+	events := corev1.EventList{}
+	err := b.cli.List(ctx, &events, client.InNamespace(cc.Namespace),
+		client.MatchingField("involvedObject.uid", string(cc.UID)))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "name": cc.Name, "error": err}).Error("list events error")
+		return nil
+	}
+	var since v1.Time
+	if condition := cc.Status.GetCondition(v1alpha1.ClusterReconciling); condition != nil {
+		since = condition.LastTransitionTime
+	}
+	var last *corev1.Event
+	for i := range events.Items {
+		event := &events.Items[i]
+		if event.LastTimestamp.Before(&since) {
+			continue
+		}
+		if last == nil || last.LastTimestamp.Before(&event.LastTimestamp) {
+			last = event
+		}
+	}
+	if last == nil {
+		return nil
+	}
+	description := fmt.Sprintf("%s: %s", last.Reason, last.Message)
+	return &description
+}
+
+// clusterOperationState tells a cluster still rolling out apart from a rejected one and a ready one
+func clusterOperationState(cc *v1alpha1.ClickHouseCluster) (osb.LastOperationState, *string) {
+	status := &cc.Status
+	if len(status.Conditions) == 0 || status.ObservedGeneration < cc.Generation {
+		return osb.StateInProgress, nil
+	}
+	if condition := status.GetCondition(v1alpha1.ClusterConfigValid); condition != nil &&
+		condition.Status == corev1.ConditionFalse {
+		description := fmt.Sprintf("%s: %s", condition.Reason, condition.Message)
+		return osb.StateFailed, &description
 	}
-	if clickHouseClusterList.Items[0].Status.Phase == clickhousecluster.ClusterPhaseRunning {
+	if status.IsConditionTrue(v1alpha1.ClusterReady) && !status.IsConditionTrue(v1alpha1.ClusterReconciling) {
 		return osb.StateSucceeded, nil
 	}
+	// a stopped cluster is not ready on purpose
+	if condition := status.GetCondition(v1alpha1.ClusterReconciling); condition != nil &&
+		condition.Status == corev1.ConditionFalse && condition.Reason == clickhousecluster.ReasonStopped {
+		return osb.StateSucceeded, nil
+	}
+	if condition := status.GetCondition(v1alpha1.ClusterDegraded); condition != nil &&
+		condition.Status == corev1.ConditionTrue {
+		description := fmt.Sprintf("%s: %s", condition.Reason, condition.Message)
+		return osb.StateInProgress, &description
+	}
 	return osb.StateInProgress, nil
 }
 
@@ -455,7 +515,7 @@ func (b *CHCBrokerLogic) checkDeprovisionAction(instanceID string) (osb.LastOper
 	return osb.StateFailed, fmt.Errorf("the num of find clickhousecluster is more than 1")
 }
 
-func (b *CHCBrokerLogic) checkUpdateAction(instanceID string) (osb.LastOperationState, error) {
+func (b *CHCBrokerLogic) checkUpdateAction(instanceID string) (osb.LastOperationState, *string, error) {
 	return b.checkProvisionAction(instanceID)
 }
 
@@ -469,14 +529,15 @@ func (b *CHCBrokerLogic) LastOperation(request *osb.LastOperationRequest, c *bro
 		}
 	}
 	var state osb.LastOperationState
+	var description *string
 	var err error
 	switch *request.OperationKey {
 	case ProvisionOperation:
-		state, err = b.checkProvisionAction(request.InstanceID)
+		state, description, err = b.checkProvisionAction(request.InstanceID)
 	case DeprovisionOperation:
 		state, err = b.checkDeprovisionAction(request.InstanceID)
 	case UpdateOperation:
-		state, err = b.checkUpdateAction(request.InstanceID)
+		state, description, err = b.checkUpdateAction(request.InstanceID)
 	default:
 		err = osb.HTTPStatusCodeError{
 			StatusCode:  http.StatusServiceUnavailable,
@@ -485,7 +546,8 @@ func (b *CHCBrokerLogic) LastOperation(request *osb.LastOperationRequest, c *bro
 	}
 	return &broker.LastOperationResponse{
 		LastOperationResponse: osb.LastOperationResponse{
-			State: state,
+			State:       state,
+			Description: description,
 		},
 	}, err
 
@@ -534,28 +596,34 @@ func (b *CHCBrokerLogic) Bind(request *osb.BindRequest, c *broker.RequestContext
 	}
 
 	host := getCHCServiceName(instance.Name, instance.Namespace)
-	namespaced := crclient.ObjectKey{Namespace: instance.Namespace, Name: fmt.Sprintf("%s-user-config", instance.Name)}
-	var cm corev1.ConfigMap
-	err = b.cli.Get(context.Background(), namespaced, &cm)
+	user := clickhousecluster.OperatorUser(&clusterList.Items[0])
+	if user == nil {
+		errMsg := fmt.Sprintf("can not find any user of clickhousecluster %s", instance.Name)
+		logrus.Errorf(errMsg)
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode:   http.StatusServiceUnavailable,
+			ErrorMessage: &errMsg,
+		}
+	}
+	password, err := clickhousecluster.GetUserPassword(b.cli, instance.Namespace, user)
 	if err != nil {
 		return nil, osb.HTTPStatusCodeError{
 			StatusCode:   http.StatusServiceUnavailable,
 			ErrorMessage: &[]string{err.Error()}[0],
 		}
 	}
-	password := cm.Annotations["password"]
 	response := broker.BindResponse{
 		BindResponse: osb.BindResponse{
 			Credentials: map[string]interface{}{
 				"host":     host,
-				"user":     "default",
+				"user":     user.Name,
 				"password": password,
 			},
 			Async: false,
 		},
 	}
 	b.bindings[request.BindingID] = &BindingInfo{
-		User:     "default",
+		User:     user.Name,
 		Password: password,
 		Host:     host,
 	}
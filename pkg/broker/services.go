@@ -146,7 +146,7 @@ loop:
 				}
 			}
 		}
-		if userField.Interface() == reflect.Zero(userField.Type()).Interface() {
+		if userField.IsZero() {
 			userField.Set(reflect.ValueOf(planField.Interface()))
 		}
 	}
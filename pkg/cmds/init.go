@@ -48,7 +48,7 @@ func createZookeeperNode() error {
 	}
 
 	for _, host := range zkc.Zookeeper.Nodes {
-		logrus.Infof("add zk node: %s/%s\n", host.Host, host.Port)
+		logrus.Infof("add zk node: %s/%d\n", host.Host, host.Port)
 		hosts = append(hosts, fmt.Sprintf("%s:%d", host.Host, host.Port))
 	}
 	conn, _, err := zk.Connect(hosts, time.Second*10)
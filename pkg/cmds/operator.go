@@ -12,6 +12,7 @@ import (
 
 	"github.com/mackwong/clickhouse-operator/pkg/apis"
 	"github.com/mackwong/clickhouse-operator/pkg/controller"
+	"github.com/mackwong/clickhouse-operator/pkg/webhook"
 	"github.com/mackwong/clickhouse-operator/version"
 
 	"github.com/operator-framework/operator-sdk/pkg/k8sutil"
@@ -35,6 +36,36 @@ func OperatorFlags() []cli.Flag {
 			Usage: "specify the kube config path to be used",
 			Value: "",
 		},
+		&cli.IntFlag{
+			Name:  "max-concurrent-reconciles",
+			Usage: "the number of ClickHouseClusters reconciled at the same time",
+			Value: 4,
+		},
+		&cli.BoolFlag{
+			Name:  "webhook-enabled",
+			Usage: "serve the admission webhooks of ClickHouseCluster",
+			Value: true,
+		},
+		&cli.IntFlag{
+			Name:  "webhook-port",
+			Usage: "the port the webhook server listens on",
+			Value: 9443,
+		},
+		&cli.StringFlag{
+			Name:  "webhook-cert-dir",
+			Usage: "the directory of the webhook serving certs, they are generated if missing",
+			Value: "/tmp/k8s-webhook-server/serving-certs",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-service-name",
+			Usage: "the Service in front of the operator the API server calls the webhooks through",
+			Value: "clickhouse-operator-webhook",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-cert-secret",
+			Usage: "the Secret of the operator namespace the generated webhook serving certs are kept in",
+			Value: "clickhouse-operator-webhook-certs",
+		},
 	}
 }
 
@@ -73,6 +104,8 @@ func OperatorRun(ctx *cli.Context) error {
 		Namespace:          namespace,
 		MapperProvider:     restmapper.NewDynamicRESTMapper,
 		MetricsBindAddress: fmt.Sprintf("%s:%d", metricsHost, metricsPort),
+		Port:               ctx.Int("webhook-port"),
+		CertDir:            ctx.String("webhook-cert-dir"),
 	})
 	if err != nil {
 		logrus.Fatal(err)
@@ -88,11 +121,33 @@ func OperatorRun(ctx *cli.Context) error {
 	}
 
 	// Setup all Controllers
-	if err = controller.AddToManager(mgr); err != nil {
+	err = controller.AddToManager(mgr, controller.Options{
+		MaxConcurrentReconciles: ctx.Int("max-concurrent-reconciles"),
+	})
+	if err != nil {
 		logrus.Fatal(err)
 		return err
 	}
 
+	// Setup the admission webhooks
+	if ctx.Bool("webhook-enabled") {
+		operatorNamespace, err := k8sutil.GetOperatorNamespace()
+		if err != nil {
+			logrus.Fatal(err, "Failed to get operator namespace")
+			return err
+		}
+		err = webhook.AddToManager(mgr, webhook.Options{
+			ServiceName:    ctx.String("webhook-service-name"),
+			Namespace:      operatorNamespace,
+			CertDir:        ctx.String("webhook-cert-dir"),
+			CertSecretName: ctx.String("webhook-cert-secret"),
+		})
+		if err != nil {
+			logrus.Fatal(err)
+			return err
+		}
+	}
+
 	// Create the prometheus-operator ServiceMonitor resources
 	//if err = createServiceMonitor(cfg, os.Getenv("NAMESPACE")); err != nil {
 	//	logrus.Warningf("Could not create ServiceMonitor object, error: %s", err.Error())
@@ -115,11 +115,16 @@ func (c *CHConnection) Query(sql string) (*Query, error) {
 
 // Exec runs given sql query
 func (c *CHConnection) Exec(sql string) error {
+	return c.ExecWithTimeout(sql, defaultTimeout)
+}
+
+// ExecWithTimeout runs given sql query, for the queries known to take longer than the default timeout
+func (c *CHConnection) ExecWithTimeout(sql string, timeout time.Duration) error {
 	if len(sql) == 0 {
 		return nil
 	}
 
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(defaultTimeout))
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(timeout))
 	defer cancel()
 
 	if !c.ensureConnected() {
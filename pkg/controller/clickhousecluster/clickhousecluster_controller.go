@@ -2,11 +2,9 @@ package clickhousecluster
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"reflect"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/samuel/go-zookeeper/zk"
@@ -25,6 +23,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
@@ -33,59 +32,57 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
-var needUpdate bool
-
-const defaultUserXML = `
-<yandex>
-  <users>
-     <default>
-        <password>%s</password>
-        <access_management>1</access_management>
-     </default>
-  </users>
-</yandex>
-`
-
 // Add creates a new ClickHouseCluster Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
-func Add(mgr manager.Manager) error {
-	return add(mgr, newReconciler(mgr))
+func Add(mgr manager.Manager, options controller.Options) error {
+	return add(mgr, newReconciler(mgr), options)
 }
 
 // newReconciler returns a new reconcileShard.Reconciler
-func newReconciler(mgr manager.Manager) reconcile.Reconciler {
+func newReconciler(mgr manager.Manager) *ReconcileClickHouseCluster {
 	defaultConfig, err := config.LoadDefaultConfig()
 	if err != nil {
 		logrus.WithFields(logrus.Fields{"error": err}).Fatal("Load default config error")
 	}
-	return &ReconcileClickHouseCluster{client: mgr.GetClient(), scheme: mgr.GetScheme(), defaultConfig: defaultConfig}
+	return &ReconcileClickHouseCluster{
+		client:        mgr.GetClient(),
+		scheme:        mgr.GetScheme(),
+		defaultConfig: defaultConfig,
+		tasks:         newBackgroundTasks(),
+		recorder:      mgr.GetEventRecorderFor("clickhouse-operator"),
+	}
 }
 
 // add adds a new Controller to mgr with r as the reconcileShard.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
-	// Create a new controller
-	c, err := controller.New("clickhousecluster-controller", mgr, controller.Options{Reconciler: r})
+func add(mgr manager.Manager, r *ReconcileClickHouseCluster, options controller.Options) error {
+	// Create a new controller, the clusters share no state in the reconciler so several of them can
+	// be reconciled at the same time
+	options.Reconciler = r
+	c, err := controller.New("clickhousecluster-controller", mgr, options)
 	if err != nil {
 		return err
 	}
 
 	// Watch for changes to primary resource ClickHouseCluster
-	err = c.Watch(&source.Kind{Type: &clickhousev1.ClickHouseCluster{}}, &handler.EnqueueRequestForObject{})
+	err = c.Watch(&source.Kind{Type: &clickhousev1.ClickHouseCluster{}}, &handler.EnqueueRequestForObject{}, clusterPredicate)
 	if err != nil {
 		return err
 	}
 
-	// TODO(user): Modify this to be the types you create that are owned by the primary resource
-	// Watch for changes to secondary resource Pods and requeue the owner ClickHouseCluster
-	//err = c.Watch(&source.Kind{Type: &corev1.Pod{}}, &handler.EnqueueRequestForOwner{
-	//	IsController: true,
-	//	OwnerType:    &clickhousev1.ClickHouseCluster{},
-	//})
-	//if err != nil {
-	//	return err
-	//}
+	// Watch for the background tasks of the clusters to finish
+	err = c.Watch(&source.Channel{Source: r.tasks.events}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
 
-	return nil
+	// Watch for changes to the objects created for the clusters, so they are repaired and the
+	// readiness of the shards is noticed without polling
+	if err := watchOwnedObjects(c); err != nil {
+		return err
+	}
+
+	// Watch for changes to the Secrets of the passwords of the users
+	return watchUserSecrets(c, mgr)
 }
 
 // blank assignment to verify that ReconcileClickHouseCluster implements reconcileShard.Reconciler
@@ -99,12 +96,17 @@ type ReconcileClickHouseCluster struct {
 	scheme *runtime.Scheme
 
 	defaultConfig *config.DefaultConfig
+	// tasks runs the long SQL work of the clusters off the reconcile goroutines
+	tasks *backgroundTasks
+	// recorder reports what is done to the clusters as events, shown by kubectl describe
+	recorder record.EventRecorder
 }
 
-func (r *ReconcileClickHouseCluster) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+func (r *ReconcileClickHouseCluster) Reconcile(request reconcile.Request) (_ reconcile.Result, reconcileErr error) {
 	log := logrus.WithFields(logrus.Fields{"namespace": request.Namespace, "name": request.Name})
 
-	requeue5 := reconcile.Result{RequeueAfter: 5 * time.Second}
+	// The cluster is reconciled again when it or one of its objects changes, the errors are retried
+	// with the exponential backoff of the controller
 	requeue30 := reconcile.Result{RequeueAfter: 30 * time.Second}
 	forget := reconcile.Result{}
 
@@ -114,12 +116,24 @@ func (r *ReconcileClickHouseCluster) Reconcile(request reconcile.Request) (recon
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			log.Info("Delete ClickHouseCluster")
+			r.tasks.forget(request.Namespace, request.Name, "")
+			deleteSchemaMetrics(request.Namespace, request.Name)
 			return forget, nil
 		}
 		log.WithField("error", err).Error("get clickhouse cluster error")
 		return forget, err
 	}
 
+	// Nothing of a paused cluster is changed, it is left to a manual maintenance. The pause only
+	// holds the changes of a live cluster, a deleted one is still cleaned up.
+	if clusterPaused(cc) && cc.DeletionTimestamp == nil {
+		log.Info("reconcile paused")
+		r.updatePausedStatus(cc)
+		return forget, nil
+	}
+
+	original := cc.DeepCopy()
+
 	// https://github.com/ClickHouse/ClickHouse/issues/6402
 	if cc.DeletionTimestamp != nil {
 		wholePath := fmt.Sprintf("default@%s-0-0.%s-0.%s.svc.cluster.local:9000", cc.Name, cc.Name, cc.Namespace)
@@ -135,45 +149,90 @@ func (r *ReconcileClickHouseCluster) Reconcile(request reconcile.Request) (recon
 		cc.Status.ShardStatus = make(map[string]*clickhousev1.ShardStatus)
 	}
 
-	//Set Default Values
-	if cc.Status.Phase == "" {
-		needUpdate = r.setDefaults(cc, r.defaultConfig)
+	status := cc.Status.DeepCopy()
+	defer func() {
+		r.updateClickHouseStatus(original, cc, status, reconcileErr)
+	}()
 
-		err = r.checkInitZookeeperCfg(cc)
-		if err != nil {
-			log.WithField("error", err).Error("check zookeeper configuration error")
-			// cannot continue until zookeeper is specified
+	// The defaults are set by the mutating webhook, they are only set in memory here for the clusters
+	// created while it was not serving, the spec is never written back
+	SetDefaults(cc, r.defaultConfig)
+
+	// A deleted cluster is only cleaned up, its objects are garbage collected once it is gone
+	if cc.DeletionTimestamp != nil {
+		if err = r.reconcileDeletion(cc, status); err != nil {
 			return forget, err
 		}
+		return forget, nil
+	}
+	updateFinalizer(cc)
+
+	// An invalid spec can not be fixed by retrying, it is reported in the ConfigValid condition
+	// until the spec is changed
+	if err = ValidateCluster(cc, r.defaultConfig); err != nil {
+		log.WithField("error", err).Error("validate ClickHouseCluster error")
+		reason := ReasonInvalidSpec
+		if cc.Spec.LegacyUsers != "" {
+			reason = ReasonLegacyUsers
+		} else if hasLegacyCustomSettings(cc) {
+			reason = ReasonLegacyCustomSettings
+		}
+		status.SetCondition(clickhousev1.ClusterConfigValid, corev1.ConditionFalse, reason, err.Error())
+		r.recorder.Event(cc, corev1.EventTypeWarning, reason, err.Error())
+		return forget, nil
 	}
+	status.SetCondition(clickhousev1.ClusterConfigValid, corev1.ConditionTrue, ReasonValid, "")
 
-	r.formatZookeeper(cc)
-
-	err = r.CheckDeletePVC(cc)
+	// Forbidden changes are rejected by the validating webhook, the check is repeated here for
+	// the clusters changed while it was not serving
+	lastApplied, err := lastAppliedCluster(cc)
 	if err != nil {
-		log.WithField("error", err).Error("check ClickHouseCluster delete pvc error")
+		log.WithField("error", err).Error("get last applied configuration error")
+	} else if lastApplied != nil {
+		if err = ValidateClusterUpdate(lastApplied, cc); err != nil {
+			log.WithField("error", err).Error("refuse the change of ClickHouseCluster")
+			status.SetCondition(clickhousev1.ClusterConfigValid, corev1.ConditionFalse, ReasonChangeRefused, err.Error())
+			r.recorder.Event(cc, corev1.EventTypeWarning, ReasonChangeRefused, err.Error())
+			return forget, nil
+		}
+		if err = CheckVolumeExpansion(r.client, lastApplied, cc); err != nil {
+			log.WithField("error", err).Error("refuse the volume expansion of ClickHouseCluster")
+			status.SetCondition(clickhousev1.ClusterConfigValid, corev1.ConditionFalse, ReasonChangeRefused, err.Error())
+			r.recorder.Event(cc, corev1.EventTypeWarning, ReasonChangeRefused, err.Error())
+			return forget, nil
+		}
+	}
+
+	if zk := zookeeperConfig(cc); zk == nil || len(zk.Nodes) == 0 {
+		status.SetCondition(clickhousev1.ClusterZookeeperReachable, corev1.ConditionUnknown, ReasonNotConfigured, "")
+	} else if err = checkZookeeperReachable(zk); err != nil {
+		log.WithField("error", err).Warning("zookeeper is unreachable")
+		status.SetCondition(clickhousev1.ClusterZookeeperReachable, corev1.ConditionFalse, ReasonUnreachable, err.Error())
+		r.recorder.Event(cc, corev1.EventTypeWarning, EventZookeeperUnreachable, err.Error())
+	} else {
+		status.SetCondition(clickhousev1.ClusterZookeeperReachable, corev1.ConditionTrue, ReasonReachable, "")
+	}
+
+	if err = r.reconcileDefaultUserPassword(cc); err != nil {
+		log.WithField("error", err).Error("create default user password error")
 		return forget, err
 	}
 
-	err = validateResource(cc)
+	passwords, err := r.getUserPasswords(cc)
 	if err != nil {
-		log.WithField("error", err).Error("validate Resource field error")
+		log.WithField("error", err).Error("get user passwords error")
 		return forget, err
 	}
 
-	status := cc.Status.DeepCopy()
-	defer r.updateClickHouseStatus(cc, status)
+	var generator = NewGenerator(r, cc, passwords)
 
-	//Some changes are not allowed, so we need to recovery to old one
-	if r.CheckNonAllowedChanges(cc) {
-		if err = r.recoveryCRD(cc); err != nil {
-			log.WithField("error", err).Error("recovery ClickHouseCluster error")
-			return requeue30, err
-		}
+	// The shards removed from the spec are drained before they are deleted, they are kept in
+	// remote_servers until their data has been copied to the remaining shards
+	if generator.removedShards, err = r.scaleDownShards(generator, status); err != nil {
+		log.WithField("error", err).Error("scale down shards error")
+		return forget, err
 	}
 
-	var generator = NewGenerator(r, cc)
-
 	serviceMonitor := generator.generateServiceMonitor()
 	if err := r.checkServiceMonitor(serviceMonitor); err != nil {
 		log.WithField("error", err).Error("check servicemonitor error")
@@ -183,77 +242,142 @@ func (r *ReconcileClickHouseCluster) Reconcile(request reconcile.Request) (recon
 	roleBinding := generator.GenerateRoleBinding()
 	if err := r.reconcileRoleBinding(roleBinding); err != nil {
 		logrus.WithFields(logrus.Fields{"namespace": roleBinding.Namespace, "name": roleBinding.Name, "error": err}).Error("create clusterRoleBinding error")
-		return requeue5, err
+		return forget, err
 	}
 
 	commonConfigMap := generator.GenerateCommonConfigMap()
-	if err := r.reconcileConfigMap(commonConfigMap); err != nil {
+	configChanges, err := r.reconcileConfigMap(commonConfigMap)
+	if err != nil {
 		logrus.WithFields(logrus.Fields{"namespace": commonConfigMap.Namespace, "name": commonConfigMap.Name, "error": err}).Error("create common configmap error")
-		return requeue5, err
+		return forget, err
 	}
 
 	commonService := generator.generateCommonService()
 	if err := r.reconcileService(commonService); err != nil {
 		logrus.WithFields(logrus.Fields{"namespace": commonService.Namespace, "name": commonService.Name, "error": err}).Error("create common service error")
-		return requeue5, err
+		return forget, err
 	}
 
-	userConfigMap := generator.generateUserConfigMap()
-	if err := r.reconcileConfigMap(userConfigMap); err != nil {
-		logrus.WithFields(logrus.Fields{"namespace": userConfigMap.Namespace, "name": userConfigMap.Name, "error": err}).Error("create users configmap error")
-		return requeue5, err
+	if cc.Spec.Keeper != nil {
+		if err := r.reconcileKeeper(generator); err != nil {
+			log.WithField("error", err).Error("reconcile keeper error")
+			return forget, err
+		}
+	}
+
+	userSecret := generator.generateUserSecret()
+	userChanges, err := r.reconcileSecret(userSecret)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"namespace": userSecret.Namespace, "name": userSecret.Name, "error": err}).Error("create users secret error")
+		return forget, err
+	}
+
+	// The changes of the configuration needing a restart roll out the pods through the checksum in
+	// their template, the others are reloaded. A stopped cluster reads them when it starts.
+	stopped := clusterStopped(generator)
+	generator.configChecksum = configChecksum(commonConfigMap.Data, secretFiles(userSecret.Data))
+	if !stopped {
+		if err := r.reloadConfig(generator, status, append(configChanges, userChanges...)); err != nil {
+			log.WithField("error", err).Error("reload configuration error")
+			return forget, err
+		}
+	}
+
+	// A canary upgrade holds the restart of the pods other than the canary, which is polled
+	requeue := forget
+	if !stopped {
+		wait, err := r.reconcileUpgrade(generator, lastApplied, status)
+		if err != nil {
+			log.WithField("error", err).Error("reconcile upgrade error")
+			return forget, err
+		}
+		if wait > 0 {
+			requeue = reconcile.Result{RequeueAfter: wait}
+		}
+		generator.canaryPod = canaryPod(status)
+		if upgradeInProgress(status) {
+			generator.pinnedImage = status.Upgrade.FromImage
+		}
 	}
 
+	var soaking bool
 	for shardID := 0; shardID < int(cc.Spec.ShardsCount); shardID++ {
+		// the shards are stopped together, they start again in order
+		if stopped {
+			if err = r.stopShard(generator, shardID, status); err != nil {
+				log.WithField("error", err).Error("stop shard error")
+				return forget, err
+			}
+			continue
+		}
 		var ready bool
 		if ready, err = r.reconcileShard(isClusterNewCreate(cc), generator, shardID, status); err != nil {
 			log.WithField("error", err).Error("reconcileShard error")
-			return requeue5, err
+			return forget, err
 		}
+		// the shard of the canary is held until it has soaked, the other shards keep their image
+		if !ready && generator.canaryPod != "" && shardID == canaryShardID {
+			soaking = true
+			continue
+		}
+		// The StatefulSet is watched, the cluster is reconciled again when the shard gets ready
 		if !ready {
-			return requeue30, nil
+			return requeue, nil
 		}
 	}
-
-	if err = r.ScaleDownCluster(cc); err != nil {
-		return requeue30, err
+	if soaking {
+		return requeue, nil
 	}
 
-	//log.Info(cc.DeletionTimestamp, cc.Spec.DeletePVC)
-	if cc.DeletionTimestamp != nil && cc.Spec.DeletePVC {
-		log.Info("deleting pvc")
-		if err = r.DeletePVCs(cc); err != nil {
-			log.WithField("error", err).Error("delete pvc error")
-			return requeue5, err
-		}
-		// Indicate delete pvc means no longer need the data, delete zookeeper path as well
-		log.Info("deleting zookeeper path")
-		if err = r.deleteZookeeperPath(cc); err != nil {
-			log.WithField("error", err).Error("delete zookeeper path error")
-			return requeue5, err
-		}
-		preventClusterDeletion(cc, false)
-		needUpdate = true
+	if stopped && cc.Status.Phase != ClusterPhaseStopped && allShardsStopped(cc, status) {
+		r.recorder.Event(cc, corev1.EventTypeNormal, EventClusterStopped, "the pods of all the shards have been stopped")
 	}
 
 	cc.Annotations[ClusterNewCreate] = "false"
-	if cc.DeletionTimestamp == nil {
-		err := r.createTablesInNewStatefulSet(cc, generator)
+	if !stopped {
+		done, err := r.createTablesInNewStatefulSet(cc, generator)
+		if syncErr, ok := err.(*schemaSyncError); ok {
+			schemaStatus(status).FailedObjects = syncErr.failedObjects()
+		} else if done && err == nil && status.Schema != nil {
+			status.Schema.FailedObjects = nil
+		}
 		if err != nil {
-			return requeue5, err
+			status.SetCondition(clickhousev1.ClusterSchemaSynced, corev1.ConditionFalse, ReasonSchemaSyncFailed, err.Error())
+			r.recorder.Event(cc, corev1.EventTypeWarning, ReasonSchemaSyncFailed, err.Error())
+			return forget, err
+		}
+		if !done {
+			status.SetCondition(clickhousev1.ClusterSchemaSynced, corev1.ConditionUnknown, ReasonSchemaSyncing, "")
+		} else {
+			// the tables of the hosts are compared again once the interval has elapsed
+			if wait := r.checkSchema(cc, generator, status); wait > 0 && (requeue.RequeueAfter == 0 || wait < requeue.RequeueAfter) {
+				requeue = reconcile.Result{RequeueAfter: wait}
+			}
+			if status.Schema != nil && len(status.Schema.Drifts) > 0 {
+				status.SetCondition(clickhousev1.ClusterSchemaSynced, corev1.ConditionFalse, ReasonSchemaDrift,
+					driftSummary(status.Schema.Drifts))
+			} else {
+				status.SetCondition(clickhousev1.ClusterSchemaSynced, corev1.ConditionTrue, ReasonSchemaSynced, "")
+			}
 		}
 	}
 	//if err := r.createTablesInNewStatefulSet(cc, generator); err != nil {
-	//	return requeue5, err
+	//	return forget, err
 	//}
-	return requeue5, nil
+	// Zookeeper is not watched, its reachability is checked again later
+	if cond := status.GetCondition(clickhousev1.ClusterZookeeperReachable); cond != nil && cond.Status == corev1.ConditionFalse {
+		return requeue30, nil
+	}
+	return requeue, nil
 }
 
+// createTablesInNewStatefulSet creates the tables on the hosts of the StatefulSets marked as changed.
+// The SQL runs as a background task, done is false until the task has finished.
 func (r *ReconcileClickHouseCluster) createTablesInNewStatefulSet(cc *clickhousev1.ClickHouseCluster,
-	generator *Generator) error {
+	generator *Generator) (done bool, err error) {
 
 	var statefulSets = appsv1.StatefulSetList{}
-	err := r.client.List(context.TODO(), &statefulSets, &client.ListOptions{
+	err = r.client.List(context.TODO(), &statefulSets, &client.ListOptions{
 		Namespace: cc.Namespace,
 		LabelSelector: labels.SelectorFromSet(map[string]string{
 			ClusterLabelKey: cc.Name,
@@ -263,180 +387,107 @@ func (r *ReconcileClickHouseCluster) createTablesInNewStatefulSet(cc *clickhouse
 		logrus.WithFields(
 			logrus.Fields{"namespace": cc.Namespace, "error": err}).
 			Error("list statefulset error")
-		return err
+		return false, err
 	}
 
-	var needCreateTable bool
-
+	var changed []appsv1.StatefulSet
 	for _, sts := range statefulSets.Items {
 		if sts.Annotations[ClusterHostsChange] == "true" {
-			needCreateTable = true
-			break
+			changed = append(changed, sts)
 		}
 	}
-	if !needCreateTable {
+	if len(changed) == 0 {
 		logrus.Debugf("no need to create table for cluster: %s/%s", cc.Namespace, cc.Name)
-		return nil
+		// The result of a task finished after the last reconcile is dropped, it is already recorded
+		// in the StatefulSets
+		r.tasks.forget(cc.Namespace, cc.Name, taskCreateTables)
+		return true, nil
 	}
 
-	hosts := generator.FQDNs()
-	scr := NewSchemer(cc)
-	if err = scr.StatefulSetCreateTables(cc.Name, hosts); err != nil {
-		logrus.WithFields(
-			logrus.Fields{"namespace": cc.Namespace, "error": err}).
-			Error("create table error")
-		return err
+	excluded, err := r.declaredAccessObjects(cc)
+	if err != nil {
+		return false, err
 	}
 
-	for _, sts := range statefulSets.Items {
-		sts := sts.DeepCopy()
-		if sts.Annotations == nil {
-			sts.Annotations = make(map[string]string)
+	// Everything the task needs is copied, it must not touch the cluster being reconciled
+	namespace, clusterName := cc.Namespace, cc.Name
+	ref := cc.DeepCopy()
+	hosts := generator.FQDNs()
+	scr := NewSchemer(generator.operatorCredential())
+	done, err = r.tasks.run(cc, taskCreateTables, func() error {
+		hidden, err := scr.StatefulSetCreateTables(clusterName, hosts, excluded)
+		if len(hidden) > 0 {
+			r.recorder.Eventf(ref, corev1.EventTypeWarning, EventSchemaObjectsSkipped,
+				"a secret of %s is hidden by the server, they are not copied to the new hosts", strings.Join(hidden, ", "))
 		}
-		sts.Annotations[ClusterHostsChange] = "false"
-		if err = r.client.Update(context.Background(), sts); err != nil {
+		if err != nil {
 			logrus.WithFields(
-				logrus.Fields{"namespace": cc.Namespace, "error": err}).
-				Error("update statefulset error")
+				logrus.Fields{"namespace": namespace, "error": err}).
+				Error("create table error")
 			return err
 		}
-	}
-
-	return nil
-}
-
-func isClusterNewCreate(cc *clickhousev1.ClickHouseCluster) bool {
-	return "true" == cc.Annotations[ClusterNewCreate]
-}
 
-func preventClusterDeletion(cc *clickhousev1.ClickHouseCluster, value bool) {
-	if value {
-		cc.SetFinalizers([]string{"kubernetes.io/pvc-to-delete"})
-		return
-	}
-	cc.SetFinalizers([]string{})
-}
-
-func updateDeletePvcStrategy(cc *clickhousev1.ClickHouseCluster) {
-	logrus.WithFields(logrus.Fields{"cluster": cc.Name, "deletePVC": cc.Spec.DeletePVC,
-		"finalizers": cc.Finalizers}).Debug("updateDeletePvcStrategy called")
-	// Remove Finalizers if DeletePVC is not enabled
-	if !cc.Spec.DeletePVC && len(cc.Finalizers) > 0 {
-		logrus.WithFields(logrus.Fields{"cluster": cc.Name}).Info("Won't delete PVCs when nodes are removed")
-		preventClusterDeletion(cc, false)
-	}
-	// Add Finalizer if DeletePVC is enabled
-	if cc.Spec.DeletePVC && len(cc.Finalizers) == 0 {
-		logrus.WithFields(logrus.Fields{"cluster": cc.Name}).Info("Will delete PVCs when nodes are removed")
-		preventClusterDeletion(cc, true)
-	}
-}
-
-func (r *ReconcileClickHouseCluster) CheckDeletePVC(cc *clickhousev1.ClickHouseCluster) error {
-	var oldCRD clickhousev1.ClickHouseCluster
-	if cc.Annotations[clickhousev1.AnnotationLastApplied] == "" {
-		if cc.DeletionTimestamp == nil && cc.Spec.DeletePVC == true {
-			logrus.Info("add finalizer when initial deletePVC is set to true")
-			preventClusterDeletion(cc, true)
+		// A StatefulSet changed while the tables were created is updated with a stale version and
+		// rejected, its tables are created again by the next task
+		for _, sts := range changed {
+			sts := sts.DeepCopy()
+			sts.Annotations[ClusterHostsChange] = "false"
+			if err := r.client.Update(context.Background(), sts); err != nil {
+				logrus.WithFields(
+					logrus.Fields{"namespace": sts.Namespace, "error": err}).
+					Error("update statefulset error")
+				return err
+			}
 		}
 		return nil
-	}
-
-	//We retrieved our last-applied-configuration stored in the CRD
-	err := json.Unmarshal([]byte(cc.Annotations[clickhousev1.AnnotationLastApplied]), &oldCRD)
-	if err != nil {
-		logrus.Errorf("[%s]: Can't get Old version of CRD", cc.Name)
-		return nil
-	}
-
-	if cc.Spec.DeletePVC != oldCRD.Spec.DeletePVC {
-		logrus.WithFields(logrus.Fields{"cluster": cc.Name}).Debug("DeletePVC has been updated")
-		updateDeletePvcStrategy(cc)
-		return r.client.Update(context.TODO(), cc)
-	}
-	return nil
-}
-
-func (r *ReconcileClickHouseCluster) ScaleDownCluster(cc *clickhousev1.ClickHouseCluster) error {
-	var statefulSets = appsv1.StatefulSetList{}
-	log := logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "name": cc.Name})
-	err := r.client.List(context.TODO(), &statefulSets, &client.ListOptions{
-		Namespace: cc.Namespace,
-		LabelSelector: labels.SelectorFromSet(map[string]string{
-			ClusterLabelKey: cc.Name,
-		}),
 	})
-	if err != nil {
-		log.WithField("error", err).Error("List statefulset error")
-		return err
-	}
-
-	for _, statefulSet := range statefulSets.Items {
-		shardID, err := strconv.Atoi(statefulSet.Labels["shard-id"])
-		if err != nil {
-			log.WithField("error", err).Error("Get shard-id error")
-			return err
-		}
-		if shardID >= int(cc.Spec.ShardsCount) {
-			err = r.client.Delete(context.TODO(), &statefulSet)
-			if err != nil {
-				log.WithField("error", err).Error("Delete statefulSet error")
-				return err
-			}
+	if done && err == nil {
+		var names []string
+		for _, sts := range changed {
+			names = append(names, sts.Name)
 		}
+		r.recorder.Eventf(cc, corev1.EventTypeNormal, EventTablesCreated, "the tables have been created on the hosts of %s",
+			strings.Join(names, ", "))
 	}
-	return nil
+	return done, err
 }
 
-func (r *ReconcileClickHouseCluster) updateClickHouseStatus(cc *clickhousev1.ClickHouseCluster, status *clickhousev1.ClickHouseClusterStatus) {
-	defer func() {
-		needUpdate = false
-	}()
-	lastApplied, _ := cc.ComputeLastAppliedConfiguration()
-	if !needUpdate && reflect.DeepEqual(cc.Status, *status) &&
-		reflect.DeepEqual(cc.Annotations[clickhousev1.AnnotationLastApplied], lastApplied) &&
-		cc.Annotations[clickhousev1.AnnotationLastApplied] != "" {
-		return
-	}
-
-	cc.Annotations[clickhousev1.AnnotationLastApplied] = lastApplied
-	cc.Status = *status.DeepCopy()
-
-	var readyCount int32
-	for _, s := range cc.Status.ShardStatus {
-		if s.Phase == ShardPhaseRunning {
-			readyCount++
+// declaredAccessObjects returns the users declared by ClickHouseUser on the cluster with their grants
+// and quotas, their controller creates them on the new hosts with their passwords
+func (r *ReconcileClickHouseCluster) declaredAccessObjects(cc *clickhousev1.ClickHouseCluster) (map[string]bool, error) {
+	var users clickhousev1.ClickHouseUserList
+	if err := r.client.List(context.TODO(), &users, client.InNamespace(cc.Namespace)); err != nil {
+		logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "error": err}).Error("list clickhouseusers error")
+		return nil, err
+	}
+	excluded := make(map[string]bool)
+	for i := range users.Items {
+		user := &users.Items[i]
+		if user.Spec.ClusterRef != cc.Name {
+			continue
 		}
+		excluded[schemaObjectKey(SchemaObjectUser, user.UserName())] = true
+		excluded[schemaObjectKey(SchemaObjectGrant, user.UserName())] = true
+		excluded[schemaObjectKey(SchemaObjectQuota, user.QuotaName())] = true
 	}
-	if readyCount == cc.Spec.ShardsCount {
-		cc.Status.Phase = ClusterPhaseRunning
-	} else {
-		cc.Status.Phase = ClusterPhaseInitial
-	}
-	err := r.client.Update(context.TODO(), cc)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{"cluster": cc.Name, "err": err}).Errorf("Issue when updating ClickHouseCluster")
-	} else {
-		logrus.WithFields(logrus.Fields{"cluster": cc.Name}).Info("Updating ClickHouseCluster")
-	}
+	return excluded, nil
 }
 
-func (r *ReconcileClickHouseCluster) recoveryCRD(cc *clickhousev1.ClickHouseCluster) error {
-	var oldCRD clickhousev1.ClickHouseCluster
-	if cc.Annotations[clickhousev1.AnnotationLastApplied] == "" {
-		return fmt.Errorf("can not find last-applied-configuration")
-	}
-	err := json.Unmarshal([]byte(cc.Annotations[clickhousev1.AnnotationLastApplied]), &oldCRD)
-	if err != nil {
-		return err
-	}
-	cc.Spec = oldCRD.Spec
-	return nil
+func isClusterNewCreate(cc *clickhousev1.ClickHouseCluster) bool {
+	return "true" == cc.Annotations[ClusterNewCreate]
 }
 
 func (r *ReconcileClickHouseCluster) reconcileShard(clusterNew bool, generator *Generator, shardID int, status *clickhousev1.ClickHouseClusterStatus) (bool, error) {
 	statefulSet := generator.generateStatefulSet(shardID)
-	if err := r.reconcileStatefulSet(clusterNew, statefulSet); err != nil {
+	dropping, err := r.scaleDownReplicas(generator, shardID, statefulSet, status.ShardStatus[statefulSet.Name])
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"namespace": statefulSet.Namespace, "name": statefulSet.Name, "error": err}).Error("scale down replicas error")
+		if shardStatus := status.ShardStatus[statefulSet.Name]; shardStatus != nil {
+			shardStatus.DroppingReplicas = dropping
+		}
+		return false, err
+	}
+	if err := r.reconcileStatefulSet(generator.cc, clusterNew, statefulSet); err != nil {
 		logrus.WithFields(logrus.Fields{"namespace": statefulSet.Namespace, "name": statefulSet.Name, "error": err}).Error("create statefulSets error")
 		return false, err
 	}
@@ -446,85 +497,45 @@ func (r *ReconcileClickHouseCluster) reconcileShard(clusterNew bool, generator *
 		return false, err
 	}
 
+	expanding, recreated, err := r.expandVolumes(generator, shardID, statefulSet)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"namespace": statefulSet.Namespace, "name": statefulSet.Name, "error": err}).Error("expand volumes error")
+		return false, err
+	}
+	// the StatefulSet is created again once its deletion is seen
+	if recreated {
+		status.ShardStatus[statefulSet.Name] = &clickhousev1.ShardStatus{Phase: ShardPhaseUpdating, DroppingReplicas: dropping}
+		return false, nil
+	}
+
 	service := generator.generateShardService(shardID, statefulSet)
 	if err := r.reconcileService(service); err != nil {
 		logrus.WithFields(logrus.Fields{"namespace": service.Namespace, "name": service.Name, "error": err}).Error("create service error")
 		return false, err
 	}
 
+	hosts := r.getHostsStatus(generator, shardID)
+	updating, err := r.rollShard(generator, shardID, statefulSet, status.ShardStatus[statefulSet.Name])
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"namespace": statefulSet.Namespace, "name": statefulSet.Name, "error": err}).Error("roll out shard error")
+	}
+	// the next shards are rolled out once this one is done
+	if updating {
+		status.ShardStatus[statefulSet.Name] = &clickhousev1.ShardStatus{Phase: ShardPhaseUpdating, Hosts: hosts,
+			DroppingReplicas: dropping, ExpandingVolumes: expanding}
+		return false, err
+	}
 	if isStatefulSetReady(statefulSet) {
-		status.ShardStatus[statefulSet.Name] = &clickhousev1.ShardStatus{Phase: ShardPhaseRunning}
+		status.ShardStatus[statefulSet.Name] = &clickhousev1.ShardStatus{Phase: ShardPhaseRunning, Hosts: hosts,
+			DroppingReplicas: dropping, ExpandingVolumes: expanding}
 		return true, nil
 	} else {
-		status.ShardStatus[statefulSet.Name] = &clickhousev1.ShardStatus{Phase: ShardPhaseInitial}
+		status.ShardStatus[statefulSet.Name] = &clickhousev1.ShardStatus{Phase: ShardPhaseInitial, Hosts: hosts,
+			DroppingReplicas: dropping, ExpandingVolumes: expanding}
 		return false, nil
 	}
 }
 
-// CheckNonAllowedChanges - checks if there are some changes on CRD that are not allowed on statefulset
-// If a non Allowed Changed is Find we won't Update associated kubernetes objects, but we will put back the old value
-// and Patch the CRD with correct values
-func (r *ReconcileClickHouseCluster) CheckNonAllowedChanges(instance *clickhousev1.ClickHouseCluster) bool {
-	var oldCRD clickhousev1.ClickHouseCluster
-	if instance.Annotations[clickhousev1.AnnotationLastApplied] == "" {
-		return false
-	}
-
-	//We retrieved our last-applied-configuration stored in the CRD
-	err := json.Unmarshal([]byte(instance.Annotations[clickhousev1.AnnotationLastApplied]), &oldCRD)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{"cluster": instance.Name}).Error("Can't get Old version of CRD")
-		return false
-	}
-	//DataCapacity change is forbidden
-	if instance.Spec.DataCapacity != oldCRD.Spec.DataCapacity {
-		logrus.WithFields(logrus.Fields{"cluster": instance.Name}).
-			Warningf("The Operator has refused the change on DataCapacity from [%s] to NewValue[%s]",
-				oldCRD.Spec.DataCapacity, instance.Spec.DataCapacity)
-		instance.Spec.DataCapacity = oldCRD.Spec.DataCapacity
-		return true
-	}
-	//ShardsCount change is forbidden
-	if instance.Spec.ShardsCount < oldCRD.Spec.ShardsCount {
-		logrus.WithFields(logrus.Fields{"cluster": instance.Name}).
-			Warningf("The Operator has refused the reduce ShardsCount from [%d] to NewValue[%d]",
-				oldCRD.Spec.ShardsCount, instance.Spec.ShardsCount)
-		instance.Spec.ShardsCount = oldCRD.Spec.ShardsCount
-		return true
-	}
-	//Add replicas without zookeeper is forbidden
-	if instance.Spec.ReplicasCount > oldCRD.Spec.ReplicasCount && instance.Spec.Zookeeper == nil {
-		logrus.WithFields(logrus.Fields{"cluster": instance.Name}).
-			Warningf("The Operator has refused the add ReplicasCount from [%d] to NewValue[%d} without zookeeper"+
-				"configuration", oldCRD.Spec.ReplicasCount, instance.Spec.ReplicasCount)
-		instance.Spec.ReplicasCount = oldCRD.Spec.ReplicasCount
-		return true
-	}
-	//DataStorage
-	if instance.Spec.DataStorageClass != oldCRD.Spec.DataStorageClass {
-		logrus.WithFields(logrus.Fields{"cluster": instance.Name}).
-			Warningf("The Operator has refused the change on DataStorageClass from [%s] to NewValue[%s]",
-				oldCRD.Spec.DataStorageClass, instance.Spec.DataStorageClass)
-		instance.Spec.DataStorageClass = oldCRD.Spec.DataStorageClass
-		return true
-	}
-	////Zookeeper Configuration change is forbidden
-	//if instance.Spec.Zookeeper != oldCRD.Spec.Zookeeper {
-	//	logrus.WithFields(logrus.Fields{"cluster": instance.Name}).
-	//		Warningf("The Operator has refused any change on Zookeeper")
-	//	instance.Spec.Zookeeper = oldCRD.Spec.Zookeeper
-	//	return true
-	//}
-	//if !reflect.DeepEqual(instance.Spec.Resources, oldCRD.Spec.Resources) {
-	//	logrus.WithFields(logrus.Fields{"cluster": instance.Name}).
-	//		Warningf("The Operator has refused the change on Resources from [%v] to NewValue[%v]",
-	//			oldCRD.Spec.Resources, instance.Spec.Resources)
-	//	instance.Spec.DataStorageClass = oldCRD.Spec.DataStorageClass
-	//	return true
-	//}
-	return false
-}
-
 func (r *ReconcileClickHouseCluster) reconcileService(service *corev1.Service) error {
 	var curService corev1.Service
 	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: service.Namespace, Name: service.Name}, &curService)
@@ -539,10 +550,10 @@ func (r *ReconcileClickHouseCluster) reconcileService(service *corev1.Service) e
 		}
 		return err
 	}
-	if curService.Spec.ClusterIP != "None" {
-		service.Spec = curService.Spec
-	}
-	if reflect.DeepEqual(curService.Spec, service.Spec) {
+	preserveServiceFields(&curService, service)
+	// the Service of a shard is left without owner when its StatefulSet is recreated
+	if reflect.DeepEqual(curService.Spec, service.Spec) && reflect.DeepEqual(curService.Annotations, service.Annotations) &&
+		reflect.DeepEqual(curService.OwnerReferences, service.OwnerReferences) {
 		logrus.Debug("no need to update service")
 		return nil
 	}
@@ -552,12 +563,6 @@ func (r *ReconcileClickHouseCluster) reconcileService(service *corev1.Service) e
 		"namespace": service.Namespace}).Info("Update Service")
 	// spec.resourceVersion is required in order to update Service
 	service.ResourceVersion = curService.ResourceVersion
-	// spec.clusterIP field is immutable, need to use already assigned value
-	// From https://kubernetes.io/docs/concepts/services-networking/service/#defining-a-service
-	// Kubernetes assigns this Service an IP address (sometimes called the “cluster IP”), which is used by the Service proxies
-	// See also https://kubernetes.io/docs/concepts/services-networking/service/#virtual-ips-and-service-proxies
-	// You can specify your own cluster IP address as part of a Service creation request. To do this, set the .spec.clusterIP
-	service.Spec.ClusterIP = curService.Spec.ClusterIP
 	return r.client.Update(context.TODO(), service)
 }
 
@@ -575,7 +580,8 @@ func (r *ReconcileClickHouseCluster) reconcileRoleBinding(roleBinding *rbacv1.Ro
 	return err
 }
 
-func (r *ReconcileClickHouseCluster) reconcileConfigMap(configMap *corev1.ConfigMap) error {
+// reconcileConfigMap creates or updates the ConfigMap, it returns the configuration changed by an update
+func (r *ReconcileClickHouseCluster) reconcileConfigMap(configMap *corev1.ConfigMap) ([]configChange, error) {
 	var curConfigMap corev1.ConfigMap
 	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name}, &curConfigMap)
 	// Object with such name does not exist or error happened
@@ -585,14 +591,14 @@ func (r *ReconcileClickHouseCluster) reconcileConfigMap(configMap *corev1.Config
 			logrus.WithFields(logrus.Fields{
 				"configmap": configMap.Name,
 				"namespace": configMap.Namespace}).Info("Create ConfigMap")
-			return r.client.Create(context.TODO(), configMap)
+			return nil, r.client.Create(context.TODO(), configMap)
 		}
-		return err
+		return nil, err
 	}
 
 	if reflect.DeepEqual(curConfigMap.Data, configMap.Data) {
 		logrus.Debug("no need to update configmap")
-		return nil
+		return nil, nil
 	}
 	dmp := diffmatchpatch.New()
 	diffs := dmp.DiffMain(fmt.Sprintf("%v", curConfigMap.Data), fmt.Sprintf("%v", configMap.Data), false)
@@ -601,10 +607,53 @@ func (r *ReconcileClickHouseCluster) reconcileConfigMap(configMap *corev1.Config
 	logrus.WithFields(logrus.Fields{
 		"configmap": configMap.Name,
 		"namespace": configMap.Namespace}).Info("Update ConfigMap")
-	return r.client.Update(context.TODO(), configMap)
+	if err := r.client.Update(context.TODO(), configMap); err != nil {
+		return nil, err
+	}
+	return changedConfig(curConfigMap.Data, configMap.Data), nil
 }
 
-func (r *ReconcileClickHouseCluster) reconcileStatefulSet(clusterNew bool, statefulSet *appsv1.StatefulSet) error {
+// reconcileSecret creates or updates the Secret, it returns the configuration changed by an update
+func (r *ReconcileClickHouseCluster) reconcileSecret(secret *corev1.Secret) ([]configChange, error) {
+	var curSecret corev1.Secret
+	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}, &curSecret)
+	// Object with such name does not exist or error happened
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// Object with such name not found - create it
+			logrus.WithFields(logrus.Fields{
+				"secret":    secret.Name,
+				"namespace": secret.Namespace}).Info("Create Secret")
+			return nil, r.client.Create(context.TODO(), secret)
+		}
+		return nil, err
+	}
+
+	if reflect.DeepEqual(curSecret.Data, secret.Data) {
+		logrus.Debug("no need to update secret")
+		return nil, nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"secret":    secret.Name,
+		"namespace": secret.Namespace}).Info("Update Secret")
+	if err := r.client.Update(context.TODO(), secret); err != nil {
+		return nil, err
+	}
+	return changedConfig(secretFiles(curSecret.Data), secretFiles(secret.Data)), nil
+}
+
+// secretFiles returns the files of a Secret as strings
+func secretFiles(data map[string][]byte) map[string]string {
+	files := make(map[string]string, len(data))
+	for name, content := range data {
+		files[name] = string(content)
+	}
+	return files
+}
+
+func (r *ReconcileClickHouseCluster) reconcileStatefulSet(cc *clickhousev1.ClickHouseCluster, clusterNew bool,
+	statefulSet *appsv1.StatefulSet) error {
 	// Check whether object with such name already exists in k8s
 	var curStatefulSet appsv1.StatefulSet
 
@@ -619,7 +668,12 @@ func (r *ReconcileClickHouseCluster) reconcileStatefulSet(clusterNew bool, state
 			if !clusterNew {
 				statefulSet.Annotations[ClusterHostsChange] = "true"
 			}
-			return r.client.Create(context.TODO(), statefulSet)
+			if err := r.client.Create(context.TODO(), statefulSet); err != nil {
+				return err
+			}
+			r.recorder.Eventf(cc, corev1.EventTypeNormal, EventShardCreated, "created StatefulSet %s with %d replicas",
+				statefulSet.Name, *statefulSet.Spec.Replicas)
+			return nil
 		}
 		return err
 	}
@@ -637,28 +691,11 @@ func (r *ReconcileClickHouseCluster) reconcileStatefulSet(clusterNew bool, state
 	logrus.WithFields(logrus.Fields{
 		"statefulSet": statefulSet.Name,
 		"namespace":   statefulSet.Namespace}).Info("Update StatefulSet")
-	return r.client.Update(context.TODO(), statefulSet)
-}
-
-func (r *ReconcileClickHouseCluster) DeletePVCs(cc *clickhousev1.ClickHouseCluster) error {
-	logrus.Info("in delete pvcs function.")
-	selector := map[string]string{
-		ClusterLabelKey: cc.Name,
-	}
-	lpvc, err := r.listPVC(cc.Namespace, selector)
-	if err != nil {
-		logrus.Errorf("failed to get clickhouse's PVC: %v", err)
+	if err := r.client.Update(context.TODO(), statefulSet); err != nil {
 		return err
 	}
-	for _, pvc := range lpvc.Items {
-		logrus.Info("", pvc.Name)
-		err = r.client.Delete(context.TODO(), &pvc)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{"PVC": pvc.Name, "Namespace": cc.Namespace}).Error("Error Deleting PVC")
-		} else {
-			logrus.WithFields(logrus.Fields{"PVC": pvc.Name, "Namespace": cc.Namespace}).Info("Delete PVC OK")
-		}
-	}
+	r.recorder.Eventf(cc, corev1.EventTypeNormal, EventShardUpdated, "updated StatefulSet %s with %d replicas",
+		statefulSet.Name, *statefulSet.Spec.Replicas)
 	return nil
 }
 
@@ -668,53 +705,6 @@ func (r *ReconcileClickHouseCluster) listPVC(namespace string, selector map[stri
 	return o, r.client.List(context.TODO(), o, opt)
 }
 
-func (r *ReconcileClickHouseCluster) setDefaults(c *clickhousev1.ClickHouseCluster, config *config.DefaultConfig) bool {
-	var changed = false
-	if c.Status.Phase == "" {
-		c.Status.Phase = ClusterPhaseInitial
-		changed = true
-	}
-	if c.Spec.Image == "" {
-		c.Spec.Image = config.DefaultClickhouseImage
-		changed = true
-	}
-	if c.Spec.InitImage == "" {
-		c.Spec.InitImage = config.DefaultClickhouseInitImage
-		changed = true
-	}
-	if c.Spec.ShardsCount == 0 {
-		c.Spec.ShardsCount = config.DefaultShardCount
-		changed = true
-	}
-	if c.Spec.ReplicasCount == 0 {
-		c.Spec.ReplicasCount = config.DefaultReplicasCount
-		changed = true
-	}
-	//if c.Spec.Zookeeper == nil {
-	//	zkConfig := *config.DefaultZookeeper
-	//	zkConfig.Root = fmt.Sprintf("%s/%s/%s", zkConfig.Root, c.Namespace, c.Name)
-	//	c.Spec.Zookeeper = &zkConfig
-	//	changed = true
-	//}
-	if c.Spec.DataStorageClass != "" && c.Spec.DataCapacity == "" {
-		c.Spec.DataCapacity = config.DefaultDataCapacity
-	}
-	if c.Spec.CustomSettings == "" {
-		c.Spec.CustomSettings = "<yandex></yandex>"
-		changed = true
-	}
-	if c.Spec.Users == "" {
-		password := RandStringRunes(10)
-		c.Spec.Users = fmt.Sprintf(defaultUserXML, password)
-		changed = true
-	}
-	if c.Spec.Resources.Limits == (clickhousev1.CPUAndMem{}) {
-		c.Spec.Resources.Limits = c.Spec.Resources.Requests
-		changed = true
-	}
-	return changed
-}
-
 func (r *ReconcileClickHouseCluster) checkServiceMonitor(sm *monitoringv1.ServiceMonitor) error {
 	if r.scheme.IsGroupRegistered("monitoring.coreos.com") != true {
 		err := monitoringv1.AddToScheme(r.scheme)
@@ -738,13 +728,14 @@ func (r *ReconcileClickHouseCluster) checkServiceMonitor(sm *monitoringv1.Servic
 }
 
 func (r *ReconcileClickHouseCluster) deleteZookeeperPath(cc *clickhousev1.ClickHouseCluster) error {
-	if cc.Spec.Zookeeper == nil {
+	// the data of the keeper deployed by the operator goes away with its PVCs
+	if cc.Spec.Zookeeper == nil || cc.Spec.Keeper != nil {
 		return nil
 	}
 
 	hosts := make([]string, 0)
 	for _, host := range cc.Spec.Zookeeper.Nodes {
-		logrus.Infof("add zk node : %s/%s to delete list\n", host.Host, host.Port)
+		logrus.Infof("add zk node : %s/%d to delete list\n", host.Host, host.Port)
 		hosts = append(hosts, fmt.Sprintf("%s:%d", host.Host, host.Port))
 	}
 	conn, _, err := zk.Connect(hosts, time.Second*10)
@@ -760,42 +751,21 @@ func (r *ReconcileClickHouseCluster) deleteZookeeperPath(cc *clickhousev1.ClickH
 	}
 	defer conn.Close()
 	err = Deleteall(conn, cc.Spec.Zookeeper.Root)
+	// the path has been deleted by a previous attempt
+	if err == zk.ErrNoNode {
+		return nil
+	}
 	if err != nil {
 		logrus.WithField("error", err).Errorf("failed to delete zookeeper path %s for clickhousecluster %s",
 			cc.Spec.Zookeeper.Root, cc.Name)
+		r.recorder.Eventf(cc, corev1.EventTypeWarning, EventZookeeperPathFailed, "delete zookeeper path %s: %v",
+			cc.Spec.Zookeeper.Root, err)
 		return err
 	}
+	r.recorder.Eventf(cc, corev1.EventTypeNormal, EventZookeeperPathDeleted, "deleted zookeeper path %s", cc.Spec.Zookeeper.Root)
 	return nil
 }
 
-func (r *ReconcileClickHouseCluster) checkInitZookeeperCfg(cc *clickhousev1.ClickHouseCluster) error {
-	if cc.Spec.Zookeeper != nil && cc.Spec.Zookeeper.Nodes != nil && cc.Spec.Zookeeper.Nodes[0].Host != "" {
-		return nil
-	}
-
-	if cc.Spec.ReplicasCount == 1 {
-		return nil
-	}
-
-	return errors.New("must have zookeeper configuration when have replicas")
-
-}
-
-func (r *ReconcileClickHouseCluster) formatZookeeper(cc *clickhousev1.ClickHouseCluster) {
-	if cc.Spec.Zookeeper == nil {
-		return
-	}
-	// set clickhouse root node force
-	cc.Spec.Zookeeper.Root = "/clickhouse/tables/" + cc.Namespace + "/" + cc.Name
-
-	if cc.Spec.Zookeeper.OperationTimeoutMs == 0 {
-		cc.Spec.Zookeeper.OperationTimeoutMs = 10000
-	}
-	if cc.Spec.Zookeeper.SessionTimeoutMs == 0 {
-		cc.Spec.Zookeeper.SessionTimeoutMs = 30000
-	}
-}
-
 // Deleteall recursively delete all nodes in zookeeper
 func Deleteall(conn *zk.Conn, root string) error {
 	logrus.Info("for root", root)
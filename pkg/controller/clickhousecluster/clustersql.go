@@ -0,0 +1,94 @@
+package clickhousecluster
+
+import (
+	"fmt"
+	"time"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// distributedDDLTimeout is how long a statement ON CLUSTER is waited on, a bit more than the
+// distributed_ddl_task_timeout of the server so its own error is the one reported
+const distributedDDLTimeout = 200 * time.Second
+
+// ClusterSQL runs the statements of the objects declared apart from a cluster, like its databases,
+// tables and users, as the operator user
+type ClusterSQL struct {
+	schemer *Schemer
+	cluster string
+	hosts   []string
+	// distributed tells if the cluster has a zookeeper for the distributed DDL
+	distributed bool
+}
+
+// NewClusterSQL returns the ClusterSQL of the cluster, its remote_servers cluster is named after it
+func NewClusterSQL(cli client.Client, cc *clickhousev1.ClickHouseCluster) (*ClusterSQL, error) {
+	user := OperatorUser(cc)
+	if user == nil {
+		return nil, fmt.Errorf("the cluster %s has no user", cc.Name)
+	}
+	password, err := GetUserPassword(cli, cc.Namespace, user)
+	if err != nil {
+		return nil, err
+	}
+	return &ClusterSQL{
+		schemer:     NewSchemer(user.Name, password),
+		cluster:     cc.Name,
+		hosts:       NewGenerator(nil, cc, nil).FQDNs(),
+		distributed: zookeeperConfig(cc) != nil,
+	}, nil
+}
+
+// OnCluster is the ON CLUSTER clause of the statements given to Exec, empty when the cluster has no
+// zookeeper and they are run on each host instead
+func (c *ClusterSQL) OnCluster() string {
+	if !c.distributed {
+		return ""
+	}
+	return " ON CLUSTER " + quoteName(c.cluster)
+}
+
+// Exec runs the statement from the first host answering, which has it run by all the hosts ON
+// CLUSTER, or on every host when the cluster has no zookeeper
+func (c *ClusterSQL) Exec(sql string) error {
+	if !c.distributed {
+		for _, host := range c.hosts {
+			if err := c.schemer.getCHConnection(host).ExecWithTimeout(sql, distributedDDLTimeout); err != nil {
+				return fmt.Errorf("%s: %v", host, err)
+			}
+		}
+		return nil
+	}
+	var lastErr error
+	for _, host := range c.hosts {
+		if _, err := c.schemer.queryCount(host, "SELECT 1"); err != nil {
+			lastErr = err
+			continue
+		}
+		return c.schemer.getCHConnection(host).ExecWithTimeout(sql, distributedDDLTimeout)
+	}
+	return fmt.Errorf("none of the hosts answered: %v", lastErr)
+}
+
+// Hosts returns the hosts of the cluster
+func (c *ClusterSQL) Hosts() []string {
+	return c.hosts
+}
+
+// Answers tells if the host answers the operator user
+func (c *ClusterSQL) Answers(host string) bool {
+	_, err := c.schemer.queryCount(host, "SELECT 1")
+	return err == nil
+}
+
+// QueryStrings returns the first column of the rows returned by the query on the host
+func (c *ClusterSQL) QueryStrings(host, sql string) ([]string, error) {
+	return c.schemer.queryStrings(host, sql)
+}
+
+// CanLogin tells if the user can connect to the host with the password
+func (c *ClusterSQL) CanLogin(host, user, password string) bool {
+	_, err := NewSchemer(user, password).queryCount(host, "SELECT 1")
+	return err == nil
+}
@@ -0,0 +1,79 @@
+package clickhousecluster
+
+import (
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/config"
+)
+
+const (
+	defaultZookeeperOperationTimeoutMs = 10000
+	defaultZookeeperSessionTimeoutMs   = 30000
+)
+
+// SetDefaults fills in the fields of the spec left empty from the default config of the operator,
+// it only depends on the cluster itself so applying it twice gives the same spec.
+// It returns true if anything has been changed.
+func SetDefaults(c *clickhousev1.ClickHouseCluster, config *config.DefaultConfig) bool {
+	var changed = false
+	if c.Spec.Image == "" {
+		c.Spec.Image = config.DefaultClickhouseImage
+		changed = true
+	}
+	if c.Spec.InitImage == "" {
+		c.Spec.InitImage = config.DefaultClickhouseInitImage
+		changed = true
+	}
+	if c.Spec.ShardsCount == 0 {
+		c.Spec.ShardsCount = config.DefaultShardCount
+		changed = true
+	}
+	if c.Spec.ReplicasCount == 0 {
+		c.Spec.ReplicasCount = config.DefaultReplicasCount
+		changed = true
+	}
+	if c.Spec.DataStorageClass != "" && c.Spec.DataCapacity == "" {
+		c.Spec.DataCapacity = config.DefaultDataCapacity
+		changed = true
+	}
+	// the users.xml of a previous release is refused until it is rewritten, it is not replaced
+	if len(c.Spec.Users) == 0 && c.Spec.LegacyUsers == "" {
+		// the password is generated into the secret by the reconcile
+		c.Spec.Users = defaultUsers(c)
+		changed = true
+	}
+	if c.Spec.Resources.Limits == (clickhousev1.CPUAndMem{}) && c.Spec.Resources.Requests != (clickhousev1.CPUAndMem{}) {
+		c.Spec.Resources.Limits = c.Spec.Resources.Requests
+		changed = true
+	}
+	if c.Spec.Storage != nil && len(c.Spec.Storage.Volumes) > 0 && c.Spec.Storage.Volumes[0].Name == "" {
+		c.Spec.Storage.Volumes[0].Name = defaultDiskName
+		changed = true
+	}
+	if c.Spec.Keeper != nil {
+		if c.Spec.Keeper.Replicas == 0 {
+			c.Spec.Keeper.Replicas = defaultKeeperReplicas
+			changed = true
+		}
+		if c.Spec.Keeper.Image == "" {
+			c.Spec.Keeper.Image = defaultKeeperImage
+			changed = true
+		}
+	}
+	if c.Spec.Zookeeper != nil {
+		// the root node of the tables of the cluster is forced
+		root := "/clickhouse/tables/" + c.Namespace + "/" + c.Name
+		if c.Spec.Zookeeper.Root != root {
+			c.Spec.Zookeeper.Root = root
+			changed = true
+		}
+		if c.Spec.Zookeeper.OperationTimeoutMs == 0 {
+			c.Spec.Zookeeper.OperationTimeoutMs = defaultZookeeperOperationTimeoutMs
+			changed = true
+		}
+		if c.Spec.Zookeeper.SessionTimeoutMs == 0 {
+			c.Spec.Zookeeper.SessionTimeoutMs = defaultZookeeperSessionTimeoutMs
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,369 @@
+package clickhousecluster
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// A cluster needing a cleanup holds the finalizer of the operator. Once it is deleted the steps of
+// the cleanup are run in order and recorded in status.deletion: the clients are cut off by deleting
+// the Service in front of the cluster, the databases are backed up if a disk is given, the pods are
+// stopped, then the PVCs and the zookeeper path of the cluster are deleted. A failed step is retried
+// until the force-delete annotation removes the finalizer without running the rest.
+
+// the finalizer set by the previous releases when deletePVC was true
+const legacyPVCFinalizer = "kubernetes.io/pvc-to-delete"
+
+const (
+	backupTimeout  = 12 * time.Hour
+	backupInterval = 10 * time.Second
+)
+
+// needsCleanup tells if something has to be done before a deleted cluster goes away
+func needsCleanup(cc *clickhousev1.ClickHouseCluster) bool {
+	return cc.Spec.DeletePVC || backupDisk(cc) != ""
+}
+
+// backupDisk returns the disk the cluster is backed up to before its deletion, empty if none
+func backupDisk(cc *clickhousev1.ClickHouseCluster) string {
+	if cc.Spec.Deletion == nil {
+		return ""
+	}
+	return cc.Spec.Deletion.BackupDisk
+}
+
+// updateFinalizer adds the finalizer of the operator to the clusters needing a cleanup and removes
+// it from the others, the finalizers set by others are kept
+func updateFinalizer(cc *clickhousev1.ClickHouseCluster) {
+	finalizers := removeString(cc.Finalizers, legacyPVCFinalizer)
+	switch {
+	case needsCleanup(cc) && !containsString(finalizers, ClusterFinalizer):
+		finalizers = append(finalizers, ClusterFinalizer)
+	case !needsCleanup(cc):
+		finalizers = removeString(finalizers, ClusterFinalizer)
+	}
+	if !reflect.DeepEqual(finalizers, cc.Finalizers) {
+		cc.SetFinalizers(finalizers)
+	}
+}
+
+// removeFinalizers removes the finalizers of the operator, the cluster goes away once the others
+// are removed too
+func removeFinalizers(cc *clickhousev1.ClickHouseCluster) {
+	cc.SetFinalizers(removeString(removeString(cc.Finalizers, legacyPVCFinalizer), ClusterFinalizer))
+}
+
+// cleanupSteps returns the steps of the cleanup of the cluster in the order they are run
+func cleanupSteps(cc *clickhousev1.ClickHouseCluster) []string {
+	steps := []string{DeletionStepStopWrites}
+	if backupDisk(cc) != "" {
+		steps = append(steps, DeletionStepBackup)
+	}
+	steps = append(steps, DeletionStepStopShards)
+	if cc.Spec.DeletePVC {
+		steps = append(steps, DeletionStepDeletePVCs, DeletionStepDeleteZookeeperPath)
+	}
+	return steps
+}
+
+// reconcileDeletion runs the next steps of the cleanup of a deleted cluster and removes the finalizer
+// of the operator once they all completed
+func (r *ReconcileClickHouseCluster) reconcileDeletion(cc *clickhousev1.ClickHouseCluster,
+	status *clickhousev1.ClickHouseClusterStatus) error {
+	log := logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "name": cc.Name})
+	if !containsString(cc.Finalizers, ClusterFinalizer) && !containsString(cc.Finalizers, legacyPVCFinalizer) {
+		return nil
+	}
+	if status.Deletion == nil {
+		status.Deletion = &clickhousev1.DeletionStatus{}
+	}
+	deletion := status.Deletion
+
+	if cc.Annotations[clickhousev1.AnnotationForceDelete] == "true" {
+		log.WithField("step", deletion.Step).Warning("force the deletion, the rest of the cleanup is skipped")
+		r.recorder.Eventf(cc, corev1.EventTypeWarning, EventCleanupSkipped,
+			"the cleanup is skipped from the step %s by the %s annotation", deletion.Step, clickhousev1.AnnotationForceDelete)
+		removeFinalizers(cc)
+		return nil
+	}
+
+	for _, step := range cleanupSteps(cc) {
+		if containsString(deletion.CompletedSteps, step) {
+			continue
+		}
+		if deletion.Step != step {
+			log.WithField("step", step).Info("run cleanup step")
+			deletion.Step, deletion.Message = step, ""
+		}
+		pending, err := r.runCleanupStep(cc, step)
+		if err != nil {
+			log.WithFields(logrus.Fields{"step": step, "error": err}).Error("cleanup step error")
+			deletion.Message = err.Error()
+			r.recorder.Eventf(cc, corev1.EventTypeWarning, EventCleanupFailed, "%s: %v", step, err)
+			return err
+		}
+		// the objects waited for are watched, a backup enqueues the cluster once done
+		if pending != "" {
+			deletion.Message = pending
+			return nil
+		}
+		deletion.CompletedSteps = append(deletion.CompletedSteps, step)
+		deletion.Step, deletion.Message = "", ""
+		r.recorder.Eventf(cc, corev1.EventTypeNormal, EventCleanupStepDone, "the cleanup step %s completed", step)
+	}
+
+	log.Info("cleanup completed")
+	r.tasks.forget(cc.Namespace, cc.Name, "")
+	removeFinalizers(cc)
+	return nil
+}
+
+// runCleanupStep runs a step of the cleanup, it returns what the step waits for until it completed
+func (r *ReconcileClickHouseCluster) runCleanupStep(cc *clickhousev1.ClickHouseCluster, step string) (string, error) {
+	switch step {
+	case DeletionStepStopWrites:
+		return "", r.deleteServices(cc)
+	case DeletionStepBackup:
+		return r.backupCluster(cc)
+	case DeletionStepStopShards:
+		return r.stopStatefulSets(cc)
+	case DeletionStepDeletePVCs:
+		if err := r.DeletePVCs(cc); err != nil {
+			return "", err
+		}
+		r.recorder.Event(cc, corev1.EventTypeNormal, EventPVCsDeleted, "the PVCs of the cluster have been deleted")
+		return "", nil
+	case DeletionStepDeleteZookeeperPath:
+		return "", r.deleteZookeeperPath(cc)
+	}
+	return "", fmt.Errorf("unknown cleanup step %s", step)
+}
+
+// deleteServices deletes the common Service and the Services of the shards, the clients do not
+// reach the cluster through them anymore and the backup is of a cluster not written
+func (r *ReconcileClickHouseCluster) deleteServices(cc *clickhousev1.ClickHouseCluster) error {
+	services := &corev1.ServiceList{}
+	err := r.client.List(context.TODO(), services, &client.ListOptions{
+		Namespace:     cc.Namespace,
+		LabelSelector: labels.SelectorFromSet(map[string]string{ClusterLabelKey: cc.Name}),
+	})
+	if err != nil {
+		return err
+	}
+	for i := range services.Items {
+		if err := r.client.Delete(context.TODO(), &services.Items[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardPodIPs returns the IPs of the running pods of the shard sorted by pod name, the names of
+// the pods are not resolved once the Services of the shards are deleted
+func (r *ReconcileClickHouseCluster) shardPodIPs(cc *clickhousev1.ClickHouseCluster, shardID int) ([]string, error) {
+	pods := &corev1.PodList{}
+	err := r.client.List(context.TODO(), pods, &client.ListOptions{
+		Namespace: cc.Namespace,
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			ClusterLabelKey: cc.Name,
+			ShardIDLabelKey: fmt.Sprintf("%d", shardID),
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+	var ips []string
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.Status.PodIP != "" {
+			ips = append(ips, pod.Status.PodIP)
+		}
+	}
+	return ips, nil
+}
+
+// backupCluster backs the databases of each shard up to the backup disk, from the first replica
+// answering
+func (r *ReconcileClickHouseCluster) backupCluster(cc *clickhousev1.ClickHouseCluster) (string, error) {
+	passwords, err := r.getUserPasswords(cc)
+	if err != nil {
+		return "", err
+	}
+	g := NewGenerator(r, cc, passwords)
+	var shards [][]string
+	for shardID := 0; shardID < int(cc.Spec.ShardsCount); shardID++ {
+		hosts, err := r.shardPodIPs(cc, shardID)
+		if err != nil {
+			return "", err
+		}
+		if len(hosts) == 0 {
+			return "", fmt.Errorf("no pod of the shard %d is running to back it up", shardID)
+		}
+		shards = append(shards, hosts)
+	}
+	disk := backupDisk(cc)
+	prefix := fmt.Sprintf("%s/%s/%s", cc.Namespace, cc.Name, cc.DeletionTimestamp.UTC().Format("20060102T150405Z"))
+	schemer := NewSchemer(g.operatorCredential())
+	done, err := r.tasks.run(cc, taskBackup, func() error {
+		for shardID, hosts := range shards {
+			if err := schemer.backupShard(hosts, disk, fmt.Sprintf("%s/%d", prefix, shardID)); err != nil {
+				return fmt.Errorf("shard %d: %v", shardID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !done {
+		return fmt.Sprintf("backing up to the disk %s under %s", disk, prefix), nil
+	}
+	return "", nil
+}
+
+// backupShard backs the databases of the shard up from the first of its hosts answering
+func (s *Schemer) backupShard(hosts []string, disk, path string) error {
+	var lastErr error
+	for _, host := range hosts {
+		databases, err := s.queryStrings(host,
+			fmt.Sprintf("SELECT name FROM system.databases WHERE name NOT IN (%s)", systemDatabases))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, database := range databases {
+			if err := s.backupDatabase(host, database, disk, path+"/"+database); err != nil {
+				return fmt.Errorf("backup database %s on %s: %v", database, host, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("none of the hosts answered: %v", lastErr)
+}
+
+// backupDatabase starts the backup of the database in the background and polls system.backups until
+// it is created. A backup still running from a previous try is waited for, and one already written
+// is kept: the server refuses to write it again.
+func (s *Schemer) backupDatabase(host, database, disk, path string) error {
+	destination := fmt.Sprintf("Disk(%s, %s)", sqlString(disk), sqlString(path))
+	rows, err := s.queryRows(host, "SELECT id, status FROM system.backups WHERE name = "+sqlString(destination)+
+		" ORDER BY start_time DESC LIMIT 1")
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 || rows[0][1] != "CREATING_BACKUP" && rows[0][1] != "BACKUP_CREATED" {
+		rows, err = s.queryRows(host, fmt.Sprintf("BACKUP DATABASE %s TO %s ASYNC", quoteName(database), destination))
+		// BACKUP_ALREADY_EXISTS, the metadata of a backup is written once all of its files are
+		if err != nil && strings.Contains(err.Error(), "Code: 598,") {
+			logrus.Infof("Backup %s already exists on %s", destination, host)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return fmt.Errorf("no backup started to %s", destination)
+		}
+	}
+
+	id := rows[0][0]
+	deadline := time.Now().Add(backupTimeout)
+	for {
+		rows, err := s.queryRows(host, "SELECT status, error FROM system.backups WHERE id = "+sqlString(id))
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return fmt.Errorf("the backup %s to %s is not in system.backups anymore", id, destination)
+		}
+		switch status := rows[0][0]; status {
+		case "BACKUP_CREATED":
+			return nil
+		case "CREATING_BACKUP":
+		default:
+			return fmt.Errorf("the backup to %s is %s: %s", destination, status, rows[0][1])
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the backup to %s is not created after %v", destination, backupTimeout)
+		}
+		time.Sleep(backupInterval)
+	}
+}
+
+// stopStatefulSets scales the StatefulSets of the cluster to zero, the drained shards included, it
+// returns the pods still running
+func (r *ReconcileClickHouseCluster) stopStatefulSets(cc *clickhousev1.ClickHouseCluster) (string, error) {
+	statefulSets := &appsv1.StatefulSetList{}
+	err := r.client.List(context.TODO(), statefulSets, &client.ListOptions{
+		Namespace:     cc.Namespace,
+		LabelSelector: labels.SelectorFromSet(map[string]string{ClusterLabelKey: cc.Name}),
+	})
+	if err != nil {
+		return "", err
+	}
+	var running int32
+	for i := range statefulSets.Items {
+		sts := &statefulSets.Items[i]
+		running += sts.Status.Replicas
+		if sts.Spec.Replicas != nil && *sts.Spec.Replicas == 0 {
+			continue
+		}
+		stopped := sts.DeepCopy()
+		var zero int32
+		stopped.Spec.Replicas = &zero
+		if err := r.client.Patch(context.TODO(), stopped, client.MergeFrom(sts)); err != nil {
+			return "", err
+		}
+	}
+	if running > 0 {
+		return fmt.Sprintf("waiting for %d pods to stop", running), nil
+	}
+	return "", nil
+}
+
+// DeletePVCs deletes the PVCs of the cluster and of its keeper, all of them are tried before the
+// errors are returned
+func (r *ReconcileClickHouseCluster) DeletePVCs(cc *clickhousev1.ClickHouseCluster) error {
+	lpvc, err := r.listPVC(cc.Namespace, map[string]string{ClusterLabelKey: cc.Name})
+	if err != nil {
+		logrus.Errorf("failed to get clickhouse's PVC: %v", err)
+		return err
+	}
+	// the PVCs of the keeper do not have the label of the cluster
+	keeperPVC, err := r.listPVC(cc.Namespace, keeperLabels(cc))
+	if err != nil {
+		logrus.Errorf("failed to get clickhouse keeper's PVC: %v", err)
+		return err
+	}
+	lpvc.Items = append(lpvc.Items, keeperPVC.Items...)
+
+	var failed []string
+	for i := range lpvc.Items {
+		pvc := &lpvc.Items[i]
+		if pvc.DeletionTimestamp != nil {
+			continue
+		}
+		if err := r.client.Delete(context.TODO(), pvc); err != nil && !apierrors.IsNotFound(err) {
+			logrus.WithFields(logrus.Fields{"PVC": pvc.Name, "Namespace": cc.Namespace, "error": err}).Error("Error Deleting PVC")
+			failed = append(failed, fmt.Sprintf("%s: %v", pvc.Name, err))
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"PVC": pvc.Name, "Namespace": cc.Namespace}).Info("Delete PVC OK")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("delete PVCs: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package clickhousecluster
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// The tables of the hosts are compared periodically by a background task, through the hash of their
+// create_table_query. A table on at least half of the hosts is missing from the others, a table on
+// less than half of them is extra where it is, and a table defined differently from most of the
+// hosts having it is mismatched there. With repair, the missing tables are created with their
+// databases as they are defined on the other hosts.
+
+const defaultSchemaCheckIntervalSeconds = 300
+
+var (
+	schemaDriftTables = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "clickhouse_operator_schema_drift_tables",
+		Help: "Tables missing, extra or mismatched on the hosts of the cluster found by the last schema check",
+	}, []string{"namespace", "cluster", "type"})
+	schemaCheckTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "clickhouse_operator_schema_check_timestamp_seconds",
+		Help: "Time of the last schema check of the cluster",
+	}, []string{"namespace", "cluster"})
+	schemaRepairedTables = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clickhouse_operator_schema_repaired_tables_total",
+		Help: "Tables created on the hosts missing them by the schema checks of the cluster",
+	}, []string{"namespace", "cluster"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(schemaDriftTables, schemaCheckTimestamp, schemaRepairedTables)
+}
+
+// schemaCheckResult is the outcome of a check of the schema of the hosts
+type schemaCheckResult struct {
+	drifts []clickhousev1.SchemaDrift
+	// repaired is the number of missing tables created
+	repaired int
+	// failures are the objects the repair could not create
+	failures []clickhousev1.SchemaObjectFailure
+}
+
+// validateSchemaCheck checks the interval of spec.schemaCheck
+func validateSchemaCheck(cc *clickhousev1.ClickHouseCluster) error {
+	if spec := cc.Spec.SchemaCheck; spec != nil && spec.IntervalSeconds < 0 {
+		return fmt.Errorf("schemaCheck: intervalSeconds can not be negative")
+	}
+	return nil
+}
+
+// schemaCheckInterval returns the time between two checks of the schema of the cluster
+func schemaCheckInterval(cc *clickhousev1.ClickHouseCluster) time.Duration {
+	if spec := cc.Spec.SchemaCheck; spec != nil && spec.IntervalSeconds > 0 {
+		return time.Duration(spec.IntervalSeconds) * time.Second
+	}
+	return defaultSchemaCheckIntervalSeconds * time.Second
+}
+
+// checkSchema starts a check of the schema once the interval has elapsed since the last one and
+// records its result in the status, it returns how long until the next check is due
+func (r *ReconcileClickHouseCluster) checkSchema(cc *clickhousev1.ClickHouseCluster, g *Generator,
+	status *clickhousev1.ClickHouseClusterStatus) time.Duration {
+	log := logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "name": cc.Name})
+	spec := cc.Spec.SchemaCheck
+	if spec != nil && spec.Disabled {
+		if status.Schema != nil {
+			status.Schema.LastCheckTime, status.Schema.Drifts = nil, nil
+		}
+		r.tasks.forget(cc.Namespace, cc.Name, taskCheckSchema)
+		deleteSchemaMetrics(cc.Namespace, cc.Name)
+		return 0
+	}
+	interval := schemaCheckInterval(cc)
+	if status.Schema != nil && status.Schema.LastCheckTime != nil {
+		if wait := time.Until(status.Schema.LastCheckTime.Add(interval)); wait > 0 {
+			return wait
+		}
+	}
+
+	// Everything the task needs is copied, it must not touch the cluster being reconciled
+	hosts := g.FQDNs()
+	repair := spec != nil && spec.Repair
+	schemer := NewSchemer(g.operatorCredential())
+	done, value, err := r.tasks.runValue(cc, taskCheckSchema, func() (interface{}, error) {
+		return schemer.checkSchema(hosts, repair)
+	})
+	// the cluster is enqueued once the task has finished
+	if !done {
+		return 0
+	}
+
+	now := metav1.Now()
+	schema := schemaStatus(status)
+	schema.LastCheckTime = &now
+	schemaCheckTimestamp.WithLabelValues(cc.Namespace, cc.Name).Set(float64(now.Unix()))
+	if err != nil {
+		log.WithField("error", err).Error("check schema error")
+		r.recorder.Eventf(cc, corev1.EventTypeWarning, EventSchemaCheckFailed, "the tables of the hosts could not be compared: %v", err)
+		return interval
+	}
+
+	result := value.(*schemaCheckResult)
+	if result.repaired > 0 {
+		schemaRepairedTables.WithLabelValues(cc.Namespace, cc.Name).Add(float64(result.repaired))
+		r.recorder.Eventf(cc, corev1.EventTypeNormal, EventSchemaRepaired, "%d missing tables have been created", result.repaired)
+	}
+	if len(result.failures) > 0 {
+		r.recorder.Event(cc, corev1.EventTypeWarning, EventSchemaCheckFailed, (&schemaSyncError{failures: result.failures}).Error())
+	}
+	for _, driftType := range []string{SchemaDriftMissing, SchemaDriftExtra, SchemaDriftMismatch} {
+		schemaDriftTables.WithLabelValues(cc.Namespace, cc.Name, strings.ToLower(driftType)).
+			Set(float64(countDrifts(result.drifts, driftType)))
+	}
+	if len(result.drifts) > 0 && !sameDrifts(schema.Drifts, result.drifts) {
+		log.WithField("drifts", result.drifts).Warning("schema drift")
+		r.recorder.Event(cc, corev1.EventTypeWarning, ReasonSchemaDrift, driftSummary(result.drifts))
+	}
+	schema.Drifts = result.drifts
+	return interval
+}
+
+// deleteSchemaMetrics removes the metrics of the schema checks of the cluster
+func deleteSchemaMetrics(namespace, name string) {
+	for _, driftType := range []string{SchemaDriftMissing, SchemaDriftExtra, SchemaDriftMismatch} {
+		schemaDriftTables.DeleteLabelValues(namespace, name, strings.ToLower(driftType))
+	}
+	schemaCheckTimestamp.DeleteLabelValues(namespace, name)
+	schemaRepairedTables.DeleteLabelValues(namespace, name)
+}
+
+// countDrifts returns the number of differences of the type
+func countDrifts(drifts []clickhousev1.SchemaDrift, driftType string) int {
+	var n int
+	for _, drift := range drifts {
+		if drift.Type == driftType {
+			n++
+		}
+	}
+	return n
+}
+
+// sameDrifts tells if two checks found the same differences
+func sameDrifts(a, b []clickhousev1.SchemaDrift) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// driftSummary describes the differences in the message of the SchemaSynced condition
+func driftSummary(drifts []clickhousev1.SchemaDrift) string {
+	first := drifts[0]
+	return fmt.Sprintf("tables missing: %d, extra: %d, mismatched: %d, the first: %s %s on %s",
+		countDrifts(drifts, SchemaDriftMissing), countDrifts(drifts, SchemaDriftExtra),
+		countDrifts(drifts, SchemaDriftMismatch), first.Table, first.Type, first.Host)
+}
+
+// schemaDrifts compares the tables of the hosts, given by host with the hash of their definition
+func schemaDrifts(hosts []string, tables map[string]map[string]string) []clickhousev1.SchemaDrift {
+	// the hosts having each table, and having each of its definitions
+	present := make(map[string]int)
+	definitions := make(map[string]map[string]int)
+	for _, host := range hosts {
+		for table, hash := range tables[host] {
+			present[table]++
+			if definitions[table] == nil {
+				definitions[table] = make(map[string]int)
+			}
+			definitions[table][hash]++
+		}
+	}
+	names := make([]string, 0, len(present))
+	for table := range present {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+
+	var drifts []clickhousev1.SchemaDrift
+	for _, table := range names {
+		// the most common definition, the one of the first host among the ties
+		var common string
+		for _, host := range hosts {
+			if hash, ok := tables[host][table]; ok && definitions[table][hash] > definitions[table][common] {
+				common = hash
+			}
+		}
+		for _, host := range hosts {
+			hash, ok := tables[host][table]
+			switch {
+			case !ok && present[table]*2 >= len(hosts):
+				drifts = append(drifts, clickhousev1.SchemaDrift{Host: host, Table: table, Type: SchemaDriftMissing})
+			case ok && present[table]*2 < len(hosts):
+				drifts = append(drifts, clickhousev1.SchemaDrift{Host: host, Table: table, Type: SchemaDriftExtra})
+			case ok && hash != common:
+				drifts = append(drifts, clickhousev1.SchemaDrift{Host: host, Table: table, Type: SchemaDriftMismatch})
+			}
+		}
+	}
+	return drifts
+}
+
+// checkSchema compares the tables of the hosts answering and, with repair, creates the missing ones
+func (s *Schemer) checkSchema(hosts []string, repair bool) (*schemaCheckResult, error) {
+	answering, tables, err := s.tableHashes(hosts)
+	if err != nil {
+		return nil, err
+	}
+	result := &schemaCheckResult{drifts: schemaDrifts(answering, tables)}
+	missing := countDrifts(result.drifts, SchemaDriftMissing)
+	if !repair || missing == 0 {
+		return result, nil
+	}
+
+	result.failures, err = s.repairSchema(answering, result.drifts)
+	if err != nil {
+		return nil, err
+	}
+	// the tables are compared again to report what the repair left
+	answering, tables, err = s.tableHashes(hosts)
+	if err != nil {
+		return nil, err
+	}
+	result.drifts = schemaDrifts(answering, tables)
+	result.repaired = missing - countDrifts(result.drifts, SchemaDriftMissing)
+	return result, nil
+}
+
+// tableHashes returns the hash of the definition of the tables of the hosts answering, by host
+func (s *Schemer) tableHashes(hosts []string) ([]string, map[string]map[string]string, error) {
+	sql := fmt.Sprintf(`SELECT concat(database, '.', name), toString(cityHash64(create_table_query)) FROM system.tables
+WHERE database NOT IN (%s) AND database != '' AND name NOT LIKE '.inner.%%' AND name NOT LIKE '.inner_id.%%'`,
+		systemDatabases)
+	var answering []string
+	tables := make(map[string]map[string]string)
+	var lastErr error
+	for _, host := range hosts {
+		rows, err := s.queryRows(host, sql)
+		if err != nil {
+			logrus.Infof("Read tables on: %s FAILED skip to next. err: %v", host, err)
+			lastErr = err
+			continue
+		}
+		answering = append(answering, host)
+		tables[host] = make(map[string]string, len(rows))
+		for _, row := range rows {
+			tables[host][row[0]] = row[1]
+		}
+	}
+	if len(answering) == 0 && lastErr != nil {
+		return nil, nil, fmt.Errorf("none of the hosts answered: %v", lastErr)
+	}
+	return answering, tables, nil
+}
+
+// repairSchema creates the tables missing on the hosts, with their databases, as they are defined on
+// the other hosts
+func (s *Schemer) repairSchema(hosts []string, drifts []clickhousev1.SchemaDrift) ([]clickhousev1.SchemaObjectFailure, error) {
+	missing := make(map[string]map[string]bool)
+	for _, drift := range drifts {
+		if drift.Type != SchemaDriftMissing {
+			continue
+		}
+		if missing[drift.Host] == nil {
+			missing[drift.Host] = make(map[string]bool)
+		}
+		missing[drift.Host][drift.Table] = true
+		missing[drift.Host][strings.SplitN(drift.Table, ".", 2)[0]] = true
+	}
+	// a table with a secret hidden by the server is left missing, it stays in the drifts
+	objects, hidden, err := s.readClusterSchema(hosts, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(hidden) > 0 {
+		logrus.WithField("objects", hidden).Warning("the objects with a hidden secret are not repaired")
+	}
+
+	var failures []clickhousev1.SchemaObjectFailure
+	for _, host := range hosts {
+		if len(missing[host]) == 0 {
+			continue
+		}
+		var repair []schemaObject
+		for _, object := range objects {
+			rank := schemaRank(object.kind)
+			if (rank == schemaRank(SchemaObjectDatabase) || rank == schemaRank(SchemaObjectTable)) && missing[host][object.name] {
+				repair = append(repair, object)
+			}
+		}
+		failures = append(failures, s.applySchema(host, repair)...)
+	}
+	return failures, nil
+}
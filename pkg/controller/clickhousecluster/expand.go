@@ -0,0 +1,230 @@
+package clickhousecluster
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The claims of the pods can grow when their StorageClass allows volume expansion. The existing PVCs
+// are patched first, then once they have been resized the StatefulSet is deleted leaving its pods
+// and recreated, as its volumeClaimTemplates can not be updated.
+
+const defaultStorageClassAnnotation = "storageclass.kubernetes.io/is-default-class"
+
+// validateCapacityUpdate rejects the shrink of a capacity
+func validateCapacityUpdate(what, oldCapacity, newCapacity string) error {
+	if oldCapacity == newCapacity || oldCapacity == "" || newCapacity == "" {
+		if oldCapacity != newCapacity {
+			return fmt.Errorf("%s can not be changed from %q to %q", what, oldCapacity, newCapacity)
+		}
+		return nil
+	}
+	oldQuantity, err := resource.ParseQuantity(oldCapacity)
+	if err != nil {
+		return fmt.Errorf("%s: invalid capacity %q", what, oldCapacity)
+	}
+	newQuantity, err := resource.ParseQuantity(newCapacity)
+	if err != nil {
+		return fmt.Errorf("%s: invalid capacity %q", what, newCapacity)
+	}
+	if newQuantity.Cmp(oldQuantity) < 0 {
+		return fmt.Errorf("%s can not be shrunk from %q to %q", what, oldCapacity, newCapacity)
+	}
+	return nil
+}
+
+// capacityIncreased tells if the capacity grows, both being valid
+func capacityIncreased(oldCapacity, newCapacity string) bool {
+	oldQuantity, oldErr := resource.ParseQuantity(oldCapacity)
+	newQuantity, newErr := resource.ParseQuantity(newCapacity)
+	return oldErr == nil && newErr == nil && newQuantity.Cmp(oldQuantity) > 0
+}
+
+// expandedStorageClasses returns the StorageClasses of the claims growing with the update, empty for
+// the default StorageClass
+func expandedStorageClasses(old, cc *clickhousev1.ClickHouseCluster) []string {
+	seen := make(map[string]bool)
+	var classes []string
+	add := func(class string) {
+		if !seen[class] {
+			seen[class] = true
+			classes = append(classes, class)
+		}
+	}
+
+	oldVolumes, newVolumes := old.Spec.DataVolumes(), cc.Spec.DataVolumes()
+	if len(newVolumes) == 0 && cc.Spec.DataStorageClass != "" {
+		for shardID := 0; shardID < int(old.Spec.ShardsCount) && shardID < int(cc.Spec.ShardsCount); shardID++ {
+			if capacityIncreased(old.Spec.ShardDataCapacity(shardID), cc.Spec.ShardDataCapacity(shardID)) {
+				add(cc.Spec.DataStorageClass)
+			}
+		}
+	}
+	for i := range newVolumes {
+		if i < len(oldVolumes) && capacityIncreased(oldVolumes[i].Capacity, newVolumes[i].Capacity) {
+			add(newVolumes[i].StorageClass)
+		}
+	}
+	if old.Spec.Storage != nil && old.Spec.Storage.Log != nil && cc.Spec.Storage != nil && cc.Spec.Storage.Log != nil &&
+		capacityIncreased(old.Spec.Storage.Log.Capacity, cc.Spec.Storage.Log.Capacity) {
+		add(cc.Spec.Storage.Log.StorageClass)
+	}
+	return classes
+}
+
+// CheckVolumeExpansion rejects the growth of the claims whose StorageClass does not allow volume expansion
+func CheckVolumeExpansion(cli client.Client, old, cc *clickhousev1.ClickHouseCluster) error {
+	for _, class := range expandedStorageClasses(old, cc) {
+		if err := checkStorageClassExpandable(cli, class); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStorageClassExpandable checks the StorageClass allows volume expansion, the default StorageClass
+// if name is empty
+func checkStorageClassExpandable(cli client.Client, name string) error {
+	storageClass := &storagev1.StorageClass{}
+	if name == "" {
+		storageClasses := &storagev1.StorageClassList{}
+		if err := cli.List(context.TODO(), storageClasses); err != nil {
+			return err
+		}
+		for i := range storageClasses.Items {
+			if storageClasses.Items[i].Annotations[defaultStorageClassAnnotation] == "true" {
+				storageClass = &storageClasses.Items[i]
+			}
+		}
+		if storageClass.Name == "" {
+			return fmt.Errorf("there is no default storage class to expand the volumes with")
+		}
+	} else if err := cli.Get(context.TODO(), types.NamespacedName{Name: name}, storageClass); err != nil {
+		return err
+	}
+	if storageClass.AllowVolumeExpansion == nil || !*storageClass.AllowVolumeExpansion {
+		return fmt.Errorf("storage class %s does not allow volume expansion", storageClass.Name)
+	}
+	return nil
+}
+
+// expandVolumes grows the PVCs of the shard to the capacity of the claim templates, it returns the
+// PVCs still being resized. The StatefulSet is deleted leaving its pods once they all have been,
+// recreated is true then.
+func (r *ReconcileClickHouseCluster) expandVolumes(g *Generator, shardID int,
+	statefulSet *appsv1.StatefulSet) (expanding []string, recreated bool, err error) {
+	log := logrus.WithFields(logrus.Fields{"namespace": statefulSet.Namespace, "name": statefulSet.Name})
+	templates := g.generateStatefulSet(shardID).Spec.VolumeClaimTemplates
+	if len(templates) == 0 {
+		return nil, false, nil
+	}
+
+	pvcs, err := r.listPVC(statefulSet.Namespace, map[string]string{
+		ClusterLabelKey: g.cc.Name,
+		ShardIDLabelKey: strconv.Itoa(shardID),
+	})
+	if err != nil {
+		log.WithField("error", err).Error("List PVC error")
+		return nil, false, err
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		template := claimTemplateOf(pvc, templates, statefulSet.Name)
+		if template == nil || pvc.Status.Phase != corev1.ClaimBound {
+			continue
+		}
+		want := template.Spec.Resources.Requests[corev1.ResourceStorage]
+		requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		if want.Cmp(requested) > 0 {
+			class := ""
+			if pvc.Spec.StorageClassName != nil {
+				class = *pvc.Spec.StorageClassName
+			}
+			if err := checkStorageClassExpandable(r.client, class); err != nil {
+				r.recorder.Eventf(g.cc, corev1.EventTypeWarning, EventVolumeExpandFailed, "PVC %s: %v", pvc.Name, err)
+				return expanding, false, fmt.Errorf("PVC %s: %v", pvc.Name, err)
+			}
+			patched := pvc.DeepCopy()
+			patched.Spec.Resources.Requests[corev1.ResourceStorage] = want
+			if err := r.client.Patch(context.TODO(), patched, client.MergeFrom(pvc)); err != nil {
+				log.WithFields(logrus.Fields{"PVC": pvc.Name, "error": err}).Error("expand PVC error")
+				return expanding, false, err
+			}
+			log.WithFields(logrus.Fields{"PVC": pvc.Name, "capacity": want.String()}).Info("expand PVC")
+			r.recorder.Eventf(g.cc, corev1.EventTypeNormal, EventVolumesExpanding, "expanding PVC %s to %s", pvc.Name, want.String())
+			expanding = append(expanding, pvc.Name)
+			continue
+		}
+		// the file system is resized by the kubelet of the node the pod runs on
+		if pvcCondition(pvc, corev1.PersistentVolumeClaimFileSystemResizePending) {
+			expanding = append(expanding, pvc.Name+" (file system resize pending)")
+			continue
+		}
+		capacity := pvc.Status.Capacity[corev1.ResourceStorage]
+		if pvcCondition(pvc, corev1.PersistentVolumeClaimResizing) || capacity.Cmp(requested) < 0 {
+			expanding = append(expanding, pvc.Name)
+		}
+	}
+	if len(expanding) > 0 || claimTemplatesEqual(statefulSet.Spec.VolumeClaimTemplates, templates) {
+		return expanding, false, nil
+	}
+
+	log.Info("recreate statefulSet with the expanded claim templates")
+	orphan := metav1.DeletePropagationOrphan
+	if err := r.client.Delete(context.TODO(), statefulSet, &client.DeleteOptions{PropagationPolicy: &orphan}); err != nil {
+		log.WithField("error", err).Error("Delete statefulSet error")
+		return nil, false, err
+	}
+	r.recorder.Eventf(g.cc, corev1.EventTypeNormal, EventStatefulSetRecreated,
+		"recreating StatefulSet %s with the expanded claim templates, its pods are left running", statefulSet.Name)
+	return nil, true, nil
+}
+
+// claimTemplateOf returns the template the PVC of a pod of the StatefulSet has been created from
+func claimTemplateOf(pvc *corev1.PersistentVolumeClaim, templates []corev1.PersistentVolumeClaim,
+	statefulSetName string) *corev1.PersistentVolumeClaim {
+	for i := range templates {
+		pod := strings.TrimPrefix(pvc.Name, templates[i].Name+"-")
+		if index := replicaIndex(pod); index >= 0 && pod == fmt.Sprintf("%s-%d", statefulSetName, index) {
+			return &templates[i]
+		}
+	}
+	return nil
+}
+
+// claimTemplatesEqual tells if the claim templates request the same capacities
+func claimTemplatesEqual(current, generated []corev1.PersistentVolumeClaim) bool {
+	if len(current) != len(generated) {
+		return false
+	}
+	for i := range current {
+		currentCapacity := current[i].Spec.Resources.Requests[corev1.ResourceStorage]
+		if current[i].Name != generated[i].Name ||
+			currentCapacity.Cmp(generated[i].Spec.Resources.Requests[corev1.ResourceStorage]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// pvcCondition tells if the condition of the PVC is true
+func pvcCondition(pvc *corev1.PersistentVolumeClaim, conditionType corev1.PersistentVolumeClaimConditionType) bool {
+	for _, condition := range pvc.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -1,9 +1,11 @@
 package clickhousecluster
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"regexp"
+	"strings"
 
 	monitoringv1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
 	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
@@ -11,7 +13,6 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
@@ -36,11 +37,14 @@ const (
 	filenameUsersXML         = "users.xml"
 	filenameZookeeperXML     = "zookeeper.xml"
 	filenameSettingsXML      = "settings.xml"
+	filenameStorageXML       = "storage.xml"
 
 	dirPathConfigd = "/etc/clickhouse-server/config.d/"
 	dirPathUsersd  = "/etc/clickhouse-server/users.d/"
 	dirPathConfd   = "/etc/clickhouse-server/conf.d/"
 	dirPathData    = "/var/lib/clickhouse/"
+	dirPathDisks   = "/var/lib/clickhouse-disks/"
+	dirPathLog     = "/var/log/clickhouse-server/"
 
 	pspName = "clickhouse-operator"
 
@@ -57,10 +61,20 @@ const (
 type Generator struct {
 	rcc *ReconcileClickHouseCluster
 	cc  *clickhousev1.ClickHouseCluster
+	// passwords of the users defined, keyed by user name
+	passwords map[string]string
+	// removedShards are the shards above shardsCount not deleted yet
+	removedShards []removedShard
+	// canaryPod is the only pod the rollout may restart while a canary upgrade is soaking
+	canaryPod string
+	// pinnedImage is the image the shards other than the one of the canary keep meanwhile
+	pinnedImage string
+	// configChecksum sums the configuration only applied when the server starts
+	configChecksum string
 }
 
-func NewGenerator(rcc *ReconcileClickHouseCluster, cc *clickhousev1.ClickHouseCluster) *Generator {
-	return &Generator{rcc: rcc, cc: cc}
+func NewGenerator(rcc *ReconcileClickHouseCluster, cc *clickhousev1.ClickHouseCluster, passwords map[string]string) *Generator {
+	return &Generator{rcc: rcc, cc: cc, passwords: passwords}
 }
 
 func (g *Generator) labelsForStatefulSet(shardID int, chcLabels map[string]string) map[string]string {
@@ -107,7 +121,7 @@ func (g *Generator) PspRoleBindingName() string {
 	return fmt.Sprintf("psp-%s", g.cc.Name)
 }
 
-func (g *Generator) userConfigMapName() string {
+func (g *Generator) userSecretName() string {
 	return fmt.Sprintf("%s-user-config", g.cc.Name)
 }
 
@@ -115,10 +129,23 @@ func (g *Generator) volumeClaimName() string {
 	return fmt.Sprintf("%s-volume-claim", g.cc.Name)
 }
 
+func (g *Generator) diskVolumeClaimName(disk string) string {
+	return fmt.Sprintf("%s-volume-claim-%s", g.cc.Name, disk)
+}
+
+func (g *Generator) logVolumeClaimName() string {
+	return fmt.Sprintf("%s-log-claim", g.cc.Name)
+}
+
 func (g *Generator) statefulSetName(shardID int) string {
 	return fmt.Sprintf("%s-%d", g.cc.Name, shardID)
 }
 
+// replicaName is the {replica} macro of a replica, the name of its pod
+func (g *Generator) replicaName(shardID, replicaID int) string {
+	return fmt.Sprintf("%s-%d", g.statefulSetName(shardID), replicaID)
+}
+
 func (g *Generator) serviceName(shardID int) string {
 	return g.statefulSetName(shardID)
 }
@@ -131,9 +158,8 @@ func (g *Generator) FQDN(shardID, replicasID int, namespace string) string {
 
 func (g *Generator) FQDNs() []string {
 	hosts := make([]string, 0)
-	shards := make([]Shard, g.cc.Spec.ShardsCount)
-	for i := range shards {
-		for j := 0; j < int(g.cc.Spec.ReplicasCount); j++ {
+	for i := 0; i < int(g.cc.Spec.ShardsCount); i++ {
+		for j := 0; j < int(g.cc.Spec.ShardReplicasCount(i)); j++ {
 			host := g.FQDN(i, j, g.cc.Namespace)
 			hosts = append(hosts, host)
 		}
@@ -144,18 +170,29 @@ func (g *Generator) FQDNs() []string {
 func (g *Generator) generateRemoteServersXML() string {
 	shards := make([]Shard, g.cc.Spec.ShardsCount)
 	for i := range shards {
-		replicas := make([]Replica, g.cc.Spec.ReplicasCount)
+		replicas := make([]Replica, g.cc.Spec.ShardReplicasCount(i))
 		for j := range replicas {
 			replicas[j].Host = g.FQDN(i, j, g.cc.Namespace)
 			replicas[j].Port = chDefaultClientPortNumber
-			for user, password := range g.getUserAndPassword() {
-				replicas[j].User = user
-				replicas[j].Password = password
-			}
+			replicas[j].User, replicas[j].Password = g.operatorCredential()
 		}
+		shards[i].Weight = int(g.cc.Spec.ShardWeight(i))
 		shards[i].InternalReplication = false
 		shards[i].Replica = replicas
 	}
+	// the shards being drained are still read from but no more written to
+	for _, removed := range g.removedShards {
+		if removed.Drained {
+			continue
+		}
+		replicas := make([]Replica, removed.Replicas)
+		for j := range replicas {
+			replicas[j].Host = g.FQDN(removed.ID, j, g.cc.Namespace)
+			replicas[j].Port = chDefaultClientPortNumber
+			replicas[j].User, replicas[j].Password = g.operatorCredential()
+		}
+		shards = append(shards, Shard{Weight: 0, InternalReplication: false, Replica: replicas})
+	}
 
 	servers := RemoteServers{RemoteServer: map[string]Cluster{
 		g.cc.Name: {shards},
@@ -163,47 +200,56 @@ func (g *Generator) generateRemoteServersXML() string {
 	return ParseXML(servers)
 }
 
-func (g *Generator) getUserAndPassword() map[string]string {
-	return decodeUsersXML(g.cc.Spec.Users)
+// operatorCredential returns the user and password the operator connects to ClickHouse with
+func (g *Generator) operatorCredential() (string, string) {
+	user := OperatorUser(g.cc)
+	if user == nil {
+		return "", ""
+	}
+	return user.Name, g.passwords[user.Name]
 }
 
 func (g *Generator) generateZookeeperXML() string {
+	config := zookeeperConfig(g.cc)
 	// no zookeeper specified
-	if g.cc.Spec.Zookeeper == nil {
+	if config == nil {
 		return "<yandex></yandex>"
 	}
-	for _, node := range g.cc.Spec.Zookeeper.Nodes {
+	for _, node := range config.Nodes {
 		if "" == node.Host {
 			logrus.Debug("node in zookeeper is null, skip to create zookeeper.xml")
 			return "<yandex></yandex>"
 		}
 	}
-	zk := Zookeeper{Zookeeper: g.cc.Spec.Zookeeper}
+	zk := Zookeeper{Zookeeper: config}
 	return ParseXML(zk)
 }
 
 func (g *Generator) generateSettingsXML() string {
-	//settings := g.cc.Spec.CustomSettings
-	//settings = strings.TrimSpace(settings)
-	//if strings.Contains(settings, "<disable_internal_dns_cache>1</disable_internal_dns_cache>") != true {
-	//	settings = strings.Trim(settings, "</yandex>")
-	//	settings = strings.Trim(settings, "<yandex>")
-	//	settings = "<yandex>" + "\n\t<disable_internal_dns_cache>1</disable_internal_dns_cache> " + settings + "</yandex>"
-	//}
-	//return fmt.Sprint(settings)
-	return g.cc.Spec.CustomSettings
+	tree, err := buildSettingsTree(g.cc.Spec.Settings)
+	if err != nil {
+		// settings are validated before generating, should never happen
+		logrus.WithFields(logrus.Fields{"err": err}).Error("build settings error")
+		return "<yandex></yandex>"
+	}
+	return ParseXML(tree)
 }
 
 func (g *Generator) generateAllMacrosJson() string {
 	macros := make(map[string]string)
 	var shardsCount = int(g.cc.Spec.ShardsCount)
-	var replicasCount = int(g.cc.Spec.ReplicasCount)
 	for i := 0; i < shardsCount; i++ {
-		for j := 0; j < replicasCount; j++ {
-			replica := fmt.Sprintf("%s-%d", g.statefulSetName(i), j)
+		for j := 0; j < int(g.cc.Spec.ShardReplicasCount(i)); j++ {
+			replica := g.replicaName(i, j)
 			macros[replica] = fmt.Sprintf(macrosTemplate, g.cc.Name, i, replica)
 		}
 	}
+	for _, removed := range g.removedShards {
+		for j := 0; j < int(removed.Replicas); j++ {
+			replica := g.replicaName(removed.ID, j)
+			macros[replica] = fmt.Sprintf(macrosTemplate, g.cc.Name, removed.ID, replica)
+		}
+	}
 	out, err := json.MarshalIndent(macros, " ", "")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{"err": err}).Error("Marshal error")
@@ -212,17 +258,42 @@ func (g *Generator) generateAllMacrosJson() string {
 	return string(out)
 }
 
-func (g *Generator) generateUsersXMl() string {
-	return g.cc.Spec.Users
-}
+func (g *Generator) generateUsersXML() string {
+	var b strings.Builder
+	b.WriteString("<yandex>\n    <users>")
+	for _, user := range g.cc.Spec.Users {
+		sum := sha256.Sum256([]byte(g.passwords[user.Name]))
+		networks := user.Networks
+		if len(networks) == 0 {
+			networks = []string{defaultUserNetwork}
+		}
+		profile, quota := user.Profile, user.Quota
+		if profile == "" {
+			profile = defaultUserProfile
+		}
+		if quota == "" {
+			quota = defaultUserQuota
+		}
+		accessManagement := 0
+		if user.AccessManagement {
+			accessManagement = 1
+		}
 
-func (g *Generator) getPassword() string {
-	pwd, _ := regexp.Compile(`<password>(.*)</password>`)
-	out := pwd.FindAllStringSubmatch(g.cc.Spec.Users, -1)
-	if len(out) > 0 {
-		return out[0][1]
+		// replace the user as a whole, otherwise the password of the built-in default user is kept
+		fmt.Fprintf(&b, "\n        <%s replace=\"replace\">", user.Name)
+		fmt.Fprintf(&b, "\n            <password_sha256_hex>%s</password_sha256_hex>", hex.EncodeToString(sum[:]))
+		b.WriteString("\n            <networks>")
+		for _, network := range networks {
+			fmt.Fprintf(&b, "\n                <ip>%s</ip>", network)
+		}
+		b.WriteString("\n            </networks>")
+		fmt.Fprintf(&b, "\n            <profile>%s</profile>", profile)
+		fmt.Fprintf(&b, "\n            <quota>%s</quota>", quota)
+		fmt.Fprintf(&b, "\n            <access_management>%d</access_management>", accessManagement)
+		fmt.Fprintf(&b, "\n        </%s>", user.Name)
 	}
-	return ""
+	b.WriteString("\n    </users>\n</yandex>")
+	return b.String()
 }
 
 func (g *Generator) GenerateRoleBinding() *rbacv1.RoleBinding {
@@ -251,10 +322,10 @@ func (g *Generator) GenerateRoleBinding() *rbacv1.RoleBinding {
 func (g *Generator) GenerateCommonConfigMap() *corev1.ConfigMap {
 
 	data := map[string]string{
-		filenameRemoteServersXML: g.generateRemoteServersXML(),
-		filenameAllMacrosJSON:    g.generateAllMacrosJson(),
-		filenameSettingsXML:      g.generateSettingsXML(),
-		filenameZookeeperXML:     g.generateZookeeperXML(),
+		filenameAllMacrosJSON: g.generateAllMacrosJson(),
+		filenameSettingsXML:   g.generateSettingsXML(),
+		filenameZookeeperXML:  g.generateZookeeperXML(),
+		filenameStorageXML:    g.generateStorageXML(),
 	}
 	for filename, content := range g.rcc.defaultConfig.GetDefaultXMLConfig() {
 		data[filename] = content
@@ -272,27 +343,26 @@ func (g *Generator) GenerateCommonConfigMap() *corev1.ConfigMap {
 	}
 }
 
-func (g *Generator) generateUserConfigMap() *corev1.ConfigMap {
-	data := map[string]string{
-		filenameUsersXML: g.generateUsersXMl(),
+func (g *Generator) generateUserSecret() *corev1.Secret {
+	data := map[string][]byte{
+		filenameUsersXML:         []byte(g.generateUsersXML()),
+		filenameRemoteServersXML: []byte(g.generateRemoteServersXML()),
 	}
-	return &corev1.ConfigMap{
+	return &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:            g.userConfigMapName(),
+			Name:            g.userSecretName(),
 			Namespace:       g.cc.Namespace,
 			Labels:          g.labelsForCluster(),
 			OwnerReferences: g.ownerReference(),
-			Annotations: map[string]string{
-				"password": g.getPassword(),
-			},
 		},
-		// Data contains several sections which are to be several xml chopConfig files
+		// Data contains users.xml and remote_servers.xml, they are kept in a Secret as they have the password
+		// hashes and the password of the operator user. remote_servers.xml is projected into config.d.
 		Data: data,
 	}
 }
 
 func (g *Generator) generateCommonService() *corev1.Service {
-	return &corev1.Service{
+	service := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            g.commonServiceName(),
 			Namespace:       g.cc.Namespace,
@@ -301,36 +371,82 @@ func (g *Generator) generateCommonService() *corev1.Service {
 		},
 		Spec: corev1.ServiceSpec{
 			// ClusterIP: templateDefaultsServiceClusterIP,
-			Ports: []corev1.ServicePort{
-				{
-					Name:     chDefaultHTTPPortName,
-					Port:     chDefaultHTTPPortNumber,
-					Protocol: "TCP",
-					TargetPort: intstr.IntOrString{
-						IntVal: chDefaultHTTPPortNumber,
-					},
-				},
-				{
-					Name:     chDefaultClientPortName,
-					Port:     chDefaultClientPortNumber,
-					Protocol: "TCP",
-					TargetPort: intstr.IntOrString{
-						IntVal: chDefaultClientPortNumber,
-					},
-				},
-				{
-					Name:     chDefaultExporterPortName,
-					Port:     chDefaultExporterPortNumber,
-					Protocol: "TCP",
-					TargetPort: intstr.IntOrString{
-						IntVal: chDefaultExporterPortNumber,
-					},
-				},
+			Ports:           g.commonServicePorts(),
+			Selector:        g.labelsForCluster(),
+			SessionAffinity: "None",
+			Type:            corev1.ServiceTypeClusterIP,
+		},
+	}
+
+	spec := g.cc.Spec.Service
+	if spec == nil {
+		return service
+	}
+	if len(spec.Annotations) > 0 {
+		service.Annotations = make(map[string]string, len(spec.Annotations)+1)
+		for k, v := range spec.Annotations {
+			service.Annotations[k] = v
+		}
+		service.Annotations[ManagedAnnotationsKey] = strings.Join(sortedKeys(spec.Annotations), ",")
+	}
+	if spec.Type != "" {
+		service.Spec.Type = spec.Type
+	}
+	if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		service.Spec.LoadBalancerSourceRanges = spec.LoadBalancerSourceRanges
+	}
+	if service.Spec.Type == corev1.ServiceTypeNodePort || service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		// defaulted by the API server otherwise, which would look like a change at every reconcile
+		service.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyTypeCluster
+		if spec.ExternalTrafficPolicy != "" {
+			service.Spec.ExternalTrafficPolicy = spec.ExternalTrafficPolicy
+		}
+	}
+	return service
+}
+
+// commonServicePorts returns the ports selected by spec.service, all the ports of ClickHouse by default
+func (g *Generator) commonServicePorts() []corev1.ServicePort {
+	ports := []corev1.ServicePort{
+		{
+			Name:     chDefaultHTTPPortName,
+			Port:     chDefaultHTTPPortNumber,
+			Protocol: "TCP",
+			TargetPort: intstr.IntOrString{
+				IntVal: chDefaultHTTPPortNumber,
+			},
+		},
+		{
+			Name:     chDefaultClientPortName,
+			Port:     chDefaultClientPortNumber,
+			Protocol: "TCP",
+			TargetPort: intstr.IntOrString{
+				IntVal: chDefaultClientPortNumber,
+			},
+		},
+		{
+			Name:     chDefaultExporterPortName,
+			Port:     chDefaultExporterPortNumber,
+			Protocol: "TCP",
+			TargetPort: intstr.IntOrString{
+				IntVal: chDefaultExporterPortNumber,
 			},
-			Selector: g.labelsForCluster(),
-			Type:     "ClusterIP",
 		},
 	}
+	if g.cc.Spec.Service == nil || len(g.cc.Spec.Service.Ports) == 0 {
+		return ports
+	}
+
+	selected := make([]corev1.ServicePort, 0, len(g.cc.Spec.Service.Ports))
+	for _, port := range g.cc.Spec.Service.Ports {
+		for _, p := range ports {
+			if p.Name == port.Name {
+				p.NodePort = port.NodePort
+				selected = append(selected, p)
+			}
+		}
+	}
+	return selected
 }
 
 func (g *Generator) generateShardService(shardID int, statefulset *appsv1.StatefulSet) *corev1.Service {
@@ -382,6 +498,14 @@ func (g *Generator) generateShardService(shardID int, statefulset *appsv1.Statef
 	}
 }
 
+// shardImage returns the image of the pods of the shard
+func (g *Generator) shardImage(shardID int) string {
+	if g.pinnedImage != "" && shardID != canaryShardID {
+		return g.pinnedImage
+	}
+	return g.cc.Spec.Image
+}
+
 func (g *Generator) setupStatefulSetPodTemplate(statefulset *appsv1.StatefulSet, shardID int) {
 	statefulset.Spec.Template = corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
@@ -393,12 +517,22 @@ func (g *Generator) setupStatefulSetPodTemplate(statefulset *appsv1.StatefulSet,
 		Volumes:       []corev1.Volume{},
 		RestartPolicy: "Always",
 	}
+	resources := g.cc.Spec.ShardResources(shardID)
 	if g.cc.Spec.Pod != nil {
-		statefulset.Spec.Template.Annotations = g.cc.Spec.Pod.Annotations
+		statefulset.Spec.Template.Annotations = make(map[string]string, len(g.cc.Spec.Pod.Annotations))
+		for k, v := range g.cc.Spec.Pod.Annotations {
+			statefulset.Spec.Template.Annotations[k] = v
+		}
 		statefulset.Spec.Template.Spec.Tolerations = g.cc.Spec.Pod.Tolerations
 		statefulset.Spec.Template.Spec.Affinity = g.cc.Spec.Pod.Affinity
-		statefulset.Spec.Template.Spec.NodeSelector = g.cc.Spec.Pod.NodeSelector
 	}
+	if g.configChecksum != "" {
+		if statefulset.Spec.Template.Annotations == nil {
+			statefulset.Spec.Template.Annotations = make(map[string]string)
+		}
+		statefulset.Spec.Template.Annotations[ConfigChecksumAnnotationKey] = g.configChecksum
+	}
+	statefulset.Spec.Template.Spec.NodeSelector = g.cc.Spec.ShardNodeSelector(shardID)
 	statefulset.Spec.Template.Spec.InitContainers = []corev1.Container{
 		{
 			Name:  InitContainerName,
@@ -420,7 +554,7 @@ func (g *Generator) setupStatefulSetPodTemplate(statefulset *appsv1.StatefulSet,
 	statefulset.Spec.Template.Spec.Containers = []corev1.Container{
 		{
 			Name:  ClickHouseContainerName,
-			Image: g.cc.Spec.Image,
+			Image: g.shardImage(shardID),
 			Env: []corev1.EnvVar{
 				{
 					Name: "POD_NAME",
@@ -468,8 +602,8 @@ func (g *Generator) setupStatefulSetPodTemplate(statefulset *appsv1.StatefulSet,
 				},
 			},
 			Resources: corev1.ResourceRequirements{
-				Requests: generateResourceList(g.cc.Spec.Resources.Requests),
-				Limits:   generateResourceList(g.cc.Spec.Resources.Limits),
+				Requests: generateResourceList(resources.Requests),
+				Limits:   generateResourceList(resources.Limits),
 			},
 		},
 	}
@@ -477,9 +611,9 @@ func (g *Generator) setupStatefulSetPodTemplate(statefulset *appsv1.StatefulSet,
 	// Add all ConfigMap objects as Volume objects of type ConfigMap
 	statefulset.Spec.Template.Spec.Volumes = append(
 		statefulset.Spec.Template.Spec.Volumes,
-		newVolumeForConfigMap(g.commonConfigMapName()),
+		newVolumeForConfig(g.commonConfigMapName(), g.userSecretName(), filenameRemoteServersXML),
 		newVolumeForEmptyDir(g.marosEmptyDirName()),
-		newVolumeForConfigMap(g.userConfigMapName()),
+		newVolumeForSecret(g.userSecretName(), filenameUsersXML),
 	)
 
 	// And reference these Volumes in each Container via VolumeMount
@@ -495,7 +629,7 @@ func (g *Generator) setupStatefulSetPodTemplate(statefulset *appsv1.StatefulSet,
 			container.VolumeMounts,
 			newVolumeMount(g.commonConfigMapName(), dirPathConfigd),
 			newVolumeMount(g.marosEmptyDirName(), dirPathConfd),
-			newVolumeMount(g.userConfigMapName(), dirPathUsersd),
+			newVolumeMount(g.userSecretName(), dirPathUsersd),
 		)
 	}
 
@@ -507,41 +641,49 @@ func (g *Generator) setupStatefulSetPodTemplate(statefulset *appsv1.StatefulSet,
 			container.VolumeMounts,
 			newVolumeMount(g.commonConfigMapName(), dirPathConfigd),
 			newVolumeMount(g.marosEmptyDirName(), dirPathConfd),
-			//newVolumeMount(g.userConfigMapName(), dirPathUsersd),
+			//newVolumeMount(g.userSecretName(), dirPathUsersd),
 		)
 	}
 }
 
-func (g *Generator) setupStatefulSetVolumeClaimTemplates(statefulSet *appsv1.StatefulSet, dataStorageClass, dataCapacity string) {
-	quantity, _ := resource.ParseQuantity(dataCapacity)
-	statefulSet.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{
-		{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: g.volumeClaimName(),
-			},
-			Spec: corev1.PersistentVolumeClaimSpec{
-				AccessModes:      []corev1.PersistentVolumeAccessMode{"ReadWriteOnce"},
-				StorageClassName: &dataStorageClass,
-				Resources: corev1.ResourceRequirements{
-					Requests: corev1.ResourceList{
-						corev1.ResourceStorage: quantity,
-					},
-				},
-			},
-		},
+func (g *Generator) setupStatefulSetVolumeClaimTemplates(statefulSet *appsv1.StatefulSet, shardID int) {
+	var claims []corev1.PersistentVolumeClaim
+	var mounts []corev1.VolumeMount
+	addClaim := func(claim corev1.PersistentVolumeClaim, mountPath string) {
+		claims = append(claims, claim)
+		mounts = append(mounts, newVolumeMount(claim.Name, mountPath))
 	}
 
+	if volumes := g.cc.Spec.DataVolumes(); len(volumes) > 0 {
+		// the first volume is the default disk, it keeps the claim name of the single data volume
+		addClaim(newPersistentVolumeClaim(g.volumeClaimName(), volumes[0].StorageClass, volumes[0].Capacity), dirPathData)
+		for _, volume := range volumes[1:] {
+			addClaim(newPersistentVolumeClaim(g.diskVolumeClaimName(volume.Name), volume.StorageClass, volume.Capacity),
+				diskPath(volume.Name))
+		}
+	} else if g.cc.Spec.DataStorageClass != "" {
+		addClaim(newPersistentVolumeClaim(g.volumeClaimName(), g.cc.Spec.DataStorageClass,
+			g.cc.Spec.ShardDataCapacity(shardID)), dirPathData)
+	}
+	if g.cc.Spec.Storage != nil && g.cc.Spec.Storage.Log != nil {
+		log := g.cc.Spec.Storage.Log
+		addClaim(newPersistentVolumeClaim(g.logVolumeClaimName(), log.StorageClass, log.Capacity), dirPathLog)
+	}
+	if len(claims) == 0 {
+		return
+	}
+
+	statefulSet.Spec.VolumeClaimTemplates = claims
 	for i := range statefulSet.Spec.Template.Spec.Containers {
 		// Convenience wrapper
 		container := &statefulSet.Spec.Template.Spec.Containers[i]
-		container.VolumeMounts = append(container.VolumeMounts, newVolumeMount(g.volumeClaimName(), dirPathData))
+		container.VolumeMounts = append(container.VolumeMounts, mounts...)
 	}
-
 }
 
 func (g *Generator) generateStatefulSet(shardID int) *appsv1.StatefulSet {
 	// Create apps.StatefulSet object
-	replicasNum := g.cc.Spec.ReplicasCount
+	replicasNum := g.cc.Spec.ShardReplicasCount(shardID)
 	// StatefulSet has additional label - ZK config fingerprint
 	statefulSet := &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
@@ -558,6 +700,10 @@ func (g *Generator) generateStatefulSet(shardID int) *appsv1.StatefulSet {
 				MatchLabels: g.labelsForStatefulSet(shardID, g.cc.Labels),
 			},
 			ServiceName: g.serviceName(shardID),
+			// the pods are restarted by the operator one at a time, see rollShard
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type: appsv1.OnDeleteStatefulSetStrategyType,
+			},
 			// IMPORTANT
 			// VolumeClaimTemplates are to be setup later
 			VolumeClaimTemplates: nil,
@@ -569,8 +715,15 @@ func (g *Generator) generateStatefulSet(shardID int) *appsv1.StatefulSet {
 	}
 
 	g.setupStatefulSetPodTemplate(statefulSet, shardID)
-	if g.cc.Spec.DataStorageClass != "" {
-		g.setupStatefulSetVolumeClaimTemplates(statefulSet, g.cc.Spec.DataStorageClass, g.cc.Spec.DataCapacity)
+	g.setupStatefulSetVolumeClaimTemplates(statefulSet, shardID)
+	if g.cc.Spec.PodTemplate != nil {
+		template, err := applyPodTemplate(statefulSet.Spec.Template, g.cc.Spec.PodTemplate)
+		if err != nil {
+			// the pod template is validated before generating, should never happen
+			logrus.WithFields(logrus.Fields{"err": err}).Error("apply pod template error")
+		} else {
+			statefulSet.Spec.Template = template
+		}
 	}
 
 	return statefulSet
@@ -631,6 +784,54 @@ func newVolumeForConfigMap(name string) corev1.Volume {
 	}
 }
 
+// newVolumeForConfig returns corev1.Volume object projecting the ConfigMap and the keys of the Secret,
+// the files with credentials are kept out of the ConfigMap
+func newVolumeForConfig(configMapName, secretName string, keys ...string) corev1.Volume {
+	return corev1.Volume{
+		Name: configMapName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ConfigMap: &corev1.ConfigMapProjection{
+							LocalObjectReference: corev1.LocalObjectReference{Name: configMapName},
+						},
+					},
+					{
+						Secret: &corev1.SecretProjection{
+							LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+							Items:                keyToPaths(keys),
+						},
+					},
+				},
+				DefaultMode: &[]int32{420}[0],
+			},
+		},
+	}
+}
+
+// newVolumeForSecret returns corev1.Volume object with defined name, only the keys are mounted if any
+func newVolumeForSecret(name string, keys ...string) corev1.Volume {
+	return corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  name,
+				Items:       keyToPaths(keys),
+				DefaultMode: &[]int32{420}[0],
+			},
+		},
+	}
+}
+
+func keyToPaths(keys []string) []corev1.KeyToPath {
+	var items []corev1.KeyToPath
+	for _, key := range keys {
+		items = append(items, corev1.KeyToPath{Key: key, Path: key})
+	}
+	return items
+}
+
 func newVolumeForEmptyDir(name string) corev1.Volume {
 	return corev1.Volume{
 		Name: name,
@@ -3,7 +3,10 @@ package clickhousecluster
 import (
 	v1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
 	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -25,12 +28,17 @@ func (g *GeneratorTestSuite) SetupTest() {
 		},
 		Status: v1.ClickHouseClusterStatus{},
 	}
-	g.g = NewGenerator(nil, chc)
+	chc.Spec.Users = defaultUsers(chc)
+	g.g = NewGenerator(nil, chc, map[string]string{"default": "fackpassword"})
 }
 
 func (g *GeneratorTestSuite) TestGenerateRemoteServersXML() {
 	out := g.g.generateRemoteServersXML()
 	g.T().Log(out)
+	// the password of the operator user is only kept in the Secret
+	if string(g.g.generateUserSecret().Data[filenameRemoteServersXML]) != out {
+		g.T().Fatal("remote_servers.xml is not in the user secret")
+	}
 }
 
 func (g *GeneratorTestSuite) TestGenerateAllMacrosJson() {
@@ -40,6 +48,253 @@ func (g *GeneratorTestSuite) TestGenerateAllMacrosJson() {
 	}
 }
 
+func (g *GeneratorTestSuite) TestGenerateUsersXML() {
+	out := g.g.generateUsersXML()
+	if strings.Contains(out, "fackpassword") {
+		g.T().Fatal("plaintext password in users.xml")
+	}
+	// sha256 of fackpassword
+	if !strings.Contains(out, "<password_sha256_hex>74b7c66cbfab211fea7f86f36ebced9d420e7d147de6955e3fba6a4bd7f2a4db</password_sha256_hex>") {
+		g.T().Fatal("password hash not found in users.xml")
+	}
+}
+
+func (g *GeneratorTestSuite) TestGenerateSettingsXML() {
+	g.g.cc.Spec.Settings = map[string]v1.SettingValue{
+		"merge_tree/parts_to_throw_insert": "600",
+		"max_concurrent_queries":           "100",
+	}
+	out := g.g.generateSettingsXML()
+	if !strings.Contains(out, "<parts_to_throw_insert>600</parts_to_throw_insert>") ||
+		!strings.Contains(out, "<max_concurrent_queries>100</max_concurrent_queries>") {
+		g.T().Fatal("generate settings error: " + out)
+	}
+}
+
+func (g *GeneratorTestSuite) TestShardOverrides() {
+	g.g.cc.Spec.Shards = []v1.ShardSpec{
+		{ID: 1, ReplicasCount: 1, Weight: 2, NodeSelector: map[string]string{"disk": "ssd"}},
+	}
+	if hosts := g.g.FQDNs(); len(hosts) != 4 {
+		g.T().Fatalf("expect 4 hosts, got %d", len(hosts))
+	}
+	if !strings.Contains(g.g.generateRemoteServersXML(), "<weight>2</weight>") {
+		g.T().Fatal("shard weight not found in remote_servers")
+	}
+	if strings.Contains(g.g.generateAllMacrosJson(), "fack-1-1") {
+		g.T().Fatal("unexpected replica fack-1-1 in macros")
+	}
+	sts := g.g.generateStatefulSet(1)
+	if *sts.Spec.Replicas != 1 || sts.Spec.Template.Spec.NodeSelector["disk"] != "ssd" {
+		g.T().Fatal("shard overrides not applied to statefulset")
+	}
+	if sts = g.g.generateStatefulSet(0); *sts.Spec.Replicas != 3 {
+		g.T().Fatal("shard 0 should keep the cluster-wide replicas count")
+	}
+
+	// the shards other than the one of the canary keep their image while it soaks
+	g.g.cc.Spec.Image, g.g.pinnedImage = "clickhouse-server:20.3", "clickhouse-server:19.16"
+	if image := g.g.generateStatefulSet(1).Spec.Template.Spec.Containers[0].Image; image != "clickhouse-server:19.16" {
+		g.T().Fatalf("expect the image of shard 1 to be pinned, got %s", image)
+	}
+	if image := g.g.generateStatefulSet(0).Spec.Template.Spec.Containers[0].Image; image != "clickhouse-server:20.3" {
+		g.T().Fatalf("expect the canary shard to get the new image, got %s", image)
+	}
+	g.g.pinnedImage = ""
+}
+
+func (g *GeneratorTestSuite) TestStorage() {
+	g.g.cc.Spec.Storage = &v1.StorageSpec{
+		Volumes: []v1.StorageVolume{
+			{Name: "default", StorageClass: "ssd", Capacity: "10Gi"},
+			{Name: "cold", StorageClass: "hdd", Capacity: "100Gi"},
+		},
+		Policies: []v1.StoragePolicy{{
+			Name: "hot_cold",
+			Volumes: []v1.StoragePolicyVolume{
+				{Name: "hot", Disks: []string{"default"}},
+				{Name: "cold", Disks: []string{"cold"}},
+			},
+			MoveFactor: "0.2",
+		}},
+		Log: &v1.StorageVolume{Capacity: "1Gi"},
+	}
+	if err := validateStorage(g.g.cc); err != nil {
+		g.T().Fatal(err)
+	}
+	out := g.g.generateStorageXML()
+	if !strings.Contains(out, "<path>/var/lib/clickhouse-disks/cold/</path>") ||
+		!strings.Contains(out, "<move_factor>0.2</move_factor>") ||
+		strings.Index(out, "<disk>default</disk>") > strings.Index(out, "<disk>cold</disk>") {
+		g.T().Fatal("generate storage error: " + out)
+	}
+
+	sts := g.g.generateStatefulSet(0)
+	if len(sts.Spec.VolumeClaimTemplates) != 3 {
+		g.T().Fatalf("expect 3 volume claims, got %d", len(sts.Spec.VolumeClaimTemplates))
+	}
+	mounts := make(map[string]string)
+	for _, mount := range sts.Spec.Template.Spec.Containers[0].VolumeMounts {
+		mounts[mount.MountPath] = mount.Name
+	}
+	if mounts[dirPathData] != "fack-volume-claim" || mounts[dirPathLog] != "fack-log-claim" ||
+		mounts["/var/lib/clickhouse-disks/cold/"] != "fack-volume-claim-cold" {
+		g.T().Fatalf("unexpected volume mounts %v", mounts)
+	}
+
+	g.g.cc.Spec.Storage.Policies[0].Volumes[1].Disks = []string{"warm"}
+	if err := validateStorage(g.g.cc); err == nil {
+		g.T().Fatal("unknown disk is allowed")
+	}
+}
+
+func (g *GeneratorTestSuite) TestPodTemplate() {
+	g.g.cc.Spec.Image = "clickhouse-server:19.16"
+	g.g.cc.Spec.PodTemplate = &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			PriorityClassName:  "high",
+			ServiceAccountName: "clickhouse",
+			Containers: []corev1.Container{
+				{Name: ClickHouseContainerName, Image: "other", Env: []corev1.EnvVar{{Name: "TZ", Value: "UTC"}}},
+				{Name: "sidecar", Image: "busybox"},
+			},
+			Volumes: []corev1.Volume{
+				{Name: "extra", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+				{Name: g.g.commonConfigMapName(), VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			},
+		},
+	}
+	if err := validatePodTemplate(g.g.cc); err != nil {
+		g.T().Fatal(err)
+	}
+
+	spec := g.g.generateStatefulSet(0).Spec.Template.Spec
+	if spec.PriorityClassName != "high" || spec.ServiceAccountName != "clickhouse" {
+		g.T().Fatal("pod settings not applied")
+	}
+	if len(spec.Containers) != 2 || len(spec.InitContainers) != 1 || len(spec.Volumes) != 4 {
+		g.T().Fatalf("unexpected containers or volumes: %v", spec)
+	}
+	clickhouse := spec.Containers[0]
+	if clickhouse.Image != "clickhouse-server:19.16" || clickhouse.ReadinessProbe == nil || len(clickhouse.Env) != 2 {
+		g.T().Fatalf("generated container not kept: %v", clickhouse)
+	}
+	for _, volume := range spec.Volumes {
+		if volume.Name == g.g.commonConfigMapName() && (volume.Projected == nil ||
+			volume.Projected.Sources[1].Secret.Items[0].Key != filenameRemoteServersXML) {
+			g.T().Fatal("generated volume overridden")
+		}
+		if volume.Name == g.g.userSecretName() && len(volume.Secret.Items) != 1 {
+			g.T().Fatal("remote_servers.xml mounted into users.d")
+		}
+	}
+}
+
+func (g *GeneratorTestSuite) TestCommonService() {
+	g.g.cc.Spec.Service = &v1.ServiceSpec{
+		Type:                     corev1.ServiceTypeLoadBalancer,
+		Annotations:              map[string]string{"lb": "internal"},
+		LoadBalancerSourceRanges: []string{"10.0.0.0/8"},
+		Ports:                    []v1.ServicePort{{Name: "client"}},
+		ExternalTrafficPolicy:    corev1.ServiceExternalTrafficPolicyTypeLocal,
+	}
+	if err := validateService(g.g.cc); err != nil {
+		g.T().Fatal(err)
+	}
+	service := g.g.generateCommonService()
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer || len(service.Spec.Ports) != 1 ||
+		service.Spec.Ports[0].Port != chDefaultClientPortNumber || service.Annotations["lb"] != "internal" {
+		g.T().Fatalf("spec.service not applied: %v", service)
+	}
+
+	// the allocated fields are kept
+	cur := service.DeepCopy()
+	cur.Spec.ClusterIP = "10.96.0.10"
+	cur.Spec.Ports[0].NodePort = 30900
+	cur.Spec.HealthCheckNodePort = 31000
+	cur.Annotations["cloud"] = "set-by-cloud"
+	service = g.g.generateCommonService()
+	preserveServiceFields(cur, service)
+	if !reflect.DeepEqual(cur.Spec, service.Spec) || service.Annotations["cloud"] != "set-by-cloud" {
+		g.T().Fatalf("allocated fields not kept: %v", service)
+	}
+
+	// the annotations removed from the spec are removed, the others are kept
+	cur = service.DeepCopy()
+	g.g.cc.Spec.Service.Annotations = map[string]string{"team": "data"}
+	service = g.g.generateCommonService()
+	preserveServiceFields(cur, service)
+	expected := map[string]string{"cloud": "set-by-cloud", "team": "data", ManagedAnnotationsKey: "team"}
+	if !reflect.DeepEqual(service.Annotations, expected) {
+		g.T().Fatalf("expect the annotations %v, got %v", expected, service.Annotations)
+	}
+
+	g.g.cc.Spec.Service.Type = corev1.ServiceTypeClusterIP
+	if err := validateService(g.g.cc); err == nil {
+		g.T().Fatal("loadBalancerSourceRanges is allowed on a ClusterIP service")
+	}
+}
+
+func (g *GeneratorTestSuite) TestKeeper() {
+	g.g.cc.Spec.Keeper = &v1.KeeperSpec{Replicas: 3, Storage: &v1.StorageVolume{Capacity: "1Gi"}}
+	if err := validateKeeper(g.g.cc); err != nil {
+		g.T().Fatal(err)
+	}
+	if err := validateZookeeper(g.g.cc); err != nil {
+		g.T().Fatal("replicas are not allowed with keeper: ", err)
+	}
+	if out := g.g.generateZookeeperXML(); !strings.Contains(out, "<host>fack-keeper-2.fack-keeper.default.svc.cluster.local</host>") {
+		g.T().Fatal("keeper not found in zookeeper.xml: " + out)
+	}
+	if out := g.g.generateKeeperXML(); strings.Count(out, "<server>") != 3 || !strings.Contains(out, "<id>3</id>") {
+		g.T().Fatal("generate keeper config error: " + out)
+	}
+	sts := g.g.generateKeeperStatefulSet()
+	if *sts.Spec.Replicas != 3 || len(sts.Spec.VolumeClaimTemplates) != 1 || sts.Spec.Template.Labels[ClusterLabelKey] != "" {
+		g.T().Fatalf("unexpected keeper statefulset: %v", sts)
+	}
+	if pdb := g.g.generateKeeperPodDisruptionBudget(); pdb.Spec.MaxUnavailable.IntValue() != 1 {
+		g.T().Fatal("keeper PDB does not keep a quorum")
+	}
+
+	g.g.cc.Spec.Keeper.Replicas = 2
+	if err := validateKeeper(g.g.cc); err == nil {
+		g.T().Fatal("even keeper replicas are allowed")
+	}
+}
+
+func (g *GeneratorTestSuite) TestRemovedShards() {
+	g.g.removedShards = []removedShard{{ID: 2, Replicas: 1}, {ID: 3, Replicas: 1, Drained: true}}
+	out := g.g.generateRemoteServersXML()
+	if !strings.Contains(out, "<weight>0</weight>") || !strings.Contains(out, g.g.FQDN(2, 0, "default")) {
+		g.T().Fatal("the draining shard is not in remote_servers: " + out)
+	}
+	if strings.Contains(out, g.g.FQDN(3, 0, "default")) {
+		g.T().Fatal("the drained shard is still in remote_servers")
+	}
+	if !strings.Contains(g.g.generateAllMacrosJson(), "fack-3-0") {
+		g.T().Fatal("the macros of the drained shard are removed before its pods")
+	}
+
+	drainer := newShardDrainer(g.g, g.g.removedShards[0], nil)
+	if len(drainer.sources) != 1 || len(drainer.targets) != 2 || len(drainer.targets[0]) != 3 {
+		g.T().Fatalf("unexpected drainer %v %v", drainer.sources, drainer.targets)
+	}
+
+	// the tables whose copy has been started are not sent again
+	drainer = newShardDrainer(g.g, g.g.removedShards[0], []v1.DrainedTable{
+		{Name: "db.copied", Rows: 10, Copied: true},
+		{Name: "db.incomplete", Rows: 10, Error: "5 rows copied, 10 expected"},
+	})
+	if err := drainer.copyTable(drainer.sources[0], localTable{database: "db", name: "copied"}); err != nil {
+		g.T().Fatalf("the copied table is copied again: %v", err)
+	}
+	if err := drainer.copyTable(drainer.sources[0], localTable{database: "db", name: "incomplete"}); err == nil ||
+		err.Error() != "5 rows copied, 10 expected" {
+		g.T().Fatalf("the incomplete copy is not reported: %v", err)
+	}
+}
+
 func TestRunSuite(t *testing.T) {
 	suite.Run(t, new(GeneratorTestSuite))
 }
@@ -0,0 +1,388 @@
+package clickhousecluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The keeper ensemble of a cluster is a StatefulSet of clickhouse-keeper behind a headless Service.
+// Its pods do not have the label of the cluster, so they are never taken for ClickHouse replicas.
+// The server id of each replica is its ordinal plus one, read by the config from KEEPER_SERVER_ID.
+
+const (
+	KeeperLabelKey = "clickhouse-keeper"
+
+	KeeperContainerName = "clickhouse-keeper"
+
+	defaultKeeperImage    = "clickhouse/clickhouse-keeper:22.3"
+	defaultKeeperReplicas = 3
+
+	keeperClientPortName   = "client"
+	keeperClientPortNumber = 9181
+	keeperRaftPortName     = "raft"
+	keeperRaftPortNumber   = 9234
+
+	filenameKeeperXML = "keeper_config.xml"
+	dirPathKeeperConf = "/etc/clickhouse-keeper/"
+	dirPathKeeperData = "/var/lib/clickhouse-keeper/"
+)
+
+func (g *Generator) keeperName() string {
+	return fmt.Sprintf("%s-keeper", g.cc.Name)
+}
+
+func (g *Generator) keeperConfigMapName() string {
+	return fmt.Sprintf("%s-keeper-config", g.cc.Name)
+}
+
+func (g *Generator) keeperVolumeClaimName() string {
+	return fmt.Sprintf("%s-keeper-claim", g.cc.Name)
+}
+
+func (g *Generator) labelsForKeeper() map[string]string {
+	return keeperLabels(g.cc)
+}
+
+func keeperLabels(cc *clickhousev1.ClickHouseCluster) map[string]string {
+	return map[string]string{
+		CreateByLabelKey: OperatorLabelKey,
+		KeeperLabelKey:   cc.Name,
+	}
+}
+
+// keeperFQDN returns the address of a replica of the keeper ensemble
+func keeperFQDN(cc *clickhousev1.ClickHouseCluster, replicaID int) string {
+	name := fmt.Sprintf("%s-keeper", cc.Name)
+	return fmt.Sprintf("%s-%d.%s.%s.svc.cluster.local", name, replicaID, name, cc.Namespace)
+}
+
+// zookeeperConfig returns the zookeeper the replicas coordinate through, it is the keeper ensemble
+// deployed by the operator when spec.keeper is set
+func zookeeperConfig(cc *clickhousev1.ClickHouseCluster) *clickhousev1.ZookeeperConfig {
+	if cc.Spec.Keeper == nil {
+		return cc.Spec.Zookeeper
+	}
+	zk := &clickhousev1.ZookeeperConfig{
+		Root:               "/clickhouse/tables/" + cc.Namespace + "/" + cc.Name,
+		OperationTimeoutMs: defaultZookeeperOperationTimeoutMs,
+		SessionTimeoutMs:   defaultZookeeperSessionTimeoutMs,
+	}
+	for i := 0; i < int(cc.Spec.Keeper.Replicas); i++ {
+		zk.Nodes = append(zk.Nodes, clickhousev1.ZookeeperNode{Host: keeperFQDN(cc, i), Port: keeperClientPortNumber})
+	}
+	return zk
+}
+
+func (g *Generator) generateKeeperXML() string {
+	var b strings.Builder
+	b.WriteString("<yandex>")
+	b.WriteString("\n    <listen_host>0.0.0.0</listen_host>")
+	b.WriteString("\n    <logger>\n        <level>information</level>\n        <console>1</console>\n    </logger>")
+	b.WriteString("\n    <keeper_server>")
+	fmt.Fprintf(&b, "\n        <tcp_port>%d</tcp_port>", keeperClientPortNumber)
+	b.WriteString("\n        <server_id from_env=\"KEEPER_SERVER_ID\"/>")
+	fmt.Fprintf(&b, "\n        <log_storage_path>%scoordination/log</log_storage_path>", dirPathKeeperData)
+	fmt.Fprintf(&b, "\n        <snapshot_storage_path>%scoordination/snapshots</snapshot_storage_path>", dirPathKeeperData)
+	b.WriteString("\n        <coordination_settings>")
+	fmt.Fprintf(&b, "\n            <operation_timeout_ms>%d</operation_timeout_ms>", defaultZookeeperOperationTimeoutMs)
+	fmt.Fprintf(&b, "\n            <session_timeout_ms>%d</session_timeout_ms>", defaultZookeeperSessionTimeoutMs)
+	b.WriteString("\n            <raft_logs_level>information</raft_logs_level>")
+	b.WriteString("\n        </coordination_settings>")
+	b.WriteString("\n        <raft_configuration>")
+	for i := 0; i < int(g.cc.Spec.Keeper.Replicas); i++ {
+		b.WriteString("\n            <server>")
+		fmt.Fprintf(&b, "\n                <id>%d</id>", i+1)
+		fmt.Fprintf(&b, "\n                <hostname>%s</hostname>", keeperFQDN(g.cc, i))
+		fmt.Fprintf(&b, "\n                <port>%d</port>", keeperRaftPortNumber)
+		b.WriteString("\n            </server>")
+	}
+	b.WriteString("\n        </raft_configuration>")
+	b.WriteString("\n    </keeper_server>\n</yandex>")
+	return b.String()
+}
+
+func (g *Generator) generateKeeperConfigMap() *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            g.keeperConfigMapName(),
+			Namespace:       g.cc.Namespace,
+			Labels:          g.labelsForKeeper(),
+			OwnerReferences: g.ownerReference(),
+		},
+		Data: map[string]string{
+			filenameKeeperXML: g.generateKeeperXML(),
+		},
+	}
+}
+
+func (g *Generator) generateKeeperService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            g.keeperName(),
+			Namespace:       g.cc.Namespace,
+			Labels:          g.labelsForKeeper(),
+			OwnerReferences: g.ownerReference(),
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Name:       keeperClientPortName,
+					Port:       keeperClientPortNumber,
+					Protocol:   "TCP",
+					TargetPort: intstr.IntOrString{IntVal: keeperClientPortNumber},
+				},
+				{
+					Name:       keeperRaftPortName,
+					Port:       keeperRaftPortNumber,
+					Protocol:   "TCP",
+					TargetPort: intstr.IntOrString{IntVal: keeperRaftPortNumber},
+				},
+			},
+			Selector:        g.labelsForKeeper(),
+			ClusterIP:       "None",
+			SessionAffinity: "None",
+			Type:            "ClusterIP",
+			// the replicas must find each other before they are ready
+			PublishNotReadyAddresses: true,
+		},
+	}
+}
+
+func (g *Generator) generateKeeperStatefulSet() *appsv1.StatefulSet {
+	keeper := g.cc.Spec.Keeper
+	replicas := keeper.Replicas
+	resources := keeper.Resources
+	if resources.Limits == (clickhousev1.CPUAndMem{}) {
+		resources.Limits = resources.Requests
+	}
+
+	container := corev1.Container{
+		Name:  KeeperContainerName,
+		Image: keeper.Image,
+		Command: []string{"/bin/sh", "-c",
+			"export KEEPER_SERVER_ID=$((${HOSTNAME##*-}+1)) && " +
+				"exec clickhouse-keeper --config-file=" + dirPathKeeperConf + filenameKeeperXML},
+		Ports: []corev1.ContainerPort{
+			{Name: keeperClientPortName, ContainerPort: keeperClientPortNumber, Protocol: "TCP"},
+			{Name: keeperRaftPortName, ContainerPort: keeperRaftPortNumber, Protocol: "TCP"},
+		},
+		ReadinessProbe: &corev1.Probe{
+			Handler: corev1.Handler{
+				TCPSocket: &corev1.TCPSocketAction{Port: intstr.Parse(keeperClientPortName)},
+			},
+			InitialDelaySeconds: 10,
+			PeriodSeconds:       10,
+		},
+		Resources: corev1.ResourceRequirements{
+			Requests: generateResourceList(resources.Requests),
+			Limits:   generateResourceList(resources.Limits),
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			newVolumeMount(g.keeperConfigMapName(), dirPathKeeperConf),
+			newVolumeMount(g.keeperVolumeClaimName(), dirPathKeeperData),
+		},
+	}
+
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            g.keeperName(),
+			Namespace:       g.cc.Namespace,
+			Annotations:     make(map[string]string),
+			Labels:          g.labelsForKeeper(),
+			OwnerReferences: g.ownerReference(),
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: g.labelsForKeeper(),
+			},
+			ServiceName: g.keeperName(),
+			// a quorum is needed before any replica is ready, they are all started at once
+			PodManagementPolicy: appsv1.ParallelPodManagement,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: g.labelsForKeeper(),
+				},
+				Spec: corev1.PodSpec{
+					Containers:    []corev1.Container{container},
+					RestartPolicy: "Always",
+					Volumes: []corev1.Volume{
+						newVolumeForConfigMap(g.keeperConfigMapName()),
+					},
+				},
+			},
+		},
+	}
+	if g.cc.Spec.Pod != nil {
+		statefulSet.Spec.Template.Spec.Tolerations = g.cc.Spec.Pod.Tolerations
+		statefulSet.Spec.Template.Spec.NodeSelector = g.cc.Spec.Pod.NodeSelector
+	}
+
+	if keeper.Storage != nil {
+		statefulSet.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{
+			newPersistentVolumeClaim(g.keeperVolumeClaimName(), keeper.Storage.StorageClass, keeper.Storage.Capacity),
+		}
+	} else {
+		statefulSet.Spec.Template.Spec.Volumes = append(statefulSet.Spec.Template.Spec.Volumes,
+			newVolumeForEmptyDir(g.keeperVolumeClaimName()))
+	}
+	return statefulSet
+}
+
+// generateKeeperPodDisruptionBudget keeps a quorum of the ensemble during voluntary disruptions,
+// nil for a single replica which can not keep one anyway
+func (g *Generator) generateKeeperPodDisruptionBudget() *policyv1beta1.PodDisruptionBudget {
+	replicas := g.cc.Spec.Keeper.Replicas
+	if replicas < 3 {
+		return nil
+	}
+	maxUnavailable := intstr.FromInt(int((replicas - 1) / 2))
+	return &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            g.keeperName(),
+			Namespace:       g.cc.Namespace,
+			Labels:          g.labelsForKeeper(),
+			OwnerReferences: g.ownerReference(),
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MaxUnavailable: &maxUnavailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: g.labelsForKeeper(),
+			},
+		},
+	}
+}
+
+// validateKeeper checks the ensemble can keep a quorum and is the only zookeeper of the cluster
+func validateKeeper(cc *clickhousev1.ClickHouseCluster) error {
+	keeper := cc.Spec.Keeper
+	if keeper == nil {
+		return nil
+	}
+	if cc.Spec.Zookeeper != nil {
+		return errors.New("keeper and zookeeper can not be both set")
+	}
+	if keeper.Replicas < 1 || keeper.Replicas%2 == 0 {
+		return fmt.Errorf("keeper: replicas must be an odd number, got %d", keeper.Replicas)
+	}
+	if keeper.Storage != nil {
+		if _, err := resource.ParseQuantity(keeper.Storage.Capacity); err != nil {
+			return fmt.Errorf("keeper: invalid storage capacity: %v", err)
+		}
+	}
+	quantities := []string{keeper.Resources.Limits.Memory, keeper.Resources.Limits.CPU,
+		keeper.Resources.Requests.Memory, keeper.Resources.Requests.CPU}
+	for _, quantity := range quantities {
+		if quantity == "" {
+			continue
+		}
+		if _, err := resource.ParseQuantity(quantity); err != nil {
+			return fmt.Errorf("keeper: invalid resources: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateKeeperUpdate rejects the changes of the ensemble the Raft configuration can not follow and
+// switching between the keeper and an external zookeeper, which would lose the replication metadata
+func validateKeeperUpdate(old, cc *clickhousev1.ClickHouseCluster) error {
+	if old.Spec.Keeper == nil && cc.Spec.Keeper == nil {
+		return nil
+	}
+	if old.Spec.Keeper == nil {
+		if old.Spec.Zookeeper != nil {
+			return errors.New("zookeeper can not be replaced by keeper")
+		}
+		return nil
+	}
+	if cc.Spec.Keeper == nil {
+		return errors.New("keeper can not be removed")
+	}
+	if old.Spec.Keeper.Replicas != cc.Spec.Keeper.Replicas {
+		return fmt.Errorf("keeper replicas can not be changed from %d to %d",
+			old.Spec.Keeper.Replicas, cc.Spec.Keeper.Replicas)
+	}
+	oldStorage, newStorage := old.Spec.Keeper.Storage, cc.Spec.Keeper.Storage
+	if (oldStorage == nil) != (newStorage == nil) || (oldStorage != nil && *oldStorage != *newStorage) {
+		return errors.New("keeper storage can not be changed")
+	}
+	return nil
+}
+
+// reconcileKeeper creates or updates the keeper ensemble of the cluster
+func (r *ReconcileClickHouseCluster) reconcileKeeper(generator *Generator) error {
+	if _, err := r.reconcileConfigMap(generator.generateKeeperConfigMap()); err != nil {
+		return err
+	}
+	if err := r.reconcileService(generator.generateKeeperService()); err != nil {
+		return err
+	}
+	if err := r.reconcileKeeperStatefulSet(generator.generateKeeperStatefulSet()); err != nil {
+		return err
+	}
+	if pdb := generator.generateKeeperPodDisruptionBudget(); pdb != nil {
+		return r.reconcilePodDisruptionBudget(pdb)
+	}
+	return nil
+}
+
+func (r *ReconcileClickHouseCluster) reconcileKeeperStatefulSet(statefulSet *appsv1.StatefulSet) error {
+	var curStatefulSet appsv1.StatefulSet
+	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: statefulSet.Namespace, Name: statefulSet.Name}, &curStatefulSet)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			logrus.WithFields(logrus.Fields{
+				"statefulset": statefulSet.Name,
+				"namespace":   statefulSet.Namespace}).Info("Create keeper StatefulSet")
+			return r.client.Create(context.TODO(), statefulSet)
+		}
+		return err
+	}
+
+	if statefulSetsAreEqual(statefulSet, &curStatefulSet) {
+		logrus.Debug("no need to update keeper statefulset")
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"statefulSet": statefulSet.Name,
+		"namespace":   statefulSet.Namespace}).Info("Update keeper StatefulSet")
+	statefulSet.ResourceVersion = curStatefulSet.ResourceVersion
+	return r.client.Update(context.TODO(), statefulSet)
+}
+
+func (r *ReconcileClickHouseCluster) reconcilePodDisruptionBudget(pdb *policyv1beta1.PodDisruptionBudget) error {
+	var curPDB policyv1beta1.PodDisruptionBudget
+	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: pdb.Namespace, Name: pdb.Name}, &curPDB)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			logrus.WithFields(logrus.Fields{
+				"pdb":       pdb.Name,
+				"namespace": pdb.Namespace}).Info("Create PodDisruptionBudget")
+			return r.client.Create(context.TODO(), pdb)
+		}
+		return err
+	}
+
+	if reflect.DeepEqual(curPDB.Spec, pdb.Spec) {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"pdb":       pdb.Name,
+		"namespace": pdb.Namespace}).Info("Update PodDisruptionBudget")
+	pdb.ResourceVersion = curPDB.ResourceVersion
+	return r.client.Update(context.TODO(), pdb)
+}
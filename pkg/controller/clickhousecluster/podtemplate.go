@@ -0,0 +1,141 @@
+package clickhousecluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// applyPodTemplate merges the overlay into the generated pod template with a strategic merge patch,
+// so the lists keyed by name like containers, env and volumes are merged instead of replaced.
+// The generated labels, containers, env vars, volume mounts and volumes are then restored, the
+// overlay can only add to them.
+func applyPodTemplate(generated corev1.PodTemplateSpec, overlay *corev1.PodTemplateSpec) (corev1.PodTemplateSpec, error) {
+	var merged corev1.PodTemplateSpec
+	original, err := toJSONMap(generated)
+	if err != nil {
+		return merged, err
+	}
+	patch, err := toJSONMap(overlay)
+	if err != nil {
+		return merged, err
+	}
+	out, err := strategicpatch.StrategicMergeMapPatch(original, patch, corev1.PodTemplateSpec{})
+	if err != nil {
+		return merged, err
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return merged, err
+	}
+	if err = json.Unmarshal(data, &merged); err != nil {
+		return merged, err
+	}
+
+	if merged.Labels == nil {
+		merged.Labels = make(map[string]string)
+	}
+	for k, v := range generated.Labels {
+		merged.Labels[k] = v
+	}
+	restoreContainers(generated.Spec.InitContainers, merged.Spec.InitContainers)
+	restoreContainers(generated.Spec.Containers, merged.Spec.Containers)
+	for _, volume := range generated.Spec.Volumes {
+		for i := range merged.Spec.Volumes {
+			if merged.Spec.Volumes[i].Name == volume.Name {
+				merged.Spec.Volumes[i] = volume
+			}
+		}
+	}
+	return merged, nil
+}
+
+// restoreContainers puts back what the operator generated in the merged containers
+func restoreContainers(generated, merged []corev1.Container) {
+	for _, container := range generated {
+		for i := range merged {
+			c := &merged[i]
+			if c.Name != container.Name {
+				continue
+			}
+			c.Image = container.Image
+			c.Args = container.Args
+			c.Ports = container.Ports
+			c.ReadinessProbe = container.ReadinessProbe
+			c.Resources = container.Resources
+			for _, env := range container.Env {
+				for j := range c.Env {
+					if c.Env[j].Name == env.Name {
+						c.Env[j] = env
+					}
+				}
+			}
+			for _, mount := range container.VolumeMounts {
+				for j := range c.VolumeMounts {
+					if c.VolumeMounts[j].MountPath == mount.MountPath {
+						c.VolumeMounts[j] = mount
+					}
+				}
+			}
+		}
+	}
+}
+
+// toJSONMap converts the object into the map a strategic merge patch works on, the null values
+// left by the fields without omitempty are dropped so they do not delete anything
+func toJSONMap(obj interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	dropNulls(m)
+	return m, nil
+}
+
+func dropNulls(m map[string]interface{}) {
+	for k, v := range m {
+		switch v := v.(type) {
+		case nil:
+			delete(m, k)
+		case map[string]interface{}:
+			dropNulls(v)
+		case []interface{}:
+			for _, item := range v {
+				if item, ok := item.(map[string]interface{}); ok {
+					dropNulls(item)
+				}
+			}
+		}
+	}
+}
+
+// validatePodTemplate checks the overlay can be merged, the containers and volumes are merged by name
+func validatePodTemplate(cc *clickhousev1.ClickHouseCluster) error {
+	overlay := cc.Spec.PodTemplate
+	if overlay == nil {
+		return nil
+	}
+	containers := append(append([]corev1.Container{}, overlay.Spec.InitContainers...), overlay.Spec.Containers...)
+	for _, container := range containers {
+		if container.Name == "" {
+			return errors.New("podTemplate: containers must have a name")
+		}
+	}
+	for _, volume := range overlay.Spec.Volumes {
+		if volume.Name == "" {
+			return errors.New("podTemplate: volumes must have a name")
+		}
+	}
+	if _, err := applyPodTemplate(corev1.PodTemplateSpec{}, overlay); err != nil {
+		return fmt.Errorf("podTemplate: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package clickhousecluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ClickHouse applies most of config.d and users.d when it reloads its configuration, the rest is only
+// read when the server starts. The changes are told apart by the top-level elements of the files:
+// the elements needing a restart are summed into a checksum annotation of the pod template, so the
+// pods are rolled out when one of them changes, the others are reloaded on the running hosts.
+
+const (
+	configReloadTimeout  = 5 * time.Minute
+	configReloadInterval = 10 * time.Second
+)
+
+// reloadableConfigElements are the top-level elements of the configuration applied by a reload
+var reloadableConfigElements = map[string]bool{
+	"remote_servers":                       true,
+	"zookeeper":                            true,
+	"auxiliary_zookeepers":                 true,
+	"users":                                true,
+	"profiles":                             true,
+	"quotas":                               true,
+	"dictionaries_config":                  true,
+	"logger":                               true,
+	"max_server_memory_usage":              true,
+	"max_server_memory_usage_to_ram_ratio": true,
+	"max_concurrent_queries":               true,
+	"max_concurrent_insert_queries":        true,
+	"max_concurrent_select_queries":        true,
+	"max_table_size_to_drop":               true,
+	"max_partition_size_to_drop":           true,
+}
+
+// configFilesNotLoaded are not read by the server, the macros of a pod are generated from them by its
+// init container
+var configFilesNotLoaded = map[string]bool{
+	filenameAllMacrosJSON: true,
+}
+
+// plainIntegerRegexp matches the values written by system.server_settings as they are
+var plainIntegerRegexp = regexp.MustCompile(`^(0|[1-9][0-9]*)$`)
+
+// configElement is a top-level element of a configuration file
+type configElement struct {
+	raw string
+	// value is the text of an element without children, the value of the server setting
+	value string
+	leaf  bool
+}
+
+// configChange is a changed top-level element of a configuration file, element is empty when the
+// file could not be parsed
+type configChange struct {
+	file    string
+	element string
+	value   string
+	leaf    bool
+}
+
+func (c configChange) String() string {
+	if c.element == "" {
+		return c.file
+	}
+	return c.file + "/" + c.element
+}
+
+// needsRestart tells if the change is only applied when the server starts
+func (c configChange) needsRestart() bool {
+	if configFilesNotLoaded[c.file] {
+		return false
+	}
+	return c.element == "" || !reloadableConfigElements[c.element]
+}
+
+// configElements returns the top-level elements of an XML configuration file keyed by their name
+func configElements(content string) (map[string]configElement, error) {
+	decoder := xml.NewDecoder(strings.NewReader(content))
+	elements := make(map[string]configElement)
+	var (
+		depth int
+		name  string
+		start int64
+		value strings.Builder
+		leaf  bool
+	)
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return elements, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				name, start, leaf = t.Name.Local, offset, true
+				value.Reset()
+			} else if depth > 2 {
+				leaf = false
+			}
+		case xml.CharData:
+			if depth == 2 {
+				value.Write(t)
+			}
+		case xml.EndElement:
+			if depth == 2 {
+				element := elements[name]
+				element.raw += content[start:decoder.InputOffset()]
+				element.value, element.leaf = strings.TrimSpace(value.String()), leaf
+				elements[name] = element
+			}
+			depth--
+		}
+	}
+}
+
+// changedConfig returns the top-level elements changed between the old and the new files
+func changedConfig(oldFiles, newFiles map[string]string) []configChange {
+	var changes []configChange
+	for _, file := range sortedKeys(oldFiles, newFiles) {
+		if oldFiles[file] == newFiles[file] {
+			continue
+		}
+		if configFilesNotLoaded[file] || !strings.HasSuffix(file, ".xml") {
+			changes = append(changes, configChange{file: file})
+			continue
+		}
+		oldElements, oldErr := configElements(oldFiles[file])
+		newElements, newErr := configElements(newFiles[file])
+		if oldErr != nil || newErr != nil {
+			changes = append(changes, configChange{file: file})
+			continue
+		}
+		for _, name := range sortedKeys(elementNames(oldElements), elementNames(newElements)) {
+			if oldElements[name].raw != newElements[name].raw {
+				changes = append(changes, configChange{file: file, element: name,
+					value: newElements[name].value, leaf: newElements[name].leaf})
+			}
+		}
+	}
+	return changes
+}
+
+// configChecksum sums the parts of the configuration files only applied when the server starts
+func configChecksum(files ...map[string]string) string {
+	h := sha256.New()
+	for _, data := range files {
+		for _, file := range sortedKeys(data) {
+			if configFilesNotLoaded[file] {
+				continue
+			}
+			elements, err := configElements(data[file])
+			if !strings.HasSuffix(file, ".xml") || err != nil {
+				fmt.Fprintf(h, "%s\n%s\n", file, data[file])
+				continue
+			}
+			for _, name := range sortedKeys(elementNames(elements)) {
+				if !reloadableConfigElements[name] {
+					fmt.Fprintf(h, "%s/%s\n%s\n", file, name, elements[name].raw)
+				}
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// reloadConfig reloads the configuration on the ready hosts when the changes do not need a restart,
+// the pods are restarted through the checksum of the pod template otherwise. A reload started by a
+// previous reconcile is collected when there are no changes.
+func (r *ReconcileClickHouseCluster) reloadConfig(g *Generator, status *clickhousev1.ClickHouseClusterStatus,
+	changes []configChange) error {
+	cc := g.cc
+	log := logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "name": cc.Name})
+	if len(changes) == 0 {
+		done, err := r.tasks.result(cc, taskReloadConfig)
+		if err != nil {
+			r.recorder.Eventf(cc, corev1.EventTypeWarning, EventConfigReloadFailed, "reload the configuration: %v", err)
+		} else if done {
+			r.recorder.Event(cc, corev1.EventTypeNormal, EventConfigReloaded, "the configuration has been reloaded")
+		}
+		return err
+	}
+
+	var keys []string
+	restart := false
+	for _, change := range changes {
+		keys = append(keys, change.String())
+		restart = restart || change.needsRestart()
+	}
+	if restart {
+		log.WithField("changes", keys).Info("the configuration change needs a restart")
+		r.recorder.Eventf(cc, corev1.EventTypeNormal, EventConfigUpdated, "changed %s, the pods are restarted",
+			strings.Join(keys, ", "))
+		return nil
+	}
+
+	var hosts []string
+	for _, shard := range status.ShardStatus {
+		for _, host := range shard.Hosts {
+			if host.Ready {
+				hosts = append(hosts, host.FQDN)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	log.WithFields(logrus.Fields{"changes": keys, "hosts": len(hosts)}).Info("reload the configuration")
+	r.recorder.Eventf(cc, corev1.EventTypeNormal, EventConfigUpdated, "changed %s, the configuration is reloaded on %d hosts",
+		strings.Join(keys, ", "), len(hosts))
+	// a reload still running is not started again, ClickHouse picks up the files by itself anyway
+	schemer := NewSchemer(g.operatorCredential())
+	_, err := r.tasks.run(cc, taskReloadConfig, func() error {
+		return schemer.reloadConfig(hosts, comparedSettings(changes))
+	})
+	if err != nil {
+		r.recorder.Eventf(cc, corev1.EventTypeWarning, EventConfigReloadFailed, "reload the configuration: %v", err)
+	}
+	return err
+}
+
+// reloadConfig runs SYSTEM RELOAD CONFIG on the hosts until system.server_settings shows the
+// settings, the files take a while to be synced into the pods
+func (s *Schemer) reloadConfig(hosts []string, settings map[string]string) error {
+	deadline := time.Now().Add(configReloadTimeout)
+	for {
+		var pending []string
+		for _, host := range hosts {
+			if err := s.getCHConnection(host).Exec("SYSTEM RELOAD CONFIG"); err != nil {
+				return err
+			}
+			applied, err := s.serverSettingsApplied(host, settings)
+			if err != nil {
+				return err
+			}
+			if !applied {
+				pending = append(pending, host)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the settings have not been reloaded on %s", strings.Join(pending, ", "))
+		}
+		time.Sleep(configReloadInterval)
+		hosts = pending
+	}
+}
+
+// comparedSettings returns the changed server settings whose value in system.server_settings can be
+// compared to the config, it normalizes the other values, like 10G written 10737418240, and they are
+// trusted to be applied once SYSTEM RELOAD CONFIG succeeded
+func comparedSettings(changes []configChange) map[string]string {
+	settings := make(map[string]string)
+	for _, change := range changes {
+		if change.leaf && plainIntegerRegexp.MatchString(change.value) {
+			settings[change.element] = change.value
+		}
+	}
+	return settings
+}
+
+// serverSettingsApplied tells if the server settings of the host have the values, the servers
+// without system.server_settings are trusted to have reloaded
+func (s *Schemer) serverSettingsApplied(host string, settings map[string]string) (bool, error) {
+	if len(settings) == 0 {
+		return true, nil
+	}
+	n, err := s.queryCount(host,
+		"SELECT count() FROM system.tables WHERE database = 'system' AND name = 'server_settings'")
+	if err != nil || n == 0 {
+		return err == nil, err
+	}
+	for _, name := range sortedKeys(settings) {
+		n, err := s.queryCount(host, fmt.Sprintf("SELECT count() FROM system.server_settings WHERE name = %s AND value != %s",
+			sqlString(name), sqlString(settings[name])))
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// elementNames returns the names of the elements as the keys of a map
+func elementNames(elements map[string]configElement) map[string]string {
+	names := make(map[string]string, len(elements))
+	for name := range elements {
+		names[name] = ""
+	}
+	return names
+}
+
+// sortedKeys returns the keys of the maps, sorted and without duplicates
+func sortedKeys(maps ...map[string]string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range maps {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,191 @@
+package clickhousecluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The StatefulSets of the shards use the OnDelete update strategy, the operator restarts their
+// outdated pods one at a time across the cluster. A pod is only restarted when the other replicas
+// of its shard have caught up, and the rollout moves to the next shard once all the replicas report
+// their tables healthy again.
+
+const (
+	// the most a replicated table of a peer may lag behind before a host is restarted
+	rolloutMaxAbsoluteDelay = 30
+	rolloutMaxQueueSize     = 100
+
+	replicasStatusTimeout = 10 * time.Second
+)
+
+// rolloutPaused tells if the rollout of the cluster has been paused by the annotation
+func rolloutPaused(cc *clickhousev1.ClickHouseCluster) bool {
+	return cc.Annotations[clickhousev1.AnnotationRolloutPaused] == "true"
+}
+
+// rollShard restarts the next outdated pod of the shard if it is safe to, it returns true while
+// the rollout of the shard is not finished
+func (r *ReconcileClickHouseCluster) rollShard(g *Generator, shardID int, statefulSet *appsv1.StatefulSet,
+	previous *clickhousev1.ShardStatus) (bool, error) {
+	cc := g.cc
+	log := logrus.WithFields(logrus.Fields{"namespace": statefulSet.Namespace, "name": statefulSet.Name})
+	if statefulSet.Status.UpdateRevision == "" {
+		return false, nil
+	}
+
+	pods := &corev1.PodList{}
+	err := r.client.List(context.TODO(), pods, &client.ListOptions{
+		Namespace:     statefulSet.Namespace,
+		LabelSelector: labels.SelectorFromSet(statefulSet.Spec.Selector.MatchLabels),
+	})
+	if err != nil {
+		log.WithField("error", err).Error("list pods error")
+		return false, err
+	}
+
+	ready := len(pods.Items) == int(*statefulSet.Spec.Replicas)
+	var outdated []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil || !isPodReady(&pod) {
+			ready = false
+		}
+		if pod.Labels[appsv1.StatefulSetRevisionLabel] != statefulSet.Status.UpdateRevision {
+			outdated = append(outdated, pod)
+		}
+	}
+	// from the highest ordinal like the RollingUpdate strategy
+	sort.Slice(outdated, func(i, j int) bool {
+		return replicaIndex(outdated[i].Name) > replicaIndex(outdated[j].Name)
+	})
+
+	// the other shards keep their image, they are rolled out as usual
+	if g.canaryPod != "" && shardID == canaryShardID && len(outdated) > 0 {
+		var canary []corev1.Pod
+		for _, pod := range outdated {
+			if pod.Name == g.canaryPod {
+				canary = append(canary, pod)
+			}
+		}
+		// the other pods wait for the canary to have soaked
+		if len(canary) == 0 {
+			return true, nil
+		}
+		outdated = canary
+	}
+
+	var hosts []string
+	for j := 0; j < int(*statefulSet.Spec.Replicas); j++ {
+		hosts = append(hosts, g.FQDN(shardID, j, cc.Namespace))
+	}
+	schemer := NewSchemer(g.operatorCredential())
+
+	if len(outdated) == 0 {
+		if previous == nil || previous.Phase != ShardPhaseUpdating {
+			return false, nil
+		}
+		// the rollout of the shard is over once the last host restarted is healthy
+		if !ready {
+			return true, nil
+		}
+		done, err := r.tasks.run(cc, taskRolloutPrefix+statefulSet.Name, func() error {
+			return schemer.checkReplicasStatus(hosts)
+		})
+		if err != nil {
+			return true, fmt.Errorf("shard %d: %v", shardID, err)
+		}
+		return !done, nil
+	}
+
+	if rolloutPaused(cc) {
+		log.WithField("outdated", len(outdated)).Info("rollout paused")
+		return true, nil
+	}
+	// an outdated pod which is not ready does not serve anyway, it is restarted without waiting
+	for _, pod := range outdated {
+		if pod.DeletionTimestamp == nil && !isPodReady(&pod) {
+			log.WithField("pod", pod.Name).Info("restart the outdated pod not ready")
+			if err := r.client.Delete(context.TODO(), &pod); err != nil {
+				log.WithFields(logrus.Fields{"pod": pod.Name, "error": err}).Error("delete pod error")
+				return true, err
+			}
+			r.recorder.Eventf(cc, corev1.EventTypeNormal, EventPodRestarted, "restarted the outdated pod %s, it was not ready", pod.Name)
+			return true, nil
+		}
+	}
+	// the host restarted last is not back yet
+	if !ready {
+		return true, nil
+	}
+
+	target := outdated[0]
+	var peers []string
+	for j, host := range hosts {
+		if g.replicaName(shardID, j) != target.Name {
+			peers = append(peers, host)
+		}
+	}
+	done, err := r.tasks.run(cc, taskRolloutPrefix+target.Name, func() error {
+		if err := schemer.checkReplicasCaughtUp(peers); err != nil {
+			return err
+		}
+		return schemer.checkReplicasStatus(peers)
+	})
+	if err != nil {
+		r.recorder.Eventf(cc, corev1.EventTypeWarning, EventRolloutBlocked, "the restart of %s waits for the replicas: %v",
+			target.Name, err)
+		return true, fmt.Errorf("shard %d: %v", shardID, err)
+	}
+	if !done {
+		return true, nil
+	}
+
+	log.WithField("pod", target.Name).Info("restart the outdated pod")
+	if err := r.client.Delete(context.TODO(), &target); err != nil {
+		log.WithFields(logrus.Fields{"pod": target.Name, "error": err}).Error("delete pod error")
+		return true, err
+	}
+	r.recorder.Eventf(cc, corev1.EventTypeNormal, EventPodRestarted, "restarted the outdated pod %s", target.Name)
+	return true, nil
+}
+
+// checkReplicasCaughtUp checks the replicated tables of the hosts are writable and not lagging
+func (s *Schemer) checkReplicasCaughtUp(hosts []string) error {
+	sql := fmt.Sprintf("SELECT count() FROM system.replicas WHERE is_readonly OR absolute_delay > %d OR queue_size > %d",
+		rolloutMaxAbsoluteDelay, rolloutMaxQueueSize)
+	for _, host := range hosts {
+		n, err := s.queryCount(host, sql)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("%d replicated tables of %s are read-only or lagging", n, host)
+		}
+	}
+	return nil
+}
+
+// checkReplicasStatus checks the /replicas_status handler of the hosts reports Ok
+func (s *Schemer) checkReplicasStatus(hosts []string) error {
+	httpClient := &http.Client{Timeout: replicasStatusTimeout}
+	for _, host := range hosts {
+		resp, err := httpClient.Get(fmt.Sprintf("http://%s:%d/replicas_status", host, s.Port))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("replicas of %s are not ok: %s", host, resp.Status)
+		}
+	}
+	return nil
+}
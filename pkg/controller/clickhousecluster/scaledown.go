@@ -0,0 +1,566 @@
+package clickhousecluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// A shard removed from the spec goes through the following phases before its StatefulSet and its
+// PVCs are deleted:
+//   Draining: it is kept in remote_servers with a weight of 0, so the Distributed tables stop
+//             writing to it, and its local MergeTree tables are copied to the remaining shards
+//   Drained:  the row counts have been verified, it is removed from remote_servers and deleted
+//             once no remaining host lists it anymore
+// Each table copied is recorded in the status of the shard before its rows are sent and is never
+// sent twice: a copy interrupted or found incomplete is checked against the row counts recorded,
+// and left to a manual check when they do not match. The rows written directly to the local tables
+// of the shard while it is drained are not copied, the drain stops with an error. Once the rows have
+// been checked the mismatch is accepted by the accept-drain-mismatch annotation and the drain goes on.
+
+const (
+	// how long the copy of a table may take
+	drainCopyTimeout = time.Hour
+)
+
+// distributedEngineRegexp extracts the cluster, the database, the table and the sharding key from
+// the engine_full of a Distributed table
+var distributedEngineRegexp = regexp.MustCompile(`^Distributed\('?([^,']+)'?,\s*'?([^,']*)'?,\s*'?([^,')]+)'?\s*(?:,\s*(.+))?\)(?:\s+SETTINGS .*)?$`)
+
+// removedShard is a shard above shardsCount whose StatefulSet has not been deleted yet
+type removedShard struct {
+	ID       int
+	Replicas int32
+	Drained  bool
+}
+
+// scaleDownShards moves the shards above shardsCount through the phases of their removal, it
+// returns the shards still to be generated into remote_servers
+func (r *ReconcileClickHouseCluster) scaleDownShards(g *Generator, status *clickhousev1.ClickHouseClusterStatus) ([]removedShard, error) {
+	cc := g.cc
+	log := logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "name": cc.Name})
+
+	var statefulSets = appsv1.StatefulSetList{}
+	err := r.client.List(context.TODO(), &statefulSets, &client.ListOptions{
+		Namespace: cc.Namespace,
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			ClusterLabelKey: cc.Name,
+		}),
+	})
+	if err != nil {
+		log.WithField("error", err).Error("List statefulset error")
+		return nil, err
+	}
+
+	var removed []removedShard
+	var draining bool
+	existing := make(map[string]bool)
+	for i := range statefulSets.Items {
+		sts := &statefulSets.Items[i]
+		existing[sts.Name] = true
+		shardID, err := strconv.Atoi(sts.Labels[ShardIDLabelKey])
+		if err != nil {
+			log.WithField("error", err).Error("Get shard-id error")
+			return nil, err
+		}
+		if shardID < int(cc.Spec.ShardsCount) {
+			continue
+		}
+
+		shard := removedShard{ID: shardID, Replicas: 1}
+		if sts.Spec.Replicas != nil {
+			shard.Replicas = *sts.Spec.Replicas
+		}
+		shardStatus := status.ShardStatus[sts.Name]
+		if shardStatus == nil || (shardStatus.Phase != ShardPhaseDraining && shardStatus.Phase != ShardPhaseDrained) {
+			log.WithField("shard", shardID).Info("drain shard")
+			r.recorder.Eventf(cc, corev1.EventTypeNormal, EventShardDraining, "draining shard %d into the remaining shards", shardID)
+			shardStatus = &clickhousev1.ShardStatus{Phase: ShardPhaseDraining}
+			if old := status.ShardStatus[sts.Name]; old != nil {
+				shardStatus.Hosts = old.Hosts
+			}
+			status.ShardStatus[sts.Name] = shardStatus
+		}
+
+		switch shardStatus.Phase {
+		case ShardPhaseDraining:
+			drainer := newShardDrainer(g, shard, shardStatus.DrainedTables)
+			done, tables, err := r.tasks.runValue(cc, taskDrainShardPrefix+sts.Name, drainer.drain)
+			if done {
+				shardStatus.DrainedTables = tables.([]clickhousev1.DrainedTable)
+			}
+			if err != nil {
+				r.recorder.Eventf(cc, corev1.EventTypeWarning, EventShardDrainFailed, "drain shard %d: %v", shardID, err)
+				return nil, fmt.Errorf("drain shard %d: %v", shardID, err)
+			}
+			if done {
+				log.WithField("shard", shardID).Info("shard drained")
+				r.recorder.Eventf(cc, corev1.EventTypeNormal, EventShardDrained, "shard %d has been drained", shardID)
+				shardStatus.Phase = ShardPhaseDrained
+				shard.Drained = true
+			} else {
+				draining = true
+			}
+		case ShardPhaseDrained:
+			shard.Drained = true
+			drainer := newShardDrainer(g, shard, nil)
+			done, err := r.tasks.run(cc, taskRemoveShardPrefix+sts.Name, drainer.waitRemoved)
+			if err != nil {
+				return nil, fmt.Errorf("remove shard %d: %v", shardID, err)
+			}
+			if done {
+				if err := r.deleteShard(sts, shardID); err != nil {
+					return nil, err
+				}
+				r.recorder.Eventf(cc, corev1.EventTypeNormal, EventShardRemoved, "deleted StatefulSet %s and the PVCs of shard %d",
+					sts.Name, shardID)
+				delete(status.ShardStatus, sts.Name)
+				continue
+			}
+		}
+		removed = append(removed, shard)
+	}
+	// the StatefulSet has been deleted by someone else
+	for name, shardStatus := range status.ShardStatus {
+		if isShardRemoving(shardStatus) && !existing[name] {
+			delete(status.ShardStatus, name)
+		}
+	}
+	// the mismatches accepted are the ones of the drains done, not of the next ones
+	if !draining && drainMismatchAccepted(cc) {
+		delete(cc.Annotations, clickhousev1.AnnotationAcceptDrainMismatch)
+	}
+	return removed, nil
+}
+
+func drainMismatchAccepted(cc *clickhousev1.ClickHouseCluster) bool {
+	return cc.Annotations[clickhousev1.AnnotationAcceptDrainMismatch] == "true"
+}
+
+// deleteShard deletes the StatefulSet of a drained shard and its PVCs, its Service is owned by the
+// StatefulSet and garbage collected with it
+func (r *ReconcileClickHouseCluster) deleteShard(sts *appsv1.StatefulSet, shardID int) error {
+	log := logrus.WithFields(logrus.Fields{"namespace": sts.Namespace, "name": sts.Name})
+	log.Info("Delete StatefulSet of the drained shard")
+	if err := r.client.Delete(context.TODO(), sts); err != nil {
+		log.WithField("error", err).Error("Delete statefulSet error")
+		return err
+	}
+
+	pvcs, err := r.listPVC(sts.Namespace, map[string]string{
+		ClusterLabelKey: sts.Labels[ClusterLabelKey],
+		ShardIDLabelKey: strconv.Itoa(shardID),
+	})
+	if err != nil {
+		log.WithField("error", err).Error("List PVC error")
+		return err
+	}
+	for i := range pvcs.Items {
+		if err := r.client.Delete(context.TODO(), &pvcs.Items[i]); err != nil {
+			log.WithFields(logrus.Fields{"PVC": pvcs.Items[i].Name, "error": err}).Error("Delete PVC error")
+			return err
+		}
+	}
+	return nil
+}
+
+// scaleDownReplicas removes the replicas above the replicas count of a shard. They are removed from
+// remote_servers first, the StatefulSet keeps them until no host lists them anymore. Once their pods
+// are gone their metadata is dropped from ZooKeeper by a remaining replica, ClickHouse refuses to
+// drop an active replica. It returns the replicas whose metadata is still to be dropped.
+func (r *ReconcileClickHouseCluster) scaleDownReplicas(g *Generator, shardID int, statefulSet *appsv1.StatefulSet,
+	previous *clickhousev1.ShardStatus) ([]string, error) {
+	cc := g.cc
+	desired := int(*statefulSet.Spec.Replicas)
+
+	var dropping []string
+	if previous != nil {
+		for _, name := range previous.DroppingReplicas {
+			// the replica has been added back
+			if replicaIndex(name) < desired {
+				continue
+			}
+			dropping = append(dropping, name)
+		}
+	}
+
+	cur := &appsv1.StatefulSet{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: statefulSet.Namespace, Name: statefulSet.Name}, cur)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return dropping, nil
+		}
+		return dropping, err
+	}
+	current := 1
+	if cur.Spec.Replicas != nil {
+		current = int(*cur.Spec.Replicas)
+	}
+	schemer := NewSchemer(g.operatorCredential())
+
+	if current > desired {
+		var removed []string
+		for j := desired; j < current; j++ {
+			removed = append(removed, g.FQDN(shardID, j, cc.Namespace))
+			if name := g.replicaName(shardID, j); !containsString(dropping, name) {
+				dropping = append(dropping, name)
+			}
+		}
+		cluster, hosts := cc.Name, g.FQDNs()
+		done, err := r.tasks.run(cc, taskRemoveReplicasPrefix+statefulSet.Name, func() error {
+			return schemer.waitHostsRemoved(cluster, hosts, removed)
+		})
+		if err != nil {
+			return dropping, fmt.Errorf("remove replicas of shard %d: %v", shardID, err)
+		}
+		if !done {
+			statefulSet.Spec.Replicas = cur.Spec.Replicas
+		}
+		return dropping, nil
+	}
+
+	// the removed pods are still terminating, the StatefulSet is watched
+	if len(dropping) == 0 || int(cur.Status.Replicas) > desired {
+		return dropping, nil
+	}
+	// without zookeeper the tables are not replicated
+	if zookeeperConfig(cc) == nil {
+		return nil, nil
+	}
+	var survivors []string
+	for j := 0; j < desired; j++ {
+		survivors = append(survivors, g.FQDN(shardID, j, cc.Namespace))
+	}
+	names := append([]string{}, dropping...)
+	done, err := r.tasks.run(cc, taskDropReplicasPrefix+statefulSet.Name, func() error {
+		return schemer.dropReplicas(survivors, names)
+	})
+	if err != nil {
+		r.recorder.Eventf(cc, corev1.EventTypeWarning, EventReplicasDropFailed, "drop replicas of shard %d: %v", shardID, err)
+		return dropping, fmt.Errorf("drop replicas of shard %d: %v", shardID, err)
+	}
+	if done {
+		logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "name": cc.Name, "replicas": names}).
+			Info("replicas dropped")
+		r.recorder.Eventf(cc, corev1.EventTypeNormal, EventReplicasDropped, "dropped the replicas %s from zookeeper",
+			strings.Join(names, ", "))
+		return nil, nil
+	}
+	return dropping, nil
+}
+
+// replicaIndex returns the index of a replica from its name, -1 if it can not be parsed
+func replicaIndex(name string) int {
+	i := strings.LastIndex(name, "-")
+	index, err := strconv.Atoi(name[i+1:])
+	if i < 0 || err != nil {
+		return -1
+	}
+	return index
+}
+
+// removeString returns the list without s, the list itself if it does not contain s
+func removeString(list []string, s string) []string {
+	if !containsString(list, s) {
+		return list
+	}
+	removed := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != s {
+			removed = append(removed, item)
+		}
+	}
+	return removed
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// shardDrainer copies the data of a removed shard to the remaining ones. Everything it needs is
+// copied from the cluster as it runs in the background.
+type shardDrainer struct {
+	schemer *Schemer
+	// cluster is the name of the cluster in remote_servers
+	cluster string
+	// sources are the replicas of the removed shard
+	sources []string
+	// targets are the replicas of the remaining shards
+	targets [][]string
+	// tables are the tables whose copy has been started, from the status of the shard
+	tables []clickhousev1.DrainedTable
+	// acceptMismatch accepts the tables whose copy could not be verified as copied
+	acceptMismatch bool
+}
+
+func newShardDrainer(g *Generator, shard removedShard, tables []clickhousev1.DrainedTable) *shardDrainer {
+	d := &shardDrainer{
+		schemer:        NewSchemer(g.operatorCredential()),
+		cluster:        g.cc.Name,
+		tables:         append([]clickhousev1.DrainedTable{}, tables...),
+		acceptMismatch: drainMismatchAccepted(g.cc),
+	}
+	for j := 0; j < int(shard.Replicas); j++ {
+		d.sources = append(d.sources, g.FQDN(shard.ID, j, g.cc.Namespace))
+	}
+	for i := 0; i < int(g.cc.Spec.ShardsCount); i++ {
+		var replicas []string
+		for j := 0; j < int(g.cc.Spec.ShardReplicasCount(i)); j++ {
+			replicas = append(replicas, g.FQDN(i, j, g.cc.Namespace))
+		}
+		d.targets = append(d.targets, replicas)
+	}
+	return d
+}
+
+// localTable is a MergeTree table of the removed shard, dist is the Distributed table writing to
+// it with a sharding key, if any
+type localTable struct {
+	database, name, engine string
+	dist                   string
+}
+
+// drain copies the local tables of the removed shard once every host writes no more to it, it
+// returns the tables whose copy has been started, even when it fails
+func (d *shardDrainer) drain() (interface{}, error) {
+	err := d.copyTables()
+	return d.tables, err
+}
+
+func (d *shardDrainer) copyTables() error {
+	if len(d.sources) == 0 {
+		return nil
+	}
+	hosts := append([]string{}, d.sources...)
+	for _, replicas := range d.targets {
+		hosts = append(hosts, replicas...)
+	}
+	sql := fmt.Sprintf("SELECT count() FROM system.clusters WHERE cluster = %s AND host_name = %s AND shard_weight = 0",
+		sqlString(d.cluster), sqlString(d.sources[0]))
+	if err := d.schemer.waitRemoteServers(hosts, sql, func(n int64) bool { return n > 0 }); err != nil {
+		return err
+	}
+
+	source, tables, err := d.listTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if err := d.copyTable(source, table); err != nil {
+			return fmt.Errorf("table %s.%s: %v", table.database, table.name, err)
+		}
+	}
+	return nil
+}
+
+// waitRemoved waits for every remaining host to remove the shard from remote_servers
+func (d *shardDrainer) waitRemoved() error {
+	var hosts []string
+	for _, replicas := range d.targets {
+		hosts = append(hosts, replicas...)
+	}
+	return d.schemer.waitHostsRemoved(d.cluster, hosts, d.sources)
+}
+
+// listTables returns the replica of the removed shard the data is copied from and its tables
+func (d *shardDrainer) listTables() (string, []localTable, error) {
+	sql := heredoc.Doc(`
+		SELECT database, name, engine, engine_full
+		FROM system.tables
+		WHERE database != 'system' AND name NOT LIKE '.inner%'
+			AND (engine LIKE '%MergeTree' OR engine = 'Distributed')`)
+
+	var lastErr error
+	for _, source := range d.sources {
+		tables, err := d.queryTables(source, sql)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return source, tables, nil
+	}
+	return "", nil, fmt.Errorf("no replica of the shard is reachable: %v", lastErr)
+}
+
+// queryTables returns the local tables of a replica of the removed shard, with the Distributed
+// table writing to each of them
+func (d *shardDrainer) queryTables(source, sql string) ([]localTable, error) {
+	query, err := d.schemer.getCHConnection(source).Query(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	var tables []localTable
+	dists := make(map[string]string)
+	for query.Rows.Next() {
+		var database, name, engine, engineFull string
+		if err := query.Rows.Scan(&database, &name, &engine, &engineFull); err != nil {
+			return nil, err
+		}
+		if engine != "Distributed" {
+			tables = append(tables, localTable{database: database, name: name, engine: engine})
+			continue
+		}
+		m := distributedEngineRegexp.FindStringSubmatch(engineFull)
+		// the rows can only be written through a Distributed table of the cluster with a sharding key
+		if m == nil || m[1] != d.cluster || m[4] == "" {
+			continue
+		}
+		localDatabase := m[2]
+		if localDatabase == "" || localDatabase == "currentDatabase()" {
+			localDatabase = database
+		}
+		dists[localDatabase+"."+m[3]] = quoteIdentifier(database, name)
+	}
+	for i := range tables {
+		tables[i].dist = dists[tables[i].database+"."+tables[i].name]
+	}
+	return tables, nil
+}
+
+// copyTable copies the rows of a table to the remaining shards and checks they have all arrived. The
+// rows are written through the Distributed table if there is one, otherwise all of them go to one
+// of the remaining shards. A table whose copy has been started is only checked.
+func (d *shardDrainer) copyTable(source string, table localTable) error {
+	name := table.database + "." + table.name
+	for i := range d.tables {
+		if d.tables[i].Name == name {
+			return d.checkCopied(source, table, &d.tables[i])
+		}
+	}
+
+	local := quoteIdentifier(table.database, table.name)
+	countSQL := fmt.Sprintf("SELECT count() FROM %s", local)
+	rows, err := d.schemer.queryCount(source, countSQL)
+	if err != nil || rows == 0 {
+		return err
+	}
+	before, err := d.countTargets(countSQL)
+	if err != nil {
+		return err
+	}
+
+	var sqls []string
+	if table.dist != "" {
+		sqls = append(sqls, fmt.Sprintf("INSERT INTO %s SETTINGS insert_distributed_sync = 1 SELECT * FROM %s",
+			table.dist, local))
+	} else {
+		// one shard for all the rows of the table, the tables are spread over the shards
+		replicas := d.targets[int(hashString(name))%len(d.targets)]
+		if strings.HasPrefix(table.engine, "Replicated") {
+			replicas = replicas[:1]
+		}
+		for _, replica := range replicas {
+			sqls = append(sqls, fmt.Sprintf("INSERT INTO FUNCTION remote(%s, %s, %s, %s, %s) SELECT * FROM %s",
+				sqlString(fmt.Sprintf("%s:%d", replica, chDefaultClientPortNumber)), sqlString(table.database),
+				sqlString(table.name), sqlString(d.schemer.Username), sqlString(d.schemer.Password), local))
+		}
+	}
+
+	d.tables = append(d.tables, clickhousev1.DrainedTable{Name: name, Rows: rows, TargetRows: before})
+	logrus.WithFields(logrus.Fields{"host": source, "table": local, "rows": rows}).Info("copy the rows of the drained shard")
+	for _, sql := range sqls {
+		if err := d.schemer.getCHConnection(source).ExecWithTimeout(sql, drainCopyTimeout); err != nil {
+			return err
+		}
+	}
+	return d.checkCopied(source, table, &d.tables[len(d.tables)-1])
+}
+
+// checkCopied checks the rows of a table whose copy has been started have all arrived. A copy still
+// running is waited for, one found incomplete is reported and never sent again until it is accepted,
+// its error is kept.
+func (d *shardDrainer) checkCopied(source string, table localTable, copied *clickhousev1.DrainedTable) error {
+	if copied.Copied {
+		return nil
+	}
+	if copied.Error != "" {
+		if d.acceptMismatch {
+			logrus.WithFields(logrus.Fields{"table": copied.Name, "error": copied.Error}).Info("accept the copy not verified")
+			copied.Copied = true
+			return nil
+		}
+		return errors.New(copied.Error)
+	}
+
+	local := quoteIdentifier(table.database, table.name)
+	running, err := d.schemer.queryCount(source, fmt.Sprintf(
+		"SELECT count() FROM system.processes WHERE query LIKE %s", sqlString("INSERT %SELECT * FROM "+local)))
+	if err != nil {
+		return err
+	}
+	if running > 0 {
+		return fmt.Errorf("the copy is still running")
+	}
+	countSQL := fmt.Sprintf("SELECT count() FROM %s", local)
+	after, err := d.countTargets(countSQL)
+	if err != nil {
+		return err
+	}
+	again, err := d.schemer.queryCount(source, countSQL)
+	if err != nil {
+		return err
+	}
+	switch {
+	case after-copied.TargetRows < copied.Rows:
+		copied.Error = fmt.Sprintf("%d rows copied, %d expected", after-copied.TargetRows, copied.Rows)
+	case again != copied.Rows:
+		copied.Error = "rows have been written while the shard was drained"
+	default:
+		copied.Copied = true
+		return nil
+	}
+	copied.Error += ", the rows are not sent again and have to be checked on the remaining shards"
+	return errors.New(copied.Error)
+}
+
+// countTargets sums the counts of the first replicas of the remaining shards
+func (d *shardDrainer) countTargets(sql string) (int64, error) {
+	var sum int64
+	for _, replicas := range d.targets {
+		n, err := d.schemer.queryCount(replicas[0], sql)
+		if err != nil {
+			return 0, err
+		}
+		sum += n
+	}
+	return sum, nil
+}
+
+// hashString spreads the tables over the shards in a stable way
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// sqlString quotes a string literal
+func sqlString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// quoteIdentifier quotes the name of a table
+func quoteIdentifier(database, name string) string {
+	return fmt.Sprintf("`%s`.`%s`", strings.ReplaceAll(database, "`", "\\`"), strings.ReplaceAll(name, "`", "\\`"))
+}
@@ -0,0 +1,518 @@
+package clickhousecluster
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/connect"
+	log "github.com/sirupsen/logrus"
+)
+
+// The schema of the cluster is read from all of its hosts and created on every one of them with IF
+// NOT EXISTS, in order: the databases, the SQL user defined functions, the tables, views and
+// dictionaries after the ones they read from or write to, then the roles, settings profiles, quotas,
+// users, row policies and grants of the local directory access storages. The tables of a Replicated
+// database are created by the database engine, the ones of a database proxying another server are
+// not created at all. The tables keep their UUID, the replicas of a table whose path in ZooKeeper
+// uses the {uuid} macro have to share it.
+
+// systemDatabases are the databases of the server itself
+const systemDatabases = "'system', 'INFORMATION_SCHEMA', 'information_schema'"
+
+// maxSchemaFailures is the number of failed objects kept in the status of the cluster
+const maxSchemaFailures = 50
+
+// localAccessStorages lists the access storages of the entities created by SQL on a single host,
+// the replicated storages sync them by themselves
+const localAccessStorages = "SELECT name FROM system.user_directories WHERE type = 'local directory'"
+
+var (
+	// createStatementRegexp matches a statement creating an object up to its name, the kind of the
+	// object is the submatch
+	createStatementRegexp = regexp.MustCompile(`^\s*(?:CREATE|ATTACH)\s+(?:OR\s+REPLACE\s+)?(TABLE|VIEW|MATERIALIZED\s+VIEW|LIVE\s+VIEW|WINDOW\s+VIEW|DICTIONARY|DATABASE|FUNCTION|USER|ROLE|ROW\s+POLICY|SETTINGS\s+PROFILE|QUOTA)\s+(?:IF\s+NOT\s+EXISTS\s+)?`)
+	// qualifiedNameRegexp matches the database.name references of a query, quoted or not
+	qualifiedNameRegexp = regexp.MustCompile("(?:`([^`]+)`|\"([^\"]+)\"|\\b([a-zA-Z_][a-zA-Z0-9_]*))\\.(?:`([^`]+)`|\"([^\"]+)\"|([a-zA-Z_][a-zA-Z0-9_]*)\\b)")
+	// dictionarySourceRegexp extracts the parameters of the ClickHouse source of a dictionary
+	dictionarySourceRegexp = regexp.MustCompile(`SOURCE\(CLICKHOUSE\((.*?)\)\)`)
+	// dictionaryTableRegexp matches the database and the table among the parameters of the source
+	dictionaryTableRegexp = regexp.MustCompile(`\b(DB|TABLE)\s+'([^']*)'`)
+	// identifiedWithRegexp matches the authentication of a user, the secret follows BY
+	identifiedWithRegexp = regexp.MustCompile(`IDENTIFIED WITH (\w+)(\s+BY\b)?`)
+)
+
+// schemaObject is an object of the schema created on every host
+type schemaObject struct {
+	kind string
+	// name is qualified by the database for the tables, views and dictionaries
+	name string
+	// statements creating the object, the grants of a user or a role take several
+	statements []string
+	// dependencies are the tables, views and dictionaries the object reads from or writes to
+	dependencies []string
+	// hidden tells a secret of the object has been hidden by the server, it can not be created again
+	hidden bool
+}
+
+// newSchemaObject returns the object created by the statements, they do nothing if it exists
+func newSchemaObject(kind, name string, statements ...string) schemaObject {
+	object := schemaObject{kind: kind, name: name}
+	for _, statement := range statements {
+		object.hidden = object.hidden || hiddenSecret(kind, statement)
+		object.statements = append(object.statements, createIfNotExists(statement))
+	}
+	return object
+}
+
+// createIfNotExists makes a statement creating an object do nothing if the object exists
+func createIfNotExists(statement string) string {
+	return createStatementRegexp.ReplaceAllString(statement, "CREATE $1 IF NOT EXISTS ")
+}
+
+// hiddenSecret tells if the server has hidden a secret in the statement, like the password of a user
+// or the credentials of an engine
+func hiddenSecret(kind, statement string) bool {
+	if strings.Contains(statement, "'[HIDDEN]'") {
+		return true
+	}
+	if kind != SchemaObjectUser {
+		return false
+	}
+	m := identifiedWithRegexp.FindStringSubmatch(statement)
+	return m != nil && m[1] != "no_password" && m[2] == "" &&
+		(strings.HasSuffix(m[1], "_password") || strings.HasSuffix(m[1], "_hash"))
+}
+
+// tableKind returns the kind of the table, view or dictionary created by the statement
+func tableKind(statement string) string {
+	m := createStatementRegexp.FindStringSubmatch(statement)
+	if m == nil {
+		return SchemaObjectTable
+	}
+	switch kind := strings.Join(strings.Fields(m[1]), " "); kind {
+	case "MATERIALIZED VIEW":
+		return SchemaObjectMaterializedView
+	case "VIEW", "LIVE VIEW", "WINDOW VIEW":
+		return SchemaObjectView
+	case "DICTIONARY":
+		return SchemaObjectDictionary
+	}
+	return SchemaObjectTable
+}
+
+// tableDependencies returns the tables, views and dictionaries a table reads from or writes to: the
+// ones named in its statement, the table of its Distributed engine and the source of a dictionary
+func tableDependencies(database, name, engineFull, statement string) []string {
+	seen := map[string]bool{database + "." + name: true}
+	var dependencies []string
+	add := func(database, name string) {
+		if key := database + "." + name; !seen[key] {
+			seen[key] = true
+			dependencies = append(dependencies, key)
+		}
+	}
+	for _, m := range qualifiedNameRegexp.FindAllStringSubmatch(statement, -1) {
+		add(m[1]+m[2]+m[3], m[4]+m[5]+m[6])
+	}
+	if m := distributedEngineRegexp.FindStringSubmatch(engineFull); m != nil {
+		target := m[2]
+		if target == "" || target == "currentDatabase()" {
+			target = database
+		}
+		add(target, m[3])
+	}
+	if m := dictionarySourceRegexp.FindStringSubmatch(statement); m != nil {
+		source := map[string]string{"DB": database}
+		for _, parameter := range dictionaryTableRegexp.FindAllStringSubmatch(m[1], -1) {
+			source[parameter[1]] = parameter[2]
+		}
+		if source["TABLE"] != "" {
+			add(source["DB"], source["TABLE"])
+		}
+	}
+	return dependencies
+}
+
+// databaseOwnsTables tells if the tables of a database with the engine are created by the operator,
+// a Replicated database creates them from ZooKeeper and the others proxy another server
+func databaseOwnsTables(engine string) bool {
+	switch engine {
+	case "Atomic", "Ordinary", "Lazy", "Memory":
+		return true
+	}
+	return false
+}
+
+// schemaRank returns the rank of the kind in the order the objects are created
+func schemaRank(kind string) int {
+	switch kind {
+	case SchemaObjectDatabase:
+		return 0
+	case SchemaObjectFunction:
+		return 1
+	case SchemaObjectTable, SchemaObjectView, SchemaObjectMaterializedView, SchemaObjectDictionary:
+		return 2
+	case SchemaObjectRole:
+		return 3
+	case SchemaObjectSettingsProfile:
+		return 4
+	case SchemaObjectQuota:
+		return 5
+	case SchemaObjectUser:
+		return 6
+	case SchemaObjectRowPolicy:
+		return 7
+	}
+	return 8
+}
+
+// orderSchema sorts the objects by kind and name, the tables, views and dictionaries coming after
+// the ones they depend on. The objects depending on each other are kept in that order.
+func orderSchema(objects []schemaObject) []schemaObject {
+	sorted := append([]schemaObject(nil), objects...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if ri, rj := schemaRank(sorted[i].kind), schemaRank(sorted[j].kind); ri != rj {
+			return ri < rj
+		}
+		return sorted[i].name < sorted[j].name
+	})
+	tables := make(map[string]int)
+	for i, object := range sorted {
+		if schemaRank(object.kind) == schemaRank(SchemaObjectTable) {
+			tables[object.name] = i
+		}
+	}
+
+	ordered := make([]schemaObject, 0, len(sorted))
+	visited := make([]bool, len(sorted))
+	var visit func(i int)
+	visit = func(i int) {
+		if visited[i] {
+			return
+		}
+		visited[i] = true
+		for _, dependency := range sorted[i].dependencies {
+			if j, ok := tables[dependency]; ok {
+				visit(j)
+			}
+		}
+		ordered = append(ordered, sorted[i])
+	}
+	for i := range sorted {
+		visit(i)
+	}
+	return ordered
+}
+
+// schemaSyncError lists the objects of the schema that could not be created on the hosts
+type schemaSyncError struct {
+	failures []clickhousev1.SchemaObjectFailure
+}
+
+func (e *schemaSyncError) Error() string {
+	hosts := make(map[string]bool)
+	for _, failure := range e.failures {
+		hosts[failure.Host] = true
+	}
+	first := e.failures[0]
+	if first.Kind == "" {
+		return fmt.Sprintf("%d objects of the schema failed on %d hosts, %s: %s",
+			len(e.failures), len(hosts), first.Host, first.Error)
+	}
+	return fmt.Sprintf("%d objects of the schema failed on %d hosts, %s %s on %s: %s",
+		len(e.failures), len(hosts), first.Kind, first.Name, first.Host, first.Error)
+}
+
+// failedObjects returns the failures kept in the status of the cluster
+func (e *schemaSyncError) failedObjects() []clickhousev1.SchemaObjectFailure {
+	if len(e.failures) > maxSchemaFailures {
+		return e.failures[:maxSchemaFailures]
+	}
+	return e.failures
+}
+
+// schemaStatus returns the state of the schema in the status, initialized if needed
+func schemaStatus(status *clickhousev1.ClickHouseClusterStatus) *clickhousev1.SchemaStatus {
+	if status.Schema == nil {
+		status.Schema = &clickhousev1.SchemaStatus{}
+	}
+	return status.Schema
+}
+
+// StatefulSetCreateTables creates the schema of the cluster on all of its hosts, but the excluded
+// objects. The objects with a secret hidden by the server can not be copied, they are skipped and
+// returned.
+func (s *Schemer) StatefulSetCreateTables(clusterName string, hosts []string, excluded map[string]bool) ([]string, error) {
+	objects, hidden, err := s.readClusterSchema(hosts, excluded)
+	if err != nil {
+		log.Errorf("Get schema objects err")
+		return nil, err
+	}
+	log.Infof("Creating %d schema objects at %s", len(objects), clusterName)
+
+	var failures []clickhousev1.SchemaObjectFailure
+	for _, host := range hosts {
+		failures = append(failures, s.applySchema(host, objects)...)
+	}
+	if len(failures) > 0 {
+		return hidden, &schemaSyncError{failures: failures}
+	}
+	return hidden, nil
+}
+
+// schemaObjectKey identifies an object of the schema among the hosts
+func schemaObjectKey(kind, name string) string {
+	return kind + "/" + name
+}
+
+// readClusterSchema merges the schemas of the hosts answering, an object found on several hosts is
+// created as defined on the first one. The excluded objects are left out, and so are the objects
+// with a secret hidden by the server, whose names are returned.
+func (s *Schemer) readClusterSchema(hosts []string, excluded map[string]bool) ([]schemaObject, []string, error) {
+	var objects []schemaObject
+	var hidden []string
+	seen := make(map[string]bool)
+	var read int
+	var lastErr error
+	for _, host := range hosts {
+		hostObjects, err := s.readSchema(host)
+		if err != nil {
+			log.Infof("Read schema on: %s FAILED skip to next. err: %v", host, err)
+			lastErr = err
+			continue
+		}
+		read++
+		for _, object := range hostObjects {
+			key := schemaObjectKey(object.kind, object.name)
+			if seen[key] || excluded[key] {
+				continue
+			}
+			seen[key] = true
+			if object.hidden {
+				hidden = append(hidden, object.kind+" "+object.name)
+				continue
+			}
+			objects = append(objects, object)
+		}
+	}
+	if read == 0 && lastErr != nil {
+		return nil, nil, fmt.Errorf("none of the hosts answered: %v", lastErr)
+	}
+	return orderSchema(objects), hidden, nil
+}
+
+// readSchema returns the objects of the schema of the host, the ones its version of ClickHouse does
+// not have are skipped
+func (s *Schemer) readSchema(host string) ([]schemaObject, error) {
+	objects, owned, err := s.readDatabases(host)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := s.readTables(host, owned)
+	if err != nil {
+		return nil, err
+	}
+	objects = append(objects, tables...)
+
+	functions, err := s.exists(host,
+		"SELECT count() FROM system.columns WHERE database = 'system' AND table = 'functions' AND name = 'create_query'")
+	if err != nil {
+		return nil, err
+	}
+	if functions {
+		rows, err := s.queryRows(host, "SELECT name, create_query FROM system.functions WHERE create_query != ''")
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			objects = append(objects, newSchemaObject(SchemaObjectFunction, row[0], row[1]))
+		}
+	}
+
+	access, err := s.exists(host, "SELECT count() FROM system.tables WHERE database = 'system' AND name = 'user_directories'")
+	if err != nil {
+		return nil, err
+	}
+	if access {
+		entities, err := s.readAccessEntities(host)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, entities...)
+	}
+	return objects, nil
+}
+
+// readDatabases returns the databases of the host, and if their tables are created by the operator
+func (s *Schemer) readDatabases(host string) ([]schemaObject, map[string]bool, error) {
+	rows, err := s.queryRows(host, fmt.Sprintf("SELECT name, engine FROM system.databases WHERE name NOT IN (%s)", systemDatabases))
+	if err != nil {
+		return nil, nil, err
+	}
+	var databases []schemaObject
+	owned := make(map[string]bool)
+	for _, row := range rows {
+		statements, err := s.queryStrings(host, "SHOW CREATE DATABASE "+quoteName(row[0]))
+		if err != nil {
+			return nil, nil, err
+		}
+		databases = append(databases, newSchemaObject(SchemaObjectDatabase, row[0], statements...))
+		owned[row[0]] = databaseOwnsTables(row[1])
+	}
+	return databases, owned, nil
+}
+
+// readTables returns the tables, views and dictionaries of the databases owning their tables, the
+// inner tables of the materialized views are created with them
+func (s *Schemer) readTables(host string, owned map[string]bool) ([]schemaObject, error) {
+	uuids, err := s.exists(host,
+		"SELECT count() FROM system.settings WHERE name = 'show_table_uuid_in_table_create_query_if_not_nil'")
+	if err != nil {
+		return nil, err
+	}
+	sql := fmt.Sprintf(`SELECT database, name, engine_full, create_table_query FROM system.tables
+WHERE database NOT IN (%s) AND database != '' AND create_table_query != ''
+	AND name NOT LIKE '.inner.%%' AND name NOT LIKE '.inner_id.%%'`, systemDatabases)
+	if uuids {
+		sql += "\nSETTINGS show_table_uuid_in_table_create_query_if_not_nil = 1"
+	}
+	rows, err := s.queryRows(host, sql)
+	if err != nil {
+		return nil, err
+	}
+	var tables []schemaObject
+	for _, row := range rows {
+		database, name, engineFull, statement := row[0], row[1], row[2], row[3]
+		if !owned[database] {
+			continue
+		}
+		table := newSchemaObject(tableKind(statement), database+"."+name, statement)
+		table.dependencies = tableDependencies(database, name, engineFull, statement)
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// accessEntities are the kinds of the access entities: the system table listing them and their
+// keyword in SHOW CREATE, in the order they are created
+var accessEntities = []struct {
+	kind, table, keyword string
+}{
+	{SchemaObjectRole, "roles", "ROLE"},
+	{SchemaObjectSettingsProfile, "settings_profiles", "SETTINGS PROFILE"},
+	{SchemaObjectQuota, "quotas", "QUOTA"},
+	{SchemaObjectUser, "users", "USER"},
+}
+
+// readAccessEntities returns the access entities of the local access storages of the host with the
+// grants of its users and roles
+func (s *Schemer) readAccessEntities(host string) ([]schemaObject, error) {
+	var entities []schemaObject
+	var grantees []string
+	for _, entity := range accessEntities {
+		names, err := s.queryStrings(host, fmt.Sprintf("SELECT name FROM system.%s WHERE storage IN (%s)",
+			entity.table, localAccessStorages))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			statements, err := s.queryStrings(host, fmt.Sprintf("SHOW CREATE %s %s", entity.keyword, quoteName(name)))
+			if err != nil {
+				return nil, err
+			}
+			entities = append(entities, newSchemaObject(entity.kind, name, statements...))
+			if entity.kind == SchemaObjectRole || entity.kind == SchemaObjectUser {
+				grantees = append(grantees, name)
+			}
+		}
+	}
+
+	policies, err := s.queryRows(host, fmt.Sprintf("SELECT short_name, database, table FROM system.row_policies WHERE storage IN (%s)",
+		localAccessStorages))
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		statements, err := s.queryStrings(host, fmt.Sprintf("SHOW CREATE ROW POLICY %s ON %s",
+			quoteName(policy[0]), quoteIdentifier(policy[1], policy[2])))
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, newSchemaObject(SchemaObjectRowPolicy,
+			fmt.Sprintf("%s ON %s.%s", policy[0], policy[1], policy[2]), statements...))
+	}
+
+	for _, grantee := range grantees {
+		grants, err := s.queryStrings(host, "SHOW GRANTS FOR "+quoteName(grantee))
+		if err != nil {
+			return nil, err
+		}
+		if len(grants) > 0 {
+			entities = append(entities, newSchemaObject(SchemaObjectGrant, grantee, grants...))
+		}
+	}
+	return entities, nil
+}
+
+// applySchema creates the objects on the host. An object failing is tried again after the others
+// as long as some of them get created, it may depend on one coming later. The objects still failing
+// once the tries are exhausted are returned.
+func (s *Schemer) applySchema(host string, objects []schemaObject) []clickhousev1.SchemaObjectFailure {
+	var failures []clickhousev1.SchemaObjectFailure
+	pending := objects
+	conn := s.getCHConnection(host)
+	errs := make(map[string]error)
+	reached := false
+	log.Infof("Start to create schema for %s", host)
+	err := Retry(defaultMaxTries, "Creating schema on "+host, func() error {
+		if err := conn.Exec("SELECT 1"); err != nil {
+			return err
+		}
+		reached = true
+		for len(pending) > 0 {
+			var failed []schemaObject
+			for _, object := range pending {
+				if err := createSchemaObject(conn, object); err != nil {
+					errs[object.kind+"/"+object.name] = err
+					failed = append(failed, object)
+				}
+			}
+			if len(failed) == len(pending) {
+				return fmt.Errorf("%d objects failed", len(failed))
+			}
+			pending = failed
+		}
+		return nil
+	})
+	if !reached {
+		return append(failures, clickhousev1.SchemaObjectFailure{Host: host, Error: err.Error()})
+	}
+	for _, object := range pending {
+		failures = append(failures, clickhousev1.SchemaObjectFailure{Host: host, Kind: object.kind, Name: object.name,
+			Error: errs[object.kind+"/"+object.name].Error()})
+	}
+	return failures
+}
+
+// createSchemaObject runs the statements of the object, a replicated table whose replica is already
+// in ZooKeeper is attached instead
+func createSchemaObject(conn *connect.CHConnection, object schemaObject) error {
+	for _, statement := range object.statements {
+		err := conn.Exec(statement)
+		if err != nil && strings.Contains(err.Error(), "Code: 253,") && strings.HasPrefix(statement, "CREATE TABLE") {
+			log.Info("Replica is already in ZooKeeper. Trying ATTACH TABLE instead")
+			err = conn.Exec("ATTACH" + strings.TrimPrefix(statement, "CREATE"))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quoteName quotes the name of a database or of an access entity
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
@@ -0,0 +1,121 @@
+package clickhousecluster
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// servicePortNames are the ports of ClickHouse spec.service can expose
+var servicePortNames = map[string]bool{
+	chDefaultHTTPPortName:     true,
+	chDefaultClientPortName:   true,
+	chDefaultExporterPortName: true,
+}
+
+// preserveServiceFields copies into the generated service the fields allocated by Kubernetes that can
+// not be changed or would be allocated again otherwise
+func preserveServiceFields(cur, service *corev1.Service) {
+	// spec.clusterIP field is immutable, need to use already assigned value
+	// From https://kubernetes.io/docs/concepts/services-networking/service/#defining-a-service
+	// Kubernetes assigns this Service an IP address (sometimes called the “cluster IP”), which is used by the Service proxies
+	// See also https://kubernetes.io/docs/concepts/services-networking/service/#virtual-ips-and-service-proxies
+	// You can specify your own cluster IP address as part of a Service creation request. To do this, set the .spec.clusterIP
+	service.Spec.ClusterIP = cur.Spec.ClusterIP
+
+	// the node ports allocated are kept as long as the Service has node ports
+	hasNodePorts := service.Spec.Type == corev1.ServiceTypeNodePort || service.Spec.Type == corev1.ServiceTypeLoadBalancer
+	if hasNodePorts {
+		for i := range service.Spec.Ports {
+			port := &service.Spec.Ports[i]
+			for _, curPort := range cur.Spec.Ports {
+				if port.NodePort == 0 && curPort.Name == port.Name {
+					port.NodePort = curPort.NodePort
+				}
+			}
+		}
+	}
+	if service.Spec.Type == corev1.ServiceTypeLoadBalancer &&
+		service.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal &&
+		cur.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal {
+		service.Spec.HealthCheckNodePort = cur.Spec.HealthCheckNodePort
+	}
+
+	// the annotations set by others, like cloud controllers, are kept, the ones set from spec.service
+	// are replaced
+	managed := make(map[string]bool)
+	for _, k := range strings.Split(cur.Annotations[ManagedAnnotationsKey], ",") {
+		managed[k] = true
+	}
+	managed[ManagedAnnotationsKey] = true
+	if len(cur.Annotations) > 0 {
+		annotations := make(map[string]string)
+		for k, v := range cur.Annotations {
+			if !managed[k] {
+				annotations[k] = v
+			}
+		}
+		for k, v := range service.Annotations {
+			annotations[k] = v
+		}
+		service.Annotations = annotations
+	}
+}
+
+// validateService checks spec.service only sets the fields relevant to its type
+func validateService(cc *clickhousev1.ClickHouseCluster) error {
+	spec := cc.Spec.Service
+	if spec == nil {
+		return nil
+	}
+
+	serviceType := spec.Type
+	switch serviceType {
+	case "":
+		serviceType = corev1.ServiceTypeClusterIP
+	case corev1.ServiceTypeClusterIP, corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
+	default:
+		return fmt.Errorf("service: unsupported type %s", spec.Type)
+	}
+	hasNodePorts := serviceType == corev1.ServiceTypeNodePort || serviceType == corev1.ServiceTypeLoadBalancer
+
+	names := make(map[string]bool)
+	for _, port := range spec.Ports {
+		if !servicePortNames[port.Name] {
+			return fmt.Errorf("service: unknown port %s, must be one of http, client and exporter", port.Name)
+		}
+		if names[port.Name] {
+			return fmt.Errorf("service: port %s is defined more than once", port.Name)
+		}
+		names[port.Name] = true
+		if port.NodePort != 0 && !hasNodePorts {
+			return fmt.Errorf("service: nodePort of port %s requires a NodePort or LoadBalancer Service", port.Name)
+		}
+		if port.NodePort < 0 || port.NodePort > 65535 {
+			return fmt.Errorf("service: invalid nodePort %d of port %s", port.NodePort, port.Name)
+		}
+	}
+
+	if len(spec.LoadBalancerSourceRanges) > 0 && serviceType != corev1.ServiceTypeLoadBalancer {
+		return fmt.Errorf("service: loadBalancerSourceRanges requires a LoadBalancer Service")
+	}
+	for _, sourceRange := range spec.LoadBalancerSourceRanges {
+		if _, _, err := net.ParseCIDR(sourceRange); err != nil {
+			return fmt.Errorf("service: invalid loadBalancerSourceRange %s", sourceRange)
+		}
+	}
+
+	switch spec.ExternalTrafficPolicy {
+	case "":
+	case corev1.ServiceExternalTrafficPolicyTypeCluster, corev1.ServiceExternalTrafficPolicyTypeLocal:
+		if !hasNodePorts {
+			return fmt.Errorf("service: externalTrafficPolicy requires a NodePort or LoadBalancer Service")
+		}
+	default:
+		return fmt.Errorf("service: unsupported externalTrafficPolicy %s", spec.ExternalTrafficPolicy)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package clickhousecluster
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/config"
+)
+
+// Settings of spec.settings are rendered into settings.xml. ClickHouse merges the files of config.d
+// in alphabetical order, so the precedence from low to high is:
+//   built-in config.xml < operator default config (0*.xml) < spec.settings (settings.xml)
+// The sections generated by the operator itself can not be overridden and are rejected.
+
+var (
+	settingNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_\-.]*$`)
+
+	// reservedSettings are generated by the operator
+	reservedSettings = map[string]bool{
+		"remote_servers":        true,
+		"zookeeper":             true,
+		"macros":                true,
+		"http_port":             true,
+		"tcp_port":              true,
+		"interserver_http_port": true,
+		"path":                  true,
+		"users_config":          true,
+		"storage_configuration": true,
+	}
+
+	// knownSettings are the top-level server settings that can be set by spec.settings besides
+	// the ones already present in the operator default config
+	knownSettings = map[string]bool{
+		"asynchronous_metric_log":                      true,
+		"background_buffer_flush_schedule_pool_size":   true,
+		"background_distributed_schedule_pool_size":    true,
+		"background_fetches_pool_size":                 true,
+		"background_message_broker_schedule_pool_size": true,
+		"background_move_pool_size":                    true,
+		"background_pool_size":                         true,
+		"background_schedule_pool_size":                true,
+		"builtin_dictionaries_reload_interval":         true,
+		"compression":                                  true,
+		"crash_log":                                    true,
+		"default_database":                             true,
+		"default_profile":                              true,
+		"default_session_timeout":                      true,
+		"dictionaries_config":                          true,
+		"dictionaries_lazy_load":                       true,
+		"disable_internal_dns_cache":                   true,
+		"distributed_ddl":                              true,
+		"format_schema_path":                           true,
+		"graphite":                                     true,
+		"graphite_rollup":                              true,
+		"keep_alive_timeout":                           true,
+		"listen_host":                                  true,
+		"listen_try":                                   true,
+		"logger":                                       true,
+		"mark_cache_size":                              true,
+		"max_concurrent_queries":                       true,
+		"max_concurrent_queries_for_all_users":         true,
+		"max_connections":                              true,
+		"max_open_files":                               true,
+		"max_partition_size_to_drop":                   true,
+		"max_server_memory_usage":                      true,
+		"max_server_memory_usage_to_ram_ratio":         true,
+		"max_session_timeout":                          true,
+		"max_table_num_to_throw":                       true,
+		"max_table_size_to_drop":                       true,
+		"max_thread_pool_size":                         true,
+		"merge_tree":                                   true,
+		"metric_log":                                   true,
+		"mlock_executable":                             true,
+		"part_log":                                     true,
+		"prometheus":                                   true,
+		"query_log":                                    true,
+		"query_masking_rules":                          true,
+		"query_thread_log":                             true,
+		"replicated_merge_tree":                        true,
+		"text_log":                                     true,
+		"timezone":                                     true,
+		"tmp_path":                                     true,
+		"total_memory_profiler_step":                   true,
+		"total_memory_tracker_sample_probability":      true,
+		"trace_log":                                    true,
+		"umask":                                        true,
+		"uncompressed_cache_size":                      true,
+		"use_minimalistic_part_header_in_zookeeper":    true,
+		"user_files_path":                              true,
+	}
+)
+
+// buildSettingsTree turns the settings into a tree of nested maps, the leaves are XML-escaped values
+func buildSettingsTree(settings map[string]clickhousev1.SettingValue) (map[string]interface{}, error) {
+	tree := make(map[string]interface{})
+	paths := make([]string, 0, len(settings))
+	for path := range settings {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		names := strings.Split(strings.Trim(path, "/"), "/")
+		for _, name := range names {
+			if !settingNameRegexp.MatchString(name) {
+				return nil, fmt.Errorf("setting %s: invalid name %q", path, name)
+			}
+		}
+		node := tree
+		for _, name := range names[:len(names)-1] {
+			child, ok := node[name]
+			if !ok {
+				child = make(map[string]interface{})
+				node[name] = child
+			}
+			section, ok := child.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("setting %s: %s is a value, not a section", path, name)
+			}
+			node = section
+		}
+		leaf := names[len(names)-1]
+		if _, ok := node[leaf]; ok {
+			return nil, fmt.Errorf("setting %s: defined more than once or is a section", path)
+		}
+		var value bytes.Buffer
+		if err := xml.EscapeText(&value, []byte(settings[path])); err != nil {
+			return nil, fmt.Errorf("setting %s: %v", path, err)
+		}
+		node[leaf] = value.String()
+	}
+	return tree, nil
+}
+
+// parseXMLSections returns the top-level sections of a <yandex> config, a section maps to true
+// if it has children and to false if it is a value
+func parseXMLSections(content string) (map[string]bool, error) {
+	sections := make(map[string]bool)
+	decoder := xml.NewDecoder(strings.NewReader(content))
+	var depth int
+	var current string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return sections, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tp := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				current = tp.Name.Local
+				if _, ok := sections[current]; !ok {
+					sections[current] = false
+				}
+			}
+			if depth == 3 {
+				sections[current] = true
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// hasLegacyCustomSettings tells if the custom_settings of a previous release have settings, the
+// <yandex></yandex> it was defaulted to has none
+func hasLegacyCustomSettings(cc *clickhousev1.ClickHouseCluster) bool {
+	if cc.Spec.LegacyCustomSettings == "" {
+		return false
+	}
+	sections, err := parseXMLSections(cc.Spec.LegacyCustomSettings)
+	return err != nil || len(sections) > 0
+}
+
+// validateSettings rejects unknown settings, the ones generated by the operator, and the ones
+// conflicting with the structure of the operator default config
+func validateSettings(cc *clickhousev1.ClickHouseCluster, defaultConfig *config.DefaultConfig) error {
+	if hasLegacyCustomSettings(cc) {
+		return errors.New("custom_settings is the XML config of a previous release, its settings have to be " +
+			"moved to settings, the cluster is left as it is until then")
+	}
+	tree, err := buildSettingsTree(cc.Spec.Settings)
+	if err != nil {
+		return err
+	}
+
+	defaults := make(map[string]bool)
+	for filename, content := range defaultConfig.GetDefaultXMLConfig() {
+		sections, err := parseXMLSections(content)
+		if err != nil {
+			return fmt.Errorf("parse default config %s error: %v", filename, err)
+		}
+		for name, isSection := range sections {
+			defaults[name] = defaults[name] || isSection
+		}
+	}
+
+	for name, value := range tree {
+		if reservedSettings[name] {
+			return fmt.Errorf("setting %s is managed by the operator", name)
+		}
+		isSection, isDefault := defaults[name]
+		if !isDefault && !knownSettings[name] {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		if _, ok := value.(map[string]interface{}); isDefault && isSection && !ok {
+			return fmt.Errorf("setting %s is a section in the default config", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package clickhousecluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const zookeeperDialTimeout = 2 * time.Second
+
+// stuckReasons are the reasons of not ready pods that won't go away without an intervention
+var stuckReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"Unschedulable":              true,
+}
+
+// updateClickHouseStatus writes back the metadata managed by the operator along with the last applied
+// configuration, then the status through the status subresource. The spec is never written back.
+func (r *ReconcileClickHouseCluster) updateClickHouseStatus(original, cc *clickhousev1.ClickHouseCluster,
+	status *clickhousev1.ClickHouseClusterStatus, reconcileErr error) {
+	log := logrus.WithFields(logrus.Fields{"cluster": cc.Name, "namespace": cc.Namespace})
+
+	// a spec is only recorded as the last applied configuration once it has been accepted, and the
+	// image being upgraded once its canary has soaked
+	lastApplied, _ := cc.ComputeLastAppliedConfiguration()
+	if status.IsConditionTrue(clickhousev1.ClusterConfigValid) && !upgradeInProgress(status) {
+		cc.Annotations[clickhousev1.AnnotationLastApplied] = lastApplied
+	}
+	if !reflect.DeepEqual(original.Annotations, cc.Annotations) || !reflect.DeepEqual(original.Finalizers, cc.Finalizers) {
+		patched := original.DeepCopy()
+		patched.Annotations = cc.Annotations
+		patched.Finalizers = cc.Finalizers
+		if err := r.client.Patch(context.TODO(), patched, client.MergeFrom(original)); err != nil {
+			log.WithField("error", err).Error("Issue when updating ClickHouseCluster")
+			return
+		}
+		cc.ResourceVersion = patched.ResourceVersion
+		log.Info("Updating ClickHouseCluster")
+	}
+	if cc.DeletionTimestamp != nil && len(cc.Finalizers) == 0 {
+		// the cluster is gone
+		return
+	}
+
+	setClusterConditions(cc, status, reconcileErr)
+	status.ObservedGeneration = cc.Generation
+	if reflect.DeepEqual(cc.Status, *status) {
+		return
+	}
+	cc.Status = *status.DeepCopy()
+	if err := r.client.Status().Update(context.TODO(), cc); err != nil {
+		log.WithField("error", err).Error("Issue when updating ClickHouseCluster status")
+	}
+}
+
+// setClusterConditions computes the phase and the Ready, Reconciling and Degraded conditions from
+// the status of the shards and the result of the reconcile
+func setClusterConditions(cc *clickhousev1.ClickHouseCluster, status *clickhousev1.ClickHouseClusterStatus,
+	reconcileErr error) {
+	// a deleted cluster only reports its cleanup
+	if cc.DeletionTimestamp != nil {
+		status.Phase = ClusterPhaseDeleting
+		message := "the cleanup is done"
+		if deletion := status.Deletion; deletion != nil && deletion.Step != "" {
+			message = "cleanup step " + deletion.Step
+			if deletion.Message != "" {
+				message += ": " + deletion.Message
+			}
+		}
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonCleaningUp, message)
+		if reconcileErr != nil {
+			status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionTrue, ReasonReconcileError, reconcileErr.Error())
+		} else {
+			status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+		}
+		return
+	}
+
+	generator := NewGenerator(nil, cc, nil)
+	shards := make(map[string]bool)
+	for shardID := 0; shardID < int(cc.Spec.ShardsCount); shardID++ {
+		shards[generator.statefulSetName(shardID)] = true
+	}
+
+	var readyCount, updatingCount, drainingCount, droppingCount, stoppedCount int32
+	var unavailable, expanding, mismatched []string
+	for name, shard := range status.ShardStatus {
+		droppingCount += int32(len(shard.DroppingReplicas))
+		expanding = append(expanding, shard.ExpandingVolumes...)
+		if isShardRemoving(shard) {
+			drainingCount++
+			for _, table := range shard.DrainedTables {
+				if table.Error != "" && !table.Copied {
+					mismatched = append(mismatched, fmt.Sprintf("%s %s: %s", name, table.Name, table.Error))
+				}
+			}
+			continue
+		}
+		// the shard has been removed
+		if !shards[name] {
+			delete(status.ShardStatus, name)
+			continue
+		}
+		// a rollout restarts one host at a time, the shard stays available
+		if shard.Phase == ShardPhaseRunning || shard.Phase == ShardPhaseUpdating {
+			readyCount++
+		}
+		if shard.Phase == ShardPhaseUpdating {
+			updatingCount++
+		}
+		if shard.Phase == ShardPhaseStopped {
+			stoppedCount++
+		}
+		for _, host := range shard.Hosts {
+			if stuckReasons[host.Reason] {
+				unavailable = append(unavailable, fmt.Sprintf("%s: %s", host.Name, host.Reason))
+			}
+		}
+	}
+	sort.Strings(unavailable)
+	sort.Strings(expanding)
+	sort.Strings(mismatched)
+
+	ready := readyCount == cc.Spec.ShardsCount
+	readyMessage := fmt.Sprintf("%d/%d shards are ready", readyCount, cc.Spec.ShardsCount)
+	// the shards being removed are drained before the others are stopped
+	stopping := cc.Spec.Stopped && drainingCount == 0
+	stopped := stopping && stoppedCount == cc.Spec.ShardsCount
+	stoppedMessage := fmt.Sprintf("%d/%d shards are stopped", stoppedCount, cc.Spec.ShardsCount)
+	switch {
+	case stopped:
+		status.Phase = ClusterPhaseStopped
+		status.SetCondition(clickhousev1.ClusterReady, corev1.ConditionFalse, ReasonStopped, stoppedMessage)
+	case stopping:
+		status.Phase = ClusterPhaseUpdating
+		status.SetCondition(clickhousev1.ClusterReady, corev1.ConditionFalse, ReasonStopping, stoppedMessage)
+	case ready:
+		status.Phase = ClusterPhaseRunning
+		status.SetCondition(clickhousev1.ClusterReady, corev1.ConditionTrue, ReasonClusterReady, readyMessage)
+	default:
+		status.Phase = ClusterPhaseInitial
+		status.SetCondition(clickhousev1.ClusterReady, corev1.ConditionFalse, ReasonShardsNotReady, readyMessage)
+	}
+
+	switch {
+	case len(mismatched) > 0:
+		message := fmt.Sprintf("the drain waits for the %s annotation: %s", clickhousev1.AnnotationAcceptDrainMismatch,
+			strings.Join(mismatched, "; "))
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonDrainMismatch, message)
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionTrue, ReasonDrainMismatch, message)
+	case reconcileErr != nil:
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonReconcileError, readyMessage)
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionTrue, ReasonReconcileError, reconcileErr.Error())
+	case stopped:
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionFalse, ReasonStopped, stoppedMessage)
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+	case stopping:
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonStopping, stoppedMessage)
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+	case len(unavailable) > 0:
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonRollingOut, readyMessage)
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionTrue, ReasonHostsUnavailable,
+			strings.Join(unavailable, ", "))
+	case !ready:
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonRollingOut, readyMessage)
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+	case upgradeInProgress(status):
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonCanaryUpgrade,
+			fmt.Sprintf("the canary %s of %s is in phase %s", status.Upgrade.CanaryPod, status.Upgrade.ToImage,
+				status.Upgrade.Phase))
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+	case updatingCount > 0 && rolloutPaused(cc):
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonRolloutPaused,
+			fmt.Sprintf("the rollout is paused by the %s annotation", clickhousev1.AnnotationRolloutPaused))
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+	case updatingCount > 0:
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonRollingOut,
+			fmt.Sprintf("%d shards are being restarted", updatingCount))
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+	case drainingCount > 0:
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonDrainingShards,
+			fmt.Sprintf("%d shards are being removed", drainingCount))
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+	case droppingCount > 0:
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonDroppingReplicas,
+			fmt.Sprintf("%d replicas are being removed", droppingCount))
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+	case len(expanding) > 0:
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionTrue, ReasonExpandingVolumes,
+			"expanding "+strings.Join(expanding, ", "))
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+	default:
+		status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionFalse, ReasonReconcileComplete, "")
+		status.SetCondition(clickhousev1.ClusterDegraded, corev1.ConditionFalse, ReasonAsExpected, "")
+	}
+}
+
+// isShardRemoving tells if the shard is being drained before its removal
+func isShardRemoving(shard *clickhousev1.ShardStatus) bool {
+	return shard.Phase == ShardPhaseDraining || shard.Phase == ShardPhaseDrained
+}
+
+// getHostsStatus returns the state of the replicas of the shard
+func (r *ReconcileClickHouseCluster) getHostsStatus(generator *Generator, shardID int) []clickhousev1.HostStatus {
+	namespace := generator.cc.Namespace
+	replicas := int(generator.cc.Spec.ShardReplicasCount(shardID))
+	hosts := make([]clickhousev1.HostStatus, 0, replicas)
+	for replicaID := 0; replicaID < replicas; replicaID++ {
+		host := clickhousev1.HostStatus{
+			Name: fmt.Sprintf("%s-%d", generator.statefulSetName(shardID), replicaID),
+			FQDN: generator.FQDN(shardID, replicaID, namespace),
+		}
+		pod := &corev1.Pod{}
+		err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: host.Name}, pod)
+		switch {
+		case apierrors.IsNotFound(err):
+			host.Reason = "PodNotFound"
+		case err != nil:
+			logrus.WithFields(logrus.Fields{"namespace": namespace, "pod": host.Name, "error": err}).
+				Warning("get pod error")
+			host.Reason = "Unknown"
+		case isPodReady(pod):
+			host.Ready = true
+		default:
+			host.Reason = podNotReadyReason(pod)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podNotReadyReason returns the most relevant reason why the pod is not ready
+func podNotReadyReason(pod *corev1.Pod) string {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse && condition.Reason != "" {
+			return condition.Reason
+		}
+	}
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, s := range statuses {
+			if s.State.Waiting != nil && s.State.Waiting.Reason != "" {
+				return s.State.Waiting.Reason
+			}
+		}
+	}
+	return "NotReady"
+}
+
+// checkZookeeperReachable returns an error if none of the zookeeper nodes accepts connections
+func checkZookeeperReachable(zookeeper *clickhousev1.ZookeeperConfig) error {
+	if zookeeper == nil || len(zookeeper.Nodes) == 0 {
+		return nil
+	}
+	var lastErr error
+	for _, node := range zookeeper.Nodes {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(node.Host, strconv.Itoa(int(node.Port))), zookeeperDialTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		_ = conn.Close()
+		return nil
+	}
+	return fmt.Errorf("none of the zookeeper nodes is reachable: %v", lastErr)
+}
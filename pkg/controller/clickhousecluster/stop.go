@@ -0,0 +1,87 @@
+package clickhousecluster
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// A stopped cluster keeps everything but its pods: the StatefulSets of the shards are scaled to zero
+// at once, their replicas are neither removed from remote_servers nor dropped from ZooKeeper. Once
+// started again the shards are scaled back one after the other, the next one waiting for the previous
+// one to be ready. A paused cluster is not reconciled at all, only its phase is reported.
+
+// clusterPaused tells if the reconcile of the cluster has been paused by the annotation
+func clusterPaused(cc *clickhousev1.ClickHouseCluster) bool {
+	return cc.Annotations[clickhousev1.AnnotationPaused] == "true"
+}
+
+// clusterStopped tells if the shards of the cluster are to be stopped, the shards being removed are
+// drained first as they need the others running
+func clusterStopped(g *Generator) bool {
+	return g.cc.Spec.Stopped && len(g.removedShards) == 0
+}
+
+// stopShard scales the StatefulSet of the shard to zero, the replicas still to be dropped are kept
+// for when the shard is started again
+func (r *ReconcileClickHouseCluster) stopShard(g *Generator, shardID int, status *clickhousev1.ClickHouseClusterStatus) error {
+	statefulSet := g.generateStatefulSet(shardID)
+	var zero int32
+	statefulSet.Spec.Replicas = &zero
+	log := logrus.WithFields(logrus.Fields{"namespace": statefulSet.Namespace, "name": statefulSet.Name})
+	if err := r.reconcileStatefulSet(g.cc, true, statefulSet); err != nil {
+		log.WithField("error", err).Error("stop statefulSet error")
+		return err
+	}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: statefulSet.Namespace, Name: statefulSet.Name}, statefulSet); err != nil {
+		log.WithField("error", err).Error("get statefulSets error")
+		return err
+	}
+
+	shardStatus := &clickhousev1.ShardStatus{Phase: ShardPhaseStopped}
+	// the StatefulSet is watched, the shard is stopped once its pods are gone
+	if statefulSet.Status.Replicas > 0 {
+		shardStatus.Phase = ShardPhaseStopping
+	}
+	if previous := status.ShardStatus[statefulSet.Name]; previous != nil {
+		shardStatus.DroppingReplicas = previous.DroppingReplicas
+	}
+	status.ShardStatus[statefulSet.Name] = shardStatus
+	return nil
+}
+
+// allShardsStopped tells if the pods of all the shards are gone
+func allShardsStopped(cc *clickhousev1.ClickHouseCluster, status *clickhousev1.ClickHouseClusterStatus) bool {
+	generator := NewGenerator(nil, cc, nil)
+	for shardID := 0; shardID < int(cc.Spec.ShardsCount); shardID++ {
+		shard := status.ShardStatus[generator.statefulSetName(shardID)]
+		if shard == nil || shard.Phase != ShardPhaseStopped {
+			return false
+		}
+	}
+	return true
+}
+
+// updatePausedStatus only reports the phase of a paused cluster, its spec is not observed
+func (r *ReconcileClickHouseCluster) updatePausedStatus(cc *clickhousev1.ClickHouseCluster) {
+	log := logrus.WithFields(logrus.Fields{"cluster": cc.Name, "namespace": cc.Namespace})
+	status := cc.Status.DeepCopy()
+	status.Phase = ClusterPhasePaused
+	status.SetCondition(clickhousev1.ClusterReconciling, corev1.ConditionFalse, ReasonPaused,
+		fmt.Sprintf("the reconcile is paused by the %s annotation", clickhousev1.AnnotationPaused))
+	if reflect.DeepEqual(cc.Status, *status) {
+		return
+	}
+	if cc.Status.Phase != ClusterPhasePaused {
+		r.recorder.Event(cc, corev1.EventTypeNormal, EventClusterPaused, "the operator leaves the cluster as it is")
+	}
+	cc.Status = *status
+	if err := r.client.Status().Update(context.TODO(), cc); err != nil {
+		log.WithField("error", err).Error("Issue when updating ClickHouseCluster status")
+	}
+}
@@ -0,0 +1,228 @@
+package clickhousecluster
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The first volume of spec.storage is mounted at /var/lib/clickhouse/ and is the built-in default disk
+// of ClickHouse, which can not be declared in storage_configuration. The other volumes are mounted under
+// /var/lib/clickhouse-disks/ and declared as disks named after them, so the policies can refer to them.
+
+const (
+	defaultDiskName = "default"
+)
+
+// volumeNameRegexp matches the names valid both in the name of a claim and as an XML tag
+var volumeNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+// diskPath returns where the volume of a disk other than the default one is mounted
+func diskPath(name string) string {
+	return dirPathDisks + name + "/"
+}
+
+// newPersistentVolumeClaim returns the template of a claim, the default StorageClass is used if
+// storageClass is empty
+func newPersistentVolumeClaim(name, storageClass, capacity string) corev1.PersistentVolumeClaim {
+	quantity, _ := resource.ParseQuantity(capacity)
+	claim := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{"ReadWriteOnce"},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: quantity,
+				},
+			},
+		},
+	}
+	if storageClass != "" {
+		claim.Spec.StorageClassName = &storageClass
+	}
+	return claim
+}
+
+// generateStorageXML renders the disks and the policies of spec.storage, the order of the volumes
+// of a policy matters so the XML is written by hand
+func (g *Generator) generateStorageXML() string {
+	storage := g.cc.Spec.Storage
+	if storage == nil || (len(storage.Volumes) <= 1 && len(storage.Policies) == 0) {
+		return "<yandex></yandex>"
+	}
+
+	var b strings.Builder
+	b.WriteString("<yandex>\n    <storage_configuration>")
+	if len(storage.Volumes) > 1 {
+		b.WriteString("\n        <disks>")
+		for _, volume := range storage.Volumes[1:] {
+			fmt.Fprintf(&b, "\n            <%s>", volume.Name)
+			fmt.Fprintf(&b, "\n                <path>%s</path>", diskPath(volume.Name))
+			fmt.Fprintf(&b, "\n            </%s>", volume.Name)
+		}
+		b.WriteString("\n        </disks>")
+	}
+	if len(storage.Policies) > 0 {
+		b.WriteString("\n        <policies>")
+		for _, policy := range storage.Policies {
+			fmt.Fprintf(&b, "\n            <%s>", policy.Name)
+			b.WriteString("\n                <volumes>")
+			for _, volume := range policy.Volumes {
+				fmt.Fprintf(&b, "\n                    <%s>", volume.Name)
+				for _, disk := range volume.Disks {
+					fmt.Fprintf(&b, "\n                        <disk>%s</disk>", disk)
+				}
+				if volume.MaxDataPartSizeBytes > 0 {
+					fmt.Fprintf(&b, "\n                        <max_data_part_size_bytes>%d</max_data_part_size_bytes>",
+						volume.MaxDataPartSizeBytes)
+				}
+				fmt.Fprintf(&b, "\n                    </%s>", volume.Name)
+			}
+			b.WriteString("\n                </volumes>")
+			if policy.MoveFactor != "" {
+				fmt.Fprintf(&b, "\n                <move_factor>%s</move_factor>", policy.MoveFactor)
+			}
+			fmt.Fprintf(&b, "\n            </%s>", policy.Name)
+		}
+		b.WriteString("\n        </policies>")
+	}
+	b.WriteString("\n    </storage_configuration>\n</yandex>")
+	return b.String()
+}
+
+// validateStorage checks the volumes can be claimed and the policies only refer to existing disks
+func validateStorage(cc *clickhousev1.ClickHouseCluster) error {
+	storage := cc.Spec.Storage
+	if storage == nil {
+		return nil
+	}
+
+	disks := map[string]bool{defaultDiskName: true}
+	for i, volume := range storage.Volumes {
+		if i == 0 && volume.Name != defaultDiskName {
+			return fmt.Errorf("storage volume %q: the first volume must be named %s", volume.Name, defaultDiskName)
+		}
+		if i > 0 {
+			if !volumeNameRegexp.MatchString(volume.Name) || len(volume.Name) > 63 {
+				return fmt.Errorf("storage volume %q: invalid name", volume.Name)
+			}
+			if disks[volume.Name] {
+				return fmt.Errorf("storage volume %s is defined more than once", volume.Name)
+			}
+			disks[volume.Name] = true
+		}
+		if _, err := resource.ParseQuantity(volume.Capacity); err != nil {
+			return fmt.Errorf("storage volume %s: invalid capacity: %v", volume.Name, err)
+		}
+	}
+	if len(storage.Volumes) > 0 {
+		if cc.Spec.DataStorageClass != "" {
+			return fmt.Errorf("dataStorageClass can not be set along with storage volumes")
+		}
+		for _, shard := range cc.Spec.Shards {
+			if shard.DataCapacity != "" {
+				return fmt.Errorf("shard %d: dataCapacity can not be set along with storage volumes", shard.ID)
+			}
+		}
+	}
+	if storage.Log != nil {
+		if _, err := resource.ParseQuantity(storage.Log.Capacity); err != nil {
+			return fmt.Errorf("storage log volume: invalid capacity: %v", err)
+		}
+	}
+
+	policies := make(map[string]bool)
+	for _, policy := range storage.Policies {
+		if !settingNameRegexp.MatchString(policy.Name) {
+			return fmt.Errorf("storage policy %q: invalid name", policy.Name)
+		}
+		if policies[policy.Name] {
+			return fmt.Errorf("storage policy %s is defined more than once", policy.Name)
+		}
+		policies[policy.Name] = true
+		if len(policy.Volumes) == 0 {
+			return fmt.Errorf("storage policy %s: no volumes", policy.Name)
+		}
+		if policy.MoveFactor != "" {
+			factor, err := strconv.ParseFloat(policy.MoveFactor, 64)
+			if err != nil || factor < 0 || factor > 1 {
+				return fmt.Errorf("storage policy %s: moveFactor must be a number between 0 and 1", policy.Name)
+			}
+		}
+
+		volumes, used := make(map[string]bool), make(map[string]bool)
+		for _, volume := range policy.Volumes {
+			if !settingNameRegexp.MatchString(volume.Name) || volumes[volume.Name] {
+				return fmt.Errorf("storage policy %s: invalid or duplicated volume name %q", policy.Name, volume.Name)
+			}
+			volumes[volume.Name] = true
+			if len(volume.Disks) == 0 {
+				return fmt.Errorf("storage policy %s: volume %s has no disks", policy.Name, volume.Name)
+			}
+			if volume.MaxDataPartSizeBytes < 0 {
+				return fmt.Errorf("storage policy %s: volume %s: invalid maxDataPartSizeBytes", policy.Name, volume.Name)
+			}
+			for _, disk := range volume.Disks {
+				if !disks[disk] {
+					return fmt.Errorf("storage policy %s: unknown disk %s", policy.Name, disk)
+				}
+				if used[disk] {
+					return fmt.Errorf("storage policy %s: disk %s is used more than once", policy.Name, disk)
+				}
+				used[disk] = true
+			}
+		}
+	}
+	return nil
+}
+
+// validateStorageUpdate rejects the changes of the volumes other than the growth of their capacity,
+// the claims of a StatefulSet can not be changed otherwise
+func validateStorageUpdate(old, cc *clickhousev1.ClickHouseCluster) error {
+	var oldVolumes, newVolumes []clickhousev1.StorageVolume
+	var oldLog, newLog *clickhousev1.StorageVolume
+	if old.Spec.Storage != nil {
+		oldVolumes, oldLog = old.Spec.Storage.Volumes, old.Spec.Storage.Log
+	}
+	if cc.Spec.Storage != nil {
+		newVolumes, newLog = cc.Spec.Storage.Volumes, cc.Spec.Storage.Log
+	}
+	if len(oldVolumes) != 0 || len(newVolumes) != 0 {
+		if len(oldVolumes) != len(newVolumes) {
+			return fmt.Errorf("storage volumes can not be changed")
+		}
+		for i := range newVolumes {
+			oldVolume, newVolume := oldVolumes[i], newVolumes[i]
+			oldVolume.Capacity, newVolume.Capacity = "", ""
+			if !reflect.DeepEqual(oldVolume, newVolume) {
+				return fmt.Errorf("storage volumes can not be changed")
+			}
+			err := validateCapacityUpdate("capacity of storage volume "+newVolumes[i].Name,
+				oldVolumes[i].Capacity, newVolumes[i].Capacity)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if (oldLog == nil) != (newLog == nil) {
+		return fmt.Errorf("storage log volume can not be changed")
+	}
+	if oldLog != nil {
+		oldVolume, newVolume := *oldLog, *newLog
+		oldVolume.Capacity, newVolume.Capacity = "", ""
+		if !reflect.DeepEqual(oldVolume, newVolume) {
+			return fmt.Errorf("storage log volume can not be changed")
+		}
+		return validateCapacityUpdate("capacity of storage log volume", oldLog.Capacity, newLog.Capacity)
+	}
+	return nil
+}
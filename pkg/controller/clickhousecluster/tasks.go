@@ -0,0 +1,125 @@
+package clickhousecluster
+
+import (
+	"sync"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// The SQL run against ClickHouse retries for minutes when the hosts are not ready yet. It is run
+// in the background so a slow cluster does not hold a worker of the controller, the cluster is
+// enqueued again through a channel source when its task is done.
+
+// The names of the tasks
+const (
+	taskCreateTables = "create-tables"
+	taskReloadConfig = "reload-config"
+	taskBackup       = "backup"
+	taskCheckSchema  = "check-schema"
+	// followed by the name of the StatefulSet of the shard
+	taskDrainShardPrefix     = "drain-"
+	taskRemoveShardPrefix    = "remove-"
+	taskRemoveReplicasPrefix = "remove-replicas-"
+	taskDropReplicasPrefix   = "drop-replicas-"
+	taskRolloutPrefix        = "rollout-"
+)
+
+// taskResult is the outcome of a finished task, kept until the cluster is reconciled again
+type taskResult struct {
+	value interface{}
+	err   error
+}
+
+// taskKey identifies a task of a cluster
+type taskKey struct {
+	cluster types.NamespacedName
+	name    string
+}
+
+// backgroundTasks runs at most one task of each name per cluster at a time
+type backgroundTasks struct {
+	mu      sync.Mutex
+	running map[taskKey]bool
+	results map[taskKey]taskResult
+	// events enqueues the cluster of a finished task
+	events chan event.GenericEvent
+}
+
+func newBackgroundTasks() *backgroundTasks {
+	return &backgroundTasks{
+		running: make(map[taskKey]bool),
+		results: make(map[taskKey]taskResult),
+		events:  make(chan event.GenericEvent),
+	}
+}
+
+// run starts the named task of the cluster unless it is running. It returns done with the error of
+// the task once it has finished, the result is only returned once.
+func (t *backgroundTasks) run(cc *clickhousev1.ClickHouseCluster, name string, task func() error) (done bool, err error) {
+	done, _, err = t.runValue(cc, name, func() (interface{}, error) {
+		return nil, task()
+	})
+	return done, err
+}
+
+// runValue is run for the tasks returning a value along with their error
+func (t *backgroundTasks) runValue(cc *clickhousev1.ClickHouseCluster, name string,
+	task func() (interface{}, error)) (done bool, value interface{}, err error) {
+	key := taskKey{cluster: types.NamespacedName{Namespace: cc.Namespace, Name: cc.Name}, name: name}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if result, ok := t.results[key]; ok {
+		delete(t.results, key)
+		return true, result.value, result.err
+	}
+	if t.running[key] {
+		return false, nil, nil
+	}
+	t.running[key] = true
+
+	meta := cc.ObjectMeta.DeepCopy()
+	go func() {
+		value, err := task()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"namespace": key.cluster.Namespace, "name": key.cluster.Name,
+				"task": name, "error": err}).Error("background task error")
+		}
+
+		t.mu.Lock()
+		delete(t.running, key)
+		t.results[key] = taskResult{value: value, err: err}
+		t.mu.Unlock()
+
+		t.events <- event.GenericEvent{Meta: meta, Object: &clickhousev1.ClickHouseCluster{ObjectMeta: *meta}}
+	}()
+	return false, nil, nil
+}
+
+// result returns done with the error of the named task once it has finished, without starting it
+func (t *backgroundTasks) result(cc *clickhousev1.ClickHouseCluster, name string) (done bool, err error) {
+	key := taskKey{cluster: types.NamespacedName{Namespace: cc.Namespace, Name: cc.Name}, name: name}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if result, ok := t.results[key]; ok {
+		delete(t.results, key)
+		return true, result.err
+	}
+	return false, nil
+}
+
+// forget drops the result of the named task of the cluster, all of them if name is empty
+func (t *backgroundTasks) forget(namespace, clusterName, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cluster := types.NamespacedName{Namespace: namespace, Name: clusterName}
+	for key := range t.results {
+		if key.cluster == cluster && (name == "" || key.name == name) {
+			delete(t.results, key)
+		}
+	}
+}
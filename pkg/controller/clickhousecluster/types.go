@@ -9,9 +9,22 @@ const (
 	ClusterPhaseCreating = "Creating"
 	ClusterPhaseUpdating = "Updating"
 	ClusterPhaseRunning  = "Running"
+	ClusterPhaseStopped  = "Stopped"
+	ClusterPhasePaused   = "Paused"
+	ClusterPhaseDeleting = "Deleting"
 
-	ShardPhaseRunning = "Running"
-	ShardPhaseInitial = "Initializing"
+	ShardPhaseRunning  = "Running"
+	ShardPhaseInitial  = "Initializing"
+	ShardPhaseUpdating = "Updating"
+	ShardPhaseDraining = "Draining"
+	ShardPhaseDrained  = "Drained"
+	ShardPhaseStopping = "Stopping"
+	ShardPhaseStopped  = "Stopped"
+
+	UpgradePhaseCanary     = "Canary"
+	UpgradePhaseSoaking    = "Soaking"
+	UpgradePhaseSucceeded  = "Succeeded"
+	UpgradePhaseRolledBack = "RolledBack"
 
 	ShardIDLabelKey  = "shard-id"
 	CreateByLabelKey = "created-by"
@@ -22,9 +35,128 @@ const (
 	LastReplicas         = "last_replicas"
 	ClusterHostsChange   = "cluster-hosts-change"
 
+	// ConfigChecksumAnnotationKey on the pod template restarts the pods when the configuration only
+	// applied at startup changes
+	ConfigChecksumAnnotationKey = "clickhouse.service.diamond.sensetime.com/config-checksum"
+
+	// ManagedAnnotationsKey on the Service lists the annotations set from spec.service, the ones
+	// removed from the spec are removed from the Service while the others are kept
+	ManagedAnnotationsKey = "clickhouse.service.diamond.sensetime.com/managed-annotations"
+
+	// ClusterFinalizer holds a deleted cluster until its cleanup is done
+	ClusterFinalizer = "clickhouse.service.diamond.sensetime.com/cleanup"
+
 	OperatorLabelKey = "clickhouse-operator"
 )
 
+// Reasons of the conditions of the cluster
+const (
+	ReasonValid                = "Valid"
+	ReasonInvalidSpec          = "InvalidSpec"
+	ReasonChangeRefused        = "ChangeRefused"
+	ReasonLegacyUsers          = "LegacyUsers"
+	ReasonLegacyCustomSettings = "LegacyCustomSettings"
+
+	ReasonClusterReady   = "ClusterReady"
+	ReasonShardsNotReady = "ShardsNotReady"
+
+	ReasonReconcileComplete = "ReconcileComplete"
+	ReasonRollingOut        = "RollingOut"
+	ReasonDrainingShards    = "DrainingShards"
+	ReasonDrainMismatch     = "DrainMismatch"
+	ReasonDroppingReplicas  = "DroppingReplicas"
+	ReasonRolloutPaused     = "RolloutPaused"
+	ReasonCanaryUpgrade     = "CanaryUpgrade"
+	ReasonExpandingVolumes  = "ExpandingVolumes"
+	ReasonStopping          = "Stopping"
+	ReasonStopped           = "Stopped"
+	ReasonPaused            = "Paused"
+	ReasonCleaningUp        = "CleaningUp"
+	ReasonReconcileError    = "ReconcileError"
+
+	ReasonHostsUnavailable = "HostsUnavailable"
+	ReasonAsExpected       = "AsExpected"
+
+	ReasonSchemaSynced     = "SchemaSynced"
+	ReasonSchemaSyncing    = "SchemaSyncing"
+	ReasonSchemaSyncFailed = "SchemaSyncFailed"
+	ReasonSchemaDrift      = "SchemaDrift"
+
+	ReasonReachable     = "Reachable"
+	ReasonUnreachable   = "Unreachable"
+	ReasonNotConfigured = "NotConfigured"
+)
+
+// Reasons of the events of the cluster, the refused specs and the schema failures are reported with
+// the reasons of the conditions
+const (
+	EventShardCreated         = "ShardCreated"
+	EventShardUpdated         = "ShardUpdated"
+	EventShardDraining        = "ShardDraining"
+	EventShardDrained         = "ShardDrained"
+	EventShardRemoved         = "ShardRemoved"
+	EventShardDrainFailed     = "ShardDrainFailed"
+	EventReplicasDropped      = "ReplicasDropped"
+	EventReplicasDropFailed   = "ReplicasDropFailed"
+	EventConfigUpdated        = "ConfigUpdated"
+	EventConfigReloaded       = "ConfigReloaded"
+	EventConfigReloadFailed   = "ConfigReloadFailed"
+	EventPodRestarted         = "PodRestarted"
+	EventRolloutBlocked       = "RolloutBlocked"
+	EventCanaryStarted        = "CanaryStarted"
+	EventCanarySoaking        = "CanarySoaking"
+	EventCanarySucceeded      = "CanarySucceeded"
+	EventCanaryRolledBack     = "CanaryRolledBack"
+	EventVolumesExpanding     = "VolumesExpanding"
+	EventVolumeExpandFailed   = "VolumeExpandFailed"
+	EventStatefulSetRecreated = "StatefulSetRecreated"
+	EventTablesCreated        = "TablesCreated"
+	EventZookeeperUnreachable = "ZookeeperUnreachable"
+	EventZookeeperPathDeleted = "ZookeeperPathDeleted"
+	EventZookeeperPathFailed  = "ZookeeperPathDeleteFailed"
+	EventPVCsDeleted          = "PVCsDeleted"
+	EventClusterStopped       = "ClusterStopped"
+	EventClusterPaused        = "ClusterPaused"
+	EventCleanupStepDone      = "CleanupStepDone"
+	EventCleanupFailed        = "CleanupFailed"
+	EventCleanupSkipped       = "CleanupSkipped"
+	EventSchemaRepaired       = "SchemaRepaired"
+	EventSchemaCheckFailed    = "SchemaCheckFailed"
+	EventSchemaObjectsSkipped = "SchemaObjectsSkipped"
+)
+
+// The steps of the cleanup of a deleted cluster
+const (
+	DeletionStepStopWrites          = "StopWrites"
+	DeletionStepBackup              = "Backup"
+	DeletionStepStopShards          = "StopShards"
+	DeletionStepDeletePVCs          = "DeletePVCs"
+	DeletionStepDeleteZookeeperPath = "DeleteZookeeperPath"
+)
+
+// The types of the differences between the tables of the hosts
+const (
+	SchemaDriftMissing  = "Missing"
+	SchemaDriftExtra    = "Extra"
+	SchemaDriftMismatch = "Mismatch"
+)
+
+// The kinds of the objects of the schema replicated to the hosts
+const (
+	SchemaObjectDatabase         = "Database"
+	SchemaObjectFunction         = "Function"
+	SchemaObjectTable            = "Table"
+	SchemaObjectView             = "View"
+	SchemaObjectMaterializedView = "MaterializedView"
+	SchemaObjectDictionary       = "Dictionary"
+	SchemaObjectRole             = "Role"
+	SchemaObjectSettingsProfile  = "SettingsProfile"
+	SchemaObjectQuota            = "Quota"
+	SchemaObjectUser             = "User"
+	SchemaObjectRowPolicy        = "RowPolicy"
+	SchemaObjectGrant            = "Grant"
+)
+
 type Replica struct {
 	Host     string `xml:"host"`
 	Port     int    `xml:"port"`
@@ -33,6 +165,7 @@ type Replica struct {
 }
 
 type Shard struct {
+	Weight              int       `xml:"weight"`
 	InternalReplication bool      `xml:"internal_replication"`
 	Replica             []Replica `xml:"replica"`
 }
@@ -0,0 +1,227 @@
+package clickhousecluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// A canary upgrade restarts the last replica of the first shard with the new image and holds the
+// rollout of the other pods until it has stayed healthy for the soak period. The other shards keep
+// the image they run and are reconciled as usual meanwhile. The last applied configuration is not
+// recorded in the meantime, a failed canary reverts spec.image to the image it still holds.
+
+const (
+	// the shard of the canary
+	canaryShardID      = 0
+	defaultSoakSeconds = 600
+	// the canary is polled as its crashes do not change the StatefulSet
+	canaryCheckInterval = 30 * time.Second
+)
+
+// validateUpgrade checks the durations and thresholds of spec.upgrade
+func validateUpgrade(cc *clickhousev1.ClickHouseCluster) error {
+	spec := cc.Spec.Upgrade
+	if spec == nil {
+		return nil
+	}
+	if spec.SoakSeconds < 0 {
+		return fmt.Errorf("upgrade: soakSeconds can not be negative")
+	}
+	if spec.MaxNewErrors < 0 {
+		return fmt.Errorf("upgrade: maxNewErrors can not be negative")
+	}
+	return nil
+}
+
+// upgradeInProgress tells if a canary upgrade is holding the rollout
+func upgradeInProgress(status *clickhousev1.ClickHouseClusterStatus) bool {
+	return status.Upgrade != nil &&
+		(status.Upgrade.Phase == UpgradePhaseCanary || status.Upgrade.Phase == UpgradePhaseSoaking)
+}
+
+// canaryPod returns the only pod the rollout may restart, empty if there is no canary upgrade
+func canaryPod(status *clickhousev1.ClickHouseClusterStatus) string {
+	if !upgradeInProgress(status) {
+		return ""
+	}
+	return status.Upgrade.CanaryPod
+}
+
+// reconcileUpgrade starts a canary upgrade when the image is changed, checks the canary and reverts
+// the image if it fails. It returns how long to wait before checking the canary again.
+func (r *ReconcileClickHouseCluster) reconcileUpgrade(g *Generator, lastApplied *clickhousev1.ClickHouseCluster,
+	status *clickhousev1.ClickHouseClusterStatus) (time.Duration, error) {
+	cc := g.cc
+	log := logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "name": cc.Name})
+	canary := cc.Spec.Upgrade != nil && cc.Spec.Upgrade.Canary
+
+	if !upgradeInProgress(status) {
+		if !canary || lastApplied == nil || lastApplied.Spec.Image == cc.Spec.Image {
+			return 0, nil
+		}
+		status.Upgrade = &clickhousev1.UpgradeStatus{
+			Phase:     UpgradePhaseCanary,
+			FromImage: lastApplied.Spec.Image,
+			ToImage:   cc.Spec.Image,
+			CanaryPod: g.replicaName(canaryShardID, int(cc.Spec.ShardReplicasCount(canaryShardID))-1),
+		}
+		log.WithFields(logrus.Fields{"from": lastApplied.Spec.Image, "to": cc.Spec.Image}).Info("start canary upgrade")
+		r.recorder.Eventf(cc, corev1.EventTypeNormal, EventCanaryStarted, "upgrade from %s to %s through the canary %s",
+			lastApplied.Spec.Image, cc.Spec.Image, status.Upgrade.CanaryPod)
+		return canaryCheckInterval, nil
+	}
+
+	upgrade := status.Upgrade
+	switch {
+	case !canary:
+		// the rollout goes on without the canary
+		status.Upgrade = nil
+		return 0, nil
+	case cc.Spec.Image == upgrade.FromImage:
+		upgrade.Phase = UpgradePhaseRolledBack
+		upgrade.Message = "the image has been reverted"
+		return 0, nil
+	case cc.Spec.Image != upgrade.ToImage:
+		// the image has been changed again, the canary starts over
+		upgrade.Phase = UpgradePhaseCanary
+		upgrade.ToImage = cc.Spec.Image
+		upgrade.CanaryVersion = ""
+		upgrade.SoakStartTime = nil
+		upgrade.BaselineErrors = 0
+		return canaryCheckInterval, nil
+	}
+
+	pod := &corev1.Pod{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: cc.Namespace, Name: upgrade.CanaryPod}, pod)
+	if err != nil {
+		log.WithFields(logrus.Fields{"pod": upgrade.CanaryPod, "error": err}).Error("get canary pod error")
+		return 0, client.IgnoreNotFound(err)
+	}
+	if podImage(pod) != upgrade.ToImage || pod.DeletionTimestamp != nil {
+		// the rollout has not restarted the canary yet
+		return canaryCheckInterval, nil
+	}
+
+	schemer := NewSchemer(g.operatorCredential())
+	host := g.FQDN(canaryShardID, replicaIndex(upgrade.CanaryPod), cc.Namespace)
+	if upgrade.Phase == UpgradePhaseCanary {
+		if !isPodReady(pod) {
+			if reason := podNotReadyReason(pod); stuckReasons[reason] {
+				return 0, r.rollbackUpgrade(cc, status, fmt.Sprintf("the canary %s is not ready: %s", pod.Name, reason))
+			}
+			return canaryCheckInterval, nil
+		}
+		version, err := schemer.queryString(host, "SELECT version()")
+		if err != nil {
+			return 0, err
+		}
+		errors, err := schemer.queryCount(host, "SELECT sum(value) FROM system.errors")
+		if err != nil {
+			return 0, err
+		}
+		now := metav1.Now()
+		upgrade.Phase = UpgradePhaseSoaking
+		upgrade.CanaryVersion = version
+		upgrade.SoakStartTime = &now
+		upgrade.BaselineErrors = errors
+		log.WithFields(logrus.Fields{"pod": pod.Name, "version": version}).Info("canary soaking")
+		r.recorder.Eventf(cc, corev1.EventTypeNormal, EventCanarySoaking, "the canary %s runs version %s", pod.Name, version)
+		return canaryCheckInterval, nil
+	}
+
+	if !isPodReady(pod) || containerRestarts(pod) > 0 {
+		return 0, r.rollbackUpgrade(cc, status, fmt.Sprintf("the canary %s restarted or is not ready: %s",
+			pod.Name, podNotReadyReason(pod)))
+	}
+	errors, err := schemer.queryCount(host, "SELECT sum(value) FROM system.errors")
+	if err != nil {
+		return 0, err
+	}
+	if errors-upgrade.BaselineErrors > cc.Spec.Upgrade.MaxNewErrors {
+		return 0, r.rollbackUpgrade(cc, status, fmt.Sprintf("%d errors have been added to system.errors of the canary %s",
+			errors-upgrade.BaselineErrors, pod.Name))
+	}
+
+	soak := time.Duration(cc.Spec.Upgrade.SoakSeconds) * time.Second
+	if soak == 0 {
+		soak = defaultSoakSeconds * time.Second
+	}
+	remaining := upgrade.SoakStartTime.Add(soak).Sub(time.Now())
+	if remaining > 0 {
+		if remaining > canaryCheckInterval {
+			remaining = canaryCheckInterval
+		}
+		return remaining, nil
+	}
+	upgrade.Phase = UpgradePhaseSucceeded
+	log.WithField("version", upgrade.CanaryVersion).Info("canary upgrade succeeded")
+	r.recorder.Eventf(cc, corev1.EventTypeNormal, EventCanarySucceeded, "the canary has soaked, the other pods are upgraded to %s",
+		upgrade.ToImage)
+	return 0, nil
+}
+
+// rollbackUpgrade reverts spec.image to the image before the upgrade, the rest of the spec is left
+// as it is
+func (r *ReconcileClickHouseCluster) rollbackUpgrade(cc *clickhousev1.ClickHouseCluster,
+	status *clickhousev1.ClickHouseClusterStatus, message string) error {
+	log := logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "name": cc.Name})
+	upgrade := status.Upgrade
+
+	reverted := cc.DeepCopy()
+	reverted.Spec.Image = upgrade.FromImage
+	if err := r.client.Patch(context.TODO(), reverted, client.MergeFrom(cc)); err != nil {
+		log.WithField("error", err).Error("revert image error")
+		return err
+	}
+	log.WithFields(logrus.Fields{"image": upgrade.FromImage, "reason": message}).Warning("canary upgrade rolled back")
+	r.recorder.Eventf(cc, corev1.EventTypeWarning, EventCanaryRolledBack, "reverted the image to %s: %s", upgrade.FromImage, message)
+	cc.Spec.Image = upgrade.FromImage
+	cc.ResourceVersion = reverted.ResourceVersion
+	upgrade.Phase = UpgradePhaseRolledBack
+	upgrade.Message = message
+	return nil
+}
+
+// podImage returns the image of the ClickHouse container of the pod
+func podImage(pod *corev1.Pod) string {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == ClickHouseContainerName {
+			return container.Image
+		}
+	}
+	return ""
+}
+
+// containerRestarts returns how many times the containers of the pod have been restarted
+func containerRestarts(pod *corev1.Pod) int32 {
+	var restarts int32
+	for _, s := range pod.Status.ContainerStatuses {
+		restarts += s.RestartCount
+	}
+	return restarts
+}
+
+// queryString returns the single string returned by sql on the host
+func (s *Schemer) queryString(host, sql string) (string, error) {
+	query, err := s.getCHConnection(host).Query(sql)
+	if err != nil {
+		return "", err
+	}
+	defer query.Close()
+	var value string
+	if !query.Rows.Next() {
+		return "", fmt.Errorf("no result for %s on %s", sql, host)
+	}
+	if err := query.Rows.Scan(&value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
@@ -0,0 +1,169 @@
+package clickhousecluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultUserName        = "default"
+	defaultUserProfile     = "default"
+	defaultUserQuota       = "default"
+	defaultUserNetwork     = "::/0"
+	defaultUserPasswordKey = "password"
+)
+
+var (
+	userNameRegexp    = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_\-]*$`)
+	userNetworkRegexp = regexp.MustCompile(`^[0-9a-fA-F:./]+$`)
+)
+
+func defaultUserPasswordSecretName(cc *clickhousev1.ClickHouseCluster) string {
+	return fmt.Sprintf("%s-default-password", cc.Name)
+}
+
+// defaultUsers returns the users of a cluster that does not define any, its password is
+// generated into an operator-managed secret by reconcileDefaultUserPassword
+func defaultUsers(cc *clickhousev1.ClickHouseCluster) []clickhousev1.UserConfig {
+	return []clickhousev1.UserConfig{
+		{
+			Name: defaultUserName,
+			Password: clickhousev1.UserPassword{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: defaultUserPasswordSecretName(cc)},
+					Key:                  defaultUserPasswordKey,
+				},
+			},
+			AccessManagement: true,
+		},
+	}
+}
+
+// OperatorUser returns the user the operator and the broker connect to ClickHouse with
+func OperatorUser(cc *clickhousev1.ClickHouseCluster) *clickhousev1.UserConfig {
+	if len(cc.Spec.Users) == 0 {
+		return nil
+	}
+	return &cc.Spec.Users[0]
+}
+
+// GetUserPassword reads the password of the user from the secret it refers to
+func GetUserPassword(cli client.Client, namespace string, user *clickhousev1.UserConfig) (string, error) {
+	ref := user.Password.SecretKeyRef
+	if ref == nil {
+		return "", fmt.Errorf("user %s has no password secretKeyRef", user.Name)
+	}
+	secret := &corev1.Secret{}
+	err := cli.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: ref.Name}, secret)
+	if err != nil {
+		if apierrors.IsNotFound(err) && ref.Optional != nil && *ref.Optional {
+			return "", nil
+		}
+		return "", err
+	}
+	password, ok := secret.Data[ref.Key]
+	if !ok {
+		if ref.Optional != nil && *ref.Optional {
+			return "", nil
+		}
+		return "", fmt.Errorf("can not find key %s in secret %s/%s", ref.Key, namespace, ref.Name)
+	}
+	return string(password), nil
+}
+
+// getUserPasswords returns the password of every user defined, keyed by user name
+func (r *ReconcileClickHouseCluster) getUserPasswords(cc *clickhousev1.ClickHouseCluster) (map[string]string, error) {
+	passwords := make(map[string]string)
+	for i := range cc.Spec.Users {
+		user := &cc.Spec.Users[i]
+		password, err := GetUserPassword(r.client, cc.Namespace, user)
+		if err != nil {
+			return nil, err
+		}
+		passwords[user.Name] = password
+	}
+	return passwords, nil
+}
+
+// reconcileDefaultUserPassword creates the secret of the default user with a random password,
+// the secret is never updated so the password stays the same for the life of the cluster
+func (r *ReconcileClickHouseCluster) reconcileDefaultUserPassword(cc *clickhousev1.ClickHouseCluster) error {
+	name := defaultUserPasswordSecretName(cc)
+	var referenced bool
+	for _, user := range cc.Spec.Users {
+		if user.Password.SecretKeyRef != nil && user.Password.SecretKeyRef.Name == name {
+			referenced = true
+		}
+	}
+	if !referenced {
+		return nil
+	}
+
+	var curSecret corev1.Secret
+	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: cc.Namespace, Name: name}, &curSecret)
+	if err == nil || !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"secret":    name,
+		"namespace": cc.Namespace}).Info("Create default user password Secret")
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cc.Namespace,
+			Labels: map[string]string{
+				ClusterLabelKey: cc.Name,
+			},
+			OwnerReferences: NewGenerator(r, cc, nil).ownerReference(),
+		},
+		Data: map[string][]byte{
+			defaultUserPasswordKey: []byte(RandStringRunes(10)),
+		},
+	}
+	return r.client.Create(context.TODO(), secret)
+}
+
+func validateUsers(cc *clickhousev1.ClickHouseCluster) error {
+	if cc.Spec.LegacyUsers != "" && len(cc.Spec.Users) == 0 {
+		return errors.New("users is the users.xml of a previous release, it has to be rewritten as a list of users " +
+			"with their passwords in Secrets, the cluster is left as it is until then")
+	}
+	names := make(map[string]bool)
+	for _, user := range cc.Spec.Users {
+		if !userNameRegexp.MatchString(user.Name) {
+			return fmt.Errorf("invalid user name %q", user.Name)
+		}
+		if names[user.Name] {
+			return fmt.Errorf("user %s is defined more than once", user.Name)
+		}
+		names[user.Name] = true
+		if user.Password.SecretKeyRef == nil || user.Password.SecretKeyRef.Name == "" ||
+			user.Password.SecretKeyRef.Key == "" {
+			return fmt.Errorf("user %s must have a password secretKeyRef", user.Name)
+		}
+		// the profile and the quota are written as they are into users.xml
+		if user.Profile != "" && !userNameRegexp.MatchString(user.Profile) {
+			return fmt.Errorf("invalid profile %q of user %s", user.Profile, user.Name)
+		}
+		if user.Quota != "" && !userNameRegexp.MatchString(user.Quota) {
+			return fmt.Errorf("invalid quota %q of user %s", user.Quota, user.Name)
+		}
+		for _, network := range user.Networks {
+			if !userNetworkRegexp.MatchString(network) {
+				return fmt.Errorf("invalid network %q of user %s", network, user.Name)
+			}
+		}
+	}
+	return nil
+}
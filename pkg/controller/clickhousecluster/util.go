@@ -1,11 +1,12 @@
 package clickhousecluster
 
 import (
-	"encoding/xml"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"math/rand"
 	"reflect"
+	"sort"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -16,6 +17,7 @@ import (
 	"strings"
 
 	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/config"
 	apiequality "k8s.io/apimachinery/pkg/api/equality"
 )
 
@@ -25,10 +27,27 @@ func doParse(v reflect.Value, indent int, father string) string {
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
 	if v.Kind() == reflect.Map {
-		for _, e := range v.MapKeys() {
+		// sort the keys, so that the output does not change between reconciles
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		for _, e := range keys {
 			tag := e.String()
-			out += fmt.Sprintf("\n%s<%s>%s\n%s</%s>", space, tag, doParse(v.MapIndex(e), indent+1, tag), space, e)
+			value := v.MapIndex(e)
+			if value.Kind() == reflect.Interface {
+				value = value.Elem()
+			}
+			switch value.Kind() {
+			case reflect.Map, reflect.Struct, reflect.Slice, reflect.Ptr:
+				out += fmt.Sprintf("\n%s<%s>%s\n%s</%s>", space, tag, doParse(value, indent+1, tag), space, e)
+			default:
+				out += fmt.Sprintf("\n%s<%s>%s</%s>", space, tag, doParse(value, indent+1, tag), e)
+			}
 		}
 	} else if v.Kind() == reflect.Struct {
 		for i := 0; i < v.NumField(); i++ {
@@ -66,14 +85,31 @@ func isStatefulSetReady(statefulSet *appsv1.StatefulSet) bool {
 		statefulSet.Status.ReadyReplicas == *statefulSet.Spec.Replicas
 }
 
-// sts1 = stored statefulset and sts2 = new generated statefulset
+// sts1 = new generated statefulset and sts2 = stored statefulset, the fields defaulted by the API server
+// are copied into sts1, which is the one sent when they differ
 func statefulSetsAreEqual(sts1, sts2 *appsv1.StatefulSet) bool {
 
 	sts1.Spec.Template.Spec.SchedulerName = sts2.Spec.Template.Spec.SchedulerName
 	sts1.Spec.Template.Spec.DNSPolicy = sts2.Spec.Template.Spec.DNSPolicy // ClusterFirst
 	sts1.Spec.Template.Spec.TerminationGracePeriodSeconds = sts2.Spec.Template.Spec.TerminationGracePeriodSeconds
 	sts1.Spec.Template.Spec.RestartPolicy = sts2.Spec.Template.Spec.RestartPolicy
-	sts1.Spec.Template.Spec.SecurityContext = sts2.Spec.Template.Spec.SecurityContext
+	// the security context may come from spec.podTemplate, it is only defaulted when it is not set
+	if sts1.Spec.Template.Spec.SecurityContext == nil {
+		sts1.Spec.Template.Spec.SecurityContext = sts2.Spec.Template.Spec.SecurityContext
+	}
+
+	//some defaultMode changes make falsepositif, so we bypass this, we already have check on configmap changes.
+	//These fields can not be updated, they are copied before any early return as the generated statefulset
+	//is the one sent as the update
+	sts1.Spec.VolumeClaimTemplates = sts2.Spec.VolumeClaimTemplates
+	sts1.Spec.PodManagementPolicy = sts2.Spec.PodManagementPolicy
+	sts1.Spec.RevisionHistoryLimit = sts2.Spec.RevisionHistoryLimit
+
+	// sidecars may have been added or removed by spec.podTemplate
+	if len(sts1.Spec.Template.Spec.Containers) != len(sts2.Spec.Template.Spec.Containers) ||
+		len(sts1.Spec.Template.Spec.InitContainers) != len(sts2.Spec.Template.Spec.InitContainers) {
+		return false
+	}
 
 	for i := 0; i < len(sts1.Spec.Template.Spec.Containers); i++ {
 		sts1.Spec.Template.Spec.Containers[i].LivenessProbe = sts2.Spec.Template.Spec.Containers[i].LivenessProbe
@@ -83,7 +119,10 @@ func statefulSetsAreEqual(sts1, sts2 *appsv1.StatefulSet) bool {
 		sts1.Spec.Template.Spec.Containers[i].TerminationMessagePath = sts2.Spec.Template.Spec.Containers[i].TerminationMessagePath
 		sts1.Spec.Template.Spec.Containers[i].TerminationMessagePolicy = sts2.Spec.Template.Spec.Containers[i].TerminationMessagePolicy
 
-		sts1.Spec.Template.Spec.Containers[i].SecurityContext = sts2.Spec.Template.Spec.Containers[i].SecurityContext
+		// a security context set by spec.podTemplate is applied, the others are left as defaulted
+		if sts1.Spec.Template.Spec.Containers[i].SecurityContext == nil {
+			sts1.Spec.Template.Spec.Containers[i].SecurityContext = sts2.Spec.Template.Spec.Containers[i].SecurityContext
+		}
 		//sts1.Spec.Template.Spec.Containers[i].Resources = sts2.Spec.Template.Spec.Containers[i].Resources
 	}
 
@@ -96,12 +135,6 @@ func statefulSetsAreEqual(sts1, sts2 *appsv1.StatefulSet) bool {
 		sts1.Spec.Template.Spec.InitContainers[i].TerminationMessagePolicy = sts2.Spec.Template.Spec.InitContainers[i].TerminationMessagePolicy
 	}
 
-	//some defaultMode changes make falsepositif, so we bypass this, we already have check on configmap changes
-	sts1.Spec.VolumeClaimTemplates = sts2.Spec.VolumeClaimTemplates
-	sts1.Spec.PodManagementPolicy = sts2.Spec.PodManagementPolicy
-	sts1.Spec.RevisionHistoryLimit = sts2.Spec.RevisionHistoryLimit
-	sts1.Spec.UpdateStrategy = sts2.Spec.UpdateStrategy
-
 	if !apiequality.Semantic.DeepEqual(sts1.Spec, sts2.Spec) {
 		return false
 	}
@@ -158,51 +191,6 @@ func Retry(tries int, desc string, f func() error) error {
 	return err
 }
 
-func decodeUsersXML(users string) map[string]string {
-	result := make(map[string]string)
-	if strings.TrimSpace(users) == "" {
-		return result
-	}
-	decoder := xml.NewDecoder(strings.NewReader(users))
-	var startRecord bool
-	var lastKey, userKey string
-	for {
-		token, err := decoder.Token()
-		if err == io.EOF {
-			return result
-		}
-		if err != nil {
-			logrus.Errorf("parse Fail: %s", err.Error())
-			return result
-		}
-		switch tp := token.(type) {
-		case xml.StartElement:
-			se := xml.StartElement(tp)
-			if lastKey == "users" || startRecord {
-				userKey = se.Name.Local
-				result[userKey] = ""
-				startRecord = false
-			}
-			lastKey = se.Name.Local
-		case xml.EndElement:
-			ee := xml.EndElement(tp)
-			if ee.Name.Local == userKey {
-				startRecord = true
-			}
-			if ee.Name.Local == "yandex" {
-				return result
-			}
-		case xml.CharData:
-			cd := xml.CharData(tp)
-			data := strings.TrimSpace(string(cd))
-			if len(data) != 0 && lastKey == "password" {
-				result[userKey] = data
-				return result
-			}
-		}
-	}
-}
-
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyz")
 
 func RandStringRunes(n int) string {
@@ -213,22 +201,144 @@ func RandStringRunes(n int) string {
 	return string(b)
 }
 
-func validateResource(cc *clickhousev1.ClickHouseCluster) error {
-	_, err := resource.ParseQuantity(cc.Spec.Resources.Limits.Memory)
-	if err != nil {
+// ValidateCluster checks the spec of the cluster before anything is generated from it
+func ValidateCluster(cc *clickhousev1.ClickHouseCluster, defaultConfig *config.DefaultConfig) error {
+	if err := validateKeeper(cc); err != nil {
+		return err
+	}
+	if err := validateZookeeper(cc); err != nil {
+		return err
+	}
+	if err := validateResource(cc); err != nil {
+		return fmt.Errorf("invalid resources: %v", err)
+	}
+	if err := validateShards(cc); err != nil {
+		return err
+	}
+	if err := validateUsers(cc); err != nil {
+		return err
+	}
+	if err := validateStorage(cc); err != nil {
+		return err
+	}
+	if err := validatePodTemplate(cc); err != nil {
+		return err
+	}
+	if err := validateService(cc); err != nil {
 		return err
 	}
-	_, err = resource.ParseQuantity(cc.Spec.Resources.Limits.CPU)
-	if err != nil {
+	if err := validateUpgrade(cc); err != nil {
 		return err
 	}
-	_, err = resource.ParseQuantity(cc.Spec.Resources.Requests.Memory)
-	if err != nil {
+	if err := validateSchemaCheck(cc); err != nil {
 		return err
 	}
-	_, err = resource.ParseQuantity(cc.Spec.Resources.Requests.CPU)
-	if err != nil {
+	return validateSettings(cc, defaultConfig)
+}
+
+// ValidateClusterUpdate rejects the changes of the spec the operator can not apply to an existing cluster
+func ValidateClusterUpdate(old, cc *clickhousev1.ClickHouseCluster) error {
+	if cc.Spec.DataStorageClass != old.Spec.DataStorageClass {
+		return fmt.Errorf("dataStorageClass can not be changed from %q to %q",
+			old.Spec.DataStorageClass, cc.Spec.DataStorageClass)
+	}
+	// the claims can grow, the StorageClass is checked by CheckVolumeExpansion
+	if err := validateCapacityUpdate("dataCapacity", old.Spec.DataCapacity, cc.Spec.DataCapacity); err != nil {
 		return err
 	}
+	if err := validateStorageUpdate(old, cc); err != nil {
+		return err
+	}
+	if err := validateKeeperUpdate(old, cc); err != nil {
+		return err
+	}
+	// The removed shards are drained then deleted, they can not be added back in the meantime
+	if cc.Spec.ShardsCount > old.Spec.ShardsCount {
+		for name, shard := range old.Status.ShardStatus {
+			if isShardRemoving(shard) {
+				return fmt.Errorf("shardsCount can not be increased while shard %s is being removed", name)
+			}
+		}
+	}
+	for shardID := 0; shardID < int(old.Spec.ShardsCount) && shardID < int(cc.Spec.ShardsCount); shardID++ {
+		err := validateCapacityUpdate(fmt.Sprintf("dataCapacity of shard %d", shardID),
+			old.Spec.ShardDataCapacity(shardID), cc.Spec.ShardDataCapacity(shardID))
+		if err != nil {
+			return err
+		}
+		oldReplicas, newReplicas := old.Spec.ShardReplicasCount(shardID), cc.Spec.ShardReplicasCount(shardID)
+		if newReplicas > oldReplicas && zookeeperConfig(cc) == nil {
+			return fmt.Errorf("replicas of shard %d can not be added without zookeeper configuration", shardID)
+		}
+	}
+	return nil
+}
+
+// lastAppliedCluster returns the cluster as it was last applied by the operator, nil if it never was
+func lastAppliedCluster(cc *clickhousev1.ClickHouseCluster) (*clickhousev1.ClickHouseCluster, error) {
+	if cc.Annotations[clickhousev1.AnnotationLastApplied] == "" {
+		return nil, nil
+	}
+	old := &clickhousev1.ClickHouseCluster{}
+	if err := json.Unmarshal([]byte(cc.Annotations[clickhousev1.AnnotationLastApplied]), old); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+func validateZookeeper(cc *clickhousev1.ClickHouseCluster) error {
+	if zk := zookeeperConfig(cc); zk != nil && len(zk.Nodes) > 0 && zk.Nodes[0].Host != "" {
+		return nil
+	}
+
+	if cc.Spec.ReplicasCount == 1 {
+		return nil
+	}
+
+	return errors.New("must have zookeeper configuration when have replicas")
+}
+
+func validateResource(cc *clickhousev1.ClickHouseCluster) error {
+	for shardID := 0; shardID < int(cc.Spec.ShardsCount); shardID++ {
+		resources := cc.Spec.ShardResources(shardID)
+		quantities := []string{resources.Limits.Memory, resources.Limits.CPU,
+			resources.Requests.Memory, resources.Requests.CPU}
+		for _, quantity := range quantities {
+			_, err := resource.ParseQuantity(quantity)
+			if err != nil {
+				return fmt.Errorf("shard %d: %v", shardID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateShards checks the per-shard overrides refer to existing shards, and that replicated
+// shards have a zookeeper
+func validateShards(cc *clickhousev1.ClickHouseCluster) error {
+	ids := make(map[int32]bool)
+	for _, shard := range cc.Spec.Shards {
+		if shard.ID < 0 || shard.ID >= cc.Spec.ShardsCount {
+			return fmt.Errorf("shard %d is out of range [0, %d)", shard.ID, cc.Spec.ShardsCount)
+		}
+		if ids[shard.ID] {
+			return fmt.Errorf("shard %d is defined more than once", shard.ID)
+		}
+		ids[shard.ID] = true
+		if shard.ReplicasCount < 0 {
+			return fmt.Errorf("shard %d: invalid replicasCount %d", shard.ID, shard.ReplicasCount)
+		}
+		if shard.Weight < 0 {
+			return fmt.Errorf("shard %d: invalid weight %d", shard.ID, shard.Weight)
+		}
+		if shard.DataCapacity != "" {
+			if _, err := resource.ParseQuantity(shard.DataCapacity); err != nil {
+				return fmt.Errorf("shard %d: invalid dataCapacity: %v", shard.ID, err)
+			}
+		}
+		if shard.ReplicasCount > 1 && zookeeperConfig(cc) == nil {
+			return fmt.Errorf("shard %d: must have zookeeper configuration when have replicas", shard.ID)
+		}
+	}
 	return nil
 }
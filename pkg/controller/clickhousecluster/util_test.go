@@ -1,8 +1,28 @@
 package clickhousecluster
 
 import (
-	v1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	v1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 func TestParseRemoteServersXML(t *testing.T) {
@@ -79,3 +99,686 @@ func TestParseZookeeperXML(t *testing.T) {
 	}
 	t.Log(ParseXML(zk))
 }
+
+func TestValidateSettings(t *testing.T) {
+	cases := []struct {
+		settings map[string]v1.SettingValue
+		valid    bool
+	}{
+		{map[string]v1.SettingValue{"merge_tree/parts_to_throw_insert": "600"}, true},
+		{map[string]v1.SettingValue{"merge_tree": "1", "merge_tree/parts_to_throw_insert": "600"}, false},
+		{map[string]v1.SettingValue{"remote_servers/demo": "1"}, false},
+		{map[string]v1.SettingValue{"no_such_setting": "1"}, false},
+		{map[string]v1.SettingValue{"merge_tree/<bad>": "1"}, false},
+	}
+	for _, c := range cases {
+		cc := &v1.ClickHouseCluster{Spec: v1.ClickHouseClusterSpec{Settings: c.settings}}
+		err := validateSettings(cc, &config.DefaultConfig{})
+		if (err == nil) != c.valid {
+			t.Errorf("validate %v: expect valid %v, got %v", c.settings, c.valid, err)
+		}
+	}
+}
+
+func TestLegacyUsers(t *testing.T) {
+	legacy := `{"shardsCount":1,"users":"<yandex><users><default><password>pw</password></default></users></yandex>"}`
+	spec := v1.ClickHouseClusterSpec{}
+	if err := json.Unmarshal([]byte(legacy), &spec); err != nil {
+		t.Fatalf("the users.xml of a previous release is not decoded: %v", err)
+	}
+	if spec.ShardsCount != 1 || spec.Users != nil || !strings.Contains(spec.LegacyUsers, "<password>pw</password>") {
+		t.Fatalf("unexpected spec %+v", spec)
+	}
+	cc := &v1.ClickHouseCluster{Spec: spec}
+	if SetDefaults(cc, &config.DefaultConfig{}); len(cc.Spec.Users) != 0 {
+		t.Error("the users.xml of a previous release is replaced by the default users")
+	}
+	if err := validateUsers(cc); err == nil {
+		t.Error("expect the users.xml of a previous release to be refused")
+	}
+	// it is written back as it is
+	data, err := json.Marshal(spec)
+	if err != nil || !strings.Contains(string(data), `"users":"\u003cyandex\u003e`) {
+		t.Errorf("unexpected users written back: %s %v", data, err)
+	}
+
+	typed := `{"users":[{"name":"admin","password":{"secretKeyRef":{"name":"s","key":"k"}}}]}`
+	if err := json.Unmarshal([]byte(typed), &spec); err != nil || len(spec.Users) != 1 || spec.LegacyUsers != "" {
+		t.Fatalf("unexpected typed users %+v %v", spec, err)
+	}
+}
+
+func TestValidateUsers(t *testing.T) {
+	password := v1.UserPassword{SecretKeyRef: &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "s"}, Key: "k"}}
+	for _, c := range []struct {
+		user  v1.UserConfig
+		valid bool
+	}{
+		{v1.UserConfig{Name: "reader", Password: password, Profile: "readonly", Quota: "default"}, true},
+		{v1.UserConfig{Name: "reader", Password: password, Profile: "readonly</profile><access_management>1"}, false},
+		{v1.UserConfig{Name: "reader", Password: password, Quota: "a<b"}, false},
+		{v1.UserConfig{Name: "reader", Password: password, Networks: []string{"10.0.0.0/8"}}, true},
+		{v1.UserConfig{Name: "reader<", Password: password}, false},
+	} {
+		cc := &v1.ClickHouseCluster{Spec: v1.ClickHouseClusterSpec{Users: []v1.UserConfig{c.user}}}
+		if err := validateUsers(cc); (err == nil) != c.valid {
+			t.Errorf("unexpected validation of %+v: %v", c.user, err)
+		}
+	}
+}
+
+func TestLegacyCustomSettings(t *testing.T) {
+	spec := v1.ClickHouseClusterSpec{}
+	legacy := `{"custom_settings":"<yandex><max_concurrent_queries>200</max_concurrent_queries></yandex>"}`
+	if err := json.Unmarshal([]byte(legacy), &spec); err != nil || !strings.Contains(spec.LegacyCustomSettings, "200") {
+		t.Fatalf("the custom_settings of a previous release are not decoded: %+v %v", spec, err)
+	}
+	cc := &v1.ClickHouseCluster{Spec: spec}
+	if err := validateSettings(cc, &config.DefaultConfig{}); err == nil || !hasLegacyCustomSettings(cc) {
+		t.Error("expect the custom_settings of a previous release to be refused")
+	}
+	data, err := json.Marshal(spec)
+	if err != nil || !strings.Contains(string(data), `"custom_settings":`) {
+		t.Errorf("unexpected custom_settings written back: %s %v", data, err)
+	}
+
+	// the default of the previous releases has no settings to move
+	cc.Spec.LegacyCustomSettings = "<yandex></yandex>"
+	if err := validateSettings(cc, &config.DefaultConfig{}); err != nil {
+		t.Errorf("expect the empty custom_settings to be accepted, got %v", err)
+	}
+}
+
+func TestSetClusterConditions(t *testing.T) {
+	cc := &v1.ClickHouseCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "fack"},
+		Spec:       v1.ClickHouseClusterSpec{ShardsCount: 2},
+	}
+	status := &v1.ClickHouseClusterStatus{ShardStatus: map[string]*v1.ShardStatus{
+		"fack-0": {Phase: ShardPhaseRunning},
+		"fack-1": {Phase: ShardPhaseInitial, Hosts: []v1.HostStatus{{Name: "fack-1-0", Reason: "CrashLoopBackOff"}}},
+		"fack-2": {Phase: ShardPhaseRunning},
+	}}
+	setClusterConditions(cc, status, nil)
+	if _, ok := status.ShardStatus["fack-2"]; ok {
+		t.Error("status of the removed shard is kept")
+	}
+	if status.IsConditionTrue(v1.ClusterReady) || !status.IsConditionTrue(v1.ClusterDegraded) {
+		t.Errorf("expect not ready and degraded, got %v", status.Conditions)
+	}
+
+	status.ShardStatus["fack-1"] = &v1.ShardStatus{Phase: ShardPhaseRunning}
+	setClusterConditions(cc, status, nil)
+	if !status.IsConditionTrue(v1.ClusterReady) || status.IsConditionTrue(v1.ClusterReconciling) ||
+		status.IsConditionTrue(v1.ClusterDegraded) || status.Phase != ClusterPhaseRunning {
+		t.Errorf("expect ready, got %v", status.Conditions)
+	}
+}
+
+func TestWatchPredicates(t *testing.T) {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", Name: "fack-0", ResourceVersion: "1",
+		Labels: map[string]string{ClusterLabelKey: "fack"},
+	}}
+	requests := requestsForObject(handler.MapObject{Meta: sts, Object: sts})
+	if len(requests) != 1 || requests[0].Name != "fack" || requests[0].Namespace != "default" {
+		t.Errorf("expect the cluster fack, got %v", requests)
+	}
+	if requests := requestsForObject(handler.MapObject{Meta: &sts.Spec.Template, Object: sts}); len(requests) != 0 {
+		t.Errorf("expect no request for an unlabeled object, got %v", requests)
+	}
+
+	updated := sts.DeepCopy()
+	if ownedObjectPredicate.Update(event.UpdateEvent{MetaOld: sts, ObjectOld: sts, MetaNew: updated, ObjectNew: updated}) {
+		t.Error("expect the resync to be ignored")
+	}
+	updated.ResourceVersion = "2"
+	if ownedObjectPredicate.Update(event.UpdateEvent{MetaOld: sts, ObjectOld: sts, MetaNew: updated, ObjectNew: updated}) {
+		t.Error("expect the no-op update to be ignored")
+	}
+	updated.Status.ReadyReplicas = 1
+	if !ownedObjectPredicate.Update(event.UpdateEvent{MetaOld: sts, ObjectOld: sts, MetaNew: updated, ObjectNew: updated}) {
+		t.Error("expect the change of the status to be kept")
+	}
+
+	s := runtime.NewScheme()
+	if err := v1.SchemeBuilder.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	referencing := &v1.ClickHouseCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other"}}
+	referencing.Spec.Users = []v1.UserConfig{{Name: "reader", Password: v1.UserPassword{SecretKeyRef: &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "passwords"}, Key: "reader"}}}}
+	mapper := &userSecretMapper{client: fake.NewFakeClientWithScheme(s, referencing,
+		&v1.ClickHouseCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "fack"}})}
+	if names := userSecretNames(referencing); !reflect.DeepEqual(names, []string{"passwords"}) {
+		t.Errorf("unexpected indexed secrets %v", names)
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "passwords"}}
+	if requests := mapper.Map(handler.MapObject{Meta: secret, Object: secret}); len(requests) != 1 || requests[0].Name != "other" {
+		t.Errorf("expect the cluster referencing the secret, got %v", requests)
+	}
+	secret.Labels = map[string]string{ClusterLabelKey: "fack"}
+	if requests := mapper.Map(handler.MapObject{Meta: secret, Object: secret}); len(requests) != 2 {
+		t.Errorf("expect the cluster of the labels and the one referencing the secret, got %v", requests)
+	}
+
+	cc := &v1.ClickHouseCluster{ObjectMeta: metav1.ObjectMeta{Name: "fack", Generation: 1}}
+	newCC := cc.DeepCopy()
+	newCC.Status.Phase = ClusterPhaseRunning
+	if clusterPredicate.Update(event.UpdateEvent{MetaOld: cc, ObjectOld: cc, MetaNew: newCC, ObjectNew: newCC}) {
+		t.Error("expect the change of the status to be ignored")
+	}
+	newCC.Generation = 2
+	if !clusterPredicate.Update(event.UpdateEvent{MetaOld: cc, ObjectOld: cc, MetaNew: newCC, ObjectNew: newCC}) {
+		t.Error("expect the change of the spec to be kept")
+	}
+}
+
+func TestBackgroundTasks(t *testing.T) {
+	tasks := newBackgroundTasks()
+	cc := &v1.ClickHouseCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "fack"}}
+
+	release := make(chan struct{})
+	task := func() error {
+		<-release
+		return fmt.Errorf("fack error")
+	}
+	if done, err := tasks.run(cc, "fack", task); done || err != nil {
+		t.Fatalf("expect the task to be started, got %v %v", done, err)
+	}
+	if done, err := tasks.run(cc, "fack", task); done || err != nil {
+		t.Fatalf("expect the running task to be waited on, got %v %v", done, err)
+	}
+
+	close(release)
+	e := <-tasks.events
+	if e.Meta.GetName() != "fack" {
+		t.Errorf("expect the cluster fack to be enqueued, got %s", e.Meta.GetName())
+	}
+	if done, err := tasks.run(cc, "fack", task); !done || err == nil {
+		t.Errorf("expect the error of the finished task, got %v %v", done, err)
+	}
+}
+
+func TestDistributedEngineRegexp(t *testing.T) {
+	cases := []struct {
+		engineFull string
+		expected   []string
+	}{
+		{"Distributed('fack', 'db', 'events_local', rand())", []string{"fack", "db", "events_local", "rand()"}},
+		{"Distributed(fack, currentDatabase(), events_local, cityHash64(id))",
+			[]string{"fack", "currentDatabase()", "events_local", "cityHash64(id)"}},
+		{"Distributed('fack', 'db', 'events_local')", []string{"fack", "db", "events_local", ""}},
+	}
+	for _, c := range cases {
+		m := distributedEngineRegexp.FindStringSubmatch(c.engineFull)
+		if m == nil || !reflect.DeepEqual(m[1:], c.expected) {
+			t.Errorf("%s: expect %v, got %v", c.engineFull, c.expected, m)
+		}
+	}
+}
+
+func TestDroppingReplicasConditions(t *testing.T) {
+	cc := &v1.ClickHouseCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "fack"},
+		Spec:       v1.ClickHouseClusterSpec{ShardsCount: 1},
+	}
+	status := &v1.ClickHouseClusterStatus{ShardStatus: map[string]*v1.ShardStatus{
+		"fack-0": {Phase: ShardPhaseRunning, DroppingReplicas: []string{"fack-0-1"}},
+	}}
+	setClusterConditions(cc, status, nil)
+	if cond := status.GetCondition(v1.ClusterReconciling); cond == nil || cond.Reason != ReasonDroppingReplicas {
+		t.Errorf("expect reconciling while dropping replicas, got %v", status.Conditions)
+	}
+	if replicaIndex("fack-0-12") != 12 || replicaIndex("fack") != -1 {
+		t.Error("unexpected replica index")
+	}
+}
+
+func TestDrainMismatch(t *testing.T) {
+	cc := &v1.ClickHouseCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "fack"},
+		Spec:       v1.ClickHouseClusterSpec{ShardsCount: 1},
+	}
+	mismatch := v1.DrainedTable{Name: "db.events", Rows: 10, Error: "9 rows copied, 10 expected"}
+	status := &v1.ClickHouseClusterStatus{ShardStatus: map[string]*v1.ShardStatus{
+		"fack-0": {Phase: ShardPhaseRunning},
+		"fack-1": {Phase: ShardPhaseDraining, DrainedTables: []v1.DrainedTable{mismatch}},
+	}}
+	setClusterConditions(cc, status, errors.New("drain shard 1: 9 rows copied, 10 expected"))
+	if cond := status.GetCondition(v1.ClusterDegraded); cond == nil || cond.Reason != ReasonDrainMismatch ||
+		!strings.Contains(cond.Message, v1.AnnotationAcceptDrainMismatch) {
+		t.Errorf("expect the mismatch to be reported, got %v", status.Conditions)
+	}
+
+	d := &shardDrainer{}
+	if err := d.checkCopied("", localTable{}, &mismatch); err == nil || mismatch.Copied {
+		t.Error("expect the mismatch to stop the drain")
+	}
+	d.acceptMismatch = true
+	if err := d.checkCopied("", localTable{}, &mismatch); err != nil || !mismatch.Copied {
+		t.Errorf("expect the mismatch to be accepted, got %v", err)
+	}
+}
+
+func TestRolloutConditions(t *testing.T) {
+	cc := &v1.ClickHouseCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "fack"},
+		Spec:       v1.ClickHouseClusterSpec{ShardsCount: 1},
+	}
+	status := &v1.ClickHouseClusterStatus{ShardStatus: map[string]*v1.ShardStatus{
+		"fack-0": {Phase: ShardPhaseUpdating},
+	}}
+	setClusterConditions(cc, status, nil)
+	if cond := status.GetCondition(v1.ClusterReconciling); cond == nil || cond.Reason != ReasonRollingOut {
+		t.Errorf("expect rolling out, got %v", status.Conditions)
+	}
+	if cond := status.GetCondition(v1.ClusterReady); cond == nil || cond.Status != "True" {
+		t.Errorf("expect ready while rolling out, got %v", status.Conditions)
+	}
+
+	cc.Annotations = map[string]string{v1.AnnotationRolloutPaused: "true"}
+	setClusterConditions(cc, status, nil)
+	if cond := status.GetCondition(v1.ClusterReconciling); cond == nil || cond.Reason != ReasonRolloutPaused {
+		t.Errorf("expect rollout paused, got %v", status.Conditions)
+	}
+}
+
+func TestStoppedConditions(t *testing.T) {
+	cc := &v1.ClickHouseCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "fack"},
+		Spec:       v1.ClickHouseClusterSpec{ShardsCount: 2, Stopped: true},
+	}
+	status := &v1.ClickHouseClusterStatus{ShardStatus: map[string]*v1.ShardStatus{
+		"fack-0": {Phase: ShardPhaseStopped},
+		"fack-1": {Phase: ShardPhaseStopping},
+	}}
+	setClusterConditions(cc, status, nil)
+	if cond := status.GetCondition(v1.ClusterReconciling); cond == nil || cond.Reason != ReasonStopping {
+		t.Errorf("expect stopping, got %v", status.Conditions)
+	}
+	if allShardsStopped(cc, status) {
+		t.Error("expect fack-1 not to be stopped yet")
+	}
+
+	status.ShardStatus["fack-1"].Phase = ShardPhaseStopped
+	setClusterConditions(cc, status, nil)
+	if status.Phase != ClusterPhaseStopped || !allShardsStopped(cc, status) {
+		t.Errorf("expect the cluster to be stopped, got %s", status.Phase)
+	}
+	if cond := status.GetCondition(v1.ClusterReconciling); cond == nil || cond.Status != "False" || cond.Reason != ReasonStopped {
+		t.Errorf("expect the reconcile to be complete, got %v", status.Conditions)
+	}
+
+	cc.Annotations = map[string]string{v1.AnnotationPaused: "true"}
+	if !clusterPaused(cc) {
+		t.Error("expect the cluster to be paused")
+	}
+}
+
+func TestCanaryUpgrade(t *testing.T) {
+	cc := &v1.ClickHouseCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "fack"},
+		Spec: v1.ClickHouseClusterSpec{
+			ShardsCount: 1,
+			Upgrade:     &v1.UpgradeSpec{Canary: true, SoakSeconds: -1},
+		},
+	}
+	if err := validateUpgrade(cc); err == nil {
+		t.Error("expect a negative soakSeconds to be refused")
+	}
+
+	status := &v1.ClickHouseClusterStatus{
+		ShardStatus: map[string]*v1.ShardStatus{"fack-0": {Phase: ShardPhaseUpdating}},
+		Upgrade:     &v1.UpgradeStatus{Phase: UpgradePhaseSoaking, CanaryPod: "fack-0-1"},
+	}
+	if canaryPod(status) != "fack-0-1" {
+		t.Errorf("expect the rollout held on the canary, got %q", canaryPod(status))
+	}
+	setClusterConditions(cc, status, nil)
+	if cond := status.GetCondition(v1.ClusterReconciling); cond == nil || cond.Reason != ReasonCanaryUpgrade {
+		t.Errorf("expect a canary upgrade, got %v", status.Conditions)
+	}
+
+	status.Upgrade.Phase = UpgradePhaseRolledBack
+	if canaryPod(status) != "" {
+		t.Error("expect no canary once rolled back")
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	old := map[string]string{
+		filenameSettingsXML:   "<yandex>\n<max_concurrent_queries>100</max_concurrent_queries>\n<merge_tree><parts_to_throw_insert>300</parts_to_throw_insert></merge_tree>\n</yandex>",
+		filenameAllMacrosJSON: "{}",
+	}
+	reloaded := map[string]string{
+		filenameSettingsXML:   "<yandex>\n<max_concurrent_queries>200</max_concurrent_queries>\n<merge_tree><parts_to_throw_insert>300</parts_to_throw_insert></merge_tree>\n</yandex>",
+		filenameAllMacrosJSON: `{"fack-0-0": ""}`,
+	}
+	changes := changedConfig(old, reloaded)
+	if len(changes) != 2 {
+		t.Fatalf("expect 2 changes, got %v", changes)
+	}
+	for _, change := range changes {
+		if change.needsRestart() {
+			t.Errorf("expect %s to be reloaded", change)
+		}
+	}
+	if change := changes[1]; change.String() != "settings.xml/max_concurrent_queries" || !change.leaf || change.value != "200" {
+		t.Errorf("unexpected change %+v", change)
+	}
+	if configChecksum(old) != configChecksum(reloaded) {
+		t.Error("expect the checksum to ignore the reloaded configuration")
+	}
+	normalized := append(changes, configChange{file: filenameSettingsXML, element: "max_server_memory_usage",
+		value: "10G", leaf: true})
+	if settings := comparedSettings(normalized); !reflect.DeepEqual(settings, map[string]string{"max_concurrent_queries": "200"}) {
+		t.Errorf("expect only the plain integers to be compared, got %v", settings)
+	}
+
+	restarted := map[string]string{
+		filenameSettingsXML: "<yandex>\n<max_concurrent_queries>100</max_concurrent_queries>\n<merge_tree><parts_to_throw_insert>600</parts_to_throw_insert></merge_tree>\n</yandex>",
+	}
+	changes = changedConfig(old, restarted)
+	if len(changes) != 2 || changes[0].String() != "all-macros.json" || !changes[1].needsRestart() || changes[1].leaf {
+		t.Errorf("expect merge_tree to need a restart, got %+v", changes)
+	}
+	if configChecksum(old) == configChecksum(restarted) {
+		t.Error("expect the checksum to change with merge_tree")
+	}
+}
+
+func TestStatefulSetsAreEqual(t *testing.T) {
+	cur := &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{
+		PodManagementPolicy:  appsv1.ParallelPodManagement,
+		VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: "data"}}},
+		Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: ClickHouseContainerName}},
+		}},
+	}}
+	// a sidecar added by spec.podTemplate, with claims the StatefulSet can not be updated to
+	generated := cur.DeepCopy()
+	generated.Spec.PodManagementPolicy = appsv1.OrderedReadyPodManagement
+	generated.Spec.VolumeClaimTemplates[0].Name = "other"
+	generated.Spec.Template.Spec.Containers = append(generated.Spec.Template.Spec.Containers, corev1.Container{Name: "sidecar"})
+	if statefulSetsAreEqual(generated, cur) {
+		t.Fatal("expect the sidecar to be a change")
+	}
+	if !reflect.DeepEqual(generated.Spec.VolumeClaimTemplates, cur.Spec.VolumeClaimTemplates) ||
+		generated.Spec.PodManagementPolicy != cur.Spec.PodManagementPolicy {
+		t.Errorf("expect the immutable fields to be kept, got %v", generated.Spec)
+	}
+
+	// the security context defaulted by the API server is not a change, the one of spec.podTemplate is
+	cur.Spec.Template.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	cur.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{}
+	generated = cur.DeepCopy()
+	generated.Spec.Template.Spec.SecurityContext = nil
+	generated.Spec.Template.Spec.Containers[0].SecurityContext = nil
+	if !statefulSetsAreEqual(generated, cur) {
+		t.Error("expect the defaulted security context to be ignored")
+	}
+	generated = cur.DeepCopy()
+	runAsUser := int64(101)
+	generated.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{RunAsUser: &runAsUser}
+	if statefulSetsAreEqual(generated, cur) {
+		t.Error("expect the security context of the container to be applied")
+	}
+}
+
+func TestStatefulSetEvents(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	r := &ReconcileClickHouseCluster{client: fake.NewFakeClient(), recorder: recorder}
+	cc := &v1.ClickHouseCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "fack"}}
+	replicas := int32(2)
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "fack-0", Annotations: map[string]string{}},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	}
+
+	if err := r.reconcileStatefulSet(cc, true, sts.DeepCopy()); err != nil {
+		t.Fatalf("create statefulset error: %v", err)
+	}
+	if e := <-recorder.Events; e != "Normal ShardCreated created StatefulSet fack-0 with 2 replicas" {
+		t.Errorf("unexpected event %q", e)
+	}
+
+	replicas = 3
+	if err := r.reconcileStatefulSet(cc, true, sts.DeepCopy()); err != nil {
+		t.Fatalf("update statefulset error: %v", err)
+	}
+	if e := <-recorder.Events; e != "Normal ShardUpdated updated StatefulSet fack-0 with 3 replicas" {
+		t.Errorf("unexpected event %q", e)
+	}
+}
+
+func TestDeletionCleanup(t *testing.T) {
+	cc := &v1.ClickHouseCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "fack",
+			Finalizers: []string{"other", legacyPVCFinalizer}},
+		Spec: v1.ClickHouseClusterSpec{ShardsCount: 1, DeletePVC: true},
+	}
+	updateFinalizer(cc)
+	if !reflect.DeepEqual(cc.Finalizers, []string{"other", ClusterFinalizer}) {
+		t.Errorf("expect the legacy finalizer to be replaced, got %v", cc.Finalizers)
+	}
+	cc.Spec.DeletePVC = false
+	updateFinalizer(cc)
+	if !reflect.DeepEqual(cc.Finalizers, []string{"other"}) {
+		t.Errorf("expect the other finalizers to be kept, got %v", cc.Finalizers)
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	service := func(name string, labels map[string]string) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels}}
+	}
+	r := &ReconcileClickHouseCluster{client: fake.NewFakeClient(
+		service("fack", map[string]string{ClusterLabelKey: "fack"}),
+		service("fack-0", map[string]string{ClusterLabelKey: "fack", ShardIDLabelKey: "0"}),
+		service("fack-keeper", map[string]string{KeeperLabelKey: "fack"}),
+		service("other", map[string]string{ClusterLabelKey: "other"}),
+	), recorder: recorder, tasks: newBackgroundTasks()}
+	now := metav1.Now()
+	cc.DeletionTimestamp = &now
+	cc.Finalizers = []string{"other", ClusterFinalizer}
+	status := &v1.ClickHouseClusterStatus{}
+	if err := r.reconcileDeletion(cc, status); err != nil {
+		t.Fatalf("cleanup error: %v", err)
+	}
+	if !reflect.DeepEqual(status.Deletion.CompletedSteps, []string{DeletionStepStopWrites, DeletionStepStopShards}) {
+		t.Errorf("unexpected completed steps %v", status.Deletion.CompletedSteps)
+	}
+	if !reflect.DeepEqual(cc.Finalizers, []string{"other"}) {
+		t.Errorf("expect the finalizer of the operator to be removed, got %v", cc.Finalizers)
+	}
+	services := &corev1.ServiceList{}
+	if err := r.client.List(context.TODO(), services); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, s := range services.Items {
+		left = append(left, s.Name)
+	}
+	sort.Strings(left)
+	if !reflect.DeepEqual(left, []string{"fack-keeper", "other"}) {
+		t.Errorf("expect the Services of the cluster and of its shards to be deleted, got %v", left)
+	}
+
+	cc.Finalizers = []string{ClusterFinalizer}
+	cc.Annotations = map[string]string{v1.AnnotationForceDelete: "true"}
+	status = &v1.ClickHouseClusterStatus{Deletion: &v1.DeletionStatus{Step: DeletionStepDeleteZookeeperPath}}
+	if err := r.reconcileDeletion(cc, status); err != nil || len(cc.Finalizers) != 0 {
+		t.Errorf("expect the forced deletion to remove the finalizer, got %v %v", err, cc.Finalizers)
+	}
+}
+
+func TestPausedClusterDeleted(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := v1.SchemeBuilder.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appsv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	now := metav1.Now()
+	cc := &v1.ClickHouseCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "fack", DeletionTimestamp: &now,
+			Finalizers:  []string{"other", ClusterFinalizer},
+			Annotations: map[string]string{v1.AnnotationPaused: "true"}},
+		Spec: v1.ClickHouseClusterSpec{ShardsCount: 1},
+	}
+	r := &ReconcileClickHouseCluster{client: fake.NewFakeClientWithScheme(s, cc), recorder: record.NewFakeRecorder(10),
+		tasks: newBackgroundTasks(), defaultConfig: &config.DefaultConfig{}}
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "fack"}}
+	if _, err := r.Reconcile(request); err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	deleted := &v1.ClickHouseCluster{}
+	if err := r.client.Get(context.TODO(), request.NamespacedName, deleted); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deleted.Finalizers, []string{"other"}) || deleted.Status.Phase == ClusterPhasePaused {
+		t.Errorf("expect the paused cluster to be cleaned up, got %v %s", deleted.Finalizers, deleted.Status.Phase)
+	}
+}
+
+func TestSchemaStatements(t *testing.T) {
+	cases := []struct {
+		statement string
+		expected  string
+	}{
+		{"CREATE TABLE db.events (id UInt64) ENGINE = MergeTree ORDER BY id",
+			"CREATE TABLE IF NOT EXISTS db.events (id UInt64) ENGINE = MergeTree ORDER BY id"},
+		{"CREATE MATERIALIZED VIEW db.mv TO db.daily AS SELECT id FROM db.events",
+			"CREATE MATERIALIZED VIEW IF NOT EXISTS db.mv TO db.daily AS SELECT id FROM db.events"},
+		{"CREATE DATABASE db\nENGINE = Atomic", "CREATE DATABASE IF NOT EXISTS db\nENGINE = Atomic"},
+		{"CREATE ROW POLICY IF NOT EXISTS p ON db.events", "CREATE ROW POLICY IF NOT EXISTS p ON db.events"},
+		{"CREATE SETTINGS PROFILE readonly SETTINGS readonly = 1", "CREATE SETTINGS PROFILE IF NOT EXISTS readonly SETTINGS readonly = 1"},
+		{"GRANT SELECT ON db.* TO reader", "GRANT SELECT ON db.* TO reader"},
+	}
+	for _, c := range cases {
+		if s := createIfNotExists(c.statement); s != c.expected {
+			t.Errorf("%s: expect %s, got %s", c.statement, c.expected, s)
+		}
+	}
+
+	hidden := []struct {
+		kind, statement string
+		expected        bool
+	}{
+		{SchemaObjectUser, "CREATE USER reader IDENTIFIED WITH sha256_password", true},
+		{SchemaObjectUser, "CREATE USER reader IDENTIFIED WITH sha256_hash BY '8C69' SALT 'AB'", false},
+		{SchemaObjectUser, "CREATE USER reader IDENTIFIED WITH no_password", false},
+		{SchemaObjectUser, "CREATE USER reader IDENTIFIED WITH ldap SERVER 'corp'", false},
+		{SchemaObjectTable, "CREATE TABLE db.m (id UInt64) ENGINE = MySQL('mysql:3306', 'db', 'm', 'root', '[HIDDEN]')", true},
+	}
+	for _, c := range hidden {
+		if got := hiddenSecret(c.kind, c.statement); got != c.expected {
+			t.Errorf("%s: expect hidden %v, got %v", c.statement, c.expected, got)
+		}
+	}
+}
+
+func TestDeclaredAccessObjects(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := v1.SchemeBuilder.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	alice := &v1.ClickHouseUser{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "alice"},
+		Spec: v1.ClickHouseUserSpec{ClusterRef: "fack"}}
+	other := &v1.ClickHouseUser{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "bob"},
+		Spec: v1.ClickHouseUserSpec{ClusterRef: "other"}}
+	r := &ReconcileClickHouseCluster{client: fake.NewFakeClientWithScheme(s, alice, other)}
+	cc := &v1.ClickHouseCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "fack"}}
+
+	excluded, err := r.declaredAccessObjects(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{"User/alice": true, "Grant/alice": true, "Quota/alice_quota": true}
+	if !reflect.DeepEqual(excluded, expected) {
+		t.Errorf("expect %v, got %v", expected, excluded)
+	}
+}
+
+func TestOrderSchema(t *testing.T) {
+	table := func(database, name, engineFull, statement string) schemaObject {
+		object := newSchemaObject(tableKind(statement), database+"."+name, statement)
+		object.dependencies = tableDependencies(database, name, engineFull, statement)
+		return object
+	}
+	objects := []schemaObject{
+		newSchemaObject(SchemaObjectGrant, "reader", "GRANT SELECT ON db.* TO reader"),
+		newSchemaObject(SchemaObjectUser, "reader", "CREATE USER reader IDENTIFIED WITH no_password DEFAULT ROLE analyst"),
+		newSchemaObject(SchemaObjectRole, "analyst", "CREATE ROLE analyst"),
+		table("db", "all_events", "Distributed('fack', 'db', 'events', rand())",
+			"CREATE TABLE db.all_events (id UInt64) ENGINE = Distributed('fack', 'db', 'events', rand())"),
+		table("db", "a_mv", "", "CREATE MATERIALIZED VIEW db.a_mv TO db.daily AS SELECT id FROM db.events"),
+		table("db", "daily", "MergeTree ORDER BY id", "CREATE TABLE db.daily (id UInt64) ENGINE = MergeTree ORDER BY id"),
+		table("db", "dict", "", "CREATE DICTIONARY db.dict (id UInt64) PRIMARY KEY id "+
+			"SOURCE(CLICKHOUSE(HOST 'localhost' PORT tcpPort() TABLE 'events' DB 'db')) LIFETIME(300) LAYOUT(FLAT())"),
+		table("db", "events", "MergeTree ORDER BY id", "CREATE TABLE db.events (id UInt64) ENGINE = MergeTree ORDER BY id"),
+		newSchemaObject(SchemaObjectFunction, "double", "CREATE FUNCTION double AS (x) -> x * 2"),
+		newSchemaObject(SchemaObjectDatabase, "db", "CREATE DATABASE db ENGINE = Atomic"),
+	}
+	var names []string
+	for _, object := range orderSchema(objects) {
+		names = append(names, object.kind+" "+object.name)
+	}
+	expected := []string{"Database db", "Function double", "Table db.daily", "Table db.events",
+		"MaterializedView db.a_mv", "Table db.all_events", "Dictionary db.dict", "Role analyst", "User reader", "Grant reader"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expect %v, got %v", expected, names)
+	}
+
+	err := &schemaSyncError{failures: []v1.SchemaObjectFailure{
+		{Host: "fack-0-0", Kind: SchemaObjectDictionary, Name: "db.dict", Error: "boom"},
+		{Host: "fack-0-1", Kind: SchemaObjectDictionary, Name: "db.dict", Error: "boom"},
+	}}
+	if msg := err.Error(); msg != "2 objects of the schema failed on 2 hosts, Dictionary db.dict on fack-0-0: boom" {
+		t.Errorf("unexpected message %s", msg)
+	}
+	if failures := err.failedObjects(); len(failures) != 2 {
+		t.Errorf("expect the failed objects in the status, got %v", failures)
+	}
+}
+
+func TestSchemaDrifts(t *testing.T) {
+	hosts := []string{"fack-0-0", "fack-0-1", "fack-1-0", "fack-1-1"}
+	tables := map[string]map[string]string{
+		"fack-0-0": {"db.events": "1", "db.daily": "2", "db.tmp": "3"},
+		"fack-0-1": {"db.events": "1", "db.daily": "2"},
+		"fack-1-0": {"db.events": "1", "db.daily": "4"},
+		"fack-1-1": {"db.daily": "2"},
+	}
+	expected := []v1.SchemaDrift{
+		{Host: "fack-1-0", Table: "db.daily", Type: SchemaDriftMismatch},
+		{Host: "fack-1-1", Table: "db.events", Type: SchemaDriftMissing},
+		{Host: "fack-0-0", Table: "db.tmp", Type: SchemaDriftExtra},
+	}
+	drifts := schemaDrifts(hosts, tables)
+	if !reflect.DeepEqual(drifts, expected) {
+		t.Errorf("expect %v, got %v", expected, drifts)
+	}
+	if msg := driftSummary(drifts); msg != "tables missing: 1, extra: 1, mismatched: 1, the first: db.daily Mismatch on fack-1-0" {
+		t.Errorf("unexpected summary %s", msg)
+	}
+	// a table on half of the hosts is missing from the others
+	if drifts := schemaDrifts(hosts[:2], map[string]map[string]string{"fack-0-0": {"db.events": "1"}}); len(drifts) != 1 ||
+		drifts[0].Type != SchemaDriftMissing || drifts[0].Host != "fack-0-1" {
+		t.Errorf("expect db.events to be missing from fack-0-1, got %v", drifts)
+	}
+
+	cc := &v1.ClickHouseCluster{Spec: v1.ClickHouseClusterSpec{SchemaCheck: &v1.SchemaCheckSpec{IntervalSeconds: -1}}}
+	if err := validateSchemaCheck(cc); err == nil {
+		t.Errorf("expect a negative interval to be refused")
+	}
+	cc.Spec.SchemaCheck.IntervalSeconds = 0
+	if interval := schemaCheckInterval(cc); interval != defaultSchemaCheckIntervalSeconds*time.Second {
+		t.Errorf("expect the default interval, got %v", interval)
+	}
+}
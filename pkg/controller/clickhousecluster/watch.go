@@ -0,0 +1,157 @@
+package clickhousecluster
+
+import (
+	"context"
+	"reflect"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// The objects of a cluster are mapped back to it by their labels rather than their owner references:
+// the Services of the shards are owned by the StatefulSets and the PVCs created from the claim
+// templates have no owner at all.
+
+// ownedObjectTypes are the kinds of the objects created for a cluster whose changes are reconciled
+var ownedObjectTypes = []runtime.Object{
+	&appsv1.StatefulSet{},
+	&corev1.Service{},
+	&corev1.ConfigMap{},
+	&corev1.PersistentVolumeClaim{},
+}
+
+// watchOwnedObjects enqueues the cluster an object belongs to when the object changes
+func watchOwnedObjects(c controller.Controller) error {
+	for _, obj := range ownedObjectTypes {
+		err := c.Watch(&source.Kind{Type: obj},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(requestsForObject)},
+			ownedObjectPredicate)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestsForObject maps an object to the cluster named by its labels
+func requestsForObject(obj handler.MapObject) []reconcile.Request {
+	labels := obj.Meta.GetLabels()
+	name := labels[ClusterLabelKey]
+	if name == "" {
+		name = labels[KeeperLabelKey]
+	}
+	if name == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: name}}}
+}
+
+// userSecretIndexField indexes the clusters by the Secrets their users read their passwords from
+const userSecretIndexField = "spec.users.password.secretKeyRef.name"
+
+// watchUserSecrets enqueues the clusters whose users read their passwords from a Secret when the
+// Secret changes, users.xml and remote_servers.xml are generated from them
+func watchUserSecrets(c controller.Controller, mgr manager.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(&clickhousev1.ClickHouseCluster{}, userSecretIndexField,
+		func(obj runtime.Object) []string {
+			return userSecretNames(obj.(*clickhousev1.ClickHouseCluster))
+		})
+	if err != nil {
+		return err
+	}
+	return c.Watch(&source.Kind{Type: &corev1.Secret{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: &userSecretMapper{client: mgr.GetClient()}},
+		ownedObjectPredicate)
+}
+
+// userSecretNames returns the names of the Secrets the users of the cluster read their passwords from
+func userSecretNames(cc *clickhousev1.ClickHouseCluster) []string {
+	var names []string
+	for _, user := range cc.Spec.Users {
+		if ref := user.Password.SecretKeyRef; ref != nil && ref.Name != "" && !containsString(names, ref.Name) {
+			names = append(names, ref.Name)
+		}
+	}
+	return names
+}
+
+// userSecretMapper maps a Secret to the cluster named by its labels and to the clusters with a user
+// whose password secretKeyRef names it, found through the userSecretIndexField index
+type userSecretMapper struct {
+	client client.Client
+}
+
+func (m *userSecretMapper) Map(obj handler.MapObject) []reconcile.Request {
+	requests := requestsForObject(obj)
+	namespace, name := obj.Meta.GetNamespace(), obj.Meta.GetName()
+	clusters := &clickhousev1.ClickHouseClusterList{}
+	err := m.client.List(context.TODO(), clusters, client.InNamespace(namespace),
+		client.MatchingField(userSecretIndexField, name))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"namespace": namespace, "secret": name, "error": err}).Error("list clusters error")
+		return requests
+	}
+	for i := range clusters.Items {
+		cc := &clusters.Items[i]
+		// the cluster named by the labels is already enqueued, the field selector is ignored by the
+		// clients without the index
+		if (len(requests) > 0 && requests[0].Name == cc.Name) || !containsString(userSecretNames(cc), name) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: cc.Name}})
+	}
+	return requests
+}
+
+// clusterPredicate ignores the updates of a cluster only touching its status, which are made by
+// the operator itself. The changes of the metadata are kept as the annotations drive the reconcile.
+var clusterPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		if e.MetaOld.GetGeneration() != e.MetaNew.GetGeneration() {
+			return true
+		}
+		if !reflect.DeepEqual(e.MetaOld.GetDeletionTimestamp(), e.MetaNew.GetDeletionTimestamp()) {
+			return true
+		}
+		return !reflect.DeepEqual(e.MetaOld.GetLabels(), e.MetaNew.GetLabels()) ||
+			!reflect.DeepEqual(e.MetaOld.GetAnnotations(), e.MetaNew.GetAnnotations()) ||
+			!reflect.DeepEqual(e.MetaOld.GetFinalizers(), e.MetaNew.GetFinalizers())
+	},
+}
+
+// ownedObjectPredicate ignores the resyncs and the updates only bumping the resource version or
+// the managed fields, the status of a StatefulSet still counts as the readiness of a shard is
+// waited on
+var ownedObjectPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		if e.MetaOld.GetResourceVersion() == e.MetaNew.GetResourceVersion() {
+			return false
+		}
+		return !reflect.DeepEqual(withoutVolatileFields(e.ObjectOld), withoutVolatileFields(e.ObjectNew))
+	},
+}
+
+// withoutVolatileFields returns a copy of the object without the fields changed by every update
+func withoutVolatileFields(obj runtime.Object) runtime.Object {
+	obj = obj.DeepCopyObject()
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return obj
+	}
+	accessor.SetResourceVersion("")
+	accessor.SetManagedFields(nil)
+	return obj
+}
@@ -0,0 +1,521 @@
+package clickhouseschema
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/controller/clickhousecluster"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// AccessFinalizer holds a deleted user or role until it is dropped from its cluster
+	AccessFinalizer = "clickhouse.service.diamond.sensetime.com/drop-access"
+
+	// driftCheckInterval is how often the users and roles of the hosts are compared with their spec
+	driftCheckInterval = 5 * time.Minute
+)
+
+var (
+	privilegeRegexp     = regexp.MustCompile(`^[A-Za-z][A-Za-z ]*$`)
+	settingNameRegexp   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	numberRegexp        = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+	quotaIntervalRegexp = regexp.MustCompile(`(?i)^[0-9]+ (second|minute|hour|day|week|month|quarter|year)$`)
+	// showGrantRegexp matches a privilege granted in SHOW GRANTS: the privileges, the database, the
+	// table and the grant option. The roles granted have no ON.
+	showGrantRegexp = regexp.MustCompile("^GRANT (.+?) ON (`(?:[^`\\\\]|\\\\.)*`|[^\\s.`]+)\\.(`(?:[^`\\\\]|\\\\.)*`|[^\\s.`]+) TO .*?( WITH GRANT OPTION)?$")
+)
+
+// quotaLimits are the resources a quota can limit
+var quotaLimits = map[string]bool{
+	"queries":        true,
+	"errors":         true,
+	"result_rows":    true,
+	"result_bytes":   true,
+	"read_rows":      true,
+	"read_bytes":     true,
+	"execution_time": true,
+}
+
+// validateGrants checks the privileges are keywords and the columns are granted on a table
+func validateGrants(grants []clickhousev1.Grant) error {
+	for _, grant := range grants {
+		if len(grant.Privileges) == 0 {
+			return errors.New("a grant needs privileges")
+		}
+		for _, privilege := range grant.Privileges {
+			if !privilegeRegexp.MatchString(privilege) {
+				return fmt.Errorf("invalid privilege %q", privilege)
+			}
+		}
+		if len(grant.Columns) > 0 && (grant.Database == "" || grant.Table == "") {
+			return errors.New("the columns of a grant need its database and table")
+		}
+		if grant.Table != "" && grant.Database == "" {
+			return errors.New("the table of a grant needs its database")
+		}
+	}
+	return nil
+}
+
+// validateSettings checks the names of the settings
+func validateSettings(settings map[string]string) error {
+	for name := range settings {
+		if !settingNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid setting %q", name)
+		}
+	}
+	return nil
+}
+
+// validateQuota checks the intervals and the limits of a quota
+func validateQuota(quota []clickhousev1.QuotaInterval) error {
+	for _, interval := range quota {
+		if !quotaIntervalRegexp.MatchString(interval.Interval) {
+			return fmt.Errorf("invalid quota interval %q, like 1 hour", interval.Interval)
+		}
+		if len(interval.Limits) == 0 {
+			return fmt.Errorf("the quota interval %s has no limit", interval.Interval)
+		}
+		for limit := range interval.Limits {
+			if !quotaLimits[limit] {
+				return fmt.Errorf("unknown quota limit %q", limit)
+			}
+		}
+	}
+	return nil
+}
+
+// settingsClause returns the SETTINGS clause of a user or a role, SETTINGS NONE removes the ones
+// set by others
+func settingsClause(profile string, settings map[string]string) string {
+	var elements []string
+	if profile != "" {
+		elements = append(elements, "PROFILE "+sqlString(profile))
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := settings[name]
+		if !numberRegexp.MatchString(value) {
+			value = sqlString(value)
+		}
+		elements = append(elements, name+" = "+value)
+	}
+	if len(elements) == 0 {
+		return " SETTINGS NONE"
+	}
+	return " SETTINGS " + strings.Join(elements, ", ")
+}
+
+// grantAtom is a privilege on a column or on all the columns of a table, a database or the server
+type grantAtom struct {
+	privilege, column, database, table string
+}
+
+// target returns the object of the privilege in a GRANT or a REVOKE
+func (a grantAtom) target() string {
+	database, table := "*", "*"
+	if a.database != "*" {
+		database = quoteName(a.database)
+	}
+	if a.table != "*" {
+		table = quoteName(a.table)
+	}
+	return database + "." + table
+}
+
+// privilegeOn returns the privilege restricted to its column
+func (a grantAtom) privilegeOn() string {
+	if a.column == "" {
+		return a.privilege
+	}
+	return a.privilege + "(" + quoteName(a.column) + ")"
+}
+
+// declaredGrants returns the privileges of the grants with their grant option
+func declaredGrants(grants []clickhousev1.Grant) map[grantAtom]bool {
+	atoms := make(map[grantAtom]bool)
+	for _, grant := range grants {
+		database, table := "*", "*"
+		if grant.Database != "" {
+			database = grant.Database
+		}
+		if grant.Table != "" {
+			table = grant.Table
+		}
+		columns := grant.Columns
+		if len(columns) == 0 {
+			columns = []string{""}
+		}
+		for _, privilege := range grant.Privileges {
+			for _, column := range columns {
+				atom := grantAtom{normalizePrivilege(privilege), column, database, table}
+				atoms[atom] = atoms[atom] || grant.GrantOption
+			}
+		}
+	}
+	return atoms
+}
+
+// parseShowGrants returns the privileges granted by the statements of SHOW GRANTS with their grant
+// option, the roles granted and the partial revokes are left out
+func parseShowGrants(statements []string) map[grantAtom]bool {
+	atoms := make(map[grantAtom]bool)
+	for _, statement := range statements {
+		m := showGrantRegexp.FindStringSubmatch(statement)
+		if m == nil {
+			continue
+		}
+		database, table, option := unquoteName(m[2]), unquoteName(m[3]), m[4] != ""
+		for _, privilege := range splitPrivileges(m[1]) {
+			columns := []string{""}
+			if i := strings.Index(privilege, "("); i > 0 && strings.HasSuffix(privilege, ")") {
+				columns = nil
+				for _, column := range splitPrivileges(privilege[i+1 : len(privilege)-1]) {
+					columns = append(columns, unquoteName(column))
+				}
+				privilege = privilege[:i]
+			}
+			for _, column := range columns {
+				atom := grantAtom{normalizePrivilege(privilege), column, database, table}
+				atoms[atom] = atoms[atom] || option
+			}
+		}
+	}
+	return atoms
+}
+
+// splitPrivileges splits the privileges of a GRANT on the commas out of the column lists
+func splitPrivileges(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+func normalizePrivilege(privilege string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(privilege), " "))
+}
+
+// unquoteName returns the name quoted by the server when needed
+func unquoteName(name string) string {
+	if len(name) < 2 || name[0] != '`' || name[len(name)-1] != '`' {
+		return name
+	}
+	return strings.NewReplacer("\\`", "`", `\\`, `\`).Replace(name[1 : len(name)-1])
+}
+
+// grantStatements returns the statements replacing the privileges of the grantee by the grants,
+// current are the grants shown by SHOW GRANTS. Only the privileges no longer declared are revoked,
+// the ones still declared are kept while the grants are applied.
+func grantStatements(grantee, onCluster string, grants []clickhousev1.Grant, current []string) []string {
+	declared := declaredGrants(grants)
+	revoked := make(map[string][]string)
+	revokedOptions := make(map[string][]string)
+	for atom, option := range parseShowGrants(current) {
+		declaredOption, ok := declared[atom]
+		if !ok {
+			revoked[atom.target()] = append(revoked[atom.target()], atom.privilegeOn())
+		} else if option && !declaredOption {
+			revokedOptions[atom.target()] = append(revokedOptions[atom.target()], atom.privilegeOn())
+		}
+	}
+	var statements []string
+	for _, target := range sortedKeys(revoked) {
+		sort.Strings(revoked[target])
+		statements = append(statements, fmt.Sprintf("REVOKE%s %s ON %s FROM %s", onCluster,
+			strings.Join(revoked[target], ", "), target, grantee))
+	}
+	for _, target := range sortedKeys(revokedOptions) {
+		sort.Strings(revokedOptions[target])
+		statements = append(statements, fmt.Sprintf("REVOKE%s GRANT OPTION FOR %s ON %s FROM %s", onCluster,
+			strings.Join(revokedOptions[target], ", "), target, grantee))
+	}
+
+	for _, grant := range grants {
+		var columns string
+		if len(grant.Columns) > 0 {
+			quoted := make([]string, 0, len(grant.Columns))
+			for _, column := range grant.Columns {
+				quoted = append(quoted, quoteName(column))
+			}
+			columns = "(" + strings.Join(quoted, ", ") + ")"
+		}
+		privileges := make([]string, 0, len(grant.Privileges))
+		for _, privilege := range grant.Privileges {
+			privileges = append(privileges, strings.ToUpper(privilege)+columns)
+		}
+		database, table := "*", "*"
+		if grant.Database != "" {
+			database = quoteName(grant.Database)
+		}
+		if grant.Table != "" {
+			table = quoteName(grant.Table)
+		}
+		sql := fmt.Sprintf("GRANT%s %s ON %s.%s TO %s", onCluster, strings.Join(privileges, ", "), database, table, grantee)
+		if grant.GrantOption {
+			sql += " WITH GRANT OPTION"
+		}
+		statements = append(statements, sql)
+	}
+	return statements
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// currentGrants returns the statements of SHOW GRANTS for the user or the role on the host, none
+// when it does not exist yet. table is the system table listing it, users or roles.
+func currentGrants(sql *clickhousecluster.ClusterSQL, host, table, name string) ([]string, error) {
+	names, err := sql.QueryStrings(host, fmt.Sprintf("SELECT name FROM system.%s WHERE name = %s", table, sqlString(name)))
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	return sql.QueryStrings(host, "SHOW GRANTS FOR "+quoteName(name))
+}
+
+// quotaStatement returns the statement replacing the quota of the user, or dropping it when the
+// user has no quota
+func quotaStatement(quota, user, onCluster string, intervals []clickhousev1.QuotaInterval) string {
+	if len(intervals) == 0 {
+		return "DROP QUOTA IF EXISTS " + quota + onCluster
+	}
+	limits := make([]string, 0, len(intervals))
+	for _, interval := range intervals {
+		names := make([]string, 0, len(interval.Limits))
+		for name := range interval.Limits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		max := make([]string, 0, len(names))
+		for _, name := range names {
+			max = append(max, fmt.Sprintf("%s = %d", name, interval.Limits[name]))
+		}
+		limits = append(limits, fmt.Sprintf("FOR INTERVAL %s MAX %s", interval.Interval, strings.Join(max, ", ")))
+	}
+	return fmt.Sprintf("CREATE QUOTA OR REPLACE %s%s %s TO %s", quota, onCluster, strings.Join(limits, ", "), user)
+}
+
+// firstAnswering returns the first host of the cluster answering
+func firstAnswering(sql *clickhousecluster.ClusterSQL) (string, error) {
+	for _, host := range sql.Hosts() {
+		if sql.Answers(host) {
+			return host, nil
+		}
+	}
+	return "", errors.New("none of the hosts answered")
+}
+
+// fingerprint returns the hash of the rows returned by the queries on the host, the definition and
+// the grants of a user or a role
+func fingerprint(sql *clickhousecluster.ClusterSQL, host string, queries []string) (string, error) {
+	hash := sha256.New()
+	for _, query := range queries {
+		rows, err := sql.QueryStrings(host, query)
+		if err != nil {
+			return "", err
+		}
+		for _, row := range rows {
+			hash.Write([]byte(row + "\n"))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// driftedHosts returns the hosts answering whose user or role is missing or differs from the hash
+// read once it was applied, or where the user can not log in with its password
+func driftedHosts(sql *clickhousecluster.ClusterSQL, queries []string, appliedHash string,
+	canLogin func(host string) bool) []string {
+	var drifted []string
+	for _, host := range sql.Hosts() {
+		if !sql.Answers(host) {
+			continue
+		}
+		hash, err := fingerprint(sql, host, queries)
+		if err != nil || hash != appliedHash || (canLogin != nil && !canLogin(host)) {
+			drifted = append(drifted, host)
+		}
+	}
+	return drifted
+}
+
+// checkDue tells if the hosts have to be compared with the spec, and how long until they do
+func checkDue(lastCheckTime *metav1.Time) (bool, time.Duration) {
+	if lastCheckTime == nil {
+		return true, 0
+	}
+	wait := driftCheckInterval - time.Since(lastCheckTime.Time)
+	return wait <= 0, wait
+}
+
+// setFinalizer adds or removes the finalizer dropping a user or a role
+func (r *reconciler) setFinalizer(obj declaredObject, present bool) error {
+	finalizers := []string{}
+	var found bool
+	for _, finalizer := range obj.GetFinalizers() {
+		if finalizer == AccessFinalizer {
+			found = true
+			continue
+		}
+		finalizers = append(finalizers, finalizer)
+	}
+	if found == present {
+		return nil
+	}
+	if present {
+		finalizers = append(finalizers, AccessFinalizer)
+	}
+	obj.SetFinalizers(finalizers)
+	return r.client.Update(context.TODO(), obj)
+}
+
+// dropAccess drops a deleted user or role from its cluster then removes the finalizer, nothing is
+// dropped when the cluster is gone. It waits for the cluster to be ready otherwise.
+func (r *reconciler) dropAccess(obj declaredObject, clusterRef string, statements func(onCluster string) []string) error {
+	if clusterRef != "" {
+		sql, cc, _, err := r.clusterSQL(obj.GetNamespace(), clusterRef)
+		if err != nil {
+			return err
+		}
+		if sql == nil && cc != nil && cc.DeletionTimestamp == nil {
+			return nil
+		}
+		if sql != nil {
+			if err := r.exec(obj, sql, statements(sql.OnCluster())); err != nil {
+				return err
+			}
+		}
+	}
+	return r.setFinalizer(obj, false)
+}
+
+// accessDefinition is what the reconcile of a user or a role needs to apply it and to compare the
+// hosts with it
+type accessDefinition struct {
+	clusterRef string
+	// invalid is why the spec is refused
+	invalid error
+	// statements create the user or the role and replace its settings, privileges and quota
+	statements func(sql *clickhousecluster.ClusterSQL) ([]string, error)
+	// queries read the definition and the grants of the user or the role on a host
+	queries []string
+	// canLogin tells if the user can log in to a host with its password, nil for a role
+	canLogin func(sql *clickhousecluster.ClusterSQL, host string) bool
+}
+
+// reconcileAccess applies a user or a role when its spec changed. Otherwise the hosts are compared
+// with it every driftCheckInterval, and it is applied again when one of them differs, reverting the
+// changes made by others. The status of a role is converted to the one of a user, they have the
+// same fields.
+func (r *reconciler) reconcileAccess(obj declaredObject, status *clickhousev1.ClickHouseUserStatus,
+	access *accessDefinition) (reconcile.Result, error) {
+	requeue := reconcile.Result{RequeueAfter: driftCheckInterval}
+	if !upToDate(obj.GetGeneration(), status.ObservedGeneration, status.Phase) {
+		*status = clickhousev1.ClickHouseUserStatus{ObservedGeneration: obj.GetGeneration()}
+		if access.invalid != nil {
+			status.Phase, status.Message, _ = r.refuse(obj, access.invalid)
+			return reconcile.Result{}, nil
+		}
+		sql, _, pending, err := r.clusterSQL(obj.GetNamespace(), access.clusterRef)
+		if err != nil {
+			status.Phase, status.Message = PhaseFailed, err.Error()
+			return reconcile.Result{}, err
+		}
+		if sql == nil {
+			status.Phase, status.Message = PhasePending, pending
+			return reconcile.Result{}, nil
+		}
+		hash, err := r.applyAccess(obj, sql, access)
+		if err != nil {
+			status.Phase, status.Message = PhaseFailed, err.Error()
+			return reconcile.Result{}, err
+		}
+		now := metav1.Now()
+		status.Phase, status.AppliedHash, status.LastCheckTime = PhaseCreated, hash, &now
+		r.recorder.Event(obj, corev1.EventTypeNormal, EventSchemaApplied,
+			fmt.Sprintf("applied to the cluster %s", access.clusterRef))
+		return requeue, nil
+	}
+	if status.Phase != PhaseCreated {
+		return reconcile.Result{}, nil
+	}
+
+	due, wait := checkDue(status.LastCheckTime)
+	if !due {
+		return reconcile.Result{RequeueAfter: wait}, nil
+	}
+	sql, _, _, err := r.clusterSQL(obj.GetNamespace(), access.clusterRef)
+	if err != nil || sql == nil {
+		// checked again once the cluster is ready
+		return reconcile.Result{}, err
+	}
+	var canLogin func(host string) bool
+	if access.canLogin != nil {
+		canLogin = func(host string) bool { return access.canLogin(sql, host) }
+	}
+	drifted := driftedHosts(sql, access.queries, status.AppliedHash, canLogin)
+	now := metav1.Now()
+	status.LastCheckTime = &now
+	if len(drifted) == 0 {
+		return requeue, nil
+	}
+	hash, err := r.applyAccess(obj, sql, access)
+	if err != nil {
+		status.Phase, status.Message = PhaseFailed, err.Error()
+		return reconcile.Result{}, err
+	}
+	status.AppliedHash = hash
+	r.recorder.Event(obj, corev1.EventTypeNormal, EventDriftReverted,
+		fmt.Sprintf("reverted the changes made on %s", strings.Join(drifted, ", ")))
+	return requeue, nil
+}
+
+// applyAccess runs the statements of a user or a role on the cluster, and returns the hash of its
+// definition and grants read back from a host
+func (r *reconciler) applyAccess(obj declaredObject, sql *clickhousecluster.ClusterSQL,
+	access *accessDefinition) (string, error) {
+	statements, err := access.statements(sql)
+	if err != nil {
+		return "", err
+	}
+	if err := r.exec(obj, sql, statements); err != nil {
+		return "", err
+	}
+	host, err := firstAnswering(sql)
+	if err != nil {
+		return "", err
+	}
+	return fingerprint(sql, host, access.queries)
+}
@@ -0,0 +1,196 @@
+package clickhouseschema
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestUserStatements(t *testing.T) {
+	user := &v1.ClickHouseUser{
+		ObjectMeta: metav1.ObjectMeta{Name: "alice"},
+		Spec: v1.ClickHouseUserSpec{
+			ClusterRef: "demo",
+			Roles:      []string{"analyst"},
+			Grants: []v1.Grant{
+				{Privileges: []string{"select"}, Database: "db", Table: "events", Columns: []string{"id", "ts"}},
+				{Privileges: []string{"INSERT", "ALTER UPDATE"}, Database: "db", GrantOption: true},
+			},
+			SettingsProfile: "default",
+			Settings:        map[string]string{"max_memory_usage": "10000000000", "load_balancing": "random"},
+			Quota:           []v1.QuotaInterval{{Interval: "1 hour", Limits: map[string]int64{"queries": 1000, "errors": 10}}},
+		},
+	}
+	if err := validateUser(&v1.ClickHouseUser{Spec: user.Spec}, nil); err == nil {
+		t.Error("expect a user without password secret to be invalid")
+	}
+	user.Spec.Password.SecretKeyRef = &corev1.SecretKeySelector{Key: "password"}
+	if err := validateUser(user, nil); err != nil {
+		t.Fatalf("unexpected invalid user: %v", err)
+	}
+
+	// the privileges still declared are kept, the others and the grant options no longer declared are revoked
+	current := []string{
+		"GRANT SELECT(id, ts), INSERT ON db.events TO alice",
+		"GRANT INSERT ON db.* TO alice WITH GRANT OPTION",
+		"GRANT ALTER UPDATE ON db.* TO alice",
+		"GRANT SELECT ON `other db`.* TO alice WITH GRANT OPTION",
+		"GRANT analyst, admin TO alice",
+	}
+	statements := userStatements(user, "secret", []string{"analyst", "admin"}, current, " ON CLUSTER `demo`")
+	expected := []string{
+		"CREATE USER IF NOT EXISTS `alice` ON CLUSTER `demo`",
+		"ALTER USER `alice` ON CLUSTER `demo` IDENTIFIED WITH sha256_hash BY " +
+			"'2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b' DEFAULT ROLE ALL " +
+			"SETTINGS PROFILE 'default', load_balancing = 'random', max_memory_usage = 10000000000",
+		"REVOKE ON CLUSTER `demo` `admin` FROM `alice`",
+		"GRANT ON CLUSTER `demo` `analyst` TO `alice`",
+		"REVOKE ON CLUSTER `demo` INSERT ON `db`.`events` FROM `alice`",
+		"REVOKE ON CLUSTER `demo` SELECT ON `other db`.* FROM `alice`",
+		"GRANT ON CLUSTER `demo` SELECT(`id`, `ts`) ON `db`.`events` TO `alice`",
+		"GRANT ON CLUSTER `demo` INSERT, ALTER UPDATE ON `db`.* TO `alice` WITH GRANT OPTION",
+		"CREATE QUOTA OR REPLACE `alice_quota` ON CLUSTER `demo` FOR INTERVAL 1 hour MAX errors = 10, queries = 1000 TO `alice`",
+	}
+	if !reflect.DeepEqual(statements, expected) {
+		t.Errorf("expect %v, got %v", expected, statements)
+	}
+
+	// the settings and the quota set by others are removed
+	user.Spec.Roles, user.Spec.Grants, user.Spec.SettingsProfile, user.Spec.Settings, user.Spec.Quota = nil, nil, "", nil, nil
+	statements = userStatements(user, "", nil, current[:2], "")
+	expected = []string{
+		"CREATE USER IF NOT EXISTS `alice`",
+		"ALTER USER `alice` IDENTIFIED WITH no_password DEFAULT ROLE ALL SETTINGS NONE",
+		"REVOKE INSERT ON `db`.* FROM `alice`",
+		"REVOKE INSERT, SELECT(`id`), SELECT(`ts`) ON `db`.`events` FROM `alice`",
+		"DROP QUOTA IF EXISTS `alice_quota`",
+	}
+	if !reflect.DeepEqual(statements, expected) {
+		t.Errorf("expect %v, got %v", expected, statements)
+	}
+
+	old := user.Spec.DeepCopy()
+	user.Spec.Name = "bob"
+	if err := validateUser(user, old); err == nil {
+		t.Error("expect the change of the name to be refused")
+	}
+}
+
+func TestRoleStatements(t *testing.T) {
+	role := &v1.ClickHouseRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "analyst"},
+		Spec: v1.ClickHouseRoleSpec{
+			ClusterRef: "demo",
+			Grants:     []v1.Grant{{Privileges: []string{"SELECT"}, Database: "db"}},
+			Settings:   map[string]string{"readonly": "1"},
+		},
+	}
+	if err := validateRole(role, nil); err != nil {
+		t.Fatalf("unexpected invalid role: %v", err)
+	}
+	expected := []string{
+		"CREATE ROLE IF NOT EXISTS `analyst`",
+		"ALTER ROLE `analyst` SETTINGS readonly = 1",
+		"GRANT SELECT ON `db`.* TO `analyst`",
+	}
+	if statements := roleStatements(role, nil, ""); !reflect.DeepEqual(statements, expected) {
+		t.Errorf("expect %v, got %v", expected, statements)
+	}
+
+	// the grant option given by others is revoked, the privilege is kept
+	current := []string{"GRANT SELECT ON db.* TO analyst WITH GRANT OPTION"}
+	expected = []string{
+		"CREATE ROLE IF NOT EXISTS `analyst`",
+		"ALTER ROLE `analyst` SETTINGS readonly = 1",
+		"REVOKE GRANT OPTION FOR SELECT ON `db`.* FROM `analyst`",
+		"GRANT SELECT ON `db`.* TO `analyst`",
+	}
+	if statements := roleStatements(role, current, ""); !reflect.DeepEqual(statements, expected) {
+		t.Errorf("expect %v, got %v", expected, statements)
+	}
+}
+
+func TestValidateAccess(t *testing.T) {
+	invalidGrants := [][]v1.Grant{
+		{{}},
+		{{Privileges: []string{"SELECT; DROP"}}},
+		{{Privileges: []string{"SELECT"}, Table: "events"}},
+		{{Privileges: []string{"SELECT"}, Database: "db", Columns: []string{"id"}}},
+	}
+	for _, grants := range invalidGrants {
+		if err := validateGrants(grants); err == nil {
+			t.Errorf("expect %+v to be invalid", grants)
+		}
+	}
+	if err := validateSettings(map[string]string{"max threads": "1"}); err == nil {
+		t.Error("expect an invalid setting name to be refused")
+	}
+	invalidQuota := [][]v1.QuotaInterval{
+		{{Interval: "1 hour"}},
+		{{Interval: "hourly", Limits: map[string]int64{"queries": 1}}},
+		{{Interval: "1 hour", Limits: map[string]int64{"memory": 1}}},
+	}
+	for _, quota := range invalidQuota {
+		if err := validateQuota(quota); err == nil {
+			t.Errorf("expect %+v to be invalid", quota)
+		}
+	}
+}
+
+func TestReconcileUserFinalizer(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := v1.SchemeBuilder.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	user := &v1.ClickHouseUser{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "alice", Generation: 1},
+		Spec: v1.ClickHouseUserSpec{ClusterRef: "demo", Password: v1.UserPassword{
+			SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "alice"}, Key: "password"}}},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "alice"},
+		Data:       map[string][]byte{"password": []byte("secret")},
+	}
+	r := &ReconcileClickHouseUser{&reconciler{client: fake.NewFakeClientWithScheme(s, user, secret), recorder: record.NewFakeRecorder(10)}}
+	name := types.NamespacedName{Namespace: "default", Name: "alice"}
+	if _, err := r.Reconcile(reconcile.Request{NamespacedName: name}); err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	got := &v1.ClickHouseUser{}
+	if err := r.client.Get(context.TODO(), name, got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Finalizers, []string{AccessFinalizer}) || got.Status.Phase != PhasePending {
+		t.Errorf("expect the user to wait for its cluster with the finalizer, got %v %+v", got.Finalizers, got.Status)
+	}
+
+	// a deleted user whose cluster is gone is released
+	now := metav1.Now()
+	got.DeletionTimestamp = &now
+	got.Annotations = map[string]string{v1.AnnotationLastApplied: `{"clusterRef":"demo","password":{}}`}
+	if err := r.client.Update(context.TODO(), got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(reconcile.Request{NamespacedName: name}); err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	got = &v1.ClickHouseUser{}
+	if err := r.client.Get(context.TODO(), name, got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Finalizers) != 0 {
+		t.Errorf("expect the finalizer to be removed, got %v", got.Finalizers)
+	}
+}
@@ -0,0 +1,295 @@
+package clickhouseschema
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/controller/clickhousecluster"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// The phases of the databases, tables, users and roles
+const (
+	PhasePending = "Pending"
+	PhaseCreated = "Created"
+	PhaseRefused = "Refused"
+	PhaseFailed  = "Failed"
+)
+
+// Reasons of the events of the databases, tables, users and roles
+const (
+	EventSchemaApplied     = "SchemaApplied"
+	EventChangeRefused     = "ChangeRefused"
+	EventSchemaApplyFailed = "SchemaApplyFailed"
+	EventDriftReverted     = "DriftReverted"
+)
+
+// Add creates the ClickHouseDatabase, ClickHouseTable, ClickHouseUser and ClickHouseRole controllers
+// and adds them to the Manager
+func Add(mgr manager.Manager, options controller.Options) error {
+	r := &reconciler{
+		client:   mgr.GetClient(),
+		recorder: mgr.GetEventRecorderFor("clickhouse-operator"),
+	}
+	controllers := []struct {
+		name       string
+		obj        runtime.Object
+		reconciler reconcile.Reconciler
+		refs       func(cli client.Client, namespace string) (map[string]string, error)
+	}{
+		{"clickhousedatabase-controller", &clickhousev1.ClickHouseDatabase{}, &ReconcileClickHouseDatabase{r}, databaseRefs},
+		{"clickhousetable-controller", &clickhousev1.ClickHouseTable{}, &ReconcileClickHouseTable{r}, tableRefs},
+		{"clickhouseuser-controller", &clickhousev1.ClickHouseUser{}, &ReconcileClickHouseUser{r}, userRefs},
+		{"clickhouserole-controller", &clickhousev1.ClickHouseRole{}, &ReconcileClickHouseRole{r}, roleRefs},
+	}
+	for _, c := range controllers {
+		if err := add(mgr, c.name, c.obj, c.reconciler, &ofCluster{r.client, c.refs}, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add watches the declared objects of the type and the clusters they are created on
+func add(mgr manager.Manager, name string, obj runtime.Object, r reconcile.Reconciler, ofCluster handler.Mapper,
+	options controller.Options) error {
+	options.Reconciler = r
+	c, err := controller.New(name, mgr, options)
+	if err != nil {
+		return err
+	}
+	err = c.Watch(&source.Kind{Type: obj}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+	// The objects waiting for their cluster are reconciled once it is ready
+	return c.Watch(&source.Kind{Type: &clickhousev1.ClickHouseCluster{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: ofCluster}, clusterReadyPredicate)
+}
+
+// clusterReadyPredicate only keeps the clusters created and the ones becoming ready or not ready
+var clusterReadyPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldCluster, ok := e.ObjectOld.(*clickhousev1.ClickHouseCluster)
+		if !ok {
+			return true
+		}
+		newCluster, ok := e.ObjectNew.(*clickhousev1.ClickHouseCluster)
+		if !ok {
+			return true
+		}
+		return oldCluster.Status.IsConditionTrue(clickhousev1.ClusterReady) !=
+			newCluster.Status.IsConditionTrue(clickhousev1.ClusterReady)
+	},
+	DeleteFunc:  func(event.DeleteEvent) bool { return false },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// ofCluster maps a cluster to the objects of a kind declared on it
+type ofCluster struct {
+	client client.Client
+	// refs lists the objects of the kind in a namespace with the cluster they are declared on
+	refs func(cli client.Client, namespace string) (map[string]string, error)
+}
+
+func (m *ofCluster) Map(obj handler.MapObject) []reconcile.Request {
+	refs, err := m.refs(m.client, obj.Meta.GetNamespace())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"namespace": obj.Meta.GetNamespace(), "error": err}).Error("list declared objects error")
+		return nil
+	}
+	var requests []reconcile.Request
+	for name, clusterRef := range refs {
+		if clusterRef == obj.Meta.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: name}})
+		}
+	}
+	return requests
+}
+
+// databaseRefs lists the databases of the namespace with the cluster they are declared on
+func databaseRefs(cli client.Client, namespace string) (map[string]string, error) {
+	list := &clickhousev1.ClickHouseDatabaseList{}
+	if err := cli.List(context.TODO(), list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string, len(list.Items))
+	for _, db := range list.Items {
+		refs[db.Name] = db.Spec.ClusterRef
+	}
+	return refs, nil
+}
+
+// tableRefs lists the tables of the namespace with the cluster they are declared on
+func tableRefs(cli client.Client, namespace string) (map[string]string, error) {
+	list := &clickhousev1.ClickHouseTableList{}
+	if err := cli.List(context.TODO(), list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string, len(list.Items))
+	for _, table := range list.Items {
+		refs[table.Name] = table.Spec.ClusterRef
+	}
+	return refs, nil
+}
+
+// userRefs lists the users of the namespace with the cluster they are declared on
+func userRefs(cli client.Client, namespace string) (map[string]string, error) {
+	list := &clickhousev1.ClickHouseUserList{}
+	if err := cli.List(context.TODO(), list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string, len(list.Items))
+	for _, user := range list.Items {
+		refs[user.Name] = user.Spec.ClusterRef
+	}
+	return refs, nil
+}
+
+// roleRefs lists the roles of the namespace with the cluster they are declared on
+func roleRefs(cli client.Client, namespace string) (map[string]string, error) {
+	list := &clickhousev1.ClickHouseRoleList{}
+	if err := cli.List(context.TODO(), list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string, len(list.Items))
+	for _, role := range list.Items {
+		refs[role.Name] = role.Spec.ClusterRef
+	}
+	return refs, nil
+}
+
+// reconciler holds what the reconcilers of the databases, tables, users and roles share
+type reconciler struct {
+	client   client.Client
+	recorder record.EventRecorder
+}
+
+// clusterSQL returns the ClusterSQL of the cluster an object is declared on once the cluster is
+// ready, otherwise why the object waits for it
+func (r *reconciler) clusterSQL(namespace, clusterRef string) (*clickhousecluster.ClusterSQL,
+	*clickhousev1.ClickHouseCluster, string, error) {
+	cc := &clickhousev1.ClickHouseCluster{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: clusterRef}, cc)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil, fmt.Sprintf("the cluster %s does not exist", clusterRef), nil
+		}
+		return nil, nil, "", err
+	}
+	if cc.DeletionTimestamp != nil {
+		return nil, cc, fmt.Sprintf("the cluster %s is being deleted", clusterRef), nil
+	}
+	if !cc.Status.IsConditionTrue(clickhousev1.ClusterReady) {
+		return nil, cc, fmt.Sprintf("waiting for the cluster %s to be ready", clusterRef), nil
+	}
+	sql, err := clickhousecluster.NewClusterSQL(r.client, cc)
+	return sql, cc, "", err
+}
+
+// apply runs the statements of a declared object on the cluster it refers to once the cluster is
+// ready, and returns the phase and the message of its status. The statements are made for the
+// cluster, a spec they can not be made of is refused. An error is returned when the statements
+// failed and have to be retried.
+func (r *reconciler) apply(obj runtime.Object, namespace, clusterRef string,
+	statements func(sql *clickhousecluster.ClusterSQL, cc *clickhousev1.ClickHouseCluster) ([]string, error)) (string, string, error) {
+	sql, cc, pending, err := r.clusterSQL(namespace, clusterRef)
+	if err != nil {
+		return PhaseFailed, err.Error(), err
+	}
+	if sql == nil {
+		return PhasePending, pending, nil
+	}
+	sqls, err := statements(sql, cc)
+	if err != nil {
+		return r.refuse(obj, err)
+	}
+	if err := r.exec(obj, sql, sqls); err != nil {
+		return PhaseFailed, err.Error(), err
+	}
+	r.recorder.Event(obj, corev1.EventTypeNormal, EventSchemaApplied,
+		fmt.Sprintf("applied to the cluster %s", clusterRef))
+	return PhaseCreated, "", nil
+}
+
+// exec runs the statements on the cluster, a failure is reported as an event of the object
+func (r *reconciler) exec(obj runtime.Object, sql *clickhousecluster.ClusterSQL, statements []string) error {
+	for _, s := range statements {
+		if err := sql.Exec(s); err != nil {
+			r.recorder.Event(obj, corev1.EventTypeWarning, EventSchemaApplyFailed, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// upToDate tells if the generation of the spec has already been created or refused
+func upToDate(generation, observedGeneration int64, phase string) bool {
+	return generation == observedGeneration && (phase == PhaseCreated || phase == PhaseRefused)
+}
+
+// quoteName quotes the name of a database, a table or a column
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
+
+// sqlString quotes a string literal
+func sqlString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// declaredObject is a database, a table, a user or a role
+type declaredObject interface {
+	runtime.Object
+	metav1.Object
+}
+
+// lastApplied reads the spec last applied to the cluster from the annotation of the object, it
+// tells if there is one
+func lastApplied(obj declaredObject, spec interface{}) (bool, error) {
+	applied := obj.GetAnnotations()[clickhousev1.AnnotationLastApplied]
+	if applied == "" {
+		return false, nil
+	}
+	return true, json.Unmarshal([]byte(applied), spec)
+}
+
+// recordApplied keeps the spec applied to the cluster in the annotation of the object, the next
+// changes are made from it
+func (r *reconciler) recordApplied(obj declaredObject, spec interface{}) error {
+	applied, err := json.Marshal(spec)
+	if err != nil || obj.GetAnnotations()[clickhousev1.AnnotationLastApplied] == string(applied) {
+		return err
+	}
+	original := obj.DeepCopyObject()
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[clickhousev1.AnnotationLastApplied] = string(applied)
+	obj.SetAnnotations(annotations)
+	return r.client.Patch(context.TODO(), obj, client.MergeFrom(original))
+}
+
+// refuse reports a spec which can not be applied
+func (r *reconciler) refuse(obj runtime.Object, err error) (string, string, error) {
+	r.recorder.Event(obj, corev1.EventTypeWarning, EventChangeRefused, err.Error())
+	return PhaseRefused, err.Error(), nil
+}
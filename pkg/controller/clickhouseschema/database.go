@@ -0,0 +1,95 @@
+package clickhouseschema
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/controller/clickhousecluster"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// blank assignment to verify that ReconcileClickHouseDatabase implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileClickHouseDatabase{}
+
+// ReconcileClickHouseDatabase creates the ClickHouseDatabases on their cluster
+type ReconcileClickHouseDatabase struct {
+	*reconciler
+}
+
+func (r *ReconcileClickHouseDatabase) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	log := logrus.WithFields(logrus.Fields{"namespace": request.Namespace, "database": request.Name})
+
+	db := &clickhousev1.ClickHouseDatabase{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, db)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// the database is left on the cluster with its tables
+			return reconcile.Result{}, nil
+		}
+		log.WithField("error", err).Error("get clickhouse database error")
+		return reconcile.Result{}, err
+	}
+	if db.DeletionTimestamp != nil || upToDate(db.Generation, db.Status.ObservedGeneration, db.Status.Phase) {
+		return reconcile.Result{}, nil
+	}
+
+	var old *clickhousev1.ClickHouseDatabaseSpec
+	applied := &clickhousev1.ClickHouseDatabaseSpec{}
+	if found, err := lastApplied(db, applied); err != nil {
+		log.WithField("error", err).Error("read last applied database error")
+	} else if found {
+		old = applied
+	}
+
+	status := clickhousev1.ClickHouseDatabaseStatus{ObservedGeneration: db.Generation}
+	status.Phase, status.Message, err = r.apply(db, db.Namespace, db.Spec.ClusterRef,
+		func(sql *clickhousecluster.ClusterSQL, _ *clickhousev1.ClickHouseCluster) ([]string, error) {
+			return databaseStatements(db, old, sql.OnCluster())
+		})
+	if err != nil {
+		log.WithField("error", err).Error("create database error")
+	}
+	if status.Phase == PhaseCreated {
+		if err := r.recordApplied(db, &db.Spec); err != nil {
+			log.WithField("error", err).Error("record applied database error")
+			return reconcile.Result{}, err
+		}
+	}
+	if status != db.Status {
+		db.Status = status
+		if err := r.client.Status().Update(context.TODO(), db); err != nil {
+			log.WithField("error", err).Error("update clickhouse database status error")
+		}
+	}
+	return reconcile.Result{}, err
+}
+
+// databaseStatements returns the statements creating the database, old is the spec last applied.
+// Nothing of an existing database can be changed.
+func databaseStatements(db *clickhousev1.ClickHouseDatabase, old *clickhousev1.ClickHouseDatabaseSpec,
+	onCluster string) ([]string, error) {
+	if old != nil {
+		var changed []string
+		if old.ClusterRef != db.Spec.ClusterRef {
+			changed = append(changed, "clusterRef")
+		}
+		if old.Name != db.Spec.Name {
+			changed = append(changed, "name")
+		}
+		if old.Engine != db.Spec.Engine {
+			changed = append(changed, "engine")
+		}
+		if len(changed) > 0 {
+			return nil, fmt.Errorf("%s of the existing database can not be changed", strings.Join(changed, ", "))
+		}
+	}
+	sql := "CREATE DATABASE IF NOT EXISTS " + quoteName(db.DatabaseName()) + onCluster
+	if db.Spec.Engine != "" {
+		sql += " ENGINE = " + db.Spec.Engine
+	}
+	return []string{sql}, nil
+}
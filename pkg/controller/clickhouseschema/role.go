@@ -0,0 +1,126 @@
+package clickhouseschema
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/controller/clickhousecluster"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// blank assignment to verify that ReconcileClickHouseRole implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileClickHouseRole{}
+
+// ReconcileClickHouseRole creates the ClickHouseRoles on their cluster and reverts the changes made
+// to them by others
+type ReconcileClickHouseRole struct {
+	*reconciler
+}
+
+func (r *ReconcileClickHouseRole) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	log := logrus.WithFields(logrus.Fields{"namespace": request.Namespace, "role": request.Name})
+
+	role := &clickhousev1.ClickHouseRole{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, role)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		log.WithField("error", err).Error("get clickhouse role error")
+		return reconcile.Result{}, err
+	}
+
+	var old *clickhousev1.ClickHouseRoleSpec
+	applied := &clickhousev1.ClickHouseRoleSpec{}
+	if found, err := lastApplied(role, applied); err != nil {
+		log.WithField("error", err).Error("read last applied role error")
+	} else if found {
+		old = applied
+	}
+
+	// the role is dropped from the cluster it was last applied to
+	if role.DeletionTimestamp != nil {
+		var clusterRef string
+		var statements func(onCluster string) []string
+		if old != nil {
+			name := quoteName((&clickhousev1.ClickHouseRole{ObjectMeta: role.ObjectMeta, Spec: *old}).RoleName())
+			clusterRef = old.ClusterRef
+			statements = func(onCluster string) []string {
+				return []string{"DROP ROLE IF EXISTS " + name + onCluster}
+			}
+		}
+		if err := r.dropAccess(role, clusterRef, statements); err != nil {
+			log.WithField("error", err).Error("drop role error")
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, nil
+	}
+	if err := r.setFinalizer(role, true); err != nil {
+		log.WithField("error", err).Error("add finalizer error")
+		return reconcile.Result{}, err
+	}
+
+	name := quoteName(role.RoleName())
+	access := &accessDefinition{
+		clusterRef: role.Spec.ClusterRef,
+		invalid:    validateRole(role, old),
+		statements: func(sql *clickhousecluster.ClusterSQL) ([]string, error) {
+			host, err := firstAnswering(sql)
+			if err != nil {
+				return nil, err
+			}
+			grants, err := currentGrants(sql, host, "roles", role.RoleName())
+			if err != nil {
+				return nil, err
+			}
+			return roleStatements(role, grants, sql.OnCluster()), nil
+		},
+		queries: []string{"SHOW CREATE ROLE " + name, "SHOW GRANTS FOR " + name},
+	}
+
+	status := clickhousev1.ClickHouseUserStatus(role.Status)
+	result, err := r.reconcileAccess(role, &status, access)
+	if err != nil {
+		log.WithField("error", err).Error("reconcile role error")
+	}
+	if status.Phase == PhaseCreated {
+		if err := r.recordApplied(role, &role.Spec); err != nil {
+			log.WithField("error", err).Error("record applied role error")
+			return reconcile.Result{}, err
+		}
+	}
+	if roleStatus := clickhousev1.ClickHouseRoleStatus(status); !reflect.DeepEqual(roleStatus, role.Status) {
+		role.Status = roleStatus
+		if err := r.client.Status().Update(context.TODO(), role); err != nil {
+			log.WithField("error", err).Error("update clickhouse role status error")
+		}
+	}
+	return result, err
+}
+
+// validateRole checks the spec of the role, the cluster and the name of an existing role can not be
+// changed
+func validateRole(role *clickhousev1.ClickHouseRole, old *clickhousev1.ClickHouseRoleSpec) error {
+	if old != nil && (old.ClusterRef != role.Spec.ClusterRef || old.Name != role.Spec.Name) {
+		return errors.New("clusterRef and name of the existing role can not be changed")
+	}
+	if err := validateGrants(role.Spec.Grants); err != nil {
+		return err
+	}
+	return validateSettings(role.Spec.Settings)
+}
+
+// roleStatements returns the statements creating the role and replacing its settings and privileges,
+// grants are the statements of SHOW GRANTS
+func roleStatements(role *clickhousev1.ClickHouseRole, grants []string, onCluster string) []string {
+	name := quoteName(role.RoleName())
+	statements := []string{
+		"CREATE ROLE IF NOT EXISTS " + name + onCluster,
+		"ALTER ROLE " + name + onCluster + settingsClause(role.Spec.SettingsProfile, role.Spec.Settings),
+	}
+	return append(statements, grantStatements(name, onCluster, role.Spec.Grants, grants)...)
+}
@@ -0,0 +1,269 @@
+package clickhouseschema
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/controller/clickhousecluster"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// blank assignment to verify that ReconcileClickHouseTable implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileClickHouseTable{}
+
+// ReconcileClickHouseTable creates the ClickHouseTables on their cluster and applies the changes
+// which keep the data of the existing tables
+type ReconcileClickHouseTable struct {
+	*reconciler
+}
+
+func (r *ReconcileClickHouseTable) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	log := logrus.WithFields(logrus.Fields{"namespace": request.Namespace, "table": request.Name})
+
+	table := &clickhousev1.ClickHouseTable{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, table)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// the table is left on the cluster with its data
+			return reconcile.Result{}, nil
+		}
+		log.WithField("error", err).Error("get clickhouse table error")
+		return reconcile.Result{}, err
+	}
+	if table.DeletionTimestamp != nil || upToDate(table.Generation, table.Status.ObservedGeneration, table.Status.Phase) {
+		return reconcile.Result{}, nil
+	}
+
+	var old *clickhousev1.ClickHouseTableSpec
+	applied := &clickhousev1.ClickHouseTableSpec{}
+	if found, err := lastApplied(table, applied); err != nil {
+		log.WithField("error", err).Error("read last applied table error")
+	} else if found {
+		old = applied
+	}
+
+	status := clickhousev1.ClickHouseTableStatus{ObservedGeneration: table.Generation}
+	if err := validateTable(&table.Spec); err != nil {
+		status.Phase, status.Message, _ = r.refuse(table, err)
+	} else {
+		status.Phase, status.Message, err = r.apply(table, table.Namespace, table.Spec.ClusterRef,
+			func(sql *clickhousecluster.ClusterSQL, cc *clickhousev1.ClickHouseCluster) ([]string, error) {
+				return tableStatements(table, old, sql.OnCluster(), cc.Name)
+			})
+		if err != nil {
+			log.WithField("error", err).Error("create table error")
+		}
+	}
+	if status.Phase == PhaseCreated {
+		if err := r.recordApplied(table, &table.Spec); err != nil {
+			log.WithField("error", err).Error("record applied table error")
+			return reconcile.Result{}, err
+		}
+	}
+	if status != table.Status {
+		table.Status = status
+		if err := r.client.Status().Update(context.TODO(), table); err != nil {
+			log.WithField("error", err).Error("update clickhouse table status error")
+		}
+	}
+	return reconcile.Result{}, err
+}
+
+// validateTable checks the spec has what the kind of table it defines needs
+func validateTable(spec *clickhousev1.ClickHouseTableSpec) error {
+	if spec.Database == "" {
+		return errors.New("database must be set")
+	}
+	switch {
+	case spec.Distributed != nil && spec.MaterializedView != nil:
+		return errors.New("a table can not be both distributed and a materialized view")
+	case spec.Distributed != nil:
+		if spec.Distributed.Table == "" {
+			return errors.New("distributed.table must be set")
+		}
+		if spec.Engine != "" || spec.OrderBy != "" || spec.PartitionBy != "" || spec.PrimaryKey != "" ||
+			spec.TTL != "" || len(spec.Settings) > 0 {
+			return errors.New("a Distributed table has no engine, orderBy, partitionBy, primaryKey, ttl or settings")
+		}
+	case spec.MaterializedView != nil:
+		view := spec.MaterializedView
+		if view.Query == "" {
+			return errors.New("materializedView.query must be set")
+		}
+		if len(spec.Columns) > 0 {
+			return errors.New("the columns of a materialized view are the ones of its query")
+		}
+		if (view.To == "") == (spec.Engine == "") {
+			return errors.New("a materialized view either writes to materializedView.to or has an engine")
+		}
+		if view.To != "" && view.Populate {
+			return errors.New("a materialized view writing to materializedView.to can not be populated")
+		}
+	default:
+		if spec.Engine == "" {
+			return errors.New("engine must be set")
+		}
+		if len(spec.Columns) == 0 {
+			return errors.New("columns must be set")
+		}
+	}
+	return nil
+}
+
+// tableStatements returns the statements creating the table and applying the changes from old, the
+// spec last applied. Only columns added at the end and a new TTL can be applied to an existing
+// table, as the other changes would need the table to be created again.
+func tableStatements(table *clickhousev1.ClickHouseTable, old *clickhousev1.ClickHouseTableSpec,
+	onCluster, cluster string) ([]string, error) {
+	statements := []string{createTableStatement(table, onCluster, cluster)}
+	if old == nil {
+		return statements, nil
+	}
+	spec := &table.Spec
+	name := quoteName(spec.Database) + "." + quoteName(table.TableName())
+
+	var changed []string
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"clusterRef", old.ClusterRef, spec.ClusterRef},
+		{"database", old.Database, spec.Database},
+		{"name", old.Name, spec.Name},
+		{"engine", old.Engine, spec.Engine},
+		{"orderBy", old.OrderBy, spec.OrderBy},
+		{"partitionBy", old.PartitionBy, spec.PartitionBy},
+		{"primaryKey", old.PrimaryKey, spec.PrimaryKey},
+		{"settings", old.Settings, spec.Settings},
+		{"distributed", old.Distributed, spec.Distributed},
+		{"materializedView", old.MaterializedView, spec.MaterializedView},
+	}
+	for _, field := range fields {
+		if !reflect.DeepEqual(field.old, field.new) {
+			changed = append(changed, field.name)
+		}
+	}
+	if len(spec.Columns) < len(old.Columns) {
+		changed = append(changed, "columns removed")
+	} else {
+		for i := range old.Columns {
+			if old.Columns[i] != spec.Columns[i] {
+				changed = append(changed, "column "+old.Columns[i].Name)
+			}
+		}
+	}
+	if old.TTL != spec.TTL && (spec.TTL == "" || spec.MaterializedView != nil) {
+		changed = append(changed, "ttl")
+	}
+	if len(changed) > 0 {
+		return nil, fmt.Errorf("%s of the existing table can not be changed, only columns added at the end and a new ttl can",
+			strings.Join(changed, ", "))
+	}
+
+	for i := len(old.Columns); i < len(spec.Columns); i++ {
+		sql := fmt.Sprintf("ALTER TABLE %s%s ADD COLUMN IF NOT EXISTS %s", name, onCluster, columnDefinition(spec.Columns[i]))
+		if i > 0 {
+			sql += " AFTER " + quoteName(spec.Columns[i-1].Name)
+		}
+		statements = append(statements, sql)
+	}
+	if old.TTL != spec.TTL {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s%s MODIFY TTL %s", name, onCluster, spec.TTL))
+	}
+	return statements, nil
+}
+
+// createTableStatement returns the CREATE statement of the table, the materialized view or the
+// Distributed table
+func createTableStatement(table *clickhousev1.ClickHouseTable, onCluster, cluster string) string {
+	spec := &table.Spec
+	var b strings.Builder
+	if spec.MaterializedView != nil {
+		b.WriteString("CREATE MATERIALIZED VIEW IF NOT EXISTS ")
+	} else {
+		b.WriteString("CREATE TABLE IF NOT EXISTS ")
+	}
+	b.WriteString(quoteName(spec.Database) + "." + quoteName(table.TableName()) + onCluster)
+
+	if len(spec.Columns) > 0 {
+		columns := make([]string, 0, len(spec.Columns))
+		for _, column := range spec.Columns {
+			columns = append(columns, columnDefinition(column))
+		}
+		b.WriteString(" (" + strings.Join(columns, ", ") + ")")
+	}
+
+	if distributed := spec.Distributed; distributed != nil {
+		database := distributed.Database
+		if database == "" {
+			database = spec.Database
+		}
+		if len(spec.Columns) == 0 {
+			b.WriteString(" AS " + quoteName(database) + "." + quoteName(distributed.Table))
+		}
+		shardingKey := distributed.ShardingKey
+		if shardingKey == "" {
+			shardingKey = "rand()"
+		}
+		b.WriteString(fmt.Sprintf(" ENGINE = Distributed(%s, %s, %s, %s)", sqlString(cluster),
+			sqlString(database), sqlString(distributed.Table), shardingKey))
+		return b.String()
+	}
+
+	if view := spec.MaterializedView; view != nil && view.To != "" {
+		b.WriteString(" TO " + view.To)
+	}
+	if spec.Engine != "" {
+		b.WriteString(" ENGINE = " + spec.Engine)
+		if spec.OrderBy != "" {
+			b.WriteString(" ORDER BY " + spec.OrderBy)
+		}
+		if spec.PartitionBy != "" {
+			b.WriteString(" PARTITION BY " + spec.PartitionBy)
+		}
+		if spec.PrimaryKey != "" {
+			b.WriteString(" PRIMARY KEY " + spec.PrimaryKey)
+		}
+		if spec.TTL != "" {
+			b.WriteString(" TTL " + spec.TTL)
+		}
+		if len(spec.Settings) > 0 {
+			keys := make([]string, 0, len(spec.Settings))
+			for key := range spec.Settings {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			settings := make([]string, 0, len(keys))
+			for _, key := range keys {
+				settings = append(settings, key+" = "+spec.Settings[key])
+			}
+			b.WriteString(" SETTINGS " + strings.Join(settings, ", "))
+		}
+	}
+	if view := spec.MaterializedView; view != nil {
+		if view.Populate {
+			b.WriteString(" POPULATE")
+		}
+		b.WriteString(" AS " + view.Query)
+	}
+	return b.String()
+}
+
+// columnDefinition returns the definition of the column in CREATE TABLE and ADD COLUMN
+func columnDefinition(column clickhousev1.TableColumn) string {
+	definition := quoteName(column.Name) + " " + column.Type
+	if column.Default != "" {
+		definition += " DEFAULT " + column.Default
+	}
+	if column.Codec != "" {
+		definition += " CODEC(" + column.Codec + ")"
+	}
+	return definition
+}
@@ -0,0 +1,175 @@
+package clickhouseschema
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestTableStatements(t *testing.T) {
+	onCluster := " ON CLUSTER `demo`"
+	events := &v1.ClickHouseTable{
+		ObjectMeta: metav1.ObjectMeta{Name: "events"},
+		Spec: v1.ClickHouseTableSpec{
+			ClusterRef: "demo",
+			Database:   "db",
+			Columns: []v1.TableColumn{
+				{Name: "ts", Type: "DateTime"},
+				{Name: "id", Type: "UInt64", Codec: "ZSTD(1)"},
+			},
+			Engine:      "ReplicatedMergeTree('/clickhouse/tables/{shard}/db/events', '{replica}')",
+			OrderBy:     "(id, ts)",
+			PartitionBy: "toYYYYMM(ts)",
+			TTL:         "ts + INTERVAL 30 DAY",
+			Settings:    map[string]string{"min_bytes_for_wide_part": "0", "index_granularity": "8192"},
+		},
+	}
+	distributed := &v1.ClickHouseTable{
+		ObjectMeta: metav1.ObjectMeta{Name: "events-all"},
+		Spec: v1.ClickHouseTableSpec{
+			ClusterRef:  "demo",
+			Database:    "db",
+			Distributed: &v1.DistributedTableSpec{Table: "events", ShardingKey: "cityHash64(id)"},
+		},
+	}
+	view := &v1.ClickHouseTable{
+		ObjectMeta: metav1.ObjectMeta{Name: "daily-mv"},
+		Spec: v1.ClickHouseTableSpec{
+			ClusterRef:       "demo",
+			Database:         "db",
+			Name:             "daily_mv",
+			MaterializedView: &v1.MaterializedViewSpec{To: "db.daily", Query: "SELECT toDate(ts) AS day, count() AS n FROM db.events GROUP BY day"},
+		},
+	}
+	cases := []struct {
+		table    *v1.ClickHouseTable
+		expected string
+	}{
+		{events, "CREATE TABLE IF NOT EXISTS `db`.`events` ON CLUSTER `demo` (`ts` DateTime, `id` UInt64 CODEC(ZSTD(1))) " +
+			"ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/db/events', '{replica}') ORDER BY (id, ts) " +
+			"PARTITION BY toYYYYMM(ts) TTL ts + INTERVAL 30 DAY SETTINGS index_granularity = 8192, min_bytes_for_wide_part = 0"},
+		{distributed, "CREATE TABLE IF NOT EXISTS `db`.`events-all` ON CLUSTER `demo` AS `db`.`events` " +
+			"ENGINE = Distributed('demo', 'db', 'events', cityHash64(id))"},
+		{view, "CREATE MATERIALIZED VIEW IF NOT EXISTS `db`.`daily_mv` ON CLUSTER `demo` TO db.daily " +
+			"AS SELECT toDate(ts) AS day, count() AS n FROM db.events GROUP BY day"},
+	}
+	for _, c := range cases {
+		if err := validateTable(&c.table.Spec); err != nil {
+			t.Errorf("%s: unexpected invalid spec: %v", c.table.Name, err)
+		}
+		statements, err := tableStatements(c.table, nil, onCluster, "demo")
+		if err != nil || !reflect.DeepEqual(statements, []string{c.expected}) {
+			t.Errorf("%s: expect %s, got %v %v", c.table.Name, c.expected, statements, err)
+		}
+	}
+
+	// the columns added at the end and a new TTL are altered
+	old := events.Spec.DeepCopy()
+	changed := events.DeepCopy()
+	changed.Spec.Columns = append(changed.Spec.Columns, v1.TableColumn{Name: "source", Type: "String", Default: "''"})
+	changed.Spec.TTL = "ts + INTERVAL 90 DAY"
+	statements, err := tableStatements(changed, old, onCluster, "demo")
+	if err != nil {
+		t.Fatalf("unexpected refused change: %v", err)
+	}
+	expected := []string{
+		"ALTER TABLE `db`.`events` ON CLUSTER `demo` ADD COLUMN IF NOT EXISTS `source` String DEFAULT '' AFTER `id`",
+		"ALTER TABLE `db`.`events` ON CLUSTER `demo` MODIFY TTL ts + INTERVAL 90 DAY",
+	}
+	if !reflect.DeepEqual(statements[1:], expected) {
+		t.Errorf("expect %v, got %v", expected, statements[1:])
+	}
+
+	// the other changes are refused
+	changed = events.DeepCopy()
+	changed.Spec.OrderBy = "id"
+	changed.Spec.Columns = changed.Spec.Columns[:1]
+	changed.Spec.TTL = ""
+	if _, err := tableStatements(changed, old, onCluster, "demo"); err == nil ||
+		!strings.HasPrefix(err.Error(), "orderBy, columns removed, ttl of the existing table can not be changed") {
+		t.Errorf("expect the change to be refused, got %v", err)
+	}
+	changed = events.DeepCopy()
+	changed.Spec.Columns[1].Type = "UInt32"
+	if _, err := tableStatements(changed, old, onCluster, "demo"); err == nil {
+		t.Error("expect the change of the type of a column to be refused")
+	}
+
+	invalid := []v1.ClickHouseTableSpec{
+		{Database: "db", Engine: "MergeTree"},
+		{Database: "db", Distributed: &v1.DistributedTableSpec{Table: "events"}, OrderBy: "id"},
+		{Database: "db", MaterializedView: &v1.MaterializedViewSpec{Query: "SELECT 1"}},
+		{Database: "db", Engine: "MergeTree", MaterializedView: &v1.MaterializedViewSpec{To: "db.t", Query: "SELECT 1"}},
+	}
+	for _, spec := range invalid {
+		if err := validateTable(&spec); err == nil {
+			t.Errorf("expect %+v to be invalid", spec)
+		}
+	}
+}
+
+func TestDatabaseStatements(t *testing.T) {
+	db := &v1.ClickHouseDatabase{
+		ObjectMeta: metav1.ObjectMeta{Name: "analytics"},
+		Spec:       v1.ClickHouseDatabaseSpec{ClusterRef: "demo", Engine: "Atomic"},
+	}
+	statements, err := databaseStatements(db, nil, " ON CLUSTER `demo`")
+	expected := []string{"CREATE DATABASE IF NOT EXISTS `analytics` ON CLUSTER `demo` ENGINE = Atomic"}
+	if err != nil || !reflect.DeepEqual(statements, expected) {
+		t.Errorf("expect %v, got %v %v", expected, statements, err)
+	}
+	old := db.Spec.DeepCopy()
+	db.Spec.Engine = "Ordinary"
+	if _, err := databaseStatements(db, old, ""); err == nil {
+		t.Error("expect the change of the engine to be refused")
+	}
+}
+
+func TestReconcilePendingCluster(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := v1.SchemeBuilder.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	table := &v1.ClickHouseTable{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "events", Generation: 1},
+		Spec: v1.ClickHouseTableSpec{ClusterRef: "demo", Database: "db", Engine: "MergeTree",
+			Columns: []v1.TableColumn{{Name: "id", Type: "UInt64"}}},
+	}
+	r := &ReconcileClickHouseTable{&reconciler{client: fake.NewFakeClientWithScheme(s, table), recorder: record.NewFakeRecorder(10)}}
+	name := types.NamespacedName{Namespace: "default", Name: "events"}
+	if _, err := r.Reconcile(reconcile.Request{NamespacedName: name}); err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	got := &v1.ClickHouseTable{}
+	if err := r.client.Get(context.TODO(), name, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhasePending || got.Status.Message != "the cluster demo does not exist" {
+		t.Errorf("expect the table to wait for its cluster, got %+v", got.Status)
+	}
+
+	// a refused spec is reported without waiting for the cluster
+	got.Spec.Engine = ""
+	got.Generation = 2
+	if err := r.client.Update(context.TODO(), got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(reconcile.Request{NamespacedName: name}); err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	if err := r.client.Get(context.TODO(), name, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseRefused || got.Status.ObservedGeneration != 2 {
+		t.Errorf("expect the table to be refused, got %+v", got.Status)
+	}
+}
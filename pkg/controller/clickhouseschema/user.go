@@ -0,0 +1,215 @@
+package clickhouseschema
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/controller/clickhousecluster"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// blank assignment to verify that ReconcileClickHouseUser implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileClickHouseUser{}
+
+// ReconcileClickHouseUser creates the ClickHouseUsers on their cluster and reverts the changes made
+// to them by others
+type ReconcileClickHouseUser struct {
+	*reconciler
+}
+
+func (r *ReconcileClickHouseUser) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	log := logrus.WithFields(logrus.Fields{"namespace": request.Namespace, "user": request.Name})
+
+	user := &clickhousev1.ClickHouseUser{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, user)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		log.WithField("error", err).Error("get clickhouse user error")
+		return reconcile.Result{}, err
+	}
+
+	var old *clickhousev1.ClickHouseUserSpec
+	applied := &clickhousev1.ClickHouseUserSpec{}
+	if found, err := lastApplied(user, applied); err != nil {
+		log.WithField("error", err).Error("read last applied user error")
+	} else if found {
+		old = applied
+	}
+
+	// the user is dropped from the cluster it was last applied to
+	if user.DeletionTimestamp != nil {
+		var clusterRef string
+		var statements func(onCluster string) []string
+		if old != nil {
+			appliedUser := &clickhousev1.ClickHouseUser{ObjectMeta: user.ObjectMeta, Spec: *old}
+			clusterRef = old.ClusterRef
+			statements = func(onCluster string) []string {
+				return dropUserStatements(appliedUser, onCluster)
+			}
+		}
+		if err := r.dropAccess(user, clusterRef, statements); err != nil {
+			log.WithField("error", err).Error("drop user error")
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, nil
+	}
+	if err := r.setFinalizer(user, true); err != nil {
+		log.WithField("error", err).Error("add finalizer error")
+		return reconcile.Result{}, err
+	}
+
+	access := &accessDefinition{
+		clusterRef: user.Spec.ClusterRef,
+		invalid:    validateUser(user, old),
+		queries:    userQueries(user),
+	}
+	if access.invalid == nil {
+		password, err := clickhousecluster.GetUserPassword(r.client, user.Namespace,
+			&clickhousev1.UserConfig{Name: user.UserName(), Password: user.Spec.Password})
+		if err != nil {
+			// the spec is applied once the secret is readable
+			log.WithField("error", err).Error("get user password error")
+			status := user.Status.DeepCopy()
+			status.ObservedGeneration, status.Phase, status.Message = user.Generation, PhaseFailed, err.Error()
+			r.updateUserStatus(user, status)
+			return reconcile.Result{}, err
+		}
+		access.statements = func(sql *clickhousecluster.ClusterSQL) ([]string, error) {
+			host, err := firstAnswering(sql)
+			if err != nil {
+				return nil, err
+			}
+			roles, err := sql.QueryStrings(host, "SELECT granted_role_name FROM system.role_grants WHERE user_name = "+sqlString(user.UserName()))
+			if err != nil {
+				return nil, err
+			}
+			grants, err := currentGrants(sql, host, "users", user.UserName())
+			if err != nil {
+				return nil, err
+			}
+			return userStatements(user, password, roles, grants, sql.OnCluster()), nil
+		}
+		access.canLogin = func(sql *clickhousecluster.ClusterSQL, host string) bool {
+			return sql.CanLogin(host, user.UserName(), password)
+		}
+	}
+
+	status := user.Status.DeepCopy()
+	result, err := r.reconcileAccess(user, status, access)
+	if err != nil {
+		log.WithField("error", err).Error("reconcile user error")
+	}
+	if status.Phase == PhaseCreated {
+		if err := r.recordApplied(user, &user.Spec); err != nil {
+			log.WithField("error", err).Error("record applied user error")
+			return reconcile.Result{}, err
+		}
+	}
+	r.updateUserStatus(user, status)
+	return result, err
+}
+
+// updateUserStatus writes the status of the user when it changed
+func (r *ReconcileClickHouseUser) updateUserStatus(user *clickhousev1.ClickHouseUser, status *clickhousev1.ClickHouseUserStatus) {
+	if reflect.DeepEqual(user.Status, *status) {
+		return
+	}
+	user.Status = *status
+	if err := r.client.Status().Update(context.TODO(), user); err != nil {
+		logrus.WithFields(logrus.Fields{"namespace": user.Namespace, "user": user.Name, "error": err}).
+			Error("update clickhouse user status error")
+	}
+}
+
+// validateUser checks the spec of the user, the cluster and the name of an existing user can not be
+// changed
+func validateUser(user *clickhousev1.ClickHouseUser, old *clickhousev1.ClickHouseUserSpec) error {
+	if user.Spec.Password.SecretKeyRef == nil {
+		return errors.New("password.secretKeyRef must be set")
+	}
+	if old != nil && (old.ClusterRef != user.Spec.ClusterRef || old.Name != user.Spec.Name) {
+		return errors.New("clusterRef and name of the existing user can not be changed")
+	}
+	if err := validateGrants(user.Spec.Grants); err != nil {
+		return err
+	}
+	if err := validateSettings(user.Spec.Settings); err != nil {
+		return err
+	}
+	return validateQuota(user.Spec.Quota)
+}
+
+// userQuota is the name of the quota of the user
+func userQuota(user *clickhousev1.ClickHouseUser) string {
+	return quoteName(user.QuotaName())
+}
+
+// userQueries read the definition of the user, its grants and its quota
+func userQueries(user *clickhousev1.ClickHouseUser) []string {
+	name := quoteName(user.UserName())
+	queries := []string{"SHOW CREATE USER " + name, "SHOW GRANTS FOR " + name}
+	if len(user.Spec.Quota) > 0 {
+		queries = append(queries, "SHOW CREATE QUOTA "+userQuota(user))
+	}
+	return queries
+}
+
+// userStatements returns the statements creating the user and replacing its password, settings,
+// roles, privileges and quota, grantedRoles are the roles it has been granted so far and grants the
+// statements of SHOW GRANTS. The password is only sent as its hash.
+func userStatements(user *clickhousev1.ClickHouseUser, password string, grantedRoles, grants []string,
+	onCluster string) []string {
+	name := quoteName(user.UserName())
+	identified := "IDENTIFIED WITH no_password"
+	if password != "" {
+		sum := sha256.Sum256([]byte(password))
+		identified = "IDENTIFIED WITH sha256_hash BY " + sqlString(hex.EncodeToString(sum[:]))
+	}
+	statements := []string{
+		"CREATE USER IF NOT EXISTS " + name + onCluster,
+		fmt.Sprintf("ALTER USER %s%s %s DEFAULT ROLE ALL%s", name, onCluster, identified,
+			settingsClause(user.Spec.SettingsProfile, user.Spec.Settings)),
+	}
+
+	roles := make(map[string]bool, len(user.Spec.Roles))
+	for _, role := range user.Spec.Roles {
+		roles[role] = true
+	}
+	var revoked []string
+	for _, role := range grantedRoles {
+		if !roles[role] {
+			revoked = append(revoked, quoteName(role))
+		}
+	}
+	if len(revoked) > 0 {
+		statements = append(statements, fmt.Sprintf("REVOKE%s %s FROM %s", onCluster, strings.Join(revoked, ", "), name))
+	}
+	if len(user.Spec.Roles) > 0 {
+		granted := make([]string, 0, len(user.Spec.Roles))
+		for _, role := range user.Spec.Roles {
+			granted = append(granted, quoteName(role))
+		}
+		statements = append(statements, fmt.Sprintf("GRANT%s %s TO %s", onCluster, strings.Join(granted, ", "), name))
+	}
+
+	statements = append(statements, grantStatements(name, onCluster, user.Spec.Grants, grants)...)
+	return append(statements, quotaStatement(userQuota(user), name, onCluster, user.Spec.Quota))
+}
+
+// dropUserStatements returns the statements dropping the user and its quota
+func dropUserStatements(user *clickhousev1.ClickHouseUser, onCluster string) []string {
+	return []string{
+		"DROP USER IF EXISTS " + quoteName(user.UserName()) + onCluster,
+		"DROP QUOTA IF EXISTS " + userQuota(user) + onCluster,
+	}
+}
@@ -0,0 +1,201 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The file names are the ones the webhook server of controller-runtime reads
+const (
+	caCertName = "ca.crt"
+	certName   = "tls.crt"
+	keyName    = "tls.key"
+
+	certValidity = 365 * 24 * time.Hour
+	// certs expiring sooner are regenerated when the operator starts
+	certRenewBefore = 30 * 24 * time.Hour
+)
+
+// serviceDNSNames returns the names the API server may call the webhook service with
+func serviceDNSNames(serviceName, namespace string) []string {
+	return []string{
+		serviceName,
+		fmt.Sprintf("%s.%s", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", serviceName, namespace),
+	}
+}
+
+// ensureCerts makes sure certDir holds a serving cert valid for the DNS names, signed by a self-signed
+// CA. The certs found in certDir are kept if they are still valid, so certs provisioned by other means
+// can be mounted there. Otherwise the certs of the Secret are used, and generated into it if they are
+// missing or not valid anymore, so the CA does not change when the operator restarts. It returns the PEM
+// encoded CA to register in the webhook configurations.
+func ensureCerts(cli client.Client, secretKey types.NamespacedName, certDir string, dnsNames []string) ([]byte, error) {
+	log := logrus.WithFields(logrus.Fields{"dir": certDir, "secret": secretKey.String()})
+	caPEM, err := loadCerts(certDir, dnsNames)
+	if err == nil {
+		log.Info("Use existing webhook serving certs")
+		return caPEM, nil
+	}
+
+	secret := &corev1.Secret{}
+	err = cli.Get(context.TODO(), secretKey, secret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	found := err == nil
+	if found {
+		if err = writeCerts(certDir, secret.Data); err != nil {
+			return nil, err
+		}
+		if caPEM, err = loadCerts(certDir, dnsNames); err == nil {
+			log.Info("Use the webhook serving certs of the Secret")
+			return caPEM, nil
+		}
+	}
+	log.WithField("reason", err).Info("Generate webhook serving certs")
+
+	caPEM, certPEM, keyPEM, err := generateCerts(dnsNames, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	data := map[string][]byte{caCertName: caPEM, certName: certPEM, keyName: keyPEM}
+	if found {
+		secret.Data = data
+		err = cli.Update(context.TODO(), secret)
+	} else {
+		err = cli.Create(context.TODO(), &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: secretKey.Namespace, Name: secretKey.Name},
+			Type:       corev1.SecretTypeTLS,
+			Data:       data,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = writeCerts(certDir, data); err != nil {
+		return nil, err
+	}
+	return caPEM, nil
+}
+
+// writeCerts writes the certs into certDir, the webhook server reads them from there
+func writeCerts(certDir string, data map[string][]byte) error {
+	if err := os.MkdirAll(certDir, 0700); err != nil {
+		return err
+	}
+	for _, name := range []string{caCertName, certName, keyName} {
+		if err := ioutil.WriteFile(filepath.Join(certDir, name), data[name], 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCerts returns the CA in certDir if the serving cert is signed by it, covers the DNS names
+// and is not about to expire
+func loadCerts(certDir string, dnsNames []string) ([]byte, error) {
+	caPEM, err := ioutil.ReadFile(filepath.Join(certDir, caCertName))
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := ioutil.ReadFile(filepath.Join(certDir, certName))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(filepath.Join(certDir, keyName)); err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("invalid CA cert")
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("invalid serving cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range dnsNames {
+		_, err = cert.Verify(x509.VerifyOptions{
+			DNSName:     name,
+			Roots:       pool,
+			CurrentTime: time.Now().Add(certRenewBefore),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return caPEM, nil
+}
+
+// generateCerts returns a self-signed CA and a serving cert for the DNS names signed by it, PEM encoded
+func generateCerts(dnsNames []string, now time.Time) (caPEM, certPEM, keyPEM []byte, err error) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "clickhouse-operator-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return encodePEM("CERTIFICATE", caDER), encodePEM("CERTIFICATE", der),
+		encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)), nil
+}
+
+func encodePEM(blockType string, der []byte) []byte {
+	var b bytes.Buffer
+	_ = pem.Encode(&b, &pem.Block{Type: blockType, Bytes: der})
+	return b.Bytes()
+}
@@ -0,0 +1,58 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/config"
+	"github.com/mackwong/clickhouse-operator/pkg/controller/clickhousecluster"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// clusterDefaulter fills in the fields of the ClickHouseClusters left empty, so the stored spec is
+// the one the operator applies
+type clusterDefaulter struct {
+	decoder       *admission.Decoder
+	defaultConfig *config.DefaultConfig
+}
+
+var _ admission.DecoderInjector = &clusterDefaulter{}
+
+// InjectDecoder is called by the webhook server when the handler is registered
+func (d *clusterDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+func (d *clusterDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1beta1.Create && req.Operation != admissionv1beta1.Update {
+		return admission.Allowed("")
+	}
+
+	cc := &clickhousev1.ClickHouseCluster{}
+	if err := d.decoder.Decode(req, cc); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if cc.DeletionTimestamp != nil {
+		return admission.Allowed("")
+	}
+
+	// the namespace may only be set in the request when the cluster is created
+	namespace := cc.Namespace
+	if namespace == "" {
+		cc.Namespace = req.Namespace
+	}
+	if !clickhousecluster.SetDefaults(cc, d.defaultConfig) {
+		return admission.Allowed("")
+	}
+	cc.Namespace = namespace
+
+	marshaled, err := json.Marshal(cc)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
@@ -0,0 +1,76 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/config"
+	"github.com/mackwong/clickhouse-operator/pkg/controller/clickhousecluster"
+	"github.com/sirupsen/logrus"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// clusterValidator rejects the ClickHouseClusters the operator can not apply
+type clusterValidator struct {
+	decoder       *admission.Decoder
+	defaultConfig *config.DefaultConfig
+	// client reads the StorageClasses of the volumes to expand
+	client client.Client
+}
+
+var _ admission.DecoderInjector = &clusterValidator{}
+
+// InjectDecoder is called by the webhook server when the handler is registered
+func (v *clusterValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+func (v *clusterValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1beta1.Create && req.Operation != admissionv1beta1.Update {
+		return admission.Allowed("")
+	}
+
+	cc := &clickhousev1.ClickHouseCluster{}
+	if err := v.decoder.Decode(req, cc); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// removing the finalizers of a cluster being deleted is never blocked
+	if cc.DeletionTimestamp != nil {
+		return admission.Allowed("")
+	}
+
+	log := logrus.WithFields(logrus.Fields{"namespace": cc.Namespace, "name": cc.Name, "operation": req.Operation})
+	// fields left empty are validated with the values the operator will use
+	clickhousecluster.SetDefaults(cc, v.defaultConfig)
+
+	if req.Operation == admissionv1beta1.Update {
+		old := &clickhousev1.ClickHouseCluster{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		clickhousecluster.SetDefaults(old, v.defaultConfig)
+		// metadata updates of clusters created before the webhook are not blocked
+		if reflect.DeepEqual(old.Spec, cc.Spec) {
+			return admission.Allowed("")
+		}
+		if err := clickhousecluster.ValidateClusterUpdate(old, cc); err != nil {
+			log.WithField("error", err).Info("Deny ClickHouseCluster update")
+			return admission.Denied(err.Error())
+		}
+		if err := clickhousecluster.CheckVolumeExpansion(v.client, old, cc); err != nil {
+			log.WithField("error", err).Info("Deny ClickHouseCluster volume expansion")
+			return admission.Denied(err.Error())
+		}
+	}
+
+	if err := clickhousecluster.ValidateCluster(cc, v.defaultConfig); err != nil {
+		log.WithField("error", err).Info("Deny invalid ClickHouseCluster")
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
@@ -0,0 +1,192 @@
+package webhook
+
+import (
+	"context"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/config"
+	"github.com/sirupsen/logrus"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	webhookConfigurationName = "clickhouse-operator"
+	validatingWebhookName    = "validate.clickhouseclusters.clickhouse.service.diamond.sensetime.com"
+	validatingPath           = "/validate-clickhousecluster"
+	// the ClickHouseClusters of the namespaces with this label set to "disabled" are not validated
+	validatingNamespaceLabel = "clickhouse.service.diamond.sensetime.com/webhook"
+	mutatingWebhookName      = "default.clickhouseclusters.clickhouse.service.diamond.sensetime.com"
+	mutatingPath             = "/mutate-clickhousecluster"
+)
+
+// Options of the webhooks served by the operator
+type Options struct {
+	// ServiceName is the Service in front of the operator the API server calls the webhooks through
+	ServiceName string
+	// Namespace of the operator and the Service
+	Namespace string
+	// CertDir holds the serving certs, they are generated if missing
+	CertDir string
+	// CertSecretName is the Secret in Namespace the generated certs are kept in
+	CertSecretName string
+}
+
+// AddToManager makes sure the serving certs exist, registers the webhook configurations with their CA
+// and adds the webhooks to the webhook server of the manager
+func AddToManager(mgr manager.Manager, options Options) error {
+	// the client of the manager can not be used before the manager is started
+	cli, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme()})
+	if err != nil {
+		return err
+	}
+
+	caBundle, err := ensureCerts(cli, types.NamespacedName{Namespace: options.Namespace, Name: options.CertSecretName},
+		options.CertDir, serviceDNSNames(options.ServiceName, options.Namespace))
+	if err != nil {
+		return err
+	}
+
+	defaultConfig, err := config.LoadDefaultConfig()
+	if err != nil {
+		return err
+	}
+	if err = reconcileValidatingWebhookConfiguration(cli, generateValidatingWebhookConfiguration(options, caBundle)); err != nil {
+		return err
+	}
+	if err = reconcileMutatingWebhookConfiguration(cli, generateMutatingWebhookConfiguration(options, caBundle)); err != nil {
+		return err
+	}
+
+	mgr.GetWebhookServer().Register(mutatingPath, &admission.Webhook{
+		Handler: &clusterDefaulter{defaultConfig: defaultConfig},
+	})
+	mgr.GetWebhookServer().Register(validatingPath, &admission.Webhook{
+		Handler: &clusterValidator{defaultConfig: defaultConfig, client: cli},
+	})
+	return nil
+}
+
+// clusterRules are the requests of ClickHouseClusters both webhooks are called for
+func clusterRules() []admissionregistrationv1beta1.RuleWithOperations {
+	return []admissionregistrationv1beta1.RuleWithOperations{
+		{
+			Operations: []admissionregistrationv1beta1.OperationType{
+				admissionregistrationv1beta1.Create,
+				admissionregistrationv1beta1.Update,
+			},
+			Rule: admissionregistrationv1beta1.Rule{
+				APIGroups:   []string{clickhousev1.SchemeGroupVersion.Group},
+				APIVersions: []string{clickhousev1.SchemeGroupVersion.Version},
+				Resources:   []string{"clickhouseclusters"},
+			},
+		},
+	}
+}
+
+func generateMutatingWebhookConfiguration(options Options, caBundle []byte) *admissionregistrationv1beta1.MutatingWebhookConfiguration {
+	path := mutatingPath
+	// the defaults are applied in memory by the reconcile anyway
+	failurePolicy := admissionregistrationv1beta1.Ignore
+	sideEffects := admissionregistrationv1beta1.SideEffectClassNone
+	var timeoutSeconds int32 = 10
+	return &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: webhookConfigurationName,
+		},
+		Webhooks: []admissionregistrationv1beta1.MutatingWebhook{
+			{
+				Name: mutatingWebhookName,
+				ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+					Service: &admissionregistrationv1beta1.ServiceReference{
+						Namespace: options.Namespace,
+						Name:      options.ServiceName,
+						Path:      &path,
+					},
+					CABundle: caBundle,
+				},
+				Rules:          clusterRules(),
+				FailurePolicy:  &failurePolicy,
+				SideEffects:    &sideEffects,
+				TimeoutSeconds: &timeoutSeconds,
+			},
+		},
+	}
+}
+
+func generateValidatingWebhookConfiguration(options Options, caBundle []byte) *admissionregistrationv1beta1.ValidatingWebhookConfiguration {
+	path := validatingPath
+	// the changes the operator can not apply are refused while it is unreachable as well, the namespaces
+	// labeled out of the webhook are only checked by the reconcile
+	failurePolicy := admissionregistrationv1beta1.Fail
+	sideEffects := admissionregistrationv1beta1.SideEffectClassNone
+	var timeoutSeconds int32 = 10
+	return &admissionregistrationv1beta1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: webhookConfigurationName,
+		},
+		Webhooks: []admissionregistrationv1beta1.ValidatingWebhook{
+			{
+				Name: validatingWebhookName,
+				ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+					Service: &admissionregistrationv1beta1.ServiceReference{
+						Namespace: options.Namespace,
+						Name:      options.ServiceName,
+						Path:      &path,
+					},
+					CABundle: caBundle,
+				},
+				Rules:         clusterRules(),
+				FailurePolicy: &failurePolicy,
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{{
+						Key:      validatingNamespaceLabel,
+						Operator: metav1.LabelSelectorOpNotIn,
+						Values:   []string{"disabled"},
+					}},
+				},
+				SideEffects:    &sideEffects,
+				TimeoutSeconds: &timeoutSeconds,
+			},
+		},
+	}
+}
+
+func reconcileValidatingWebhookConfiguration(cli client.Client,
+	configuration *admissionregistrationv1beta1.ValidatingWebhookConfiguration) error {
+	var cur admissionregistrationv1beta1.ValidatingWebhookConfiguration
+	err := cli.Get(context.TODO(), types.NamespacedName{Name: configuration.Name}, &cur)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			logrus.WithFields(logrus.Fields{"name": configuration.Name}).Info("Create ValidatingWebhookConfiguration")
+			return cli.Create(context.TODO(), configuration)
+		}
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{"name": configuration.Name}).Info("Update ValidatingWebhookConfiguration")
+	configuration.ResourceVersion = cur.ResourceVersion
+	return cli.Update(context.TODO(), configuration)
+}
+
+func reconcileMutatingWebhookConfiguration(cli client.Client,
+	configuration *admissionregistrationv1beta1.MutatingWebhookConfiguration) error {
+	var cur admissionregistrationv1beta1.MutatingWebhookConfiguration
+	err := cli.Get(context.TODO(), types.NamespacedName{Name: configuration.Name}, &cur)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			logrus.WithFields(logrus.Fields{"name": configuration.Name}).Info("Create MutatingWebhookConfiguration")
+			return cli.Create(context.TODO(), configuration)
+		}
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{"name": configuration.Name}).Info("Update MutatingWebhookConfiguration")
+	configuration.ResourceVersion = cur.ResourceVersion
+	return cli.Update(context.TODO(), configuration)
+}
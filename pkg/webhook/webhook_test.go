@@ -0,0 +1,219 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	clickhousev1 "github.com/mackwong/clickhouse-operator/pkg/apis/clickhouse/v1"
+	"github.com/mackwong/clickhouse-operator/pkg/config"
+	"github.com/mackwong/clickhouse-operator/pkg/controller/clickhousecluster"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newValidator(t *testing.T) *clusterValidator {
+	scheme := runtime.NewScheme()
+	if err := clickhousev1.SchemeBuilder.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expandable := true
+	v := &clusterValidator{
+		defaultConfig: &config.DefaultConfig{},
+		client: fake.NewFakeClient(
+			&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "local"}, AllowVolumeExpansion: &expandable},
+			&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "fixed"}},
+		),
+	}
+	_ = v.InjectDecoder(decoder)
+	return v
+}
+
+func newRequest(t *testing.T, operation admissionv1beta1.Operation, cc, old *clickhousev1.ClickHouseCluster) admission.Request {
+	req := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Operation: operation}}
+	raw, err := json.Marshal(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Object = runtime.RawExtension{Raw: raw}
+	if old != nil {
+		if req.OldObject.Raw, err = json.Marshal(old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return req
+}
+
+func newCluster() *clickhousev1.ClickHouseCluster {
+	return &clickhousev1.ClickHouseCluster{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "clickhouse.service.diamond.sensetime.com/v1", Kind: "ClickHouseCluster"},
+		ObjectMeta: metav1.ObjectMeta{Name: "fack", Namespace: "default"},
+		Spec: clickhousev1.ClickHouseClusterSpec{
+			ShardsCount:      2,
+			ReplicasCount:    1,
+			DataStorageClass: "local",
+			DataCapacity:     "10Gi",
+			Resources: clickhousev1.ClickHouseResources{
+				Requests: clickhousev1.CPUAndMem{CPU: "1", Memory: "1Gi"},
+			},
+		},
+	}
+}
+
+func TestValidateCreate(t *testing.T) {
+	v := newValidator(t)
+
+	cc := newCluster()
+	if resp := v.Handle(context.TODO(), newRequest(t, admissionv1beta1.Create, cc, nil)); !resp.Allowed {
+		t.Errorf("expect allowed, got %v", resp.Result)
+	}
+
+	cc.Spec.Resources.Requests.Memory = "1 Gi"
+	if resp := v.Handle(context.TODO(), newRequest(t, admissionv1beta1.Create, cc, nil)); resp.Allowed {
+		t.Error("invalid resources are allowed")
+	}
+
+	cc = newCluster()
+	cc.Spec.Settings = map[string]clickhousev1.SettingValue{"remote_servers/fack": "1"}
+	if resp := v.Handle(context.TODO(), newRequest(t, admissionv1beta1.Create, cc, nil)); resp.Allowed {
+		t.Error("reserved settings are allowed")
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	v := newValidator(t)
+	cases := []struct {
+		name    string
+		mutate  func(cc *clickhousev1.ClickHouseCluster)
+		allowed bool
+	}{
+		{"add shards", func(cc *clickhousev1.ClickHouseCluster) { cc.Spec.ShardsCount = 3 }, true},
+		{"reduce shards", func(cc *clickhousev1.ClickHouseCluster) { cc.Spec.ShardsCount = 1 }, true},
+		{"grow capacity", func(cc *clickhousev1.ClickHouseCluster) { cc.Spec.DataCapacity = "20Gi" }, true},
+		{"shrink capacity", func(cc *clickhousev1.ClickHouseCluster) { cc.Spec.DataCapacity = "5Gi" }, false},
+		{"change storage class", func(cc *clickhousev1.ClickHouseCluster) { cc.Spec.DataStorageClass = "ssd" }, false},
+		{"add replicas without zookeeper", func(cc *clickhousev1.ClickHouseCluster) { cc.Spec.ReplicasCount = 2 }, false},
+		{"add storage volumes", func(cc *clickhousev1.ClickHouseCluster) {
+			cc.Spec.DataStorageClass, cc.Spec.DataCapacity = "", ""
+			cc.Spec.Storage = &clickhousev1.StorageSpec{Volumes: []clickhousev1.StorageVolume{{Capacity: "10Gi"}}}
+		}, false},
+		{"add storage policy", func(cc *clickhousev1.ClickHouseCluster) {
+			cc.Spec.Storage = &clickhousev1.StorageSpec{Policies: []clickhousev1.StoragePolicy{{
+				Name:    "default_only",
+				Volumes: []clickhousev1.StoragePolicyVolume{{Name: "main", Disks: []string{"default"}}},
+			}}}
+		}, true},
+		{"grow shard capacity", func(cc *clickhousev1.ClickHouseCluster) {
+			cc.Spec.Shards = []clickhousev1.ShardSpec{{ID: 1, DataCapacity: "20Gi"}}
+		}, true},
+		{"shrink shard capacity", func(cc *clickhousev1.ClickHouseCluster) {
+			cc.Spec.Shards = []clickhousev1.ShardSpec{{ID: 1, DataCapacity: "5Gi"}}
+		}, false},
+	}
+	for _, c := range cases {
+		old, cc := newCluster(), newCluster()
+		c.mutate(cc)
+		resp := v.Handle(context.TODO(), newRequest(t, admissionv1beta1.Update, cc, old))
+		if resp.Allowed != c.allowed {
+			t.Errorf("%s: expect allowed %v, got %v", c.name, c.allowed, resp.Result)
+		}
+	}
+
+	old, cc := newCluster(), newCluster()
+	old.Status.ShardStatus = map[string]*clickhousev1.ShardStatus{"fack-2": {Phase: "Draining"}}
+	cc.Spec.ShardsCount = 3
+	if resp := v.Handle(context.TODO(), newRequest(t, admissionv1beta1.Update, cc, old)); resp.Allowed {
+		t.Error("shards are added while a shard is being removed")
+	}
+
+	old, cc = newCluster(), newCluster()
+	old.Spec.DataStorageClass, cc.Spec.DataStorageClass = "fixed", "fixed"
+	cc.Spec.DataCapacity = "20Gi"
+	if resp := v.Handle(context.TODO(), newRequest(t, admissionv1beta1.Update, cc, old)); resp.Allowed {
+		t.Error("volumes are expanded with a storage class not allowing it")
+	}
+}
+
+func TestEnsureCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cli := fake.NewFakeClient()
+	secretKey := types.NamespacedName{Namespace: "clickhouse-system", Name: "clickhouse-operator-webhook-certs"}
+	dnsNames := serviceDNSNames("clickhouse-operator-webhook", "clickhouse-system")
+	caPEM, err := ensureCerts(cli, secretKey, dir, dnsNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// valid certs are kept
+	again, err := ensureCerts(cli, secretKey, dir, dnsNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(caPEM) {
+		t.Error("valid certs have been regenerated")
+	}
+	// the certs of the Secret are used by a restarted operator
+	restarted, err := ioutil.TempDir("", "webhook-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(restarted)
+	if again, err = ensureCerts(cli, secretKey, restarted, dnsNames); err != nil || string(again) != string(caPEM) {
+		t.Errorf("the certs of the Secret have not been used: %v", err)
+	}
+	// certs for another service are not
+	if _, err = loadCerts(dir, serviceDNSNames("other", "clickhouse-system")); err == nil {
+		t.Error("certs are valid for another service")
+	}
+}
+
+func TestDefault(t *testing.T) {
+	d := &clusterDefaulter{defaultConfig: &config.DefaultConfig{
+		DefaultClickhouseImage: "clickhouse-server:19.16",
+		DefaultShardCount:      1,
+		DefaultReplicasCount:   1,
+	}}
+	_ = d.InjectDecoder(newValidator(t).decoder)
+
+	cc := newCluster()
+	cc.Spec.Zookeeper = &clickhousev1.ZookeeperConfig{Root: "/fack"}
+	resp := d.Handle(context.TODO(), newRequest(t, admissionv1beta1.Create, cc, nil))
+	if !resp.Allowed {
+		t.Fatalf("expect allowed, got %v", resp.Result)
+	}
+	patched := map[string]string{}
+	for _, p := range resp.Patches {
+		if value, ok := p.Value.(string); ok {
+			patched[p.Path] = value
+		}
+	}
+	if patched["/spec/image"] != "clickhouse-server:19.16" {
+		t.Errorf("image is not defaulted, got %v", resp.Patches)
+	}
+	if patched["/spec/zookeeper/root"] != "/clickhouse/tables/default/fack" {
+		t.Errorf("zookeeper root is not forced, got %v", resp.Patches)
+	}
+
+	// a defaulted cluster is left as it is
+	cc = newCluster()
+	clickhousecluster.SetDefaults(cc, d.defaultConfig)
+	resp = d.Handle(context.TODO(), newRequest(t, admissionv1beta1.Update, cc, cc))
+	if !resp.Allowed || len(resp.Patches) != 0 {
+		t.Errorf("expect no patch, got %v", resp.Patches)
+	}
+}